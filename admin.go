@@ -0,0 +1,64 @@
+package devcache
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+)
+
+// adminAuth requires requests to carry the configured admin token, either as
+// a bearer token or in the X-Devcache-Token header. Without a configured token
+// the admin endpoints are open. With tenants, requests with the admin token
+// are scoped to the tenant they name, and tenantRoutes are open to requests
+// carrying a -tenant-token instead, scoped to its tenant. Without an admin
+// token, tenantRoutes must name a tenant.
+func adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if flagAdminToken != "" {
+			token := r.Header.Get("X-Devcache-Token")
+			if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+				token = strings.TrimPrefix(auth, "Bearer ")
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(flagAdminToken)) != 1 {
+				tenant, ok := flagTenantTokens.tenant(token)
+				if !ok || !tenancy() || !tenantRoutes[mux.CurrentRoute(r)] {
+					http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+					return
+				}
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), scopeKey{}, tenant)))
+				return
+			}
+		}
+		r, ok := scopeTenant(r)
+		if !ok {
+			http.Error(w, "invalid tenant", http.StatusBadRequest)
+			return
+		}
+		if flagAdminToken == "" && tenancy() && adminScope(r) == "" && tenantRoutes[mux.CurrentRoute(r)] {
+			// no one may see every tenant's entries without the admin token
+			http.Error(w, "missing tenant", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleHealthz reports that the server is up.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports whether the server is ready: it isn't until every
+// priority 1 warm file path has been warmed.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if n := atomic.LoadInt64(&criticalPending); n > 0 {
+		http.Error(w, fmt.Sprintf("warming %d priority 1 paths", n), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ready\n"))
+}
@@ -0,0 +1,156 @@
+// Package api defines the versioned responses of devcache's admin API. Every
+// response carries the API version it conforms to, both in its api_version
+// field and in the X-Devcache-Api-Version header.
+//
+// Additive changes to these types bump the minor version. Changes that would
+// break existing clients are made to a new set of types served under a new
+// path prefix, such as /_devcache/v2/, leaving these as they are.
+package api
+
+import "time"
+
+// Version is the version of the API described by this package.
+const Version = "1.3"
+
+// VersionHeader is the response header carrying Version.
+const VersionHeader = "X-Devcache-Api-Version"
+
+// Prefix is the path prefix, under devcache's admin prefix, of the endpoints
+// described by this package.
+const Prefix = "/v1"
+
+// Key describes a cached entry.
+type Key struct {
+	Key      string    `json:"key"`
+	Bytes    int       `json:"bytes"`
+	Hits     int64     `json:"hits"`
+	Stored   time.Time `json:"stored"`
+	Expires  time.Time `json:"expires"`
+	Checksum string    `json:"checksum"`
+	// Source is how the entry came to be cached: organic, warmup, refresh
+	// or import. Added in 1.1.
+	Source string `json:"source"`
+}
+
+// KeysResponse lists every cached entry.
+type KeysResponse struct {
+	APIVersion string `json:"api_version"`
+	Keys       []Key  `json:"keys"`
+}
+
+// Entry describes a cached entry in full, without its body.
+type Entry struct {
+	Key
+	URL         string   `json:"url"`
+	Status      int      `json:"status"`
+	ContentType string   `json:"content_type"`
+	Tags        []string `json:"tags"`
+}
+
+// EntryResponse describes a single cached entry.
+type EntryResponse struct {
+	APIVersion string `json:"api_version"`
+	Entry      Entry  `json:"entry"`
+}
+
+// StatsResponse summarizes the cache's state.
+type StatsResponse struct {
+	APIVersion string    `json:"api_version"`
+	Time       time.Time `json:"time"`
+	Entries    int       `json:"entries"`
+	Bytes      int64     `json:"bytes"`
+	// ReadOnly is set while the cache is frozen: nothing is stored,
+	// evicted or saved. Added in 1.3.
+	ReadOnly bool `json:"read_only"`
+	// Counters are the server's activity counters by name.
+	Counters map[string]int64 `json:"counters"`
+	// Stores counts the entries stored by each source. Added in 1.1.
+	Stores map[string]int64 `json:"stores"`
+	// TopKeys are the most frequently hit keys.
+	TopKeys []Key `json:"top_keys"`
+}
+
+// Request describes a handled request.
+type Request struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Outcome    string    `json:"outcome"`
+	Status     int       `json:"status"`
+	DurationNS int64     `json:"duration_ns"`
+	Size       int       `json:"size"`
+	Client     string    `json:"client"`
+}
+
+// RecentResponse lists the latest handled requests, oldest first.
+type RecentResponse struct {
+	APIVersion string    `json:"api_version"`
+	Requests   []Request `json:"requests"`
+}
+
+// Upstream is the health of an upstream host.
+type Upstream struct {
+	State       string  `json:"state"`
+	Fetches     int     `json:"fetches"`
+	SuccessRate float64 `json:"success_rate"`
+	P95NS       int64   `json:"p95_ns"`
+}
+
+// UpstreamsResponse reports the health of every upstream host fetched from.
+type UpstreamsResponse struct {
+	APIVersion string              `json:"api_version"`
+	Upstreams  map[string]Upstream `json:"upstreams"`
+}
+
+// Route sends requests under a path prefix to its own upstream.
+type Route struct {
+	Prefix   string `json:"prefix"`
+	Upstream string `json:"upstream"`
+	Auth     string `json:"auth"`
+}
+
+// SizeBudget is a response size budget for matching paths.
+type SizeBudget struct {
+	Pattern string `json:"pattern"`
+	Limit   int64  `json:"limit"`
+}
+
+// RulesResponse lists the configured rules.
+type RulesResponse struct {
+	APIVersion    string       `json:"api_version"`
+	Routes        []Route      `json:"routes"`
+	Transforms    []string     `json:"transforms"`
+	KeyTransforms []string     `json:"key_transforms"`
+	SizeBudgets   []SizeBudget `json:"size_budgets"`
+	// Fixtures describes how recorded entries are made stable. Added in
+	// 1.2.
+	Fixtures Fixtures `json:"fixtures"`
+}
+
+// Fixtures describes what is left out of recorded entries so recording the
+// same responses twice gives identical files.
+type Fixtures struct {
+	Stable          bool     `json:"stable"`
+	VolatileHeaders []string `json:"volatile_headers"`
+	// Scrub are the body scrubbing rules, as PATH=VALUE.
+	Scrub []string `json:"scrub"`
+}
+
+// Endpoint is a GET endpoint of the API and the type of its response.
+type Endpoint struct {
+	Path        string
+	Description string
+	Response    interface{}
+	// Params are the names of the endpoint's query parameters.
+	Params []string
+}
+
+// Endpoints are every endpoint of the API, relative to Prefix.
+var Endpoints = []Endpoint{
+	{Path: "/keys", Description: "Lists every cached entry, or those from one source.", Response: KeysResponse{}, Params: []string{"source"}},
+	{Path: "/entry", Description: "Describes the entry cached under a key.", Response: EntryResponse{}, Params: []string{"key"}},
+	{Path: "/stats", Description: "Summarizes the cache's state.", Response: StatsResponse{}},
+	{Path: "/recent", Description: "Lists the latest handled requests.", Response: RecentResponse{}, Params: []string{"n", "outcome"}},
+	{Path: "/upstreams", Description: "Reports the health of each upstream host.", Response: UpstreamsResponse{}},
+	{Path: "/rules", Description: "Lists the configured rules.", Response: RulesResponse{}},
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+var (
+	stored  = time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	expires = stored.Add(time.Hour)
+	key     = Key{
+		Key:      "/users?id=1",
+		Bytes:    42,
+		Hits:     3,
+		Stored:   stored,
+		Expires:  expires,
+		Checksum: "9f86d081884c7d65",
+		Source:   "organic",
+	}
+)
+
+// fixtures holds a response of each endpoint with every field set, by the
+// name of its golden file.
+var fixtures = map[string]interface{}{
+	"keys": KeysResponse{APIVersion: Version, Keys: []Key{key}},
+	"entry": EntryResponse{APIVersion: Version, Entry: Entry{
+		Key:         key,
+		URL:         "/users?id=1",
+		Status:      200,
+		ContentType: "application/json",
+		Tags:        []string{"users"},
+	}},
+	"stats": StatsResponse{
+		APIVersion: Version,
+		Time:       stored,
+		Entries:    1,
+		Bytes:      42,
+		ReadOnly:   true,
+		Counters:   map[string]int64{"hits": 3, "misses": 1},
+		Stores:     map[string]int64{"organic": 1},
+		TopKeys:    []Key{key},
+	},
+	"recent": RecentResponse{APIVersion: Version, Requests: []Request{{
+		Time:       stored,
+		Method:     "GET",
+		Path:       "/users?id=1",
+		Outcome:    "hit",
+		Status:     200,
+		DurationNS: 1500000,
+		Size:       42,
+		Client:     "127.0.0.1",
+	}}},
+	"upstreams": UpstreamsResponse{APIVersion: Version, Upstreams: map[string]Upstream{
+		"api.example.com": {State: "healthy", Fetches: 10, SuccessRate: 0.9, P95NS: 250000000},
+	}},
+	"rules": RulesResponse{
+		APIVersion:    Version,
+		Routes:        []Route{{Prefix: "/auth", Upstream: "http://auth.example.com", Auth: "forward"}},
+		Transforms:    []string{"minify=2xx"},
+		KeyTransforms: []string{"strip-query=utm_*"},
+		SizeBudgets:   []SizeBudget{{Pattern: "/images/*", Limit: 1 << 20}},
+		Fixtures: Fixtures{
+			Stable:          true,
+			VolatileHeaders: []string{"Date"},
+			Scrub:           []string{"/users=$.token"},
+		},
+	},
+	"openapi": OpenAPI("/_devcache/v1"),
+}
+
+// TestGolden fails on any change to the shape of a response, or to the API
+// description. Check the change is compatible with clients of this version,
+// bump Version, and rerun with -update.
+func TestGolden(t *testing.T) {
+	for name, v := range fixtures {
+		t.Run(name, func(t *testing.T) {
+			got, err := json.MarshalIndent(v, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+			path := filepath.Join("testdata", name+".json")
+			if *update {
+				if err := ioutil.WriteFile(path, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s changed:\n%s\nwant:\n%s", name, got, want)
+			}
+		})
+	}
+}
+
+func TestEndpointsHaveFixtures(t *testing.T) {
+	for _, ep := range Endpoints {
+		if _, ok := fixtures[ep.Path[1:]]; !ok {
+			t.Errorf("no golden fixture for %s", ep.Path)
+		}
+	}
+}
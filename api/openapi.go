@@ -0,0 +1,105 @@
+package api
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// OpenAPI returns an OpenAPI 3 description of Endpoints, served under
+// basePath. Response schemas are derived from the response types themselves,
+// so the description can't drift from what the endpoints return.
+func OpenAPI(basePath string) map[string]interface{} {
+	paths := map[string]interface{}{}
+	for _, ep := range Endpoints {
+		var params []interface{}
+		for _, name := range ep.Params {
+			params = append(params, map[string]interface{}{
+				"name":   name,
+				"in":     "query",
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		op := map[string]interface{}{
+			"summary": ep.Description,
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "OK",
+					"headers": map[string]interface{}{
+						VersionHeader: map[string]interface{}{
+							"schema": map[string]interface{}{"type": "string"},
+						},
+					},
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": schema(reflect.TypeOf(ep.Response)),
+						},
+					},
+				},
+			},
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+		paths[basePath+ep.Path] = map[string]interface{}{"get": op}
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "devcache admin API",
+			"version": Version,
+		},
+		"paths": paths,
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schema returns the JSON schema of values of t as encoded by encoding/json.
+func schema(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schema(t.Elem())}
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		addFields(t, props)
+		return map[string]interface{}{"type": "object", "properties": props}
+	}
+	return map[string]interface{}{}
+}
+
+// addFields adds the schemas of the JSON fields of struct type t to props,
+// flattening embedded structs as encoding/json does.
+func addFields(t reflect.Type, props map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.Anonymous && name == "" {
+			addFields(f.Type, props)
+			continue
+		}
+		if f.PkgPath != "" || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = schema(f.Type)
+	}
+}
@@ -0,0 +1,188 @@
+package devcache
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+	"github.com/travis-g/devcache/api"
+)
+
+// apiVersion adds the API version header to admin responses.
+func apiVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(api.VersionHeader, api.Version)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiRoutes registers the versioned API endpoints on admin, the admin prefix
+// subrouter.
+func (s *server) apiRoutes(admin *mux.Router) {
+	admin.HandleFunc("/openapi.json", handleOpenAPI).Methods("GET")
+	v1 := admin.PathPrefix(api.Prefix).Subrouter()
+	tenantRoute(v1.HandleFunc("/keys", handleAPIKeys).Methods("GET"))
+	tenantRoute(v1.HandleFunc("/entry", handleAPIEntry).Methods("GET"))
+	v1.HandleFunc("/stats", s.handleAPIStats).Methods("GET")
+	v1.HandleFunc("/recent", handleAPIRecent).Methods("GET")
+	v1.HandleFunc("/upstreams", handleAPIUpstreams).Methods("GET")
+	v1.HandleFunc("/rules", handleAPIRules).Methods("GET")
+}
+
+func writeAPI(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleOpenAPI serves the description of the versioned API.
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeAPI(w, api.OpenAPI(adminPrefix+api.Prefix))
+}
+
+// apiKey describes the entry e cached under key.
+func apiKey(key string, e *entry) api.Key {
+	return api.Key{
+		Key:      key,
+		Bytes:    e.size(),
+		Hits:     atomic.LoadInt64(&e.hits),
+		Stored:   e.Stored,
+		Expires:  e.Expires,
+		Checksum: e.Checksum,
+		Source:   e.source(),
+	}
+}
+
+func handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	source := r.URL.Query().Get("source")
+	res := api.KeysResponse{APIVersion: api.Version, Keys: []api.Key{}}
+	for key, item := range scopedItems(r) {
+		if e, ok := toEntry(item.Object); ok && (source == "" || e.source() == source) {
+			res.Keys = append(res.Keys, apiKey(key, e))
+		}
+	}
+	sort.Slice(res.Keys, func(i, j int) bool { return res.Keys[i].Key < res.Keys[j].Key })
+	writeAPI(w, res)
+}
+
+func handleAPIEntry(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	v, found := Cache.Get(key)
+	e, ok := toEntry(v)
+	if !found || !ok || !inScope(r, key) {
+		http.Error(w, "no entry cached under "+key, http.StatusNotFound)
+		return
+	}
+	tags := e.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	writeAPI(w, api.EntryResponse{
+		APIVersion: api.Version,
+		Entry: api.Entry{
+			Key:         apiKey(key, e),
+			URL:         e.URL,
+			Status:      e.status(),
+			ContentType: e.ContentType,
+			Tags:        tags,
+		},
+	})
+}
+
+func (s *server) handleAPIStats(w http.ResponseWriter, r *http.Request) {
+	snap := s.Snapshot()
+	res := api.StatsResponse{
+		APIVersion: api.Version,
+		Time:       snap.Time,
+		Entries:    snap.Entries,
+		Bytes:      snap.Bytes,
+		ReadOnly:   snap.ReadOnly,
+		Counters:   snap.Stats.byName(),
+		Stores:     snap.Stores,
+		TopKeys:    make([]api.Key, 0, len(snap.TopKeys)),
+	}
+	for _, k := range snap.TopKeys {
+		v, _ := Cache.Get(k.Key)
+		if e, ok := toEntry(v); ok {
+			res.TopKeys = append(res.TopKeys, apiKey(k.Key, e))
+		}
+	}
+	writeAPI(w, res)
+}
+
+func handleAPIRecent(w http.ResponseWriter, r *http.Request) {
+	n, outcome, ok := recentParams(w, r)
+	if !ok {
+		return
+	}
+	res := api.RecentResponse{APIVersion: api.Version, Requests: []api.Request{}}
+	for _, rec := range recent.last(n, outcome) {
+		res.Requests = append(res.Requests, api.Request{
+			Time:       rec.Time,
+			Method:     rec.Method,
+			Path:       rec.Path,
+			Outcome:    rec.Outcome,
+			Status:     rec.Status,
+			DurationNS: int64(rec.Duration),
+			Size:       rec.Size,
+			Client:     rec.Client,
+		})
+	}
+	writeAPI(w, res)
+}
+
+func handleAPIUpstreams(w http.ResponseWriter, r *http.Request) {
+	res := api.UpstreamsResponse{APIVersion: api.Version, Upstreams: map[string]api.Upstream{}}
+	for host, h := range health.snapshot() {
+		res.Upstreams[host] = api.Upstream{
+			State:       h.State,
+			Fetches:     h.Fetches,
+			SuccessRate: h.SuccessRate,
+			P95NS:       int64(h.P95),
+		}
+	}
+	writeAPI(w, res)
+}
+
+func handleAPIRules(w http.ResponseWriter, r *http.Request) {
+	res := api.RulesResponse{
+		APIVersion:    api.Version,
+		Routes:        []api.Route{},
+		Transforms:    strings.Fields(flagTransforms.String()),
+		KeyTransforms: strings.Fields(flagKeyTransforms.String()),
+		SizeBudgets:   []api.SizeBudget{},
+		Fixtures: api.Fixtures{
+			Stable:          flagStableFixtures,
+			VolatileHeaders: append([]string{}, flagVolatileHeaders...),
+			Scrub:           []string{},
+		},
+	}
+	for _, rule := range flagScrub {
+		res.Fixtures.Scrub = append(res.Fixtures.Scrub, rule.String())
+	}
+	for _, rt := range flagRoutes {
+		auth := string(rt.auth)
+		if auth == "" {
+			auth = "default"
+		}
+		res.Routes = append(res.Routes, api.Route{Prefix: rt.prefix, Upstream: rt.upstream, Auth: auth})
+	}
+	for _, rule := range flagSizeBudgets {
+		res.SizeBudgets = append(res.SizeBudgets, api.SizeBudget{Pattern: rule.pattern, Limit: rule.limit})
+	}
+	writeAPI(w, res)
+}
+
+// byName returns the counters in s keyed by their JSON names.
+func (s Stats) byName() map[string]int64 {
+	t := reflect.TypeOf(s)
+	counters := s.counters()
+	byName := make(map[string]int64, len(counters))
+	for i, p := range counters {
+		byName[strings.Split(t.Field(i).Tag.Get("json"), ",")[0]] = *p
+	}
+	return byName
+}
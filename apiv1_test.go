@@ -0,0 +1,81 @@
+package devcache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/travis-g/devcache/api"
+)
+
+// fields returns the sorted names of the top-level fields of the JSON object
+// data.
+func fields(t testing.TB, data []byte) []string {
+	t.Helper()
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		t.Fatalf("%s: %s", data, err)
+	}
+	var names []string
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TestAPIContract checks every endpoint of the versioned API is served with
+// the version header and the shape of its response type, which the api
+// package's golden files pin.
+func TestAPIContract(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": 1}`))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL)
+	do(s.Handler(), "GET", "/users?id=1", nil)
+
+	for _, ep := range api.Endpoints {
+		t.Run(ep.Path, func(t *testing.T) {
+			target := adminPrefix + api.Prefix + ep.Path
+			if ep.Path == "/entry" {
+				target += "?key=" + url.QueryEscape("/users?id=1")
+			}
+			w := do(s.Handler(), "GET", target, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			if v := w.Header().Get(api.VersionHeader); v != api.Version {
+				t.Errorf("%s %q, want %q", api.VersionHeader, v, api.Version)
+			}
+			var res struct {
+				APIVersion string `json:"api_version"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.APIVersion != api.Version {
+				t.Errorf("api_version %q, want %q (%v)", res.APIVersion, api.Version, err)
+			}
+			want, err := json.Marshal(ep.Response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := fields(t, w.Body.Bytes()), fields(t, want); !reflect.DeepEqual(got, want) {
+				t.Errorf("fields %q, want %q", got, want)
+			}
+		})
+	}
+
+	w := do(s.Handler(), "GET", adminPrefix+"/openapi.json", nil)
+	var doc struct {
+		Paths map[string]interface{} `json:"paths"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Paths) != len(api.Endpoints) {
+		t.Errorf("openapi.json describes %d paths, want %d", len(doc.Paths), len(api.Endpoints))
+	}
+}
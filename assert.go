@@ -0,0 +1,144 @@
+package devcache
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statusNotRecorded is returned for requests missing from the recording in
+// -assert-recorded mode. It's outside the range upstreams use so it can't be
+// mistaken for a real response.
+const statusNotRecorded = 599
+
+// assertReportLimit bounds the unexpected requests kept for the assert report
+// endpoint. Every one is still written to the report file.
+const assertReportLimit = 1000
+
+// unexpected collects the requests that weren't in the recording.
+var unexpected struct {
+	sync.Mutex
+	count    int64
+	requests []unexpectedRequest
+}
+
+// unexpectedRequest describes a request that wasn't in the recording.
+type unexpectedRequest struct {
+	Time   time.Time   `json:"time"`
+	Method string      `json:"method"`
+	URI    string      `json:"uri"`
+	Header http.Header `json:"header"`
+	Client string      `json:"client"`
+}
+
+// patternList is a repeatable flag of path patterns.
+type patternList []string
+
+func (p *patternList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patternList) Set(v string) error {
+	if _, err := path.Match(v, ""); err != nil {
+		return err
+	}
+	*p = append(*p, v)
+	return nil
+}
+
+func (p *patternList) repeatable() {}
+
+// match reports whether uri's path matches one of the patterns, either as a
+// glob or as a prefix.
+func (p patternList) match(uri string) bool {
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		uri = uri[:i]
+	}
+	for _, pattern := range p {
+		if ok, _ := path.Match(pattern, uri); ok || strings.HasPrefix(uri, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// assertRecorded reports whether the request for uri must be served from the
+// recording.
+func assertRecorded(uri string) bool {
+	return flagAssertRecorded && !flagAssertAllow.match(uri)
+}
+
+// failUnrecorded answers a request that isn't in the recording and reports it.
+func failUnrecorded(w http.ResponseWriter, r *http.Request) {
+	req := unexpectedRequest{
+		Time:   time.Now(),
+		Method: r.Method,
+		URI:    r.RequestURI,
+		Header: reportHeader(r.Header),
+		Client: r.RemoteAddr,
+	}
+	unexpected.Lock()
+	unexpected.count++
+	if len(unexpected.requests) < assertReportLimit {
+		unexpected.requests = append(unexpected.requests, req)
+	}
+	if flagAssertReport != "" {
+		if err := appendJSONLine(flagAssertReport, req); err != nil {
+			log.Printf("error writing assert report: %s", err)
+		}
+	}
+	unexpected.Unlock()
+
+	log.Printf("unexpected request not in recording: %s %s", r.Method, r.RequestURI)
+	setOutcome(w, outcomeRejected)
+	http.Error(w, "request not in recording: "+r.Method+" "+r.RequestURI, statusNotRecorded)
+}
+
+// reportHeader returns a copy of h for the assert report, with credentials
+// digested as they are in keys so they can still be told apart.
+func reportHeader(h http.Header) http.Header {
+	c := h.Clone()
+	for name := range c {
+		if credentialHeaders[name] || name == "X-Devcache-Token" {
+			c[name] = []string{digestValues(c[name])}
+		}
+	}
+	return c
+}
+
+// appendJSONLine appends v to filePath as a line of JSON.
+func appendJSONLine(filePath string, v interface{}) error {
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(file).Encode(v); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// unexpectedCount returns how many requests weren't in the recording.
+func unexpectedCount() int64 {
+	unexpected.Lock()
+	defer unexpected.Unlock()
+	return unexpected.count
+}
+
+// handleAssertReport lists the requests that weren't in the recording.
+func handleAssertReport(w http.ResponseWriter, r *http.Request) {
+	unexpected.Lock()
+	report := map[string]interface{}{
+		"unexpected": unexpected.count,
+		"requests":   append([]unexpectedRequest{}, unexpected.requests...),
+	}
+	unexpected.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,49 @@
+package devcache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAssertReportRedactsCredentials(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	report := filepath.Join(t.TempDir(), "report.jsonl")
+	s := newTestServer(t, up.URL, "-assert-recorded", "-assert-report", report)
+
+	header := http.Header{
+		"Authorization":    {"Bearer secret-token"},
+		"Cookie":           {"session=secret-cookie"},
+		"X-Devcache-Token": {"secret-admin"},
+		"Accept":           {"text/plain"},
+	}
+	if w := do(s.Handler(), "GET", "/missing", header); w.Code != statusNotRecorded {
+		t.Fatalf("status %d, want %d", w.Code, statusNotRecorded)
+	}
+	w := do(s.Handler(), "GET", "/_devcache/assert-report", nil)
+	data, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range map[string]string{"endpoint": w.Body.String(), "file": string(data)} {
+		if strings.Contains(body, "secret") {
+			t.Errorf("%s report leaks a credential: %s", name, body)
+		}
+		if !strings.Contains(body, "text/plain") {
+			t.Errorf("%s report lost the Accept header: %s", name, body)
+		}
+	}
+
+	var req unexpectedRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := req.Header.Get("Authorization"), digestValues(header["Authorization"]); got != want {
+		t.Errorf("Authorization reported as %q, want its digest %q", got, want)
+	}
+}
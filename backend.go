@@ -0,0 +1,255 @@
+package devcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+// Store is where the cache is persisted between runs.
+type Store interface {
+	// Load calls fn with each saved item as it's read, hottest first if the
+	// store keeps an order. It returns an error satisfying os.IsNotExist if
+	// nothing was saved.
+	Load(fn func(key string, item cache.Item)) error
+	// Save replaces what was saved with items.
+	Save(items map[string]cache.Item) error
+}
+
+// Formats of -store.
+const (
+	storeGob    = "gob"
+	storeJSON   = "json"
+	storeBolt   = "bolt"
+	storeSQLite = "sqlite"
+)
+
+// storeFiles are the default -cache-file of each -store format.
+var storeFiles = map[string]string{
+	storeGob:    "./cache.gob",
+	storeJSON:   "./cache.jsonl",
+	storeBolt:   "./cache.db",
+	storeSQLite: "./cache.sqlite",
+}
+
+// newStore returns the -store for the cache file at filePath, or for
+// -cache-dir if it's set.
+func newStore(filePath string) Store {
+	switch {
+	case flagCacheDir != "":
+		return dirStore(flagCacheDir)
+	case flagStore == storeJSON:
+		return jsonStore(filePath)
+	case flagStore == storeBolt:
+		return boltStore(filePath)
+	case flagStore == storeSQLite:
+		return sqliteStore(filePath)
+	default:
+		return gobStore(filePath)
+	}
+}
+
+// dbStore is the -store database entries are written through to as they're
+// stored, and read from on a miss in memory, or nil. It's set with -store bolt
+// or sqlite, unless -cache-dir or tenants keep files of their own; the
+// database is then neither loaded at startup nor saved at shutdown, so the
+// cache can outgrow memory.
+var dbStore entryBackend
+
+// openDBStore opens the -store database at filePath for dbStore, returning nil
+// for the stores saved a file at a time.
+func openDBStore(filePath string) (entryBackend, error) {
+	if flagCacheDir != "" || tenancy() {
+		return nil, nil
+	}
+	switch flagStore {
+	case storeBolt:
+		b, err := newBoltBackend(filePath)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	case storeSQLite:
+		b, err := newSQLiteBackend(filePath)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	return nil, nil
+}
+
+// storedSet writes e, cached under key for ttl, through to dbStore.
+func storedSet(key string, e *entry, ttl time.Duration) {
+	if dbStore == nil {
+		return
+	}
+	if err := dbStore.set(key, e, ttl); err != nil {
+		log.Printf("error saving %s to %s: %s", key, flagCacheFile, err)
+	}
+}
+
+// storedLookup looks key up in dbStore after a miss in memory. An entry found
+// is cached in memory too, for the rest of its TTL.
+func storedLookup(key string) (interface{}, bool) {
+	if dbStore == nil {
+		return nil, false
+	}
+	e, exp, err := dbStore.get(key)
+	switch {
+	case err == errNotStored:
+		return nil, false
+	case err != nil:
+		log.Printf("error looking up %s in %s: %s", key, flagCacheFile, err)
+		return nil, false
+	}
+	ttl := cache.NoExpiration
+	if exp > 0 {
+		if ttl = time.Until(time.Unix(0, exp)); ttl <= 0 {
+			return nil, false
+		}
+	}
+	setEntry(key, e, ttl)
+	varies.learn(key, e)
+	return e, true
+}
+
+// storedDelete deletes key from dbStore.
+func storedDelete(key string) {
+	if dbStore == nil {
+		return
+	}
+	if err := dbStore.del(key); err != nil {
+		log.Printf("error deleting %s from %s: %s", key, flagCacheFile, err)
+	}
+}
+
+// storedExpire deletes key from dbStore after it's evicted from memory, if its
+// record has expired too. Entries shed to save memory are kept, to be read
+// again when they're next requested.
+func storedExpire(key string) {
+	if dbStore == nil {
+		return
+	}
+	if _, _, err := dbStore.get(key); err == errNotStored {
+		storedDelete(key)
+	}
+}
+
+// gobStore saves the cache to a file of gob records, see writeCache.
+type gobStore string
+
+func (s gobStore) Load(fn func(key string, item cache.Item)) error {
+	return streamCache(string(s), fn)
+}
+
+func (s gobStore) Save(items map[string]cache.Item) error {
+	return writeCache(string(s), items)
+}
+
+// jsonStore saves the cache to a file of JSON lines, one entry per line in
+// the format of -cache-dir entry files. It's slower and larger than a gob
+// file, but can be read and edited by hand.
+type jsonStore string
+
+func (s jsonStore) Load(fn func(key string, item cache.Item)) error {
+	file, err := os.Open(string(s))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	dec := json.NewDecoder(bufio.NewReader(file))
+	for dec.More() {
+		de := dirEntry{entry: &entry{}}
+		if err := dec.Decode(&de); err != nil {
+			return err
+		}
+		fn(de.Key, de.item())
+	}
+	return nil
+}
+
+func (s jsonStore) Save(items map[string]cache.Item) error {
+	// write aside and rename, as writeCache does
+	tmp := string(s) + ".tmp"
+	if err := writeJSONLines(tmp, items); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, string(s))
+}
+
+func writeJSONLines(filePath string, items map[string]cache.Item) error {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	for _, key := range profile.order(items) {
+		if de := newDirEntry(key, items[key]); de != nil {
+			if err := enc.Encode(de); err != nil {
+				return err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// dirStore saves the cache to a directory with a file per entry, see
+// -cache-dir.
+type dirStore string
+
+func (s dirStore) Load(fn func(key string, item cache.Item)) error {
+	items := new(map[string]cache.Item)
+	if err := readCacheDir(string(s), items); err != nil {
+		return err
+	}
+	for _, key := range profile.order(*items) {
+		fn(key, (*items)[key])
+	}
+	return nil
+}
+
+func (s dirStore) Save(items map[string]cache.Item) error {
+	return writeCacheDir(string(s), items)
+}
+
+// encodeItem encodes item as a record of the stores saving an item per
+// record.
+func encodeItem(item cache.Item) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(item); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeItem decodes a record written by encodeItem.
+func decodeItem(data []byte) (cache.Item, error) {
+	var item cache.Item
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&item)
+	return item, err
+}
+
+// loadStore reads every item saved to s into a map.
+func loadStore(s Store) (map[string]cache.Item, error) {
+	items := make(map[string]cache.Item)
+	err := s.Load(func(key string, item cache.Item) {
+		items[key] = item
+	})
+	return items, err
+}
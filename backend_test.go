@@ -0,0 +1,111 @@
+package devcache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+func TestStores(t *testing.T) {
+	exp := time.Now().Add(time.Hour).UnixNano()
+	first := map[string]cache.Item{
+		"a": {Object: &entry{Body: []byte("a"), ContentType: "text/plain"}, Expiration: exp},
+		"b": {Object: &entry{Body: []byte("b")}, Expiration: exp + 1},
+	}
+	second := map[string]cache.Item{
+		"c": {Object: &entry{Body: []byte("c")}, Expiration: exp},
+	}
+	for name, newStore := range map[string]func(path string) Store{
+		storeGob:    func(path string) Store { return gobStore(path) },
+		storeJSON:   func(path string) Store { return jsonStore(path) },
+		storeBolt:   func(path string) Store { return boltStore(path) },
+		storeSQLite: func(path string) Store { return sqliteStore(path) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(filepath.Join(t.TempDir(), "cache"))
+			if _, err := loadStore(s); !os.IsNotExist(err) {
+				t.Fatalf("loading nothing: got %v, want a not-exist error", err)
+			}
+			for _, items := range []map[string]cache.Item{first, second} {
+				if err := s.Save(items); err != nil {
+					t.Fatal(err)
+				}
+				got, err := loadStore(s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(got) != len(items) {
+					t.Fatalf("loaded %d items, want %d", len(got), len(items))
+				}
+				for key, item := range items {
+					e, ok := toEntry(got[key].Object)
+					want := item.Object.(*entry)
+					if !ok || string(e.Body) != string(want.Body) || e.ContentType != want.ContentType {
+						t.Errorf("%s: loaded %+v, want %+v", key, got[key].Object, want)
+					}
+					if got[key].Expiration != item.Expiration {
+						t.Errorf("%s: expiration %d, want %d", key, got[key].Expiration, item.Expiration)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDBStore(t *testing.T) {
+	for _, store := range []string{storeBolt, storeSQLite} {
+		t.Run(store, func(t *testing.T) {
+			var fetches int64
+			up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt64(&fetches, 1)
+				w.Write([]byte("body of " + r.URL.Path))
+			}))
+			defer up.Close()
+			file := filepath.Join(t.TempDir(), "cache")
+			s := newTestServer(t, up.URL, "-store", store, "-cache-file", file)
+
+			// entries are written through as they're stored
+			do(s.Handler(), "GET", "/a", nil)
+			do(s.Handler(), "GET", "/b", nil)
+			if _, _, err := dbStore.get("/a"); err != nil {
+				t.Fatalf("entry not written through: %v", err)
+			}
+
+			// and read back once shed from memory
+			Cache.Delete("/a")
+			if w := do(s.Handler(), "GET", "/a", nil); w.Header().Get("X-Cache") != "HIT" || w.Body.String() != "body of /a" {
+				t.Errorf("shed entry: %s %q", w.Header().Get("X-Cache"), w.Body)
+			}
+
+			// purges reach the database
+			if w := do(s.Handler(), "POST", controlPrefix+"/purge?key=/b", nil); w.Code != http.StatusOK {
+				t.Fatalf("purge: status %d", w.Code)
+			}
+			if _, _, err := dbStore.get("/b"); err != errNotStored {
+				t.Errorf("purged entry: %v, want errNotStored", err)
+			}
+			if err := s.Shutdown(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			// the next server starts empty, reading entries as they're requested
+			s = newTestServer(t, up.URL, "-store", store, "-cache-file", file)
+			if n := Cache.ItemCount(); n != 0 {
+				t.Errorf("%d entries loaded at startup, want 0", n)
+			}
+			if w := do(s.Handler(), "GET", "/a", nil); w.Header().Get("X-Cache") != "HIT" {
+				t.Errorf("after restarting: X-Cache %s", w.Header().Get("X-Cache"))
+			}
+			if n := atomic.LoadInt64(&fetches); n != 2 {
+				t.Errorf("fetched %d times, want 2", n)
+			}
+		})
+	}
+}
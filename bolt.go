@@ -0,0 +1,145 @@
+package devcache
+
+import (
+	"os"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBucket is the bucket of a bolt store holding the entries.
+var boltBucket = []byte("entries")
+
+// boltOpenTimeout bounds waiting for another process to release the bolt
+// database.
+const boltOpenTimeout = 5 * time.Second
+
+// boltStore saves the cache to a BoltDB database, with a record per entry
+// keyed by its cache key. Unlike the files written by the gob and JSON stores
+// it can be read one entry at a time, but it's loaded in key order rather
+// than hottest first.
+type boltStore string
+
+// open opens the database, creating it if create is set.
+func (s boltStore) open(create bool) (*bolt.DB, error) {
+	if !create {
+		if _, err := os.Stat(string(s)); err != nil {
+			return nil, err
+		}
+	}
+	return bolt.Open(string(s), 0644, &bolt.Options{Timeout: boltOpenTimeout})
+}
+
+func (s boltStore) Load(fn func(key string, item cache.Item)) error {
+	db, err := s.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			item, err := decodeItem(v)
+			if err != nil {
+				return err
+			}
+			fn(string(k), item)
+			return nil
+		})
+	})
+}
+
+func (s boltStore) Save(items map[string]cache.Item) error {
+	db, err := s.open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	// the bucket is replaced in a single transaction, so an interrupted save
+	// leaves the previous one
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(boltBucket); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		b, err := tx.CreateBucket(boltBucket)
+		if err != nil {
+			return err
+		}
+		for key, item := range items {
+			data, err := encodeItem(item)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(key), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// boltBackend reads and writes the entries of an open bolt store one at a
+// time, as a -store-verify backend.
+type boltBackend struct {
+	db *bolt.DB
+}
+
+func newBoltBackend(path string) (*boltBackend, error) {
+	db, err := boltStore(path).open(true)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltBackend{db: db}, nil
+}
+
+func (b *boltBackend) get(key string) (*entry, int64, error) {
+	var data []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		// the value is only valid during the transaction
+		data = append(data, tx.Bucket(boltBucket).Get([]byte(key))...)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if data == nil {
+		return nil, 0, errNotStored
+	}
+	return decodeRecord(data)
+}
+
+func (b *boltBackend) set(key string, e *entry, ttl time.Duration) error {
+	data, err := encodeRecord(e, ttl)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), data)
+	})
+}
+
+func (b *boltBackend) del(key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	})
+}
+
+func (b *boltBackend) close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,152 @@
+package devcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// budgetOffenders bounds the offenders kept per size budget rule.
+const budgetOffenders = 10
+
+// sizeBudget is a response size budget for the paths matching pattern.
+type sizeBudget struct {
+	pattern string
+	limit   int64
+	// over counts the fetched responses that exceeded the budget.
+	over int64
+
+	mu sync.Mutex
+	// worst are the largest responses over the budget, one per URL, largest
+	// first.
+	worst []budgetOffender
+}
+
+// budgetOffender is a response that exceeded its size budget.
+type budgetOffender struct {
+	URL   string `json:"url"`
+	Bytes int64  `json:"bytes"`
+}
+
+// sizeBudgets is a repeatable flag of PATTERN=SIZE size budget rules.
+// Patterns match paths as globs or prefixes, and the first matching rule
+// applies.
+type sizeBudgets []*sizeBudget
+
+func (b *sizeBudgets) String() string {
+	rules := make([]string, len(*b))
+	for i, rule := range *b {
+		rules[i] = rule.pattern + "=" + formatBytes(rule.limit)
+	}
+	return strings.Join(rules, ",")
+}
+
+func (b *sizeBudgets) Set(v string) error {
+	i := strings.LastIndexByte(v, '=')
+	if i <= 0 {
+		return fmt.Errorf("size budget %q is not PATTERN=SIZE", v)
+	}
+	pattern := v[:i]
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+	limit, err := parseBytes(v[i+1:])
+	if err != nil {
+		return err
+	}
+	*b = append(*b, &sizeBudget{pattern: pattern, limit: limit})
+	return nil
+}
+
+func (b *sizeBudgets) repeatable() {}
+
+// match returns the budget for uri, or nil if no rule matches.
+func (b sizeBudgets) match(uri string) *sizeBudget {
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		uri = uri[:i]
+	}
+	for _, rule := range b {
+		if ok, _ := path.Match(rule.pattern, uri); ok || strings.HasPrefix(uri, rule.pattern) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// exceeded reports whether a response of size bytes is over the budget.
+func (rule *sizeBudget) exceeded(size int) bool {
+	return rule != nil && int64(size) > rule.limit
+}
+
+// header is the X-Devcache-Over-Budget value for a response of size bytes.
+func (rule *sizeBudget) header(size int) string {
+	return formatBytes(int64(size)) + "/" + formatBytes(rule.limit)
+}
+
+// checkSizeBudget records a fetched response for url of size bytes if it's
+// over its budget. Budgets are only observed: the response is still cached
+// and served.
+func checkSizeBudget(url string, size int) {
+	rule := flagSizeBudgets.match(url)
+	if !rule.exceeded(size) {
+		return
+	}
+	atomic.AddInt64(&rule.over, 1)
+	log.Printf("warning: response for %s is %s, over its %s budget (%s)",
+		url, formatBytes(int64(size)), formatBytes(rule.limit), rule.pattern)
+
+	rule.mu.Lock()
+	defer rule.mu.Unlock()
+	worst := rule.worst[:0]
+	for _, o := range rule.worst {
+		if o.URL != url {
+			worst = append(worst, o)
+		}
+	}
+	worst = append(worst, budgetOffender{URL: url, Bytes: int64(size)})
+	sort.SliceStable(worst, func(i, j int) bool { return worst[i].Bytes > worst[j].Bytes })
+	if len(worst) > budgetOffenders {
+		worst = worst[:budgetOffenders]
+	}
+	rule.worst = worst
+}
+
+// overBudget returns the number of responses over budget per rule.
+func overBudget() map[string]int64 {
+	counts := make(map[string]int64, len(flagSizeBudgets))
+	for _, rule := range flagSizeBudgets {
+		counts[rule.pattern] = atomic.LoadInt64(&rule.over)
+	}
+	return counts
+}
+
+// budgetReport describes a size budget rule and its worst offenders.
+type budgetReport struct {
+	Pattern string           `json:"pattern"`
+	Limit   int64            `json:"limit"`
+	Over    int64            `json:"over"`
+	Worst   []budgetOffender `json:"worst"`
+}
+
+// handleSizeBudgets lists each size budget rule with its worst offenders.
+func handleSizeBudgets(w http.ResponseWriter, r *http.Request) {
+	report := make([]budgetReport, 0, len(flagSizeBudgets))
+	for _, rule := range flagSizeBudgets {
+		rule.mu.Lock()
+		report = append(report, budgetReport{
+			Pattern: rule.pattern,
+			Limit:   rule.limit,
+			Over:    atomic.LoadInt64(&rule.over),
+			Worst:   append([]budgetOffender{}, rule.worst...),
+		})
+		rule.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,39 @@
+package devcache
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// maxPooledBuffer is the largest buffer returned to the pool. Bigger ones are
+// left to the garbage collector so one huge response doesn't pin its memory.
+const maxPooledBuffer = 4 << 20
+
+// bufPool holds buffers reused for reading and transforming bodies.
+var bufPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// getBuffer returns an empty buffer from the pool.
+func getBuffer() *bytes.Buffer {
+	return bufPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer returns buf to the pool. It must not be used afterwards.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufPool.Put(buf)
+}
+
+// readBody reads r to EOF through a pooled buffer, so only the returned body
+// is allocated rather than every intermediate size ReadAll grows through.
+func readBody(r io.Reader) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	_, err := buf.ReadFrom(r)
+	return append([]byte(nil), buf.Bytes()...), err
+}
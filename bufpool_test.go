@@ -0,0 +1,66 @@
+package devcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// benchmarkBody is a typical JSON body, indented as upstreams often send it.
+var benchmarkBody = func() []byte {
+	items := make([]map[string]interface{}, 200)
+	for i := range items {
+		items[i] = map[string]interface{}{"id": i, "name": "item", "tags": []string{"a", "b"}}
+	}
+	body, _ := json.MarshalIndent(items, "", "    ")
+	return body
+}()
+
+func TestReadBody(t *testing.T) {
+	body, err := readBody(bytes.NewReader(benchmarkBody))
+	if err != nil || !bytes.Equal(body, benchmarkBody) {
+		t.Fatalf("got %d bytes, %v", len(body), err)
+	}
+	// the body doesn't share the pooled buffer's memory
+	again, _ := readBody(strings.NewReader(strings.Repeat("x", len(body))))
+	if !bytes.Equal(body, benchmarkBody) || len(again) != len(body) {
+		t.Error("body changed when the buffer was reused")
+	}
+
+	// buffers are returned even when reading fails
+	failing := iotest.TimeoutReader(iotest.OneByteReader(strings.NewReader("abc")))
+	body, err = readBody(failing)
+	if !errors.Is(err, iotest.ErrTimeout) || string(body) != "a" {
+		t.Errorf("got %q, %v", body, err)
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if buf.Len() != 0 {
+		t.Errorf("pooled buffer holds %d bytes", buf.Len())
+	}
+}
+
+// BenchmarkReadBody compares reading and minifying a body through pooled
+// buffers with ioutil.ReadAll and an unpooled json.Compact.
+func BenchmarkReadBody(b *testing.B) {
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			body, _ := readBody(bytes.NewReader(benchmarkBody))
+			jsonMinify(&body)
+		}
+	})
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			body, _ := ioutil.ReadAll(bytes.NewReader(benchmarkBody))
+			var buf bytes.Buffer
+			json.Compact(&buf, body)
+			body = append([]byte(nil), buf.Bytes()...)
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package devcache
+
+import (
+	"crypto/subtle"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// bypassHeader carries the -bypass-token of requests that skip the cache.
+const bypassHeader = "X-Devcache-Bypass"
+
+// bypassed reports whether r carries the -bypass-token. Without a configured
+// token nothing bypasses the cache, so clients can't opt out by themselves.
+func bypassed(r *http.Request) bool {
+	if flagBypassToken == "" {
+		return false
+	}
+	token := r.Header.Get(bypassHeader)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(flagBypassToken)) == 1
+}
+
+// serveBypass proxies r to the upstream live, without looking it up in or
+// storing it to the cache. The token itself is never forwarded, see
+// newUpstreamRequest.
+func serveBypass(w http.ResponseWriter, r *http.Request) {
+	log.Printf("BYPASS-TOKEN %s: proxying live\n", r.RequestURI)
+	atomic.AddInt64(&stats.Bypassed, 1)
+	setOutcome(w, outcomeBypass)
+	proxyLive(w, r)
+}
+
+// serveUncachedMethod proxies r live because its method isn't cached, see
+// cachedMethod.
+func serveUncachedMethod(w http.ResponseWriter, r *http.Request) {
+	setOutcome(w, outcomeUncached)
+	if !upstreamEnabled() {
+		serveMaintenance(w, r)
+		return
+	}
+	proxyLive(w, r)
+}
+
+// proxyLive forwards r, along with its method and body, to the upstream and
+// streams back its response, leaving the cache alone.
+func proxyLive(w http.ResponseWriter, r *http.Request) {
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		// read whole so a retry can send it again
+		if body, err = readBody(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	req, err := newUpstreamRequest(r.Method, r.RequestURI, r.Header, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	start := time.Now()
+	res, err := doWithRetry(traceConns(req))
+	setUpstreamLatency(w, time.Since(start))
+	if err != nil {
+		atomic.AddInt64(&stats.UpstreamErrors, 1)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	header := res.Header.Clone()
+	removeHopHeaders(header)
+	for name, values := range header {
+		if name != "X-Cache" {
+			w.Header()[name] = values
+		}
+	}
+	w.WriteHeader(res.StatusCode)
+	n, _ := io.Copy(w, bandwidth.reader(res.Body))
+	atomic.AddInt64(&stats.UpstreamBytes, n)
+}
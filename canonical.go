@@ -0,0 +1,77 @@
+package devcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+)
+
+// canonicalJSON re-serializes a JSON body with the keys of every object
+// sorted, so bodies that differ only in key order are byte for byte the same.
+// Numbers are kept exactly as sent and arrays keep their order. If an object
+// repeats a key, the last value wins, as with encoding/json. Unlike minify,
+// which only drops whitespace, this can reorder the body.
+func canonicalJSON(path string, body []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	v, err := decodeCanonical(dec, path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("trailing data after JSON value")
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	// maps are encoded with their keys sorted
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), bytes.TrimSuffix(buf.Bytes(), []byte("\n"))...), nil
+}
+
+// decodeCanonical decodes the next JSON value from dec, logging duplicate
+// object keys in the body of path.
+func decodeCanonical(dec *json.Decoder, path string) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj := map[string]interface{}{}
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key, _ := tok.(string)
+			v, err := decodeCanonical(dec, path)
+			if err != nil {
+				return nil, err
+			}
+			if _, dup := obj[key]; dup {
+				log.Printf("warning: duplicate key %q in JSON body of %s, keeping the last value", key, path)
+			}
+			obj[key] = v
+		}
+		_, err := dec.Token()
+		return obj, err
+	case json.Delim('['):
+		arr := []interface{}{}
+		for dec.More() {
+			v, err := decodeCanonical(dec, path)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		_, err := dec.Token()
+		return arr, err
+	}
+	return tok, nil
+}
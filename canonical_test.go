@@ -0,0 +1,61 @@
+package devcache
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	for _, tt := range []struct {
+		in, want string
+		// dup is the duplicate key logged, if any
+		dup string
+	}{
+		{`{"b": 1, "a": {"d": [3, 1], "c": null}}`, `{"a":{"c":null,"d":[3,1]},"b":1}`, ""},
+		{`[{"b": true}, {"a": false}]`, `[{"b":true},{"a":false}]`, ""},
+		// numbers are kept as sent, however big or precise
+		{`{"n": 12345678901234567890123}`, `{"n":12345678901234567890123}`, ""},
+		{`{"n": 1.10, "m": -0, "e": 1e400}`, `{"e":1e400,"m":-0,"n":1.10}`, ""},
+		// escapes are decoded, except where JSON requires them
+		{`{"s": "caf\u00e9 \ud83d\ude00"}`, `{"s":"café 😀"}`, ""},
+		{`{"s": "<a href=\"x\">&amp;</a>"}`, `{"s":"<a href=\"x\">&amp;</a>"}`, ""},
+		{`{"s": "a\u2028b\tc\u0001\"\\"}`, `{"s":"a\u2028b\tc\u0001\"\\"}`, ""},
+		{`{"é": 1, "e": 2}`, `{"e":2,"é":1}`, ""},
+		// the last of a repeated key wins
+		{`{"a": 1, "b": 2, "a": 3}`, `{"a":3,"b":2}`, "a"},
+		{`{"x": {"k": [1], "k": {"z": 1}}}`, `{"x":{"k":{"z":1}}}`, "k"},
+	} {
+		logged.Reset()
+		got, err := canonicalJSON("/a", []byte(tt.in))
+		if err != nil {
+			t.Errorf("%s: %v", tt.in, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.in, got, tt.want)
+		}
+		if warned := strings.Contains(logged.String(), "duplicate key"); warned != (tt.dup != "") ||
+			tt.dup != "" && !strings.Contains(logged.String(), `"`+tt.dup+`"`) {
+			t.Errorf("%s: logged %q, want the duplicate %q", tt.in, logged.String(), tt.dup)
+		}
+
+		// and the canonical form is its own
+		again, err := canonicalJSON("/a", got)
+		if err != nil || string(again) != string(got) {
+			t.Errorf("%s: canonicalized again to %s, %v", got, again, err)
+		}
+	}
+}
+
+func TestCanonicalJSONInvalid(t *testing.T) {
+	for _, in := range []string{``, `{"a": 1`, `{"a": 1} {"b": 2}`, `[1, 2,]`, `{"a" 1}`} {
+		if got, err := canonicalJSON("/a", []byte(in)); err == nil {
+			t.Errorf("%q: canonicalized to %s, want an error", in, got)
+		}
+	}
+}
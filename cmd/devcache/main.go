@@ -0,0 +1,9 @@
+// Command devcache is a caching HTTP proxy for development. See the devcache
+// package for its options.
+package main
+
+import "github.com/travis-g/devcache"
+
+func main() {
+	devcache.Main()
+}
@@ -0,0 +1,65 @@
+package devcache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// flights coalesces fetches of the same key.
+var flights = &flightGroup{calls: make(map[string]*flight)}
+
+// flight is a fetch in progress or, for -coalesce-window after it finished,
+// just done.
+type flight struct {
+	done chan struct{}
+	e    *entry
+	err  error
+}
+
+// flightGroup lets requests missing the same key share one fetch: those
+// arriving while it's in progress wait for it, as do those arriving within
+// -coalesce-window after it finished, which would otherwise have raced to
+// fetch and overwrite the entry just stored.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+// do calls fetch unless a fetch of key is in progress or finished within the
+// window, in which case it returns that fetch's result. Responses that
+// weren't cached are never shared, as they may have been meant for the
+// requester only, so requests that would share one fetch for themselves.
+func (g *flightGroup) do(key string, fetch func() (*entry, error)) (*entry, error) {
+	g.mu.Lock()
+	if f, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-f.done
+		if f.err != errUncacheable && f.err != errUnsafeKey {
+			atomic.AddInt64(&stats.Coalesced, 1)
+			return f.e, f.err
+		}
+		return fetch()
+	}
+	f := &flight{done: make(chan struct{})}
+	g.calls[key] = f
+	g.mu.Unlock()
+
+	f.e, f.err = fetch()
+	close(f.done)
+	if flagCoalesceWindow <= 0 {
+		g.forget(key, f)
+	} else {
+		time.AfterFunc(flagCoalesceWindow, func() { g.forget(key, f) })
+	}
+	return f.e, f.err
+}
+
+// forget drops f, unless another fetch of key has replaced it.
+func (g *flightGroup) forget(key string, f *flight) {
+	g.mu.Lock()
+	if g.calls[key] == f {
+		delete(g.calls, key)
+	}
+	g.mu.Unlock()
+}
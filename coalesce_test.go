@@ -0,0 +1,68 @@
+package devcache
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalesceWindow(t *testing.T) {
+	defer func(window time.Duration) { flagCoalesceWindow = window }(flagCoalesceWindow)
+	for _, tt := range []struct {
+		window time.Duration
+		err    error
+		want   int64
+	}{
+		// only the request during the first fetch shares it
+		{0, nil, 4},
+		// as do those within the window after it
+		{200 * time.Millisecond, nil, 1},
+		// responses that weren't cached are never shared
+		{200 * time.Millisecond, errUncacheable, 5},
+	} {
+		flagCoalesceWindow = tt.window
+		g := &flightGroup{calls: make(map[string]*flight)}
+		var fetches int64
+		fetch := func() (*entry, error) {
+			atomic.AddInt64(&fetches, 1)
+			time.Sleep(30 * time.Millisecond)
+			return &entry{}, tt.err
+		}
+
+		// the second request arrives during the first fetch, the rest
+		// each after the last fetch finished
+		var wg sync.WaitGroup
+		start := time.Now()
+		for _, at := range []time.Duration{0, 10, 70, 130, 190} {
+			time.Sleep(time.Until(start.Add(at * time.Millisecond)))
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				g.do("/a", fetch)
+			}()
+		}
+		wg.Wait()
+		if n := atomic.LoadInt64(&fetches); n != tt.want {
+			t.Errorf("window %s, error %v: fetched %d times, want %d", tt.window, tt.err, n, tt.want)
+		}
+	}
+}
+
+func TestCoalesceWindowExpires(t *testing.T) {
+	defer func(window time.Duration) { flagCoalesceWindow = window }(flagCoalesceWindow)
+	flagCoalesceWindow = 20 * time.Millisecond
+	g := &flightGroup{calls: make(map[string]*flight)}
+	var fetches int64
+	fetch := func() (*entry, error) {
+		atomic.AddInt64(&fetches, 1)
+		return &entry{}, nil
+	}
+	g.do("/a", fetch)
+	g.do("/a", fetch)
+	time.Sleep(100 * time.Millisecond)
+	g.do("/a", fetch)
+	if n := atomic.LoadInt64(&fetches); n != 2 {
+		t.Errorf("fetched %d times, want 2", n)
+	}
+}
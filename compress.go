@@ -0,0 +1,63 @@
+package devcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"log"
+)
+
+// compress gzips the entry's body in place if -compress-cache is set and the
+// body is over -compress-threshold, unless that wouldn't make it smaller.
+func (e *entry) compress() {
+	if !flagCompressCache || e.Compressed || len(e.Body) <= int(flagCompressThreshold) {
+		return
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(e.Body); err != nil || zw.Close() != nil || buf.Len() >= len(e.Body) {
+		return
+	}
+	e.RawSize = len(e.Body)
+	e.Body = append([]byte(nil), buf.Bytes()...)
+	e.Compressed = true
+}
+
+// body returns the entry's body, decompressed if need be. A body that can't
+// be decompressed is reported and read as empty; it fails verify.
+func (e *entry) body() []byte {
+	if !e.Compressed {
+		return e.Body
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(e.Body))
+	if err != nil {
+		log.Printf("error decompressing cache entry %s: %s", e.URL, err)
+		return nil
+	}
+	defer zr.Close()
+	body, err := readBody(zr)
+	if err != nil {
+		log.Printf("error decompressing cache entry %s: %s", e.URL, err)
+		return nil
+	}
+	return body
+}
+
+// size returns the length of the entry's body, uncompressed.
+func (e *entry) size() int {
+	if e.Compressed {
+		return e.RawSize
+	}
+	return len(e.Body)
+}
+
+// decompressed returns e with its body uncompressed: e itself if it isn't
+// compressed, otherwise a copy.
+func (e *entry) decompressed() *entry {
+	if !e.Compressed {
+		return e
+	}
+	c := e.clone()
+	c.Body, c.Compressed, c.RawSize = e.body(), false, 0
+	return c
+}
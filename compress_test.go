@@ -0,0 +1,116 @@
+package devcache
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCompressBySize(t *testing.T) {
+	random := make([]byte, 8<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+	bodies := map[string]string{
+		"/small":  strings.Repeat("s", 100),
+		"/large":  strings.Repeat("a compressible body ", 500),
+		"/random": string(random),
+	}
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte(bodies[r.URL.Path]))
+	}))
+	defer up.Close()
+
+	for _, tt := range []struct {
+		args       []string
+		compressed map[string]bool
+	}{
+		{nil, map[string]bool{}},
+		// small bodies are under the threshold, and random ones wouldn't
+		// get any smaller
+		{[]string{"-compress-cache"}, map[string]bool{"/large": true}},
+		{[]string{"-compress-cache", "-compress-threshold", "10"}, map[string]bool{"/small": true, "/large": true}},
+	} {
+		args := append([]string{"-cache-file", filepath.Join(t.TempDir(), "cache.gob")}, tt.args...)
+		s := newTestServer(t, up.URL, args...)
+		for path, body := range bodies {
+			for _, outcome := range []string{"MISS", "HIT"} {
+				w := do(s.Handler(), "GET", path, nil)
+				if w.Body.String() != body || w.Header().Get("X-Cache") != outcome {
+					t.Fatalf("%v %s: %s %.20q", tt.args, path, w.Header().Get("X-Cache"), w.Body)
+				}
+			}
+		}
+
+		var want CompressedStats
+		var stored int64
+		for path, body := range bodies {
+			v, _ := Cache.Get(path)
+			e := v.(*entry)
+			if e.Compressed != tt.compressed[path] {
+				t.Errorf("%v %s: compressed %v, want %v", tt.args, path, e.Compressed, tt.compressed[path])
+			}
+			if e.size() != len(body) {
+				t.Errorf("%v %s: size %d, want %d", tt.args, path, e.size(), len(body))
+			}
+			if e.Compressed {
+				want.Entries++
+				want.Bytes += int64(len(e.Body))
+				want.RawBytes += int64(len(body))
+			}
+			stored += int64(len(e.Body))
+		}
+		snap := s.Stats()
+		if snap.Compressed != want || snap.Bytes != stored {
+			t.Errorf("%v: stats %d bytes, %+v, want %d bytes, %+v", tt.args, snap.Bytes, snap.Compressed, stored, want)
+		}
+		if want.Entries > 0 && want.Bytes >= want.RawBytes {
+			t.Errorf("%v: compressed bodies are %d bytes, %d raw", tt.args, want.Bytes, want.RawBytes)
+		}
+
+		// and they're served from a saved cache as they were
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		s = newTestServer(t, up.URL, args...)
+		for path, body := range bodies {
+			w := do(s.Handler(), "GET", path, nil)
+			if w.Body.String() != body || w.Header().Get("X-Cache") != "HIT" {
+				t.Errorf("%v %s reloaded: %s %.20q", tt.args, path, w.Header().Get("X-Cache"), w.Body)
+			}
+		}
+		s.Shutdown(context.Background())
+	}
+}
+
+// TestCompressedConcurrentHits serves a compressed entry from many requests at
+// once. Run with -race: decompressing it mustn't race with counting its hits.
+func TestCompressedConcurrentHits(t *testing.T) {
+	body := strings.Repeat("a compressible body ", 500)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL, "-compress-cache")
+	do(s.Handler(), "GET", "/large", nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := do(s.Handler(), "GET", "/large", nil); w.Body.String() != body {
+				t.Errorf("body %.20q", w.Body)
+			}
+		}()
+	}
+	wg.Wait()
+	// the miss was served from the entry too
+	if keys := s.Stats().TopKeys; len(keys) != 1 || keys[0].Hits != 21 {
+		t.Errorf("keys %+v, want /large with 21 hits", keys)
+	}
+}
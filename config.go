@@ -0,0 +1,280 @@
+package devcache
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// configSetting is a flag value read from a -config file. A setting holds
+// several values when the file gives a list.
+type configSetting struct {
+	name   string
+	values []string
+	line   int
+	// list is set for YAML settings whose values are listed on the lines
+	// after them.
+	list bool
+}
+
+// readConfig reads the settings in the -config file at filePath. Its format
+// follows from its extension: YAML for .yaml and .yml, TOML otherwise. Only
+// the flat subset of either is understood, one setting per flag named like
+// the flag, with underscores allowed for dashes:
+//
+//	url = "http://localhost:8080/"    # TOML
+//	route = ["/auth=http://localhost:9000/", "/img=http://localhost:9001/"]
+//
+//	url: http://localhost:8080/       # YAML
+//	route:
+//	  - /auth=http://localhost:9000/
+//
+// Anything else either format allows, such as tables, nested mappings or
+// multi-line strings, is refused with the line it's on rather than misread.
+func readConfig(filePath string) ([]configSetting, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	yaml := false
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".yaml", ".yml":
+		yaml = true
+	}
+	var settings []configSetting
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		fail := func(msg string) error {
+			return fmt.Errorf("%s:%d: %s", filePath, n, msg)
+		}
+		raw := stripComment(scanner.Text())
+		line := strings.TrimSpace(raw)
+		if line == "" || yaml && (line == "---" || line == "...") {
+			continue
+		}
+		if msg := unsupportedSyntax(line, yaml); msg != "" {
+			return nil, fail(msg)
+		}
+		if yaml && (line == "-" || strings.HasPrefix(line, "- ")) {
+			if len(settings) == 0 {
+				return nil, fail("list item outside of a setting")
+			}
+			last := &settings[len(settings)-1]
+			if !last.list {
+				return nil, fail("list item after the value of " + last.name)
+			}
+			item := strings.TrimSpace(strings.TrimPrefix(line, "-"))
+			if msg := unsupportedValue(item, yaml); msg != "" {
+				return nil, fail(msg)
+			}
+			last.values = append(last.values, unquote(item))
+			continue
+		}
+		if yaml && (raw[0] == ' ' || raw[0] == '\t') {
+			return nil, fail("nested settings aren't supported, settings are named like flags")
+		}
+		if err := checkListEnded(filePath, settings, yaml); err != nil {
+			return nil, err
+		}
+		if !yaml && strings.HasPrefix(line, "[") {
+			return nil, fail("tables aren't supported, settings are named like flags")
+		}
+		sep := "="
+		if yaml {
+			sep = ":"
+		}
+		i := strings.Index(line, sep)
+		if i <= 0 {
+			return nil, fail("expected name " + sep + " value")
+		}
+		s := configSetting{
+			name: strings.Replace(unquote(strings.TrimSpace(line[:i])), "_", "-", -1),
+			line: n,
+		}
+		value := strings.TrimSpace(line[i+1:])
+		switch {
+		case value == "" && yaml:
+			// a list follows
+			s.list = true
+		case value == "":
+			return nil, fail("missing value for " + s.name)
+		case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+			for _, v := range splitList(value[1 : len(value)-1]) {
+				if msg := unsupportedValue(v, yaml); msg != "" {
+					return nil, fail(msg)
+				}
+				s.values = append(s.values, unquote(v))
+			}
+		case strings.HasPrefix(value, "["):
+			return nil, fail("lists must be on one line")
+		default:
+			if msg := unsupportedValue(value, yaml); msg != "" {
+				return nil, fail(msg)
+			}
+			s.values = []string{unquote(value)}
+		}
+		settings = append(settings, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := checkListEnded(filePath, settings, yaml); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// checkListEnded returns an error if the last of settings read from filePath
+// started a YAML list that has no items.
+func checkListEnded(filePath string, settings []configSetting, yaml bool) error {
+	if !yaml || len(settings) == 0 {
+		return nil
+	}
+	if last := settings[len(settings)-1]; last.list && len(last.values) == 0 {
+		return fmt.Errorf("%s:%d: missing value for %s", filePath, last.line, last.name)
+	}
+	return nil
+}
+
+// unsupportedSyntax describes what's wrong with a line of a config file using
+// syntax beyond the flat subset readConfig understands, or returns "".
+func unsupportedSyntax(line string, yaml bool) string {
+	switch {
+	case !yaml && (strings.Contains(line, `"""`) || strings.Contains(line, "'''")):
+		return "multi-line strings aren't supported"
+	case yaml && (line == "---" || strings.HasPrefix(line, "--- ") || strings.HasPrefix(line, "%")):
+		return "YAML directives aren't supported"
+	case yaml && strings.HasPrefix(line, "? "):
+		return "complex keys aren't supported"
+	}
+	return ""
+}
+
+// unsupportedValue describes what's wrong with a value using syntax beyond the
+// flat subset readConfig understands, or returns "".
+func unsupportedValue(v string, yaml bool) string {
+	if v == "" {
+		return "missing value"
+	}
+	switch c := v[0]; {
+	case c == '{':
+		return "inline tables and mappings aren't supported"
+	case c == '"' || c == '\'':
+		if len(v) < 2 || v[len(v)-1] != c {
+			return "unterminated string " + v
+		}
+		if c == '"' {
+			if _, err := strconv.Unquote(v); err != nil {
+				return "invalid string " + v
+			}
+		}
+	case !yaml:
+		return ""
+	case c == '|' || c == '>':
+		return "block scalars aren't supported"
+	case c == '&' || c == '*':
+		return "anchors and aliases aren't supported"
+	case c == '!':
+		return "tags aren't supported"
+	case strings.Contains(v, ": "):
+		return "nested mappings aren't supported, quote the value if it holds \": \""
+	}
+	return ""
+}
+
+// stripComment removes a # comment from line, unless the # is quoted or
+// part of a value such as a URL fragment.
+func stripComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// splitList splits the items of a one-line list at commas outside quotes.
+func splitList(s string) []string {
+	var items []string
+	quote, start := byte(0), 0
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) {
+			switch c := s[i]; {
+			case quote != 0:
+				if c == quote {
+					quote = 0
+				}
+				continue
+			case c == '"' || c == '\'':
+				quote = c
+				continue
+			case c != ',':
+				continue
+			}
+		}
+		if item := strings.TrimSpace(s[start:i]); item != "" {
+			items = append(items, item)
+		}
+		start = i + 1
+	}
+	return items
+}
+
+// unquote strips the quotes from a quoted value. Double-quoted values may hold
+// escapes, single-quoted ones are literal.
+func unquote(v string) string {
+	if len(v) < 2 {
+		return v
+	}
+	switch {
+	case v[0] == '"' && v[len(v)-1] == '"':
+		if s, err := strconv.Unquote(v); err == nil {
+			return s
+		}
+	case v[0] == '\'' && v[len(v)-1] == '\'':
+		return v[1 : len(v)-1]
+	}
+	return v
+}
+
+// applyConfig sets the flags named by settings, except those given on the
+// command line, which override the file. Lists set a repeatableValue flag
+// once per value, and any other flag to the values joined by commas.
+func applyConfig(settings []configSetting) error {
+	set := map[string]bool{}
+	flagSet.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for _, s := range settings {
+		f := flagSet.Lookup(s.name)
+		if f == nil || s.name == "config" {
+			return fmt.Errorf("line %d: unknown setting %s", s.line, s.name)
+		}
+		if set[s.name] {
+			continue
+		}
+		values := s.values
+		if _, ok := f.Value.(repeatableValue); !ok {
+			values = []string{strings.Join(values, ",")}
+		}
+		for _, v := range values {
+			if err := f.Value.Set(v); err != nil {
+				return fmt.Errorf("line %d: invalid value %q for %s: %s", s.line, v, s.name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package devcache
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyConfigLists(t *testing.T) {
+	tests := []struct {
+		name, config string
+	}{
+		{"cache.yaml", "url: http://localhost:9000/\ntransform:\n  - minify=2xx\n  - error-envelope=4xx\nkey-headers:\n  - X-Api-Version\n  - Accept\n"},
+		{"cache.toml", "url = \"http://localhost:9000/\"\ntransform = [\"minify=2xx\", \"error-envelope=4xx\"]\nkey_headers = [\"X-Api-Version\", \"Accept\"]\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), tt.name)
+			if err := ioutil.WriteFile(filePath, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			flagSet = flag.NewFlagSet("devcache", flag.ContinueOnError)
+			registerFlags(flagSet)
+			settings, err := readConfig(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := applyConfig(settings); err != nil {
+				t.Fatal(err)
+			}
+			if flagURL != "http://localhost:9000/" {
+				t.Errorf("url = %q", flagURL)
+			}
+			// transform is repeatable, so each item is its own rule
+			if len(flagTransforms) != 2 || flagTransforms[1].name != "error-envelope" {
+				t.Errorf("transform = %v", flagTransforms.String())
+			}
+			// key-headers isn't, so the items are joined by commas
+			if got := flagKeyHeaders.String(); got != "X-Api-Version,Accept" {
+				t.Errorf("key-headers = %q", got)
+			}
+		})
+	}
+}
+
+func TestApplyConfigCommandLineWins(t *testing.T) {
+	flagSet = flag.NewFlagSet("devcache", flag.ContinueOnError)
+	registerFlags(flagSet)
+	if err := flagSet.Parse([]string{"-ttl", "1m"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig([]configSetting{{name: "ttl", values: []string{"1h"}, line: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if flagTTL.String() != "1m0s" {
+		t.Errorf("ttl = %s, want the command line's 1m", flagTTL)
+	}
+	if err := applyConfig([]configSetting{{name: "no-such-flag", values: []string{"x"}, line: 2}}); err == nil {
+		t.Error("unknown setting accepted")
+	}
+}
+
+func TestReadConfigRejectsUnsupported(t *testing.T) {
+	for _, tt := range []struct {
+		name, config string
+		// line is where the error is reported, and msg part of it
+		line int
+		msg  string
+	}{
+		{"cache.toml", "url = \"http://localhost/\"\n[upstream]\nurl = \"x\"\n", 2, "tables aren't supported"},
+		{"cache.toml", "route = [\n  \"/a=http://a/\",\n]\n", 1, "lists must be on one line"},
+		{"cache.toml", "ttl = \"1h\"\nurl = { host = \"x\" }\n", 2, "inline tables"},
+		{"cache.toml", "url = \"\"\"\nhttp://x/\n\"\"\"\n", 1, "multi-line strings"},
+		{"cache.toml", "url = \"http://x/\n", 1, "unterminated string"},
+		{"cache.toml", "url =\n", 1, "missing value"},
+		{"cache.yaml", "url: http://x/\nupstream:\n  url: http://y/\n", 3, "nested settings"},
+		{"cache.yaml", "url: |\n  http://x/\n", 1, "block scalars"},
+		{"cache.yaml", "url: &u http://x/\n", 1, "anchors"},
+		{"cache.yaml", "url: {host: x}\n", 1, "inline tables and mappings"},
+		{"cache.yaml", "route:\n  - path: /a\n", 2, "nested mappings"},
+		{"cache.yaml", "url: http://x/\n  - http://y/\n", 2, "list item after the value of url"},
+		{"cache.yaml", "- http://y/\n", 1, "list item outside of a setting"},
+		{"cache.yaml", "route:\nttl: 1h\n", 1, "missing value for route"},
+		{"cache.yaml", "ttl: 1h\nroute:\n", 2, "missing value for route"},
+	} {
+		filePath := filepath.Join(t.TempDir(), tt.name)
+		if err := ioutil.WriteFile(filePath, []byte(tt.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := readConfig(filePath)
+		want := fmt.Sprintf("%s:%d: ", filePath, tt.line)
+		if err == nil || !strings.HasPrefix(err.Error(), want) || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%q: error %v, want %q at line %d", tt.config, err, tt.msg, tt.line)
+		}
+	}
+}
+
+func TestReadConfigQuoting(t *testing.T) {
+	for _, tt := range []struct {
+		name, config string
+		want         []string
+	}{
+		{"cache.yaml", "key-headers: \"X-Foo: bar\"\n", []string{"X-Foo: bar"}},
+		{"cache.yaml", "route:\n  - '/a=http://a/#x'  # comment\n", []string{"/a=http://a/#x"}},
+		{"cache.yaml", "url: http://x/#frag\n", []string{"http://x/#frag"}},
+		{"cache.toml", "route = [\"/a=http://a/\", '/b=c,d']\n", []string{"/a=http://a/", "/b=c,d"}},
+		{"cache.toml", "  url = \"http://x/\\u00e9\"\n", []string{"http://x/é"}},
+	} {
+		filePath := filepath.Join(t.TempDir(), tt.name)
+		if err := ioutil.WriteFile(filePath, []byte(tt.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		settings, err := readConfig(filePath)
+		if err != nil {
+			t.Errorf("%q: %v", tt.config, err)
+			continue
+		}
+		if len(settings) != 1 || !reflect.DeepEqual(settings[0].values, tt.want) {
+			t.Errorf("%q: read %+v, want %q", tt.config, settings, tt.want)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+// Package devcache is a caching HTTP proxy for development: it forwards
+// requests to an upstream API and serves repeated requests from its cache,
+// saved between runs. The devcache command runs it as a server; New embeds
+// it in other programs and tests.
+//
+// The server's state, such as its cache, stats and settings, is kept in
+// package variables rather than in the Server, so only one Server may be in
+// use per process at a time: New fails until the previous one has been shut
+// down. Tests using devcache can't run in parallel with each other for the
+// same reason.
+package devcache
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	cache "github.com/patrickmn/go-cache"
+	"golang.org/x/net/netutil"
+)
+
+// Config configures a Server. Fields left at their zero value take the
+// default of the flag they stand for.
+type Config struct {
+	// URL is the upstream requests are forwarded to, as set by -url.
+	URL string
+	// Addr is the address Start serves on, as set by -addr.
+	Addr string
+	// CacheFile is the file the cache is loaded from and saved to, as set
+	// by -cache-file.
+	CacheFile string
+	// TTL is how long responses are cached for, as set by -ttl.
+	TTL time.Duration
+	// Offline never contacts the upstream, as set by -offline.
+	Offline bool
+	// ReadOnly freezes the cache, as set by -read-only.
+	ReadOnly bool
+	// AdminToken is required to use the admin endpoints, as set by
+	// -admin-token.
+	AdminToken string
+	// Args are any other settings, given as the devcache command's flags,
+	// such as []string{"-transform", "minify=2xx"}. They're parsed after the
+	// fields above, so override them.
+	Args []string
+	// VaryFunc, if set, computes a fingerprint of each proxied request that
+	// becomes part of its cache key, so requests it tells apart are cached
+	// separately. It's for variation rules that no single header captures,
+	// such as a claim inside a token. Requests it returns "" for are keyed
+	// as they would be without it.
+	VaryFunc func(*http.Request) string
+}
+
+// Server is a devcache server. Its Handler can be served directly, or Start
+// serves it on -addr like the devcache command does.
+type Server struct {
+	srv     *server
+	servers []*http.Server
+	stops   []func()
+	// done is set once the server has been shut down.
+	done bool
+}
+
+// errServerLive is returned by New while an earlier Server is in use.
+var errServerLive = errors.New("devcache: a server is already in use, shut it down first")
+
+// live is the Server in use, if any.
+var live struct {
+	sync.Mutex
+	server *Server
+}
+
+// New returns a Server configured by cfg, with its cache loaded from the
+// cache file. Settings are parsed as the devcache command parses its flags,
+// any not given taking their defaults.
+func New(cfg Config) (*Server, error) {
+	live.Lock()
+	defer live.Unlock()
+	if live.server != nil {
+		return nil, errServerLive
+	}
+	fs := flag.NewFlagSet("devcache", flag.ContinueOnError)
+	registerFlags(fs)
+	if err := fs.Parse(cfg.args()); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	flagSet = fs
+	resetState()
+	if err := setup(); err != nil {
+		teardown()
+		return nil, err
+	}
+	s := &Server{srv: newServer(flagAdminAddr != "")}
+	s.srv.VaryFunc = cfg.VaryFunc
+	live.server = s
+	current.Store(s.srv)
+	publishOnce.Do(func() {
+		expvar.Publish("devcache", expvar.Func(func() interface{} {
+			return current.Load().(*server).Snapshot()
+		}))
+	})
+	return s, nil
+}
+
+// args returns cfg as the devcache command's flags.
+func (cfg Config) args() []string {
+	var args []string
+	for _, f := range []struct {
+		name, value string
+	}{
+		{"url", cfg.URL},
+		{"addr", cfg.Addr},
+		{"cache-file", cfg.CacheFile},
+		{"admin-token", cfg.AdminToken},
+	} {
+		if f.value != "" {
+			args = append(args, "-"+f.name, f.value)
+		}
+	}
+	if cfg.TTL != 0 {
+		args = append(args, "-ttl", cfg.TTL.String())
+	}
+	if cfg.Offline {
+		args = append(args, "-offline")
+	}
+	if cfg.ReadOnly {
+		args = append(args, "-read-only")
+	}
+	return append(args, cfg.Args...)
+}
+
+// current is the server of the latest New, published with expvar.
+var (
+	current     atomic.Value
+	publishOnce sync.Once
+)
+
+// resetState forgets what an earlier Server in the process counted and
+// toggled, so a new one starts as afresh as the devcache command does.
+func resetState() {
+	stats.Reset()
+	tenantRequests.reset()
+	upstreamLatency.reset()
+	keys.Range(func(k, _ interface{}) bool {
+		keys.Delete(k)
+		return true
+	})
+	tags = newTagIndex()
+	varies = newVaryIndex()
+	tenantUsage = newUsageIndex()
+	hot = &hotKeys{keys: make(map[string]*hotKey)}
+	atomic.StoreInt32(&readOnly, 0)
+	frozen.expirations = nil
+	atomic.StoreInt32(&upstreamDisabled, 0)
+	atomic.StoreInt32(&cacheLoaded, 0)
+	shared = nil
+	storeVerify = nil
+	unexpected.Lock()
+	unexpected.count, unexpected.requests = 0, nil
+	unexpected.Unlock()
+}
+
+// Handler returns the handler serving both the proxy and, unless -admin-addr
+// is set, devcache's own endpoints.
+func (s *Server) Handler() http.Handler {
+	return s.srv
+}
+
+// Stats returns a snapshot of the cache and its stats, as served by
+// /__cache/stats.
+func (s *Server) Stats() Snapshot {
+	return s.srv.Snapshot()
+}
+
+// Unrecorded returns the requests that weren't in the recording with
+// -assert-recorded, as "METHOD URI", up to the first thousand.
+func (s *Server) Unrecorded() []string {
+	unexpected.Lock()
+	defer unexpected.Unlock()
+	requests := make([]string, len(unexpected.requests))
+	for i, req := range unexpected.requests {
+		requests[i] = req.Method + " " + req.URI
+	}
+	return requests
+}
+
+// Start starts the background work of the server, such as warming and
+// snapshots, and serves it on -addr, and on -admin-addr if it's set. It
+// returns once the server is listening.
+func (s *Server) Start() error {
+	s.servers = []*http.Server{{Addr: flagAddr, Handler: s.srv}}
+	if flagAdminAddr != "" {
+		s.servers = append(s.servers, &http.Server{Addr: flagAdminAddr, Handler: s.srv.admin})
+	}
+	listeners := make([]net.Listener, len(s.servers))
+	for i, hs := range s.servers {
+		ln, err := net.Listen(familyNetwork(flagListenFamily), hs.Addr)
+		if err != nil {
+			for _, ln := range listeners[:i] {
+				ln.Close()
+			}
+			return err
+		}
+		if flagMaxConns > 0 && hs.Handler == s.srv {
+			// connections over the limit wait to be accepted; idle
+			// keep-alive connections count towards it until -idle-timeout
+			// closes them
+			ln = netutil.LimitListener(ln, flagMaxConns)
+		}
+		listeners[i] = ln
+	}
+	s.stops = append(s.stops, startMemoryMonitor(), startUpstreamPinger(), startFsck(), startSnapshots())
+	if flagWarmFile != "" {
+		paths, err := readWarmFile(flagWarmFile)
+		if err != nil {
+			log.Printf("error reading warm file: %s", err)
+		} else {
+			startWarm(paths)
+		}
+	}
+	for i, hs := range s.servers {
+		hs.IdleTimeout = flagIdleTimeout
+		hs.SetKeepAlivesEnabled(!flagDisableKeepAlive)
+		go func(hs *http.Server, ln net.Listener) {
+			if err := hs.Serve(ln); err != nil && err != http.ErrServerClosed {
+				log.Println(err)
+			}
+		}(hs, listeners[i])
+	}
+	if flagAdminAddr != "" {
+		log.Printf("admin listening on %s", flagAdminAddr)
+	}
+	log.Printf("server listening on %s, forwarding to %s", flagAddr, flagURL)
+	return nil
+}
+
+// Shutdown stops the server once the requests and background fetches in
+// flight are done, or ctx is, and saves the cache. With -assert-recorded, it
+// returns an error if requests weren't in the recording.
+func (s *Server) Shutdown(ctx context.Context) error {
+	live.Lock()
+	defer live.Unlock()
+	if s.done {
+		return nil
+	}
+	s.done = true
+	defer func() {
+		teardown()
+		live.server = nil
+	}()
+	for _, hs := range s.servers {
+		if err := hs.Shutdown(ctx); err != nil {
+			log.Printf("error shutting down server: %s", err)
+		}
+	}
+	if !background.drain(ctx) {
+		log.Printf("background fetches still running after shutting down, not waiting for them")
+	}
+	for _, stop := range s.stops {
+		stop()
+	}
+	s.stops = nil
+	snapshot := snapshotItems()
+	switch {
+	case cacheReadOnly():
+		log.Printf("cache is read-only, not saving it")
+	case atomic.LoadInt32(&cacheLoaded) == 0:
+		// saving now would replace the file with the part loaded so far
+		log.Printf("cache is still loading, not saving it")
+	default:
+		saveSnapshot(snapshot)
+	}
+	if n := unexpectedCount(); n > 0 {
+		return fmt.Errorf("%d unexpected requests weren't in the recording", n)
+	}
+	return nil
+}
+
+// saveSnapshot saves the cache and the access profile updated with it at
+// shutdown.
+func saveSnapshot(snapshot map[string]cache.Item) {
+	if flagProfileFile != "" {
+		profile = profile.update(snapshot)
+		if err := writeProfile(flagProfileFile, profile); err != nil {
+			log.Printf("error writing access profile: %s", err)
+		}
+	}
+	if err := saveCache(snapshot); err != nil {
+		log.Printf("error writing cache: %s", err)
+	} else {
+		log.Printf("cache saved")
+	}
+}
+
+// teardown stops the background work setup started and closes its
+// connections, so they don't outlive the server.
+func teardown() {
+	if background != nil {
+		background.stop()
+	}
+	if shared != nil {
+		shared.stop()
+		shared = nil
+	}
+	if storeVerify != nil {
+		storeVerify.close()
+		storeVerify = nil
+	}
+	if dbStore != nil {
+		if err := dbStore.close(); err != nil {
+			log.Printf("error closing %s: %s", flagCacheFile, err)
+		}
+		dbStore = nil
+	}
+	upstreamClient.CloseIdleConnections()
+	mirrorClient = nil
+	// the next server registers its own routes and starts its own counts
+	tenantRoutes = map[*mux.Route]bool{}
+	flights = &flightGroup{calls: make(map[string]*flight)}
+	health = &upstreamHealth{hosts: make(map[string]*hostHealth), pathFailures: make(map[string]int)}
+	stores = &sourceCounts{counts: make(map[string]int64)}
+	conns = &connStats{hosts: make(map[string]*ConnCounts)}
+	session.Lock()
+	session.name = ""
+	session.Unlock()
+}
@@ -0,0 +1,316 @@
+package devcache
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// newTestServer returns a server forwarding to upstream, configured by args
+// and with its cache file in a temporary directory. It's shut down when the
+// test completes.
+func newTestServer(t testing.TB, upstream string, args ...string) *Server {
+	t.Helper()
+	args = append([]string{"-cache-file", filepath.Join(t.TempDir(), "cache.gob")}, args...)
+	s, err := New(Config{URL: upstream, Args: args})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Shutdown(context.Background())
+	})
+	return s
+}
+
+// startTestServer starts a server forwarding to upstream on a free local
+// port and returns it with its address.
+func startTestServer(t testing.TB, upstream string, args ...string) (*Server, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	s := newTestServer(t, upstream, append([]string{"-addr", addr}, args...)...)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return s, addr
+}
+
+// do serves a request for target with h and returns the response.
+func do(h http.Handler, method, target string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestNewWhileLive(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer up.Close()
+	dir := t.TempDir()
+	s, err := New(Config{URL: up.URL, Args: []string{"-cache-file", filepath.Join(dir, "cache.gob")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := background
+	if _, err := New(Config{URL: up.URL}); err != errServerLive {
+		t.Fatalf("second New: got %v, want errServerLive", err)
+	}
+	if w := do(s.Handler(), "GET", "/a", nil); w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-pool.quit:
+	default:
+		t.Error("work pool still running after Shutdown")
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("second Shutdown: %v", err)
+	}
+
+	// the cache was saved, and the next server loads it
+	s = newTestServer(t, up.URL, "-cache-file", filepath.Join(dir, "cache.gob"))
+	if got := s.Stats().Entries; got != 1 {
+		t.Errorf("loaded %d entries, want 1", got)
+	}
+}
+
+func TestConfigFields(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cache.gob")
+	s, err := New(Config{
+		URL:        "http://127.0.0.1:1/",
+		Addr:       "127.0.0.1:0",
+		CacheFile:  file,
+		TTL:        90 * time.Minute,
+		Offline:    true,
+		AdminToken: "root",
+		// Args win over the fields
+		Args: []string{"-addr", "127.0.0.1:9999"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	for name, want := range map[string]string{
+		"url":         "http://127.0.0.1:1/",
+		"addr":        "127.0.0.1:9999",
+		"cache-file":  file,
+		"ttl":         "1h30m0s",
+		"offline":     "true",
+		"read-only":   "false",
+		"admin-token": "root",
+	} {
+		if got := flagSet.Lookup(name).Value.String(); got != want {
+			t.Errorf("-%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestShutdownResetsRoutes(t *testing.T) {
+	var routes int
+	for i := 0; i < 3; i++ {
+		s, err := New(Config{URL: "http://127.0.0.1:1/", CacheFile: filepath.Join(t.TempDir(), "cache.gob")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			routes = len(tenantRoutes)
+		} else if len(tenantRoutes) != routes {
+			t.Errorf("server %d has %d tenant routes, want %d", i+1, len(tenantRoutes), routes)
+		}
+		s.Shutdown(context.Background())
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	fetching := make(chan struct{})
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(fetching)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("slow body"))
+	}))
+	defer up.Close()
+	file := filepath.Join(t.TempDir(), "cache.gob")
+	s, addr := startTestServer(t, up.URL, "-cache-file", file)
+
+	type result struct {
+		body string
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		res, err := http.Get("http://" + addr + "/slow")
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		done <- result{string(body), err}
+	}()
+	<-fetching
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the request in flight is answered before the cache is saved with it
+	if res := <-done; res.err != nil || res.body != "slow body" {
+		t.Errorf("request in flight: %q, %v", res.body, res.err)
+	}
+	items, err := loadStore(gobStore(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := items["/slow"]; !ok {
+		t.Errorf("saved %d items without /slow", len(items))
+	}
+	if _, err := http.Get("http://" + addr + "/slow"); err == nil {
+		t.Error("request accepted after shutting down")
+	}
+}
+
+// countConns returns an upstream counting the connections made to it.
+func countConns(t testing.TB, conns *int64) *httptest.Server {
+	up := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("body of " + r.URL.Path))
+	}))
+	up.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(conns, 1)
+		}
+	}
+	up.Start()
+	t.Cleanup(up.Close)
+	return up
+}
+
+// get requests path from the server at addr with client, returning whether
+// the connection was reused.
+func get(t testing.TB, client *http.Client, addr, path string, close bool) bool {
+	t.Helper()
+	var reused bool
+	trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+		reused = info.Reused
+	}}
+	r, err := http.NewRequest("GET", "http://"+addr+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close = close
+	res, err := client.Do(r.WithContext(httptrace.WithClientTrace(r.Context(), trace)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "body of "+path {
+		t.Fatalf("%s: got %q", path, body)
+	}
+	return reused
+}
+
+func TestKeepAlive(t *testing.T) {
+	var conns int64
+	up := countConns(t, &conns)
+	_, addr := startTestServer(t, up.URL)
+	client := &http.Client{Transport: &http.Transport{}}
+	defer client.CloseIdleConnections()
+
+	get(t, client, addr, "/a", false)
+	if !get(t, client, addr, "/b", false) {
+		t.Error("client connection not reused")
+	}
+	if n := atomic.LoadInt64(&conns); n != 1 {
+		t.Errorf("%d upstream connections for two fetches, want 1", n)
+	}
+
+	// Connection: close is honored, so the next request needs a new one
+	get(t, client, addr, "/c", true)
+	if get(t, client, addr, "/d", false) {
+		t.Error("connection reused after Connection: close")
+	}
+}
+
+func TestDisableKeepAlive(t *testing.T) {
+	var conns int64
+	up := countConns(t, &conns)
+	_, addr := startTestServer(t, up.URL, "-disable-keepalive")
+	client := &http.Client{Transport: &http.Transport{}}
+	defer client.CloseIdleConnections()
+
+	get(t, client, addr, "/a", false)
+	if get(t, client, addr, "/b", false) {
+		t.Error("client connection reused with -disable-keepalive")
+	}
+	if n := atomic.LoadInt64(&conns); n != 2 {
+		t.Errorf("%d upstream connections for two fetches, want 2", n)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	var conns int64
+	up := countConns(t, &conns)
+	_, addr := startTestServer(t, up.URL, "-max-conns", "1")
+
+	// a's idle keep-alive connection holds the only slot
+	a := &http.Client{Transport: &http.Transport{}}
+	get(t, a, addr, "/a", false)
+
+	b := &http.Client{Transport: &http.Transport{}}
+	defer b.CloseIdleConnections()
+	done := make(chan error)
+	go func() {
+		res, err := b.Get("http://" + addr + "/b")
+		if err == nil {
+			res.Body.Close()
+		}
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("second connection served over the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// it's accepted once a's is closed, rather than refused
+	a.CloseIdleConnections()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second connection not served after the first closed")
+	}
+}
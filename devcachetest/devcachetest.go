@@ -0,0 +1,108 @@
+// Package devcachetest serves recorded responses to Go tests with devcache,
+// in place of hand-written httptest.Server mocks.
+//
+//	srv := devcachetest.NewServer(t, devcachetest.Config{
+//		Fixture: "testdata/api.gob",
+//		Strict:  true,
+//	})
+//	client := api.NewClient(srv.URL)
+//
+// Only one Server may be in use at a time, as devcache keeps its state per
+// process, so tests using it can't be run in parallel: NewServer fails the
+// test if another Server hasn't been closed yet.
+package devcachetest
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/travis-g/devcache"
+)
+
+// Config configures a Server.
+type Config struct {
+	// Fixture is the saved cache the server serves: a cache file, or a file
+	// of JSON lines if its name ends in .jsonl. It's never written to.
+	Fixture string
+	// URL is the upstream requests that aren't in the fixture are proxied
+	// to, uncached. It's unused with Strict.
+	URL string
+	// Strict fails the test on any request that isn't in the fixture. Such
+	// requests are answered with status 599.
+	Strict bool
+	// Args are any other devcache flags.
+	Args []string
+}
+
+// Server is a devcache server listening on an ephemeral port.
+type Server struct {
+	// URL is the base URL of the server, such as http://127.0.0.1:1234.
+	URL string
+	// Proxy is the devcache server, for its Stats.
+	Proxy *devcache.Server
+
+	t      testing.TB
+	ts     *httptest.Server
+	config Config
+	closed bool
+}
+
+// inUse is set while a Server is open.
+var inUse int32
+
+// NewServer starts a server serving cfg.Fixture, which is closed when the
+// test and its subtests complete. It fails the test at once if the server
+// can't be started, as when another test's is still open.
+func NewServer(t testing.TB, cfg Config) *Server {
+	t.Helper()
+	if !atomic.CompareAndSwapInt32(&inUse, 0, 1) {
+		t.Fatalf("devcachetest: another Server is still open; tests using devcachetest can't run in parallel")
+	}
+	if _, err := os.Stat(cfg.Fixture); err != nil {
+		atomic.StoreInt32(&inUse, 0)
+		t.Fatalf("devcachetest: %s", err)
+	}
+	var args []string
+	if filepath.Ext(cfg.Fixture) == ".jsonl" {
+		args = append(args, "-store", "json")
+	}
+	if cfg.Strict {
+		args = append(args, "-assert-recorded", "-assert-report", "")
+	}
+	proxy, err := devcache.New(devcache.Config{
+		URL:       cfg.URL,
+		CacheFile: cfg.Fixture,
+		// the fixture is served frozen, entries however old, and never
+		// saved
+		ReadOnly: true,
+		Args:     append(args, cfg.Args...),
+	})
+	if err != nil {
+		atomic.StoreInt32(&inUse, 0)
+		t.Fatalf("devcachetest: %s", err)
+	}
+	s := &Server{Proxy: proxy, t: t, ts: httptest.NewServer(proxy.Handler()), config: cfg}
+	s.URL = s.ts.URL
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Close shuts the server down and, with Strict, fails the test with each
+// request that wasn't in the fixture.
+func (s *Server) Close() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.ts.Close()
+	for _, req := range s.Proxy.Unrecorded() {
+		s.t.Errorf("devcachetest: %s isn't in %s", req, s.config.Fixture)
+	}
+	// the only error is about the requests reported above
+	s.Proxy.Shutdown(context.Background())
+	atomic.StoreInt32(&inUse, 0)
+}
@@ -0,0 +1,162 @@
+package devcachetest
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/travis-g/devcache"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// record returns a fixture named name holding the upstream's responses to
+// paths, saved with args.
+func record(t *testing.T, name string, paths []string, args ...string) string {
+	t.Helper()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "recorded %s", r.URL.Path)
+	}))
+	defer up.Close()
+	fixture := filepath.Join(t.TempDir(), name)
+	s, err := devcache.New(devcache.Config{URL: up.URL, CacheFile: fixture, Args: args})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		s.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return fixture
+}
+
+// fakeT records the failures of a test instead of failing it.
+type fakeT struct {
+	testing.TB
+	mu       sync.Mutex
+	failures []string
+}
+
+func (f *fakeT) Helper() {}
+
+func (f *fakeT) Errorf(format string, args ...interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeT) Fatalf(format string, args ...interface{}) {
+	f.Errorf(format, args...)
+	runtime.Goexit()
+}
+
+// failures runs fn as a test of its own and returns how it failed.
+func failures(t *testing.T, fn func(testing.TB)) []string {
+	f := &fakeT{TB: t}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn(f)
+	}()
+	<-done
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.failures
+}
+
+func get(t *testing.T, url string) (int, string) {
+	t.Helper()
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return res.StatusCode, string(body)
+}
+
+func TestNewServer(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		args []string
+	}{
+		{"api.gob", nil},
+		{"api.jsonl", []string{"-store", "json"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fixture := record(t, tt.name, []string{"/users"}, tt.args...)
+			srv := NewServer(t, Config{Fixture: fixture})
+			if status, body := get(t, srv.URL+"/users"); status != http.StatusOK || body != "recorded /users" {
+				t.Errorf("status %d, body %q", status, body)
+			}
+			if hits := srv.Proxy.Stats().Stats.Hits; hits != 1 {
+				t.Errorf("%d hits, want 1", hits)
+			}
+		})
+	}
+}
+
+func TestStrict(t *testing.T) {
+	fixture := record(t, "api.gob", []string{"/users"})
+	f := &fakeT{TB: t}
+	srv := NewServer(f, Config{Fixture: fixture, Strict: true})
+	if status, _ := get(t, srv.URL+"/users"); status != http.StatusOK {
+		t.Errorf("recorded request: status %d", status)
+	}
+	if status, _ := get(t, srv.URL+"/orders"); status != 599 {
+		t.Errorf("unrecorded request: status %d, want 599", status)
+	}
+	srv.Close()
+	if len(f.failures) != 1 || !strings.Contains(f.failures[0], "GET /orders isn't in "+fixture) {
+		t.Errorf("failures %q, want /orders reported", f.failures)
+	}
+}
+
+func TestNewServerFailures(t *testing.T) {
+	fixture := record(t, "api.gob", []string{"/users"})
+	for _, tt := range []struct {
+		name string
+		fn   func(testing.TB)
+		want string
+	}{
+		{"missing fixture", func(tb testing.TB) {
+			NewServer(tb, Config{Fixture: filepath.Join(t.TempDir(), "missing.gob")})
+		}, "no such file"},
+		{"invalid flag", func(tb testing.TB) {
+			NewServer(tb, Config{Fixture: fixture, Args: []string{"-no-such-flag"}})
+		}, "no-such-flag"},
+		{"in parallel", func(tb testing.TB) {
+			srv := NewServer(tb, Config{Fixture: fixture})
+			defer srv.Close()
+			NewServer(tb, Config{Fixture: fixture})
+		}, "can't run in parallel"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			failed := failures(t, tt.fn)
+			if len(failed) != 1 || !strings.Contains(failed[0], tt.want) {
+				t.Errorf("failures %q, want %q", failed, tt.want)
+			}
+			// and the next server can start
+			srv := NewServer(t, Config{Fixture: fixture})
+			srv.Close()
+		})
+	}
+}
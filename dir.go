@@ -0,0 +1,211 @@
+package devcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+// dirIndexFile is the name of the file mapping entry file names back to keys
+// within a cache directory.
+const dirIndexFile = "index.json"
+
+// dirMu serializes writes to the cache directory and guards dirIndex.
+var (
+	dirMu    sync.Mutex
+	dirIndex = map[string]string{}
+)
+
+// dirEntry is the on-disk form of a cache entry in directory mode. Text bodies
+// are stored as strings so the files stay diffable.
+type dirEntry struct {
+	Key string `json:"key"`
+	*entry
+	Expiration int64  `json:"expiration"`
+	Body       string `json:"body,omitempty"`
+	BodyBase64 []byte `json:"body_base64,omitempty"`
+}
+
+// newDirEntry returns the on-disk form of item, or nil if it isn't an entry.
+func newDirEntry(key string, item cache.Item) *dirEntry {
+	e, ok := toEntry(item.Object)
+	if !ok {
+		return nil
+	}
+	// bodies are written uncompressed so the files stay diffable
+	e = e.decompressed()
+	de := &dirEntry{Key: key, entry: e, Expiration: item.Expiration}
+	if utf8.Valid(e.Body) {
+		de.Body = string(e.Body)
+	} else {
+		de.BodyBase64 = e.Body
+	}
+	return de
+}
+
+// item returns the cache item de describes. de.entry must have been
+// allocated before de was unmarshaled.
+func (de *dirEntry) item() cache.Item {
+	de.entry.Body = de.BodyBase64
+	if de.entry.Body == nil {
+		de.entry.Body = []byte(de.Body)
+	}
+	return cache.Item{Object: de.entry, Expiration: de.Expiration}
+}
+
+// keyHash is the file name stem an entry with the given key is written to.
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// readCacheDir loads every entry file in dir into items.
+func readCacheDir(dir string, items *map[string]cache.Item) error {
+	dirMu.Lock()
+	defer dirMu.Unlock()
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return os.ErrNotExist
+	}
+	*items = make(map[string]cache.Item, len(files))
+	for _, file := range files {
+		if filepath.Base(file) == dirIndexFile {
+			continue
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		de := dirEntry{entry: &entry{}}
+		if err := json.Unmarshal(data, &de); err != nil {
+			return err
+		}
+		(*items)[de.Key] = de.item()
+		dirIndex[strings.TrimSuffix(filepath.Base(file), ".json")] = de.Key
+	}
+	return nil
+}
+
+// writeCacheDir writes every item to its own file in dir and removes files for
+// entries that are no longer cached.
+func writeCacheDir(dir string, items map[string]cache.Item) error {
+	dirMu.Lock()
+	defer dirMu.Unlock()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	index := make(map[string]string, len(items))
+	for key, item := range items {
+		if err := writeDirEntry(dir, key, item); err != nil {
+			return err
+		}
+		index[keyHash(key)] = key
+	}
+	for name := range dirIndex {
+		if _, ok := index[name]; !ok {
+			os.Remove(filepath.Join(dir, name+".json"))
+		}
+	}
+	dirIndex = index
+	return writeDirIndex(dir)
+}
+
+// persistDirEntry writes the current Cache entry for key to dir.
+func persistDirEntry(dir, key string) error {
+	v, exp, found := Cache.GetWithExpiration(key)
+	if !found {
+		return nil
+	}
+	item := cache.Item{Object: v}
+	if !exp.IsZero() {
+		item.Expiration = exp.UnixNano()
+	}
+	return writeCacheDirEntry(dir, key, item)
+}
+
+// writeCacheDirEntry persists a single updated item to dir.
+func writeCacheDirEntry(dir, key string, item cache.Item) error {
+	dirMu.Lock()
+	defer dirMu.Unlock()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := writeDirEntry(dir, key, item); err != nil {
+		return err
+	}
+	dirIndex[keyHash(key)] = key
+	return writeDirIndex(dir)
+}
+
+// removeCacheDirEntry deletes the file for key from dir.
+func removeCacheDirEntry(dir, key string) error {
+	dirMu.Lock()
+	defer dirMu.Unlock()
+	name := keyHash(key)
+	if _, ok := dirIndex[name]; !ok {
+		return nil
+	}
+	delete(dirIndex, name)
+	if err := os.Remove(filepath.Join(dir, name+".json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return writeDirIndex(dir)
+}
+
+func writeDirEntry(dir, key string, item cache.Item) error {
+	de := newDirEntry(key, item)
+	if de == nil {
+		return nil
+	}
+	if flagStableFixtures {
+		de = de.stable()
+	}
+	data, err := json.MarshalIndent(de, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, keyHash(key)+".json"), data)
+}
+
+func writeDirIndex(dir string) error {
+	data, err := json.MarshalIndent(dirIndex, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, dirIndexFile), data)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place so readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,273 @@
+package devcache
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/travis-g/devcache/httpcache"
+)
+
+// entry is a single cached upstream response along with the metadata needed to
+// describe it. Its JSON form is the metadata only.
+type entry struct {
+	// Body is the (possibly minified) response body, gzipped if Compressed
+	// is set. Use body to read it.
+	Body []byte `json:"-"`
+	// Compressed is set if Body was gzipped when it was stored, and RawSize
+	// is then the length of the body uncompressed.
+	Compressed bool `json:"compressed,omitempty"`
+	RawSize    int  `json:"raw_size,omitempty"`
+	// URL is the full original request URI. It's kept because keys for very
+	// long URIs are truncated and digested, see limitKey.
+	URL string `json:"url,omitempty"`
+	// Method is the method the entry was fetched with. Entries fetched with
+	// GET, or before it was kept, have none.
+	Method string `json:"method,omitempty"`
+	// Source is the code path that stored the entry, such as organic
+	// traffic or warm-up.
+	Source string `json:"source,omitempty"`
+	// Status is the upstream's response status. Entries recorded before it
+	// was kept have none and are served as 200 OK.
+	Status int `json:"status,omitempty"`
+	// ContentType is the Content-Type the entry is served with.
+	ContentType string `json:"content_type,omitempty"`
+	// Header holds the upstream's other response headers, replayed when the
+	// entry is served. See storedHeader for those left out.
+	Header http.Header `json:"header,omitempty"`
+	// SniffedType is set to the sniffed content type of Body when it
+	// conflicts with ContentType.
+	SniffedType string `json:"sniffed_type,omitempty"`
+	// Tags are the upstream-assigned tags the entry can be invalidated by.
+	Tags []string `json:"tags,omitempty"`
+	// Sessions are the recording sessions the entry was stored or served
+	// during. It's guarded by sessionMu.
+	Sessions []string `json:"sessions,omitempty"`
+	// Checksum is the hex sha256 of Body, used to detect corrupted entries.
+	Checksum string `json:"checksum,omitempty"`
+	// Stored is when the entry was fetched from the upstream.
+	Stored time.Time `json:"stored"`
+	// Expires is when the entry stops being fresh. Expired entries are kept
+	// for as long as they may be served stale.
+	Expires time.Time `json:"expires,omitempty"`
+	// StaleIfError is how long past Expires the upstream allows the entry to
+	// be served if refreshing it fails.
+	StaleIfError time.Duration `json:"stale_if_error,omitempty"`
+	// StaleWhileRevalidate is how long past Expires the upstream allows the
+	// entry to be served while it's refreshed in the background.
+	StaleWhileRevalidate time.Duration `json:"stale_while_revalidate,omitempty"`
+	// Ranges are the parts of the body cached so far by -range-cache
+	// partial, in order and never overlapping, and Size the length of the
+	// whole body. Body is unset for these entries.
+	Ranges []byteRange `json:"ranges,omitempty"`
+	Size   int64       `json:"size,omitempty"`
+	// FetchDuration is how long the upstream took to respond.
+	FetchDuration time.Duration `json:"fetch_duration,omitempty"`
+	// OriginalHeaders are the upstream headers named by -original-headers,
+	// along with Date.
+	OriginalHeaders http.Header `json:"original_headers,omitempty"`
+	// Freshness is the caching decision made for the entry when it was
+	// stored.
+	Freshness httpcache.Decision `json:"freshness"`
+
+	// hits counts how often the entry has been served since it was stored or
+	// loaded. It's updated with sync/atomic and isn't persisted.
+	hits int64
+}
+
+func init() {
+	gob.Register(&entry{})
+}
+
+// toEntry converts a value pulled out of the Cache into an entry. Caches
+// persisted by older versions stored raw body bytes, so those are wrapped.
+func toEntry(v interface{}) (*entry, bool) {
+	switch e := v.(type) {
+	case *entry:
+		return e, true
+	case []byte:
+		return &entry{Body: e}, true
+	}
+	return nil, false
+}
+
+// clone returns a copy of e sharing its body and headers. Entries may be
+// served while they're copied, so unlike *e it reads hits atomically and
+// Sessions under sessionMu.
+func (e *entry) clone() *entry {
+	sessionMu.Lock()
+	sessions := append([]string(nil), e.Sessions...)
+	sessionMu.Unlock()
+	return &entry{
+		Body:                 e.Body,
+		Compressed:           e.Compressed,
+		RawSize:              e.RawSize,
+		URL:                  e.URL,
+		Method:               e.Method,
+		Source:               e.Source,
+		Status:               e.Status,
+		ContentType:          e.ContentType,
+		Header:               e.Header,
+		SniffedType:          e.SniffedType,
+		Tags:                 e.Tags,
+		Sessions:             sessions,
+		Checksum:             e.Checksum,
+		Stored:               e.Stored,
+		Expires:              e.Expires,
+		StaleIfError:         e.StaleIfError,
+		StaleWhileRevalidate: e.StaleWhileRevalidate,
+		Ranges:               e.Ranges,
+		Size:                 e.Size,
+		FetchDuration:        e.FetchDuration,
+		OriginalHeaders:      e.OriginalHeaders,
+		Freshness:            e.Freshness,
+		hits:                 atomic.LoadInt64(&e.hits),
+	}
+}
+
+// checksum returns the hex sha256 of body.
+func checksum(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// verify reports whether the entry's body still matches its checksum. Entries
+// without a checksum can't be verified and are assumed intact.
+func (e *entry) verify() bool {
+	return e.Checksum == "" || e.Checksum == checksum(e.body())
+}
+
+// etag returns the entity tag of the entry, derived from its body so identical
+// bodies cached under different keys share a tag.
+func (e *entry) etag() string {
+	sum := e.Checksum
+	if sum == "" {
+		sum = checksum(e.body())
+	}
+	return `"` + sum + `"`
+}
+
+// etagMatch reports whether an If-None-Match header value matches etag.
+func etagMatch(header, etag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == "*" || v == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// fresh reports whether the entry hasn't expired at now. Entries stored before
+// expiry was tracked are fresh until the Cache drops them.
+func (e *entry) fresh(now time.Time) bool {
+	return e.Expires.IsZero() || now.Before(e.Expires)
+}
+
+// staleGrace returns how long past expiry the entry may be served when
+// refreshing it fails, and whether that was allowed by the upstream rather
+// than -serve-stale.
+func (e *entry) staleGrace() (time.Duration, bool) {
+	if e.Freshness.MustRevalidate {
+		return 0, false
+	}
+	if e.StaleIfError > 0 {
+		return e.StaleIfError, true
+	}
+	if flagServeStale {
+		return flagStaleMax, false
+	}
+	return 0, false
+}
+
+// status returns the status the entry is served with.
+func (e *entry) status() int {
+	if e.Status == 0 {
+		return http.StatusOK
+	}
+	return e.Status
+}
+
+// method returns the method the entry was fetched with.
+func (e *entry) method() string {
+	if e.Method == "" {
+		return http.MethodGet
+	}
+	return e.Method
+}
+
+// derivedHeaders are the upstream response headers that aren't stored with
+// an entry: devcache sets them itself when serving it, or they only held for
+// the original response. Set-Cookie is left out so one client's session
+// isn't handed to every other.
+var derivedHeaders = []string{
+	"Age", "Content-Encoding", "Content-Length", "Content-Range", "Content-Type",
+	"Date", "ETag", "Set-Cookie", "Warning", "X-Cache",
+}
+
+// storedHeader returns the headers of an upstream response kept with its
+// entry.
+func storedHeader(h http.Header) http.Header {
+	stored := h.Clone()
+	removeHopHeaders(stored)
+	for _, name := range derivedHeaders {
+		stored.Del(name)
+	}
+	if len(stored) == 0 {
+		return nil
+	}
+	return stored
+}
+
+// writeHeader adds the entry's stored upstream headers to h.
+func (e *entry) writeHeader(h http.Header) {
+	for name, values := range e.Header {
+		for _, v := range values {
+			h.Add(name, v)
+		}
+	}
+}
+
+// transformInput describes the entry to the transforms.
+func (e *entry) transformInput() transformInput {
+	return transformInput{path: e.URL, status: e.status(), contentType: e.ContentType}
+}
+
+// writeOriginalMetadata describes the original fetch of the entry in h.
+// Entries recorded before fetches were timed have nothing to describe.
+func (e *entry) writeOriginalMetadata(h http.Header) {
+	if e.FetchDuration == 0 {
+		return
+	}
+	h.Set("X-Devcache-Original-Duration", e.FetchDuration.String())
+	date := e.Stored.UTC().Format(http.TimeFormat)
+	if d := e.OriginalHeaders.Get("Date"); d != "" {
+		date = d
+	}
+	h.Set("X-Devcache-Original-Date", date)
+	for name, values := range e.OriginalHeaders {
+		if name == "Date" {
+			continue
+		}
+		for _, v := range values {
+			h.Add(name, v)
+		}
+	}
+}
+
+// retention returns how long past expiry the entry is kept so it can be
+// served stale.
+func (e *entry) retention() time.Duration {
+	grace, _ := e.staleGrace()
+	if flagFetchBudget > 0 && !e.Freshness.MustRevalidate && grace < flagStaleMax {
+		grace = flagStaleMax
+	}
+	if window := e.revalidateWindow(); grace < window {
+		grace = window
+	}
+	return grace
+}
@@ -0,0 +1,172 @@
+package devcache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSharedBodiesShareETag(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/other" {
+			w.Write([]byte(`{"config": 2}`))
+			return
+		}
+		w.Write([]byte(`{"config": 1}`))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL)
+
+	a := do(s.Handler(), "GET", "/a/config", nil).Header().Get("ETag")
+	b := do(s.Handler(), "GET", "/b/config", nil).Header().Get("ETag")
+	other := do(s.Handler(), "GET", "/other", nil).Header().Get("ETag")
+	if a == "" || a != b {
+		t.Errorf("identical bodies have ETags %q and %q", a, b)
+	}
+	if other == a {
+		t.Errorf("different bodies share the ETag %q", a)
+	}
+
+	// a client holding one path's body can skip the other's
+	if w := do(s.Handler(), "GET", "/b/config", http.Header{"If-None-Match": {a}}); w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match with the shared ETag: status %d, want 304", w.Code)
+	}
+	if w := do(s.Handler(), "GET", "/other", http.Header{"If-None-Match": {a}}); w.Code != http.StatusOK {
+		t.Errorf("If-None-Match with another ETag: status %d, want 200", w.Code)
+	}
+}
+
+func TestErrorBodyRoundTrip(t *testing.T) {
+	var failing int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`[
+			{"field": "name", "code": "required"},
+			{"field": "age", "min": 18, "got": 12345678901234567890}
+		]`))
+	}))
+	defer up.Close()
+	file := filepath.Join(t.TempDir(), "cache.gob")
+	// minified, with the array, key order and numbers kept as they were sent
+	const want = `[{"field":"name","code":"required"},{"field":"age","min":18,"got":12345678901234567890}]`
+
+	check := func(s *Server, outcome string) {
+		t.Helper()
+		w := do(s.Handler(), "GET", "/users", nil)
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: status %d, want 422", outcome, w.Code)
+		}
+		if w.Body.String() != want {
+			t.Errorf("%s: body %s", outcome, w.Body)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: Content-Type %q", outcome, ct)
+		}
+		if got := w.Header().Get("X-Cache"); got != outcome {
+			t.Errorf("X-Cache %q, want %s", got, outcome)
+		}
+	}
+	s := newTestServer(t, up.URL, "-cache-file", file)
+	check(s, "MISS")
+	check(s, "HIT")
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// replayed from the saved cache while the upstream fails
+	atomic.StoreInt32(&failing, 1)
+	s = newTestServer(t, up.URL, "-cache-file", file)
+	check(s, "HIT")
+}
+
+func TestHeaderReplay(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/items/1")
+		w.Header().Set("Set-Cookie", "session=alice")
+		w.Header()["Link"] = []string{`</items/2>; rel="next"`, `</items>; rel="up"`}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Request-Id", "abc")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id": 1}`))
+	}))
+	defer up.Close()
+	file := filepath.Join(t.TempDir(), "cache.gob")
+
+	check := func(s *Server, outcome string) {
+		t.Helper()
+		w := do(s.Handler(), "GET", "/items/1", nil)
+		if got := w.Header().Get("X-Cache"); got != outcome {
+			t.Fatalf("X-Cache %q, want %s", got, outcome)
+		}
+		if w.Code != http.StatusCreated {
+			t.Errorf("%s: status %d, want 201", outcome, w.Code)
+		}
+		for name, want := range map[string][]string{
+			"Location":      {"/items/1"},
+			"Link":          {`</items/2>; rel="next"`, `</items>; rel="up"`},
+			"Cache-Control": {"max-age=60"},
+			"Content-Type":  {"application/json"},
+			"X-Request-Id":  {"abc"},
+			// one client's cookies are never handed to another
+			"Set-Cookie": nil,
+		} {
+			if got := w.Header()[name]; !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: %s %q, want %q", outcome, name, got, want)
+			}
+		}
+	}
+	s := newTestServer(t, up.URL, "-cache-file", file)
+	check(s, "MISS")
+	check(s, "HIT")
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// and replayed the same from the saved cache
+	s = newTestServer(t, up.URL, "-cache-file", file)
+	check(s, "HIT")
+}
+
+func TestCacheHeaders(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the upstream's own age isn't passed on
+		w.Header().Set("Age", "600")
+		w.Write([]byte("body"))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL)
+
+	for _, tt := range []struct {
+		stored     time.Duration
+		cache, age string
+	}{
+		{0, "MISS", "0"},
+		{0, "HIT", "0"},
+		// Age counts whole seconds since the entry was stored
+		{-90 * time.Second, "HIT", "90"},
+	} {
+		if tt.stored != 0 {
+			v, _ := Cache.Get("/a")
+			v.(*entry).Stored = time.Now().Add(tt.stored)
+		}
+		w := do(s.Handler(), "GET", "/a", nil)
+		if got := w.Header().Get("X-Cache"); got != tt.cache {
+			t.Errorf("X-Cache %q, want %q", got, tt.cache)
+		}
+		if got := w.Header().Get("Age"); got != tt.age {
+			t.Errorf("%s: Age %q, want %q", tt.cache, got, tt.age)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package devcache_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/travis-g/devcache"
+)
+
+// An upstream whose responses depend on the plan encoded in each client's API
+// key is cached per plan, rather than per key or for everyone.
+func ExampleConfig_varyFunc() {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "quota for %s", strings.SplitN(r.Header.Get("X-Api-Key"), ".", 2)[0])
+	}))
+	defer upstream.Close()
+	dir, _ := ioutil.TempDir("", "devcache")
+	defer os.RemoveAll(dir)
+
+	s, err := devcache.New(devcache.Config{
+		URL:       upstream.URL,
+		CacheFile: filepath.Join(dir, "cache.gob"),
+		VaryFunc: func(r *http.Request) string {
+			// keys look like PLAN.SECRET
+			return strings.SplitN(r.Header.Get("X-Api-Key"), ".", 2)[0]
+		},
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer s.Shutdown(context.Background())
+	proxy := httptest.NewServer(s.Handler())
+	defer proxy.Close()
+
+	for _, key := range []string{"free.abc", "pro.def", "free.ghi"} {
+		req, _ := http.NewRequest("GET", proxy.URL+"/quota", nil)
+		req.Header.Set("X-Api-Key", key)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		fmt.Printf("%s: %s (%s)\n", key, body, res.Header.Get("X-Cache"))
+	}
+	// Output:
+	// free.abc: quota for free (MISS)
+	// pro.def: quota for pro (MISS)
+	// free.ghi: quota for free (HIT)
+}
@@ -0,0 +1,208 @@
+package devcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+// scrubRule sets the JSON body values at a path to a fixed value.
+type scrubRule struct {
+	path  string
+	steps []string
+	value interface{}
+}
+
+// scrubRules is the list of body scrubbing rules, set with the -scrub flag.
+type scrubRules []scrubRule
+
+func (rule scrubRule) String() string {
+	value, _ := json.Marshal(rule.value)
+	return rule.path + "=" + string(value)
+}
+
+func (sr *scrubRules) String() string {
+	var specs []string
+	for _, rule := range *sr {
+		specs = append(specs, rule.String())
+	}
+	return strings.Join(specs, " ")
+}
+
+// Set adds a rule given as PATH=VALUE. PATH is a JSONPath of object fields,
+// array indexes and [*] wildcards, such as $.items[*].updated_at. VALUE is a
+// JSON value, or else taken as a string.
+func (sr *scrubRules) Set(spec string) error {
+	i := strings.Index(spec, "=")
+	if i <= 0 {
+		return fmt.Errorf("scrub rule %q must be PATH=VALUE", spec)
+	}
+	steps, err := parseJSONPath(spec[:i])
+	if err != nil {
+		return fmt.Errorf("scrub rule %q: %s", spec, err)
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(spec[i+1:]), &value); err != nil {
+		value = spec[i+1:]
+	}
+	*sr = append(*sr, scrubRule{path: spec[:i], steps: steps, value: value})
+	return nil
+}
+
+func (sr *scrubRules) repeatable() {}
+
+// parseJSONPath splits a path such as $.a.b[0][*] into the steps a, b, 0
+// and *.
+func parseJSONPath(p string) ([]string, error) {
+	if !strings.HasPrefix(p, "$") {
+		return nil, fmt.Errorf("path must start with $")
+	}
+	var steps []string
+	rest := p[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[") + 1
+			if end == 0 {
+				end = len(rest)
+			}
+			if end == 1 {
+				return nil, fmt.Errorf("empty field name")
+			}
+			steps = append(steps, rest[1:end])
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [")
+			}
+			index := rest[1:end]
+			if _, err := strconv.Atoi(index); err != nil && index != "*" {
+				return nil, fmt.Errorf("invalid index %q", index)
+			}
+			steps = append(steps, index)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("unexpected %q", rest[0])
+		}
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("path selects the whole body")
+	}
+	return steps, nil
+}
+
+// apply sets the values selected by steps within v, reporting whether any
+// were.
+func (rule scrubRule) apply(v interface{}, steps []string) bool {
+	step, last := steps[0], len(steps) == 1
+	var set bool
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for name, child := range v {
+			if name != step && step != "*" {
+				continue
+			}
+			if last {
+				v[name], set = rule.value, true
+			} else if rule.apply(child, steps[1:]) {
+				set = true
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			if strconv.Itoa(i) != step && step != "*" {
+				continue
+			}
+			if last {
+				v[i], set = rule.value, true
+			} else if rule.apply(child, steps[1:]) {
+				set = true
+			}
+		}
+	}
+	return set
+}
+
+// scrubBody applies the -scrub rules to a JSON body. Bodies that aren't JSON
+// or that no rule applies to are returned as they are. Scrubbed bodies are
+// re-encoded with their object keys sorted.
+func scrubBody(body []byte) []byte {
+	if len(flagScrub) == 0 {
+		return body
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return body
+	}
+	var set bool
+	for _, rule := range flagScrub {
+		if rule.apply(v, rule.steps) {
+			set = true
+		}
+	}
+	if !set {
+		return body
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return body
+	}
+	return append([]byte(nil), bytes.TrimSuffix(buf.Bytes(), []byte("\n"))...)
+}
+
+// volatile reports whether the header name matches one of -volatile-headers,
+// which may end in * to match a prefix.
+func volatile(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	for _, pattern := range flagVolatileHeaders {
+		if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// stableHeader returns h without -volatile-headers.
+func stableHeader(h http.Header) http.Header {
+	stable := http.Header{}
+	for name, values := range h {
+		if !volatile(name) {
+			stable[name] = values
+		}
+	}
+	if len(stable) == 0 {
+		return nil
+	}
+	return stable
+}
+
+// stable returns a copy of de with everything that changes between two
+// recordings of the same response removed, for -stable-fixtures: the times it
+// was fetched and expires, -volatile-headers and the body values selected by
+// -scrub. Stable fixtures never expire. de itself, and the entry it holds,
+// are left alone so live responses are never scrubbed.
+func (de *dirEntry) stable() *dirEntry {
+	e := *de.entry
+	e.Stored, e.Expires, e.FetchDuration = time.Time{}, time.Time{}, 0
+	e.OriginalHeaders = stableHeader(de.entry.OriginalHeaders)
+	e.Header = stableHeader(de.entry.Header)
+	e.Body = scrubBody(e.Body)
+	e.Checksum = checksum(e.Body)
+	return newDirEntry(de.Key, cache.Item{Object: &e})
+}
@@ -0,0 +1,136 @@
+package devcache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestStableFixtures records the same upstream twice and checks the fixture
+// files are identical, though its volatile headers and timestamps differ.
+func TestStableFixtures(t *testing.T) {
+	var n int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := atomic.AddInt64(&n, 1)
+		now := time.Now().Add(time.Duration(i) * time.Hour).UTC().Format(time.RFC3339Nano)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Request-Id", fmt.Sprint("req-", i))
+		w.Header().Set("X-RateLimit-Remaining", fmt.Sprint(1000-i))
+		w.Header().Set("Set-Cookie", fmt.Sprint("session=", i))
+		w.Header().Set("Age", fmt.Sprint(i))
+		w.Header().Set("X-Api-Version", "2")
+		fmt.Fprintf(w, `{"generated_at": %q, "items": [{"id": 1, "updated_at": %q}, {"id": 2, "updated_at": %q}]}`, now, now, now)
+	}))
+	defer up.Close()
+	paths := []string{"/items", "/items?page=2"}
+
+	record := func(dir string) string {
+		s := newTestServer(t, up.URL, "-cache-dir", dir, "-stable-fixtures", "-record",
+			"-scrub", "$.generated_at=0", "-scrub", `$.items[*].updated_at="2024-01-01T00:00:00Z"`)
+		for _, path := range paths {
+			w := do(s.Handler(), "GET", path, nil)
+			// live responses are never scrubbed
+			if strings.Contains(w.Body.String(), `"generated_at":0`) || w.Header().Get("X-Request-Id") == "" {
+				t.Errorf("%s: live response scrubbed: %s %v", path, w.Body, w.Header())
+			}
+		}
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	a, b := record(t.TempDir()), record(t.TempDir())
+
+	files, _ := filepath.Glob(filepath.Join(a, "*"))
+	if len(files) != len(paths)+1 {
+		t.Fatalf("recorded %d files, want an index and %d entries", len(files), len(paths))
+	}
+	for _, file := range files {
+		name := filepath.Base(file)
+		fa, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fb, err := ioutil.ReadFile(filepath.Join(b, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(fa, fb) {
+			t.Errorf("%s differs between recordings:\n%s\n%s", name, fa, fb)
+		}
+		for _, volatile := range []string{"X-Request-Id", "X-Ratelimit-Remaining", "Set-Cookie", "Age"} {
+			if bytes.Contains(fa, []byte(volatile)) {
+				t.Errorf("%s recorded %s", name, volatile)
+			}
+		}
+		if name != dirIndexFile && !bytes.Contains(fa, []byte("X-Api-Version")) {
+			t.Errorf("%s dropped a stable header:\n%s", name, fa)
+		}
+	}
+}
+
+func TestScrubBody(t *testing.T) {
+	for _, tt := range []struct {
+		rules []string
+		body  string
+		want  string
+	}{
+		{[]string{"$.t=0"}, `{"t": "now", "a": 1}`, `{"a":1,"t":0}`},
+		{[]string{"$.items[*].t=x"}, `{"items": [{"t": 1}, {"t": 2, "u": 3}]}`, `{"items":[{"t":"x"},{"t":"x","u":3}]}`},
+		{[]string{"$.items[1].t=null"}, `{"items": [{"t": 1}, {"t": 2}]}`, `{"items":[{"t":1},{"t":null}]}`},
+		// nothing selected, or not JSON: left as it is
+		{[]string{"$.missing=0"}, `{"t": "now"}`, `{"t": "now"}`},
+		{[]string{"$.t=0"}, `t=now`, `t=now`},
+		// numbers keep their precision
+		{[]string{"$.t=0"}, `{"t": 1, "n": 12345678901234567890}`, `{"n":12345678901234567890,"t":0}`},
+	} {
+		flagScrub = nil
+		for _, rule := range tt.rules {
+			if err := flagScrub.Set(rule); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := string(scrubBody([]byte(tt.body))); got != tt.want {
+			t.Errorf("%v on %s: got %s, want %s", tt.rules, tt.body, got, tt.want)
+		}
+	}
+	flagScrub = nil
+
+	for _, spec := range []string{"t=0", "$=0", "$.a[x]=0", "$.a[0=0", "$..a=0"} {
+		if err := flagScrub.Set(spec); err == nil {
+			t.Errorf("%s: no error", spec)
+		}
+	}
+	flagScrub = nil
+}
+
+func TestRulesListFixtures(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	s := newTestServer(t, up.URL, "-stable-fixtures", "-scrub", "$.t=0", "-volatile-headers", "Date,X-Trace-*")
+
+	w := do(s.Handler(), "GET", adminPrefix+"/v1/rules", nil)
+	var res struct {
+		Fixtures struct {
+			Stable          bool     `json:"stable"`
+			VolatileHeaders []string `json:"volatile_headers"`
+			Scrub           []string `json:"scrub"`
+		} `json:"fixtures"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	f := res.Fixtures
+	if !f.Stable || strings.Join(f.VolatileHeaders, ",") != "Date,X-Trace-*" || strings.Join(f.Scrub, ",") != "$.t=0" {
+		t.Errorf("fixtures %+v", f)
+	}
+}
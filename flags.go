@@ -0,0 +1,103 @@
+package devcache
+
+import (
+	"flag"
+	"net/http"
+	"strings"
+)
+
+// byteSize is a flag.Value for sizes in bytes.
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return formatBytes(int64(*b))
+}
+
+func (b *byteSize) Set(s string) error {
+	n, err := parseBytes(s)
+	*b = byteSize(n)
+	return err
+}
+
+// methodList is a flag.Value for a comma-separated list of HTTP methods.
+type methodList []string
+
+func (m *methodList) String() string {
+	return strings.Join(*m, ",")
+}
+
+func (m *methodList) Set(v string) error {
+	*m = nil
+	for _, method := range strings.Split(v, ",") {
+		if method = strings.TrimSpace(method); method != "" {
+			*m = append(*m, strings.ToUpper(method))
+		}
+	}
+	return nil
+}
+
+func (m methodList) contains(method string) bool {
+	for _, v := range m {
+		if v == method {
+			return true
+		}
+	}
+	return false
+}
+
+// repeatableValue is a flag.Value set once per occurrence of its flag, each
+// adding to it, rather than replaced by the last. Its flag's usage says
+// "(repeatable)".
+type repeatableValue interface {
+	flag.Value
+	repeatable()
+}
+
+// headerList is a flag.Value for a comma-separated list of header names.
+type headerList []string
+
+func (h *headerList) String() string {
+	return strings.Join(*h, ",")
+}
+
+func (h *headerList) Set(v string) error {
+	*h = nil
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			*h = append(*h, http.CanonicalHeaderKey(name))
+		}
+	}
+	return nil
+}
+
+// paramList is a flag.Value for a comma-separated list of query parameter
+// names. A trailing * matches a prefix.
+type paramList []string
+
+func (p *paramList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *paramList) Set(v string) error {
+	*p = nil
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			*p = append(*p, name)
+		}
+	}
+	return nil
+}
+
+// contains reports whether the parameter name is listed.
+func (p paramList) contains(name string) bool {
+	for _, pattern := range p {
+		if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
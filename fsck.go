@@ -0,0 +1,320 @@
+package devcache
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+// Problems fsck finds with the records of a cache file. Records with the
+// first four are bad and left out by a repair; the rest compare the file to
+// the entries in memory and only report a difference.
+const (
+	fsckUndecodable = "undecodable" // the file can't be decoded from here on
+	fsckNotEntry    = "not-entry"   // the record isn't a cache entry
+	fsckChecksum    = "checksum"    // the body doesn't match its checksum
+	fsckExpiration  = "expiration"  // stored in the future or after it expires
+	fsckDuplicate   = "duplicate"   // shadowed by a later record of its key
+	fsckOrphaned    = "orphaned"    // fresh in the file but not in memory
+	fsckMissing     = "missing"     // in memory since before the file was saved, but not in it
+	fsckDiffers     = "differs"     // in memory with another body since before the file was saved
+)
+
+// fsckBad reports whether records with problem are left out by a repair.
+func fsckBad(problem string) bool {
+	switch problem {
+	case fsckNotEntry, fsckChecksum, fsckExpiration, fsckDuplicate:
+		return true
+	}
+	return false
+}
+
+// fsckProblem is a problem found with a record of a cache file, as written to
+// the report. Record counts from 0 in the order the file was written.
+type fsckProblem struct {
+	Key     string `json:"key,omitempty"`
+	Record  int    `json:"record"`
+	Problem string `json:"problem"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// fsckResult is the outcome of checking a cache file.
+type fsckResult struct {
+	records  int
+	problems []fsckProblem
+	// undecodable is set if the file couldn't be read to its end
+	undecodable bool
+	// items are the records that aren't bad, for a repair to write
+	items map[string]cache.Item
+}
+
+// bad returns the number of bad records found.
+func (res *fsckResult) bad() int {
+	n := 0
+	for _, p := range res.problems {
+		if fsckBad(p.Problem) {
+			n++
+		}
+	}
+	return n
+}
+
+// summary describes the result in a line, with a count of each problem.
+func (res *fsckResult) summary() string {
+	counts := map[string]int{}
+	for _, p := range res.problems {
+		counts[p.Problem]++
+	}
+	names := make([]string, 0, len(counts))
+	for name, n := range counts {
+		names = append(names, fmt.Sprintf("%d %s", n, name))
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		names = []string{"no problems"}
+	}
+	return fmt.Sprintf("%d records, %d bad: %s", res.records, res.bad(), strings.Join(names, ", "))
+}
+
+// writeReport writes the problems found to filePath as JSON lines.
+func (res *fsckResult) writeReport(filePath string) error {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(file)
+	for _, p := range res.problems {
+		enc.Encode(p)
+	}
+	return file.Close()
+}
+
+// fsck checks every record of the cache file at filePath: that it decodes to
+// an entry, that its body matches its checksum and that its times make sense.
+// Given the entries in memory it also compares them with the file, taking
+// into account that entries stored after the file was saved are expected to
+// differ. pace is called after each record, and stops the check early by
+// returning false.
+func fsck(filePath string, live map[string]entrySummary, pace func() bool) (*fsckResult, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	saved := info.ModTime()
+	now := time.Now()
+	res := &fsckResult{items: make(map[string]cache.Item)}
+	records := map[string]int{}
+	stopped := false
+	err = streamCache(filePath, func(key string, item cache.Item) {
+		if stopped {
+			return
+		}
+		n := res.records
+		res.records++
+		problem := func(name, detail string) {
+			res.problems = append(res.problems, fsckProblem{Key: key, Record: n, Problem: name, Detail: detail})
+		}
+		if prev, ok := records[key]; ok {
+			res.problems = append(res.problems, fsckProblem{Key: key, Record: prev, Problem: fsckDuplicate,
+				Detail: fmt.Sprintf("shadowed by record %d", n)})
+			delete(res.items, key)
+		}
+		records[key] = n
+		e, ok := toEntry(item.Object)
+		switch {
+		case !ok:
+			problem(fsckNotEntry, fmt.Sprintf("%T", item.Object))
+		case !e.verify():
+			problem(fsckChecksum, "")
+		case e.Stored.After(now):
+			problem(fsckExpiration, "stored "+e.Stored.Format(time.RFC3339))
+		case item.Expiration > 0 && time.Unix(0, item.Expiration).Before(e.Stored):
+			problem(fsckExpiration, "expires "+time.Unix(0, item.Expiration).Format(time.RFC3339)+" before it was stored")
+		default:
+			res.items[key] = item
+		}
+		if !pace() {
+			stopped = true
+		}
+	})
+	if stopped {
+		return nil, errFsckStopped
+	}
+	if err != nil {
+		res.undecodable = true
+		res.problems = append(res.problems, fsckProblem{Record: res.records, Problem: fsckUndecodable, Detail: err.Error()})
+	}
+	if live == nil {
+		return res, nil
+	}
+	for key, n := range records {
+		item, ok := res.items[key]
+		if !ok {
+			continue
+		}
+		e, _ := toEntry(item.Object)
+		s, found := live[key]
+		switch {
+		case !found && !item.Expired():
+			res.problems = append(res.problems, fsckProblem{Key: key, Record: n, Problem: fsckOrphaned})
+		case found && s.Stored.Before(saved) && e.Checksum != "" && s.Checksum != e.Checksum:
+			res.problems = append(res.problems, fsckProblem{Key: key, Record: n, Problem: fsckDiffers,
+				Detail: fmt.Sprintf("%s in memory, %s in the file", s.Checksum, e.Checksum)})
+		}
+	}
+	for key, s := range live {
+		if _, ok := records[key]; !ok && s.Stored.Before(saved) {
+			res.problems = append(res.problems, fsckProblem{Key: key, Record: -1, Problem: fsckMissing})
+		}
+	}
+	sort.SliceStable(res.problems, func(i, j int) bool { return res.problems[i].Record < res.problems[j].Record })
+	return res, nil
+}
+
+// errFsckStopped is returned by fsck when pace stops it.
+var errFsckStopped = errors.New("fsck stopped")
+
+// repairCache rewrites the cache file at filePath with only the records fsck
+// found to be good. The file is replaced at once, so an interrupted repair
+// leaves it as it was.
+func repairCache(filePath string, res *fsckResult) error {
+	return writeCache(filePath, res.items)
+}
+
+// liveEntries summarizes the entries in memory, for fsck to compare a cache
+// file with.
+func liveEntries() map[string]entrySummary {
+	items := snapshotItems()
+	live := make(map[string]entrySummary, len(items))
+	for key, item := range items {
+		// other tenants are saved to their own files
+		if tenant, _ := splitTenantKey(key); tenant != defaultTenant {
+			continue
+		}
+		if e, ok := toEntry(item.Object); ok {
+			live[key] = entrySummary{Key: key, Checksum: e.Checksum, Stored: e.Stored}
+		}
+	}
+	return live
+}
+
+// runFsck implements the fsck subcommand, which checks a cache file on its
+// own or against the entries of a running instance, and can repair it.
+func runFsck(args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	cacheFile := fs.String("cache-file", "./cache.gob", "cache file to check")
+	server := fs.String("server", "", "base URL of a running devcache instance to compare the file with")
+	token := fs.String("token", "", "admin token of the -server instance")
+	report := fs.String("report", "", "write the problems found to this file as JSON lines")
+	repair := fs.Bool("repair", false, "rewrite the file without its bad records")
+	fs.Parse(args)
+
+	var live map[string]entrySummary
+	if *server != "" {
+		var err error
+		if live, err = (syncPeer{url: *server, token: *token}).entries(); err != nil {
+			return err
+		}
+	}
+	res, err := fsck(*cacheFile, live, func() bool { return true })
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %s\n", *cacheFile, res.summary())
+	if *report != "" {
+		if err := res.writeReport(*report); err != nil {
+			return err
+		}
+	}
+	if res.bad() == 0 && !res.undecodable {
+		return nil
+	}
+	if !*repair {
+		return fmt.Errorf("fsck: %s has bad records, run with -repair to remove them", *cacheFile)
+	}
+	if err := repairCache(*cacheFile, res); err != nil {
+		return err
+	}
+	fmt.Printf("repaired %s, keeping %d of %d records\n", *cacheFile, len(res.items), res.records)
+	return nil
+}
+
+// Pauses of the background check between records, depending on whether
+// requests were served since the last one.
+const (
+	fsckIdlePause = time.Millisecond
+	fsckBusyPause = 100 * time.Millisecond
+)
+
+// startFsck checks the cache file against the entries in memory every
+// -fsck-interval, logging a summary and writing the problems found to
+// -fsck-report. The check pauses after every record, for longer while
+// requests are being served, so it never competes with them. It returns a
+// function stopping the check, or a no-op if it's disabled.
+func startFsck() func() {
+	if flagFsckInterval <= 0 {
+		return func() {}
+	}
+	if flagCacheDir != "" || flagStore != storeGob {
+		log.Printf("not checking the cache file: only gob files are checked")
+		return func() {}
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	pace := func() func() bool {
+		served := atomic.LoadInt64(&stats.Hits) + atomic.LoadInt64(&stats.Misses)
+		return func() bool {
+			pause := fsckIdlePause
+			if n := atomic.LoadInt64(&stats.Hits) + atomic.LoadInt64(&stats.Misses); n != served {
+				served, pause = n, fsckBusyPause
+			}
+			select {
+			case <-stop:
+				return false
+			case <-time.After(pause):
+				return true
+			}
+		}
+	}
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(flagFsckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			res, err := fsck(flagCacheFile, liveEntries(), pace())
+			switch {
+			case err == errFsckStopped:
+				return
+			case os.IsNotExist(err):
+				debugf("not checking the cache file: %s", err)
+				continue
+			case err != nil:
+				log.Printf("error checking the cache file: %s", err)
+				continue
+			}
+			log.Printf("checked the cache file: %s", res.summary())
+			if flagFsckReport != "" {
+				if err := res.writeReport(flagFsckReport); err != nil {
+					log.Printf("error writing the fsck report: %s", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
@@ -0,0 +1,303 @@
+package devcache
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Health states of an upstream host.
+const (
+	healthHealthy  = "healthy"
+	healthDegraded = "degraded"
+	healthDown     = "down"
+)
+
+// healthSampleLimit bounds the fetch attempts kept per host.
+const healthSampleLimit = 10000
+
+// failureLimit bounds the failed fetches kept in all, and failurePathLimit
+// those kept per path. The oldest are dropped first.
+const (
+	failureLimit     = 10000
+	failurePathLimit = 100
+)
+
+// Classes of failed fetches.
+const (
+	failureTimeout    = "timeout"
+	failureConnection = "connection"
+	failureStatus     = "status"
+)
+
+// health scores each upstream host by its recent fetches and keeps the
+// history of failed ones.
+var health = &upstreamHealth{hosts: make(map[string]*hostHealth), pathFailures: make(map[string]int)}
+
+// fetchResult is the outcome of a fetch from an upstream, after any retries.
+type fetchResult struct {
+	host     string
+	path     string
+	attempts int
+	latency  time.Duration
+	status   int
+	err      error
+}
+
+func (fr fetchResult) ok() bool {
+	return fr.err == nil && fr.status < 500
+}
+
+// fetchFailure describes a failed fetch.
+type fetchFailure struct {
+	Time     time.Time     `json:"time"`
+	Host     string        `json:"host"`
+	Path     string        `json:"path"`
+	Class    string        `json:"class"`
+	Status   int           `json:"status,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Attempts int           `json:"attempts"`
+	Duration time.Duration `json:"duration"`
+}
+
+func newFetchFailure(at time.Time, fr fetchResult) fetchFailure {
+	f := fetchFailure{
+		Time:     at,
+		Host:     fr.host,
+		Path:     fr.path,
+		Class:    failureStatus,
+		Status:   fr.status,
+		Attempts: fr.attempts,
+		Duration: fr.latency,
+	}
+	if fr.err != nil {
+		f.Error = fr.err.Error()
+		f.Class = failureConnection
+		if ne, ok := fr.err.(net.Error); ok && ne.Timeout() {
+			f.Class = failureTimeout
+		}
+	}
+	return f
+}
+
+// healthSample is the outcome of a single fetch from an upstream.
+type healthSample struct {
+	at      time.Time
+	latency time.Duration
+	ok      bool
+}
+
+type hostHealth struct {
+	samples []healthSample
+	state   string
+}
+
+type upstreamHealth struct {
+	mu    sync.Mutex
+	hosts map[string]*hostHealth
+	// failures are the failed fetches from every host, oldest first, and
+	// pathFailures counts those kept for each path.
+	failures     []fetchFailure
+	pathFailures map[string]int
+}
+
+// HostHealth is the health of one upstream host over -health-window.
+type HostHealth struct {
+	State       string        `json:"state"`
+	Fetches     int           `json:"fetches"`
+	SuccessRate float64       `json:"success_rate"`
+	P95         time.Duration `json:"p95"`
+}
+
+// record adds the outcome of a fetch, keeping it in the failure history if
+// it failed, and logs if that changes the host's health.
+func (h *upstreamHealth) record(fr fetchResult) {
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hh, found := h.hosts[fr.host]
+	if !found {
+		hh = &hostHealth{state: healthHealthy}
+		h.hosts[fr.host] = hh
+	}
+	hh.samples = append(hh.samples, healthSample{at: now, latency: fr.latency, ok: fr.ok()})
+	if len(hh.samples) > healthSampleLimit {
+		hh.samples = hh.samples[len(hh.samples)-healthSampleLimit:]
+	}
+	if !fr.ok() {
+		h.addFailure(newFetchFailure(now, fr))
+	}
+	if state := hh.score().State; state != hh.state {
+		log.Printf("upstream %s is %s (was %s)", fr.host, state, hh.state)
+		hh.state = state
+	}
+}
+
+// addFailure appends f to the failure history, dropping the oldest failure
+// of its path or, failing that, of any path to stay within the limits. h.mu
+// must be held.
+func (h *upstreamHealth) addFailure(f fetchFailure) {
+	if h.pathFailures[f.Path] >= failurePathLimit {
+		for i, old := range h.failures {
+			if old.Path == f.Path {
+				h.failures = append(h.failures[:i], h.failures[i+1:]...)
+				h.pathFailures[f.Path]--
+				break
+			}
+		}
+	} else if len(h.failures) >= failureLimit {
+		oldest := h.failures[0]
+		h.failures = h.failures[1:]
+		if h.pathFailures[oldest.Path]--; h.pathFailures[oldest.Path] == 0 {
+			delete(h.pathFailures, oldest.Path)
+		}
+	}
+	h.failures = append(h.failures, f)
+	h.pathFailures[f.Path]++
+}
+
+// failuresFor returns the failed fetches of path since the given time,
+// newest first.
+func (h *upstreamHealth) failuresFor(path string, since time.Time) []fetchFailure {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	failures := []fetchFailure{}
+	for i := len(h.failures) - 1; i >= 0 && h.failures[i].Time.After(since); i-- {
+		if h.failures[i].Path == path {
+			failures = append(failures, h.failures[i])
+		}
+	}
+	return failures
+}
+
+// pathErrors summarizes the failed fetches of one path.
+type pathErrors struct {
+	Path     string         `json:"path"`
+	Failures int            `json:"failures"`
+	Last     time.Time      `json:"last"`
+	Classes  map[string]int `json:"classes"`
+}
+
+// errorProne returns the paths with failed fetches since the given time,
+// those that failed most first.
+func (h *upstreamHealth) errorProne(since time.Time) []pathErrors {
+	h.mu.Lock()
+	byPath := map[string]*pathErrors{}
+	for i := len(h.failures) - 1; i >= 0 && h.failures[i].Time.After(since); i-- {
+		f := h.failures[i]
+		pe, ok := byPath[f.Path]
+		if !ok {
+			pe = &pathErrors{Path: f.Path, Last: f.Time, Classes: map[string]int{}}
+			byPath[f.Path] = pe
+		}
+		pe.Failures++
+		pe.Classes[f.Class]++
+	}
+	h.mu.Unlock()
+	paths := make([]pathErrors, 0, len(byPath))
+	for _, pe := range byPath {
+		paths = append(paths, *pe)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if paths[i].Failures != paths[j].Failures {
+			return paths[i].Failures > paths[j].Failures
+		}
+		return paths[i].Path < paths[j].Path
+	})
+	return paths
+}
+
+// score computes the health of the host from the samples within the window,
+// dropping older ones. h.mu must be held.
+func (hh *hostHealth) score() HostHealth {
+	cutoff := time.Now().Add(-flagHealthWindow)
+	i := sort.Search(len(hh.samples), func(i int) bool { return hh.samples[i].at.After(cutoff) })
+	hh.samples = hh.samples[i:]
+	s := HostHealth{State: healthHealthy, Fetches: len(hh.samples), SuccessRate: 1}
+	if len(hh.samples) == 0 {
+		return s
+	}
+	latencies := make([]time.Duration, len(hh.samples))
+	succeeded := 0
+	for i, sample := range hh.samples {
+		latencies[i] = sample.latency
+		if sample.ok {
+			succeeded++
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	s.P95 = latencies[(len(latencies)*95-1)/100]
+	s.SuccessRate = float64(succeeded) / float64(len(hh.samples))
+	switch {
+	case s.SuccessRate < flagHealthDownRate:
+		s.State = healthDown
+	case s.SuccessRate < flagHealthDegradedRate, flagHealthDegradedP95 > 0 && s.P95 > flagHealthDegradedP95:
+		s.State = healthDegraded
+	}
+	return s
+}
+
+// state returns the health state of host. Hosts not fetched from yet are
+// healthy.
+func (h *upstreamHealth) state(host string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if hh, ok := h.hosts[host]; ok {
+		return hh.score().State
+	}
+	return healthHealthy
+}
+
+func (h *upstreamHealth) snapshot() map[string]HostHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	snap := make(map[string]HostHealth, len(h.hosts))
+	for host, hh := range h.hosts {
+		snap[host] = hh.score()
+	}
+	return snap
+}
+
+// setHealthHeader adds the health of the upstream r would be fetched from to
+// a response served without reaching it, if -health-header is set.
+func setHealthHeader(w http.ResponseWriter, r *http.Request) {
+	if !flagHealthHeader {
+		return
+	}
+	u, err := url.Parse(upstreamFor(flagRoutes.match(r.RequestURI), r.Header))
+	if err != nil {
+		return
+	}
+	w.Header().Set("X-Devcache-Upstream-Health", health.state(u.Host))
+}
+
+// handleUpstreams reports the health of every upstream host fetched from.
+func handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(health.snapshot())
+}
+
+// handleErrors reports the failed fetches of the path given in the request,
+// or else the paths that failed most, within the since duration if given.
+func handleErrors(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid since "+v, http.StatusBadRequest)
+			return
+		}
+		since = time.Now().Add(-d)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if path := r.URL.Query().Get("path"); path != "" {
+		json.NewEncoder(w).Encode(health.failuresFor(path, since))
+		return
+	}
+	json.NewEncoder(w).Encode(health.errorProne(since))
+}
@@ -0,0 +1,100 @@
+package devcache
+
+import (
+	"sync"
+	"time"
+)
+
+// hotKeyLimit bounds the number of keys tracked by hotKeys.
+const hotKeyLimit = 10000
+
+// hot tracks how often keys are refetched to extend the TTL of hot ones.
+var hot = &hotKeys{keys: make(map[string]*hotKey)}
+
+// hotKey is the refetch history of a single key.
+type hotKey struct {
+	windowStart time.Time
+	fetches     int
+	// ttl is the key's extended TTL, or zero if it hasn't been promoted.
+	ttl time.Duration
+}
+
+// hotKeys raises the TTL floor of keys refetched more than -hot-refetches
+// times within one TTL, doubling it on each further refetch up to
+// -hot-ttl-cap.
+type hotKeys struct {
+	mu   sync.Mutex
+	keys map[string]*hotKey
+}
+
+// ttl records a fetch of key and returns the TTL to store it with, given the
+// TTL it would otherwise get.
+func (h *hotKeys) ttl(key string, ttl time.Duration) time.Duration {
+	if flagHotRefetches <= 0 || ttl <= 0 {
+		return ttl
+	}
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hk, ok := h.keys[key]
+	if !ok {
+		if len(h.keys) >= hotKeyLimit {
+			h.prune(now)
+		}
+		hk = &hotKey{windowStart: now}
+		h.keys[key] = hk
+	}
+	window := ttl
+	if hk.ttl > window {
+		window = hk.ttl
+	}
+	if now.Sub(hk.windowStart) > 2*window {
+		// the key has cooled down
+		hk.windowStart, hk.fetches, hk.ttl = now, 0, 0
+	}
+	hk.fetches++
+	if hk.fetches <= flagHotRefetches {
+		return ttl
+	}
+	next := ttl
+	if hk.ttl > 0 {
+		next = 2 * hk.ttl
+	} else {
+		next = 2 * ttl
+	}
+	if flagHotTTLCap > 0 && next > flagHotTTLCap {
+		next = flagHotTTLCap
+	}
+	if next <= ttl {
+		return ttl
+	}
+	hk.ttl = next
+	return next
+}
+
+// prune forgets keys whose windows are older than the longest TTL a key can
+// have. h.mu must be held.
+func (h *hotKeys) prune(now time.Time) {
+	max := flagHotTTLCap
+	if max < flagTTL {
+		max = flagTTL
+	}
+	for key, hk := range h.keys {
+		if now.Sub(hk.windowStart) > 2*max {
+			delete(h.keys, key)
+		}
+	}
+}
+
+// promoted returns the keys whose TTL is currently extended.
+func (h *hotKeys) promoted() map[string]time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	promoted := map[string]time.Duration{}
+	for key, hk := range h.keys {
+		if hk.ttl > 0 {
+			promoted[key] = hk.ttl
+		}
+	}
+	return promoted
+}
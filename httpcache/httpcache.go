@@ -0,0 +1,241 @@
+// Package httpcache decides whether and for how long HTTP responses may be
+// cached, following RFC 7234 in strict mode and devcache's relaxed defaults
+// otherwise. Its functions only look at request and response metadata.
+package httpcache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Request is the metadata of a request relevant to caching its response.
+type Request struct {
+	Method string
+	Header http.Header
+}
+
+// Response is the metadata of a response relevant to caching it.
+type Response struct {
+	Status int
+	Header http.Header
+	// Time is when the response was received.
+	Time time.Time
+}
+
+// Decision is the outcome of Decide.
+type Decision struct {
+	// Store is set if the response may be cached.
+	Store bool
+	// TTL is how long the response stays fresh. Zero means the cache's
+	// default TTL.
+	TTL time.Duration
+	// Heuristic is set if TTL is a heuristic rather than explicit lifetime.
+	Heuristic bool
+	// MustRevalidate is set if the response must not be served once stale.
+	MustRevalidate bool
+}
+
+// Directives are parsed Cache-Control directives. Directives without a value
+// map to the empty string.
+type Directives map[string]string
+
+// ParseCacheControl parses the Cache-Control directives in h.
+func ParseCacheControl(h http.Header) Directives {
+	d := Directives{}
+	for _, line := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, value := part, ""
+			if i := strings.Index(part, "="); i >= 0 {
+				name, value = part[:i], strings.Trim(part[i+1:], `"`)
+			}
+			d[strings.ToLower(name)] = value
+		}
+	}
+	return d
+}
+
+// Has reports whether the directive name is present.
+func (d Directives) Has(name string) bool {
+	_, ok := d[name]
+	return ok
+}
+
+// Seconds returns the value of a delta-seconds directive.
+func (d Directives) Seconds(name string) (time.Duration, bool) {
+	v, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		// invalid values are treated as stale, RFC 7234 §1.2.1
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// heuristicStatuses are the status codes cacheable by default, RFC 7231 §6.1.
+var heuristicStatuses = map[int]bool{
+	200: true, 203: true, 204: true, 206: true, 300: true, 301: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// understoodStatuses are the status codes a cache may store at all.
+func understood(status int) bool {
+	return status >= 100 && status < 600
+}
+
+// heuristicFraction is the fraction of the time since Last-Modified used as a
+// heuristic lifetime, RFC 7234 §4.2.2.
+const heuristicFraction = 10
+
+// Decide determines whether res, received for req, may be cached and for how
+// long. In relaxed mode every response is stored for the default TTL; strict
+// mode follows the rules of RFC 7234 for a shared cache. maxHeuristic caps
+// heuristic lifetimes.
+func Decide(req Request, res Response, strict bool, maxHeuristic time.Duration) Decision {
+	if !strict {
+		return Decision{Store: true}
+	}
+	reqCC := ParseCacheControl(req.Header)
+	resCC := ParseCacheControl(res.Header)
+
+	// RFC 7234 §3
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return Decision{}
+	}
+	if !understood(res.Status) || reqCC.Has("no-store") || resCC.Has("no-store") || resCC.Has("private") {
+		return Decision{}
+	}
+	// RFC 7234 §3.2
+	if req.Header.Get("Authorization") != "" &&
+		!resCC.Has("must-revalidate") && !resCC.Has("public") && !resCC.Has("s-maxage") {
+		return Decision{}
+	}
+
+	d := Decision{
+		Store:          true,
+		MustRevalidate: resCC.Has("must-revalidate") || resCC.Has("proxy-revalidate"),
+	}
+	// RFC 7234 §5.2.2.2: a no-cache response can't be served without
+	// revalidation, so there's no point keeping it.
+	if resCC.Has("no-cache") {
+		return Decision{}
+	}
+	if ttl, ok := explicitLifetime(res, resCC); ok {
+		if ttl <= 0 {
+			return Decision{}
+		}
+		d.TTL = ttl
+		return d
+	}
+	if !heuristicStatuses[res.Status] && !resCC.Has("public") {
+		return Decision{}
+	}
+	d.TTL = heuristicLifetime(res, maxHeuristic)
+	if d.TTL <= 0 {
+		return Decision{}
+	}
+	d.Heuristic = true
+	return d
+}
+
+// Honor determines whether res may be cached and for how long by its own
+// Cache-Control and Expires headers alone, without the rest of RFC 7234's
+// rules: no-store responses aren't stored, an explicit lifetime becomes the
+// TTL and a response without one is stored for the default TTL.
+func Honor(res Response) Decision {
+	cc := ParseCacheControl(res.Header)
+	if cc.Has("no-store") {
+		return Decision{}
+	}
+	ttl, ok := explicitLifetime(res, cc)
+	if !ok {
+		return Decision{Store: true}
+	}
+	if ttl <= 0 {
+		return Decision{}
+	}
+	return Decision{Store: true, TTL: ttl}
+}
+
+// Explicit reports whether a response with header sets its own freshness
+// lifetime with Cache-Control or Expires, rather than leaving it to a cache's
+// heuristics.
+func Explicit(header http.Header) bool {
+	cc := ParseCacheControl(header)
+	_, smaxage := cc.Seconds("s-maxage")
+	_, maxage := cc.Seconds("max-age")
+	return smaxage || maxage || header.Get("Expires") != ""
+}
+
+// explicitLifetime returns the freshness lifetime set by the origin, RFC 7234
+// §4.2.1.
+func explicitLifetime(res Response, cc Directives) (time.Duration, bool) {
+	if ttl, ok := cc.Seconds("s-maxage"); ok {
+		return ttl, true
+	}
+	if ttl, ok := cc.Seconds("max-age"); ok {
+		return ttl, true
+	}
+	if v := res.Header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			// invalid dates are in the past, RFC 7234 §5.3
+			return 0, true
+		}
+		date := res.Time
+		if v := res.Header.Get("Date"); v != "" {
+			if t, err := http.ParseTime(v); err == nil {
+				date = t
+			}
+		}
+		return expires.Sub(date), true
+	}
+	return 0, false
+}
+
+// heuristicLifetime returns a fraction of the time since the response was
+// last modified, capped at max.
+func heuristicLifetime(res Response, max time.Duration) time.Duration {
+	lm, err := http.ParseTime(res.Header.Get("Last-Modified"))
+	if err != nil {
+		return max
+	}
+	date := res.Time
+	if t, err := http.ParseTime(res.Header.Get("Date")); err == nil {
+		date = t
+	}
+	ttl := date.Sub(lm) / heuristicFraction
+	if max > 0 && ttl > max {
+		ttl = max
+	}
+	return ttl
+}
+
+// Warning values, RFC 7234 §5.5.
+const (
+	WarningStale               = `110 - "Response is Stale"`
+	WarningRevalidationFailed  = `111 - "Revalidation Failed"`
+	WarningHeuristicExpiration = `113 - "Heuristic Expiration"`
+)
+
+// Warnings returns the Warning header values for serving a response of the
+// given age that was stored under d.
+func Warnings(d Decision, age time.Duration, stale bool) []string {
+	var warnings []string
+	if stale {
+		warnings = append(warnings, WarningStale)
+	}
+	// RFC 7234 §5.5.4
+	if d.Heuristic && age > 24*time.Hour {
+		warnings = append(warnings, WarningHeuristicExpiration)
+	}
+	return warnings
+}
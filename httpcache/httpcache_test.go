@@ -0,0 +1,287 @@
+package httpcache
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// now is the time every response in the tests is received.
+var now = time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+
+func header(kv ...string) http.Header {
+	h := http.Header{}
+	for i := 0; i < len(kv); i += 2 {
+		h.Add(kv[i], kv[i+1])
+	}
+	return h
+}
+
+func httpDate(t time.Time) string {
+	return t.UTC().Format(http.TimeFormat)
+}
+
+// TestDecide checks both modes against cases following the rules and
+// examples of RFC 7234.
+func TestDecide(t *testing.T) {
+	const max = 24 * time.Hour
+	for _, tt := range []struct {
+		name    string
+		method  string
+		req     http.Header
+		status  int
+		res     http.Header
+		strict  Decision
+		relaxed Decision
+	}{
+		{
+			name:    "max-age",
+			res:     header("Cache-Control", "max-age=60"),
+			strict:  Decision{Store: true, TTL: time.Minute},
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "s-maxage overrides max-age for a shared cache, §5.2.2.9",
+			res:     header("Cache-Control", "max-age=60, s-maxage=120"),
+			strict:  Decision{Store: true, TTL: 2 * time.Minute},
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "max-age overrides Expires, §4.2.1",
+			res:     header("Cache-Control", "max-age=60", "Expires", httpDate(now.Add(time.Hour))),
+			strict:  Decision{Store: true, TTL: time.Minute},
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "Expires relative to Date, §4.2.1",
+			res:     header("Date", httpDate(now), "Expires", httpDate(now.Add(time.Hour))),
+			strict:  Decision{Store: true, TTL: time.Hour},
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "invalid Expires is in the past, §5.3",
+			res:     header("Expires", "0"),
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "invalid max-age is stale, §1.2.1",
+			res:     header("Cache-Control", "max-age=soon"),
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "max-age=0",
+			res:     header("Cache-Control", "max-age=0"),
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "response no-store, §5.2.2.3",
+			res:     header("Cache-Control", "no-store"),
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "request no-store, §5.2.1.5",
+			req:     header("Cache-Control", "no-store"),
+			res:     header("Cache-Control", "max-age=60"),
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "private in a shared cache, §5.2.2.6",
+			res:     header("Cache-Control", "private, max-age=60"),
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "no-cache, §5.2.2.2",
+			res:     header("Cache-Control", "no-cache, max-age=60"),
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "must-revalidate, §5.2.2.1",
+			res:     header("Cache-Control", "max-age=60, must-revalidate"),
+			strict:  Decision{Store: true, TTL: time.Minute, MustRevalidate: true},
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "proxy-revalidate, §5.2.2.7",
+			res:     header("Cache-Control", "max-age=60, proxy-revalidate"),
+			strict:  Decision{Store: true, TTL: time.Minute, MustRevalidate: true},
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "Authorization without permission, §3.2",
+			req:     header("Authorization", "Bearer x"),
+			res:     header("Cache-Control", "max-age=60"),
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "Authorization with public, §3.2",
+			req:     header("Authorization", "Bearer x"),
+			res:     header("Cache-Control", "public, max-age=60"),
+			strict:  Decision{Store: true, TTL: time.Minute},
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "Authorization with s-maxage, §3.2",
+			req:     header("Authorization", "Bearer x"),
+			res:     header("Cache-Control", "s-maxage=60"),
+			strict:  Decision{Store: true, TTL: time.Minute},
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "Authorization with must-revalidate, §3.2",
+			req:     header("Authorization", "Bearer x"),
+			res:     header("Cache-Control", "max-age=60, must-revalidate"),
+			strict:  Decision{Store: true, TTL: time.Minute, MustRevalidate: true},
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "heuristic from Last-Modified, §4.2.2",
+			res:     header("Date", httpDate(now), "Last-Modified", httpDate(now.Add(-10*time.Hour))),
+			strict:  Decision{Store: true, TTL: time.Hour, Heuristic: true},
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "heuristic capped",
+			res:     header("Date", httpDate(now), "Last-Modified", httpDate(now.Add(-1000*time.Hour))),
+			strict:  Decision{Store: true, TTL: max, Heuristic: true},
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "heuristic without Last-Modified",
+			strict:  Decision{Store: true, TTL: max, Heuristic: true},
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "404 is cacheable by default, RFC 7231 §6.1",
+			status:  404,
+			strict:  Decision{Store: true, TTL: max, Heuristic: true},
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "500 isn't cacheable by default",
+			status:  500,
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "500 with an explicit lifetime",
+			status:  500,
+			res:     header("Cache-Control", "max-age=60"),
+			strict:  Decision{Store: true, TTL: time.Minute},
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "public makes any status heuristically cacheable, §4.2.2",
+			status:  302,
+			res:     header("Cache-Control", "public"),
+			strict:  Decision{Store: true, TTL: max, Heuristic: true},
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "status not understood, §3",
+			status:  999,
+			res:     header("Cache-Control", "max-age=60"),
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "POST isn't cacheable here, §3",
+			method:  http.MethodPost,
+			res:     header("Cache-Control", "max-age=60"),
+			relaxed: Decision{Store: true},
+		},
+		{
+			name:    "HEAD",
+			method:  http.MethodHead,
+			res:     header("Cache-Control", "max-age=60"),
+			strict:  Decision{Store: true, TTL: time.Minute},
+			relaxed: Decision{Store: true},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := Request{Method: tt.method, Header: tt.req}
+			if req.Method == "" {
+				req.Method = http.MethodGet
+			}
+			if req.Header == nil {
+				req.Header = http.Header{}
+			}
+			res := Response{Status: tt.status, Header: tt.res, Time: now}
+			if res.Status == 0 {
+				res.Status = http.StatusOK
+			}
+			if res.Header == nil {
+				res.Header = http.Header{}
+			}
+			if got := Decide(req, res, true, max); got != tt.strict {
+				t.Errorf("strict: got %+v, want %+v", got, tt.strict)
+			}
+			if got := Decide(req, res, false, max); got != tt.relaxed {
+				t.Errorf("relaxed: got %+v, want %+v", got, tt.relaxed)
+			}
+		})
+	}
+}
+
+func TestHonor(t *testing.T) {
+	for _, tt := range []struct {
+		res  http.Header
+		want Decision
+	}{
+		{header(), Decision{Store: true}},
+		{header("Cache-Control", "max-age=60"), Decision{Store: true, TTL: time.Minute}},
+		{header("Cache-Control", "no-store"), Decision{}},
+		{header("Cache-Control", "max-age=0"), Decision{}},
+		{header("Date", httpDate(now), "Expires", httpDate(now.Add(time.Hour))), Decision{Store: true, TTL: time.Hour}},
+	} {
+		if got := Honor(Response{Status: http.StatusOK, Header: tt.res, Time: now}); got != tt.want {
+			t.Errorf("%v: got %+v, want %+v", tt.res, got, tt.want)
+		}
+	}
+}
+
+func TestParseCacheControl(t *testing.T) {
+	got := ParseCacheControl(header("Cache-Control", `Max-Age=60, no-cache="Set-Cookie"`, "Cache-Control", "public"))
+	want := Directives{"max-age": "60", "no-cache": "Set-Cookie", "public": ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	for _, tt := range []struct {
+		d     Decision
+		age   time.Duration
+		stale bool
+		want  []string
+	}{
+		{Decision{Store: true, TTL: time.Minute}, time.Hour, false, nil},
+		{Decision{Store: true, TTL: time.Minute}, time.Hour, true, []string{WarningStale}},
+		// §5.5.4: only once a heuristic response is over a day old
+		{Decision{Store: true, Heuristic: true}, time.Hour, false, nil},
+		{Decision{Store: true, Heuristic: true}, 25 * time.Hour, true, []string{WarningStale, WarningHeuristicExpiration}},
+	} {
+		if got := Warnings(tt.d, tt.age, tt.stale); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v at %s: got %q, want %q", tt.d, tt.age, got, tt.want)
+		}
+	}
+}
+
+func TestExplicit(t *testing.T) {
+	for _, tt := range []struct {
+		res  http.Header
+		want bool
+	}{
+		{header(), false},
+		{header("Cache-Control", "public"), false},
+		{header("Last-Modified", httpDate(now)), false},
+		{header("Cache-Control", "max-age=60"), true},
+		{header("Cache-Control", "s-maxage=0"), true},
+		{header("Expires", httpDate(now.Add(time.Hour))), true},
+		// invalid, but still the origin's own say on freshness
+		{header("Expires", "0"), true},
+		{header("Cache-Control", "max-age=soon"), true},
+	} {
+		if got := Explicit(tt.res); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.res, got, tt.want)
+		}
+	}
+}
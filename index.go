@@ -0,0 +1,84 @@
+package devcache
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"github.com/travis-g/devcache/api"
+)
+
+// endpointDocs describes devcache's own endpoints by path template. The
+// versioned API endpoints are described by api.Endpoints.
+var endpointDocs = map[string]string{
+	"/healthz":                             "Reports that the server is up.",
+	"/readyz":                              "Reports whether priority 1 warm paths have been warmed.",
+	"/debug/vars":                          "Exposes expvar variables, including the stats.",
+	"/metrics":                             "Exposes the stats in the Prometheus text format.",
+	adminPrefix + "/openapi.json":          "Describes the versioned API in OpenAPI 3.",
+	adminPrefix + "/misses":                "Reports recent cache misses.",
+	adminPrefix + "/recent":                "Lists the latest handled requests.",
+	adminPrefix + "/tail":                  "Streams handled requests as server-sent events.",
+	adminPrefix + "/assert-report":         "Lists the requests that weren't in the recording.",
+	adminPrefix + "/store-verify":          "Reports the divergences found between the -store-verify backends.",
+	adminPrefix + "/size-budgets":          "Lists each size budget rule with its worst offenders.",
+	adminPrefix + "/entries":               "Lists a summary of every cached entry.",
+	adminPrefix + "/export":                "Exports the entries for a list of keys.",
+	adminPrefix + "/import":                "Imports exported entries.",
+	adminPrefix + "/upstreams":             "Reports the health of every upstream host.",
+	adminPrefix + "/errors":                "Lists failed upstream fetches by path.",
+	adminPrefix + "/session/start":         "Starts a named recording session.",
+	adminPrefix + "/session/stop":          "Ends the recording session in progress.",
+	adminPrefix + "/session/{name}/export": "Exports the entries of a recording session.",
+	controlPrefix + "/":                    "Lists devcache's own endpoints.",
+	controlPrefix + "/invalidate":          "Evicts entries by tag or source.",
+	controlPrefix + "/purge":               "Evicts the entry under a key, or every entry under a key prefix.",
+	controlPrefix + "/flush":               "Evicts every entry.",
+	controlPrefix + "/stats":               "Reports the stats.",
+	controlPrefix + "/stats/reset":         "Zeroes the stats counters.",
+	controlPrefix + "/upstream":            "Reports, or enables or disables, the upstream.",
+	controlPrefix + "/read-only":           "Reports, or freezes or thaws, the cache.",
+	controlPrefix + "/tenants":             "Reports the entries and requests of each tenant.",
+	controlPrefix + "/key":                 "Previews the cache key of a request for a path.",
+}
+
+func init() {
+	for _, ep := range api.Endpoints {
+		endpointDocs[adminPrefix+api.Prefix+ep.Path] = ep.Description
+	}
+}
+
+// endpoint describes one of devcache's own endpoints.
+type endpoint struct {
+	Path        string   `json:"path"`
+	Methods     []string `json:"methods"`
+	Description string   `json:"description,omitempty"`
+}
+
+// endpoints lists the routes registered on s.admin, so it always matches
+// what's served. Prefix routes such as the proxy itself have no methods and
+// are left out.
+func (s *server) endpoints() []endpoint {
+	var endpoints []endpoint
+	s.admin.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		endpoints = append(endpoints, endpoint{Path: path, Methods: methods, Description: endpointDocs[path]})
+		return nil
+	})
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].Path < endpoints[j].Path })
+	return endpoints
+}
+
+// handleIndex lists devcache's own endpoints.
+func (s *server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"endpoints": s.endpoints()})
+}
@@ -0,0 +1,327 @@
+package devcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// keyDigestSep separates the kept prefix of an over-long key from the digest
+// of the full key, and keyBodySep precedes the digest of a request body.
+const (
+	keyDigestSep   = "#sha256:"
+	keyBodySep     = "#body:"
+	keyLangSep     = "#lang:"
+	keyHeaderSep   = "#header:"
+	keyAuthSep     = "#auth:"
+	keyUpstreamSep = "#upstream:"
+	keyVarySep     = "#vary:"
+	keyMethodSep   = "#method:"
+	keyVariantSep  = "#variant:"
+)
+
+// Modes of -body-key, how request bodies are digested into keys.
+const (
+	// bodyKeyRaw digests the body byte for byte.
+	bodyKeyRaw = "raw"
+	// bodyKeyJSON digests JSON bodies with their object keys sorted and
+	// whitespace dropped, so bodies that only differ in formatting share a
+	// key. Other bodies are digested byte for byte.
+	bodyKeyJSON = "json"
+)
+
+// requestKey is a cache key along with what it was derived from. Keys must be
+// built with keyFor so the store can refuse keys that would let requests with
+// different bodies share an entry.
+type requestKey struct {
+	key string
+	// hasBody is set if the request the key was derived from had a body.
+	hasBody bool
+	// bodyDigest is set once a digest of that body is part of key, and
+	// digest is that digest.
+	bodyDigest bool
+	digest     string
+	// base is the key before any -honor-vary variant was folded in, and vary
+	// the headers of the variant.
+	base string
+	vary []string
+	// method and body are what the request is replayed upstream with. body
+	// is only kept for methods cached with -cache-methods.
+	method string
+	body   []byte
+}
+
+// requestKeyCtx is the context key the key of a request is stored under when
+// keyFor can't derive it again, as for requests whose body is in the key.
+type requestKeyCtx struct{}
+
+// cachedMethod reports whether requests with method are cached. GET and HEAD
+// always are, others only if listed by -cache-methods.
+func cachedMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || flagCacheMethods.contains(method)
+}
+
+// hasMethod reports whether k's method is part of the key, as it is for every
+// method but GET and HEAD.
+func (k requestKey) hasMethod() bool {
+	return k.method != "" && k.method != http.MethodGet && k.method != http.MethodHead
+}
+
+// keyFor returns the key the response to r is cached under.
+func keyFor(r *http.Request) requestKey {
+	key := tenantKey(requestTenant(r), canonicalURI(r.RequestURI))
+	if flagVaryLanguage {
+		if lang := primaryLanguage(r.Header.Get("Accept-Language")); lang != "" {
+			key += keyLangSep + lang
+		}
+	}
+	if hk := headerKey(r.RequestURI, r.Header); hk != "" {
+		key += keyHeaderSep + hk
+	}
+	if name, _ := selectedUpstream(r.Header); name != "" {
+		key += keyUpstreamSep + name
+	}
+	if fp := fingerprint(r); fp != "" {
+		key += keyVarySep + fp
+	}
+	if flagRoutes.match(r.RequestURI).perCredential() {
+		if cred := credentialDigest(r.Header); cred != "" {
+			key += keyAuthSep + cred
+		}
+	}
+	k := requestKey{hasBody: r.ContentLength != 0, method: r.Method}
+	if k.hasMethod() {
+		key += keyMethodSep + r.Method
+	}
+	k.base = key
+	if names := varies.get(key); flagHonorVary && names != nil {
+		return k.withVariant(names, r.Header)
+	}
+	k.key = limitKey(key, flagMaxKeyBytes)
+	return k
+}
+
+// primaryLanguage returns the lowercased primary subtag of the most preferred
+// language in an Accept-Language header, so "en-US,fr;q=0.8" and "en" both
+// give "en". Ties go to the earliest language listed. The wildcard and an
+// empty header give "".
+func primaryLanguage(header string) string {
+	best, bestQ := "", -1.0
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > bestQ && q > 0 {
+			best, bestQ = tag, q
+		}
+	}
+	if i := strings.Index(best, "-"); i >= 0 {
+		best = best[:i]
+	}
+	return strings.ToLower(best)
+}
+
+// headerKey returns the values in h of the headers keyed for uri, encoded to
+// be folded into a key after the path and query. Headers a request doesn't
+// send are left out, so a request sending none of them shares the key of the
+// plain URI, and one that also sends the same setting in its query is keyed
+// by both. Credentials are keyed by a digest, so they aren't saved with the
+// cache.
+func headerKey(uri string, h http.Header) string {
+	values := url.Values{}
+	for _, name := range flagPathKeyHeaders.names(uri) {
+		if v := keyedValues(name, h); len(v) > 0 {
+			values[name] = v
+		}
+	}
+	return values.Encode()
+}
+
+// keyedValues returns the values of the header name in h as they're keyed:
+// as they are, or as a digest for credentials.
+func keyedValues(name string, h http.Header) []string {
+	v := h.Values(name)
+	if len(v) > 0 && credentialHeaders[name] {
+		v = []string{digestValues(v)}
+	}
+	return v
+}
+
+// digestValues returns a short digest standing in for the credential v.
+func digestValues(v []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(v, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// credentialHeaders are the key headers whose values are digested.
+var credentialHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+}
+
+// keyHeaderRule keys the requests whose paths match pattern, as a glob or a
+// prefix, by headers.
+type keyHeaderRule struct {
+	pattern string
+	headers headerList
+}
+
+// keyHeaderRules is a repeatable flag of PATTERN=HEADER[,HEADER...] rules,
+// scoping key headers to paths.
+type keyHeaderRules []keyHeaderRule
+
+func (rules *keyHeaderRules) String() string {
+	specs := make([]string, len(*rules))
+	for i, rule := range *rules {
+		specs[i] = rule.pattern + "=" + rule.headers.String()
+	}
+	return strings.Join(specs, " ")
+}
+
+func (rules *keyHeaderRules) Set(spec string) error {
+	i := strings.LastIndexByte(spec, '=')
+	if i <= 0 {
+		return fmt.Errorf("key header rule %q is not PATTERN=HEADER[,HEADER...]", spec)
+	}
+	rule := keyHeaderRule{pattern: spec[:i]}
+	if _, err := path.Match(rule.pattern, ""); err != nil {
+		return err
+	}
+	rule.headers.Set(spec[i+1:])
+	if len(rule.headers) == 0 {
+		return fmt.Errorf("key header rule %q names no headers", spec)
+	}
+	*rules = append(*rules, rule)
+	return nil
+}
+
+func (rules *keyHeaderRules) repeatable() {}
+
+// names returns the headers keyed for uri: the -key-headers, then those of
+// every rule matching its path.
+func (rules keyHeaderRules) names(uri string) []string {
+	names := flagKeyHeaders
+	for _, rule := range rules {
+		if (patternList{rule.pattern}).match(uri) {
+			names = append(names[:len(names):len(names)], rule.headers...)
+		}
+	}
+	return names
+}
+
+// withBody folds a digest of the request body into k, canonicalizing JSON
+// bodies first with -body-key json. The body itself is kept to be replayed
+// upstream if k's method is part of the key.
+func (k requestKey) withBody(body []byte) requestKey {
+	if len(body) == 0 {
+		k.hasBody = false
+		return k
+	}
+	if k.hasMethod() {
+		k.body = body
+	}
+	if flagBodyKey == bodyKeyJSON {
+		if canonical, err := canonicalJSON(k.key, body); err == nil {
+			body = canonical
+		}
+	}
+	sum := sha256.Sum256(body)
+	k.digest = hex.EncodeToString(sum[:])
+	k.key = limitKey(k.key+keyBodySep+k.digest, flagMaxKeyBytes)
+	k.hasBody = true
+	k.bodyDigest = true
+	return k
+}
+
+// safe reports whether entries may be stored under k.
+func (k requestKey) safe() bool {
+	return !k.hasBody || k.bodyDigest
+}
+
+func (k requestKey) String() string {
+	return k.key
+}
+
+// limitKey keeps keys at most max bytes long. Keys over the limit have their
+// overflow replaced with a sha256 digest of the entire key, so two long keys
+// sharing a prefix still map to distinct entries. A max of 0 disables the
+// limit.
+func limitKey(key string, max int) string {
+	if max <= 0 || len(key) <= max {
+		return key
+	}
+	sum := sha256.Sum256([]byte(key))
+	suffix := keyDigestSep + hex.EncodeToString(sum[:])
+	keep := max - len(suffix)
+	if keep < 0 {
+		keep = 0
+	}
+	return key[:keep] + suffix
+}
+
+// handleKey previews the key a request for the path parameter would be
+// cached under, without proxying it. The preview request carries the headers
+// of the request for it, so key headers, the language, the upstream and the
+// tenant can be set as they would be, and method sets its method.
+func (s *server) handleKey(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	uri := q.Get("path")
+	if _, err := url.ParseRequestURI(uri); err != nil {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	method := q.Get("method")
+	if method == "" {
+		method = "GET"
+	}
+	req, err := http.NewRequest(method, uri, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.RequestURI = uri
+	req.Header = r.Header.Clone()
+	req = cleanPath(req)
+	tenant := defaultTenant
+	if t, ok := tenantOf(req); ok && tenancy() {
+		if !validTenant.MatchString(t) {
+			http.Error(w, "invalid tenant", http.StatusBadRequest)
+			return
+		}
+		tenant = t
+	}
+	ctx := context.WithValue(req.Context(), tenantCtxKey{}, tenant)
+	if s.VaryFunc != nil {
+		if fp := s.VaryFunc(req); fp != "" {
+			ctx = context.WithValue(ctx, fingerprintKey{}, fp)
+		}
+	}
+	k := keyFor(req.WithContext(ctx))
+	_, cached := Cache.Get(k.String())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"path":   req.RequestURI,
+		"tenant": tenant,
+		"key":    k.String(),
+		"cached": cached,
+	})
+}
@@ -0,0 +1,356 @@
+package devcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLimitKey(t *testing.T) {
+	prefix := "/search?q=" + strings.Repeat("x", 4096)
+	a, b := limitKey(prefix+"a", 2048), limitKey(prefix+"b", 2048)
+	if a == b {
+		t.Fatal("long keys sharing a prefix collide")
+	}
+	for _, key := range []string{a, b} {
+		if len(key) > 2048 {
+			t.Errorf("key is %d bytes, want at most 2048", len(key))
+		}
+		if !strings.Contains(key, keyDigestSep) {
+			t.Errorf("key %q has no digest", key[len(key)-80:])
+		}
+	}
+	if limitKey(prefix+"a", 2048) != a {
+		t.Error("limitKey isn't stable")
+	}
+	if short := "/short?q=1"; limitKey(short, 2048) != short {
+		t.Error("short key changed")
+	}
+	if limitKey(prefix, 0) != prefix {
+		t.Error("a max of 0 changed the key")
+	}
+}
+
+func TestLongURIs(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Query().Get("q")[4096:]))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL, "-max-key-bytes", "512", "-max-uri-bytes", "8192")
+
+	prefix := "/search?q=" + strings.Repeat("x", 4096)
+	for i := 0; i < 2; i++ {
+		for _, suffix := range []string{"a", "b"} {
+			w := do(s.Handler(), "GET", prefix+suffix, nil)
+			if w.Code != http.StatusOK || w.Body.String() != suffix {
+				t.Fatalf("%s: got %d %q", suffix, w.Code, w.Body)
+			}
+		}
+	}
+	if n := Cache.ItemCount(); n != 2 {
+		t.Errorf("%d entries cached, want 2", n)
+	}
+	for _, item := range Cache.Items() {
+		if e, _ := toEntry(item.Object); !strings.HasPrefix(e.URL, prefix) {
+			t.Errorf("entry doesn't keep its full URL: %.40q", e.URL)
+		}
+	}
+
+	if w := do(s.Handler(), "GET", "/search?q="+strings.Repeat("x", 8192), nil); w.Code != http.StatusRequestURITooLong {
+		t.Errorf("huge URI: got %d, want 414", w.Code)
+	}
+}
+
+func TestPrimaryLanguage(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                        "",
+		"*":                       "",
+		"en":                      "en",
+		"en-US":                   "en",
+		"EN-gb":                   "en",
+		"en-US,fr;q=0.8":          "en",
+		"fr;q=0.8,de":             "de",
+		"fr;q=0.5, en;q=0.5":      "fr",
+		"de;q=0, fr-CA;q=0.1":     "fr",
+		"*, es;q=0.9":             "es",
+		"zh-Hant-TW;q=0.9, *;q=1": "zh",
+	} {
+		if got := primaryLanguage(header); got != want {
+			t.Errorf("%q: got %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestVaryLanguage(t *testing.T) {
+	var fetches int
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write([]byte("hello in " + r.Header.Get("Accept-Language")))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL, "-vary-language")
+
+	for _, tt := range []struct{ lang, want string }{
+		{"en-US", "hello in en-US"},
+		{"fr", "hello in fr"},
+		// en-GB shares the entry of en-US
+		{"en-GB", "hello in en-US"},
+		{"fr-CA,en;q=0.5", "hello in fr"},
+	} {
+		w := do(s.Handler(), "GET", "/greeting", http.Header{"Accept-Language": {tt.lang}})
+		if w.Body.String() != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.lang, w.Body, tt.want)
+		}
+	}
+	if fetches != 2 {
+		t.Errorf("upstream fetched %d times, want once per language", fetches)
+	}
+}
+
+func TestBodyKeyJSON(t *testing.T) {
+	key := func(mode, body string) string {
+		flagBodyKey = mode
+		defer func() { flagBodyKey = bodyKeyRaw }()
+		return requestKey{key: "/search"}.withBody([]byte(body)).String()
+	}
+	for _, tt := range []struct {
+		a, b string
+		same bool
+	}{
+		{`{"b": 2, "a": [1, 2]}`, `{"a":[1,2],"b":2}`, true},
+		{`{"outer": {"y": null, "x": "s"}}`, "{\n  \"outer\": {\"x\": \"s\", \"y\": null}\n}", true},
+		{`{"a": [1, 2]}`, `{"a": [2, 1]}`, false},
+		{`{"a": 1}`, `{"a": 2}`, false},
+		// not JSON, so digested byte for byte
+		{`a=1&b=2`, `b=2&a=1`, false},
+		{`{"a": 1`, `{"a":1`, false},
+	} {
+		if got := key(bodyKeyJSON, tt.a) == key(bodyKeyJSON, tt.b); got != tt.same {
+			t.Errorf("json: %s and %s share a key: %v, want %v", tt.a, tt.b, got, tt.same)
+		}
+		if tt.a != tt.b && key(bodyKeyRaw, tt.a) == key(bodyKeyRaw, tt.b) {
+			t.Errorf("raw: %s and %s share a key", tt.a, tt.b)
+		}
+	}
+}
+
+func TestBodyKeyJSONCoalesces(t *testing.T) {
+	var fetches int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&fetches, 1)
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL, "-cache-methods", "POST", "-body-key", "json")
+
+	for _, body := range []string{`{"q": "x", "page": 1}`, `{"page":1,"q":"x"}`, "{\n\t\"q\": \"x\",\n\t\"page\": 1\n}"} {
+		r := httptest.NewRequest("POST", "/search", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", body, w.Code)
+		}
+	}
+	if n := atomic.LoadInt64(&fetches); n != 1 {
+		t.Errorf("fetched %d times, want equivalent bodies to share an entry", n)
+	}
+}
+
+func TestCacheMethods(t *testing.T) {
+	var fetches int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&fetches, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s", r.Method, body)
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL, "-cache-methods", "post,PUT")
+
+	for _, tt := range []struct {
+		method, body string
+		cache        string
+		fetches      int64
+	}{
+		{"POST", "q=a", "MISS", 1},
+		{"POST", "q=a", "HIT", 1},
+		// the body is part of the key
+		{"POST", "q=b", "MISS", 2},
+		// and so is the method
+		{"PUT", "q=a", "MISS", 3},
+		{"PUT", "q=a", "HIT", 3},
+		{"GET", "", "MISS", 4},
+		// methods not listed are proxied live, body and all
+		{"PATCH", "q=a", "MISS", 5},
+		{"PATCH", "q=a", "MISS", 6},
+	} {
+		var body io.Reader
+		if tt.body != "" {
+			body = strings.NewReader(tt.body)
+		}
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest(tt.method, "/search", body))
+		if want := tt.method + " " + tt.body; w.Body.String() != want {
+			t.Errorf("%s %s: body %q, want %q", tt.method, tt.body, w.Body, want)
+		}
+		if got := w.Header().Get("X-Cache"); got != tt.cache {
+			t.Errorf("%s %s: X-Cache %q, want %q", tt.method, tt.body, got, tt.cache)
+		}
+		if n := atomic.LoadInt64(&fetches); n != tt.fetches {
+			t.Errorf("%s %s: fetched %d times, want %d", tt.method, tt.body, n, tt.fetches)
+		}
+	}
+}
+
+func TestKeyHeaders(t *testing.T) {
+	var fetches int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&fetches, 1)
+		w.Write([]byte("version " + r.Header.Get("X-Api-Version") + " of " + r.URL.RequestURI()))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL, "-key-headers", "X-Api-Version,Authorization", "-cache-authenticated")
+
+	for _, tt := range []struct {
+		uri     string
+		version string
+	}{
+		{"/items", "1"},
+		{"/items", "2"},
+		{"/items", ""},
+		{"/items?page=2", "1"},
+		{"/items?page=2", ""},
+	} {
+		for i := 0; i < 2; i++ {
+			h := http.Header{}
+			if tt.version != "" {
+				h.Set("x-api-version", tt.version)
+			}
+			w := do(s.Handler(), "GET", tt.uri, h)
+			if want := "version " + tt.version + " of " + tt.uri; w.Body.String() != want {
+				t.Errorf("%s version %q: got %q, want %q", tt.uri, tt.version, w.Body, want)
+			}
+		}
+	}
+	if n := atomic.LoadInt64(&fetches); n != 5 {
+		t.Errorf("fetched %d times, want once for each version of each URI", n)
+	}
+	if n := Cache.ItemCount(); n != 5 {
+		t.Errorf("%d entries cached, want 5", n)
+	}
+
+	// credentials are keyed by a digest
+	do(s.Handler(), "GET", "/me", http.Header{"Authorization": {"Bearer secret"}})
+	var keyed bool
+	for key := range Cache.Items() {
+		if strings.Contains(key, "secret") {
+			t.Errorf("credential in key %s", key)
+		}
+		keyed = keyed || strings.HasPrefix(key, "/me"+keyHeaderSep)
+	}
+	if !keyed {
+		t.Error("request with credentials not keyed by them")
+	}
+}
+
+func TestPathKeyHeaders(t *testing.T) {
+	var fetches int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&fetches, 1)
+		w.Write([]byte(r.Header.Get("X-Tenant") + r.Header.Get("Accept-Language") + " " + r.URL.Path))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL,
+		"-key-headers", "Accept-Language",
+		"-path-key-headers", "/tenants/*/items=X-Tenant",
+		"-path-key-headers", "/reports=X-Tenant")
+
+	for _, tt := range []struct {
+		path, tenant string
+		// keyed is whether the tenant is part of the key
+		keyed bool
+	}{
+		{"/tenants/1/items", "a", true},
+		{"/tenants/2/items", "a", true},
+		// a prefix
+		{"/reports/daily", "a", true},
+		{"/other", "a", false},
+		{"/tenants/1/users", "a", false},
+	} {
+		before := atomic.LoadInt64(&fetches)
+		for _, tenant := range []string{tt.tenant, "b", tt.tenant} {
+			w := do(s.Handler(), "GET", tt.path, http.Header{"X-Tenant": {tenant}})
+			if tt.keyed && w.Body.String() != tenant+" "+tt.path {
+				t.Errorf("%s for %s: got %q", tt.path, tenant, w.Body)
+			}
+		}
+		want := int64(1)
+		if tt.keyed {
+			want = 2
+		}
+		if n := atomic.LoadInt64(&fetches) - before; n != want {
+			t.Errorf("%s: fetched %d times, want %d", tt.path, n, want)
+		}
+	}
+
+	// and the -key-headers still apply
+	before := atomic.LoadInt64(&fetches)
+	do(s.Handler(), "GET", "/reports/daily", http.Header{"X-Tenant": {"a"}, "Accept-Language": {"fr"}})
+	if n := atomic.LoadInt64(&fetches) - before; n != 1 {
+		t.Errorf("with -key-headers: fetched %d times, want 1", n)
+	}
+}
+
+func TestKeyHeaderRulesInvalid(t *testing.T) {
+	for _, spec := range []string{"X-Tenant", "=X-Tenant", "/a=", "/a= , ", "[=X-Tenant"} {
+		var rules keyHeaderRules
+		if err := rules.Set(spec); err == nil {
+			t.Errorf("%q: no error", spec)
+		}
+	}
+}
+
+func TestKeyPreview(t *testing.T) {
+	var fetches int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&fetches, 1)
+		w.Write([]byte("ok"))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL, "-ignore-params", "utm_*,_", "-key-headers", "X-Api-Version")
+	version := http.Header{"X-Api-Version": {"2"}}
+	do(s.Handler(), "GET", "/items?a=1&utm_source=mail&b=2", version)
+	var stored string
+	for key := range Cache.Items() {
+		stored = key
+	}
+
+	preview := func(path string, h http.Header) (key string, cached bool) {
+		t.Helper()
+		w := do(s.Handler(), "GET", controlPrefix+"/key?path="+url.QueryEscape(path), h)
+		var res struct {
+			Key    string `json:"key"`
+			Cached bool   `json:"cached"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: %s", w.Body, err)
+		}
+		return res.Key, res.Cached
+	}
+	// the ignored params are dropped and the key header folded in
+	if key, cached := preview("/items?a=1&b=2&_=1700000000", version); key != stored || !cached {
+		t.Errorf("preview %q, cached %v, want %q cached", key, cached, stored)
+	}
+	if key, cached := preview("/items?a=1&b=2", nil); key == stored || cached {
+		t.Errorf("preview without the key header %q, cached %v", key, cached)
+	}
+	if n := atomic.LoadInt64(&fetches); n != 1 {
+		t.Errorf("fetched %d times, want previews not proxied", n)
+	}
+}
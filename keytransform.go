@@ -0,0 +1,175 @@
+package devcache
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// keyTransformOps canonicalize the value of a query parameter. arg is the
+// operation's argument, if it takes one.
+var keyTransformOps = map[string]func(value, arg string) (string, error){
+	// round rounds every comma-separated number in the value to arg
+	// decimal places, so a bbox of 1.23456,4.56789 becomes 1.23,4.57.
+	"round": func(value, arg string) (string, error) {
+		places, err := strconv.Atoi(arg)
+		if err != nil || places < 0 {
+			return "", fmt.Errorf("invalid decimal places %q", arg)
+		}
+		parts := strings.Split(value, ",")
+		for i, part := range parts {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(part), 64); err == nil {
+				parts[i] = strconv.FormatFloat(f, 'f', places, 64)
+			}
+		}
+		return strings.Join(parts, ","), nil
+	},
+	"lower": func(value, arg string) (string, error) {
+		return strings.ToLower(value), nil
+	},
+}
+
+// keyTransform canonicalizes a query parameter in the keys of requests whose
+// paths match pattern.
+type keyTransform struct {
+	spec    string
+	pattern string
+	op      string
+	param   string
+	arg     string
+}
+
+// keyTransforms is a repeatable flag of PATTERN=OP:PARAM[:ARG] key
+// transforms. They only change cache keys; the upstream still receives the
+// request as sent.
+type keyTransforms []keyTransform
+
+func (t *keyTransforms) String() string {
+	specs := make([]string, len(*t))
+	for i, kt := range *t {
+		specs[i] = kt.spec
+	}
+	return strings.Join(specs, " ")
+}
+
+func (t *keyTransforms) Set(spec string) error {
+	i := strings.LastIndexByte(spec, '=')
+	if i <= 0 {
+		return fmt.Errorf("key transform %q is not PATTERN=OP:PARAM[:ARG]", spec)
+	}
+	kt := keyTransform{spec: spec, pattern: spec[:i]}
+	if _, err := path.Match(kt.pattern, ""); err != nil {
+		return err
+	}
+	fields := strings.SplitN(spec[i+1:], ":", 3)
+	if len(fields) < 2 || fields[1] == "" {
+		return fmt.Errorf("key transform %q is not PATTERN=OP:PARAM[:ARG]", spec)
+	}
+	kt.op, kt.param = fields[0], fields[1]
+	if len(fields) == 3 {
+		kt.arg = fields[2]
+	}
+	op, ok := keyTransformOps[kt.op]
+	if !ok {
+		return fmt.Errorf("unknown key transform %q", kt.op)
+	}
+	if _, err := op("0", kt.arg); err != nil {
+		return fmt.Errorf("key transform %q: %s", spec, err)
+	}
+	*t = append(*t, kt)
+	return nil
+}
+
+func (t *keyTransforms) repeatable() {}
+
+// canonical applies the transforms scoped to uri's path to its query. The
+// order of the parameters and any the transforms don't name are kept as
+// they are.
+func (t keyTransforms) canonical(uri string) string {
+	i := strings.IndexByte(uri, '?')
+	if i < 0 || len(t) == 0 {
+		return uri
+	}
+	p, query := uri[:i], uri[i+1:]
+	var scoped []keyTransform
+	for _, kt := range t {
+		if ok, _ := path.Match(kt.pattern, p); ok || strings.HasPrefix(p, kt.pattern) {
+			scoped = append(scoped, kt)
+		}
+	}
+	if len(scoped) == 0 {
+		return uri
+	}
+	params := strings.Split(query, "&")
+	for j, param := range params {
+		eq := strings.IndexByte(param, '=')
+		if eq < 0 {
+			continue
+		}
+		name, err1 := url.QueryUnescape(param[:eq])
+		value, err2 := url.QueryUnescape(param[eq+1:])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		changed := false
+		for _, kt := range scoped {
+			if kt.param == name {
+				value, _ = keyTransformOps[kt.op](value, kt.arg)
+				changed = true
+			}
+		}
+		if changed {
+			params[j] = param[:eq+1] + url.QueryEscape(value)
+		}
+	}
+	return p + "?" + strings.Join(params, "&")
+}
+
+// canonicalURI returns uri as it's keyed: with the -key-transform rules
+// applied to its query, then normalized by normalizeQuery.
+func canonicalURI(uri string) string {
+	return normalizeQuery(flagKeyTransforms.canonical(uri))
+}
+
+// normalizeQuery drops the -ignore-params from uri's query and, with
+// -sort-query, sorts its parameters by name. Repeated parameters keep their
+// order, and parameters are kept escaped as they were sent.
+func normalizeQuery(uri string) string {
+	i := strings.IndexByte(uri, '?')
+	if i < 0 || !flagSortQuery && len(flagIgnoreParams) == 0 {
+		return uri
+	}
+	type param struct{ name, raw string }
+	var params []param
+	for _, raw := range strings.Split(uri[i+1:], "&") {
+		if raw == "" {
+			continue
+		}
+		name := raw
+		if eq := strings.IndexByte(raw, '='); eq >= 0 {
+			name = raw[:eq]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if !flagIgnoreParams.contains(name) {
+			params = append(params, param{name, raw})
+		}
+	}
+	if flagSortQuery {
+		sort.SliceStable(params, func(a, b int) bool {
+			return params[a].name < params[b].name
+		})
+	}
+	if len(params) == 0 {
+		return uri[:i]
+	}
+	query := make([]string, len(params))
+	for j, p := range params {
+		query[j] = p.raw
+	}
+	return uri[:i+1] + strings.Join(query, "&")
+}
@@ -0,0 +1,57 @@
+package devcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNormalizeQuery(t *testing.T) {
+	defer func() { flagSortQuery, flagIgnoreParams = false, nil }()
+	for _, tt := range []struct {
+		sort   bool
+		ignore paramList
+		uri    string
+		want   string
+	}{
+		{false, nil, "/a?b=2&a=1", "/a?b=2&a=1"},
+		{true, nil, "/a?b=2&a=1", "/a?a=1&b=2"},
+		// repeated parameters keep their order, and escapes are kept
+		{true, nil, "/a?b=2&a=3&a=1&c=%20", "/a?a=3&a=1&b=2&c=%20"},
+		{true, nil, "/a?b&&a=", "/a?a=&b"},
+		{false, paramList{"_", "utm_*"}, "/a?_=123&b=2&utm_source=x&utm=y", "/a?b=2&utm=y"},
+		{true, paramList{"_"}, "/a?_=123&b=2&a=1", "/a?a=1&b=2"},
+		// names are matched unescaped
+		{false, paramList{"a b"}, "/a?a%20b=1&c=2", "/a?c=2"},
+		// the query goes if nothing's left of it
+		{false, paramList{"_"}, "/a?_=123", "/a"},
+		{true, paramList{"_"}, "/a", "/a"},
+	} {
+		flagSortQuery, flagIgnoreParams = tt.sort, tt.ignore
+		if got := normalizeQuery(tt.uri); got != tt.want {
+			t.Errorf("sort %v, ignore %v: %s: got %s, want %s", tt.sort, tt.ignore, tt.uri, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizedKeysShareEntries(t *testing.T) {
+	var fetches int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&fetches, 1)
+		w.Write([]byte("body"))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL, "-sort-query", "-ignore-params", "_,utm_*")
+
+	for _, uri := range []string{"/a?a=1&b=2", "/a?b=2&a=1", "/a?_=1700000000&a=1&b=2", "/a?a=1&utm_source=mail&b=2"} {
+		do(s.Handler(), "GET", uri, nil)
+	}
+	if n := atomic.LoadInt64(&fetches); n != 1 {
+		t.Errorf("fetched %d times, want equivalent queries to share an entry", n)
+	}
+	do(s.Handler(), "GET", "/a?a=2&b=2", nil)
+	if n := atomic.LoadInt64(&fetches); n != 2 {
+		t.Errorf("fetched %d times, want other values to get their own entry", n)
+	}
+}
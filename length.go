@@ -0,0 +1,61 @@
+package devcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Modes of -length-check, what to do with upstream bodies that don't match
+// their Content-Length.
+const (
+	// lengthStrict refuses to cache them, as truncated.
+	lengthStrict = "strict"
+	// lengthWarn logs them and caches them anyway.
+	lengthWarn = "warn"
+	// lengthOff doesn't compare lengths.
+	lengthOff = "off"
+)
+
+// errTruncated is returned by fetch for upstream bodies shorter or longer
+// than their Content-Length under -length-check strict.
+var errTruncated = errors.New("upstream body doesn't match its Content-Length")
+
+// checkLength compares the body read for path with the length the upstream
+// declared. When the transport decompressed the body itself, because the
+// client didn't ask for an encoding, the declared length is that of the
+// compressed body and there's nothing to compare: the transport drops it and
+// reports the length as unknown. Bodies the upstream encoded because the
+// client asked for it are compared before decodeBody decodes them.
+func checkLength(path string, res *http.Response, body []byte) error {
+	if flagLengthCheck == lengthOff || res.Uncompressed || res.ContentLength < 0 {
+		return nil
+	}
+	if int64(len(body)) == res.ContentLength {
+		return nil
+	}
+	log.Printf("warning: %s: read %d bytes, Content-Length is %d", path, len(body), res.ContentLength)
+	if flagLengthCheck == lengthWarn {
+		return nil
+	}
+	return errTruncated
+}
+
+// decodeBody returns the body of res decoded from the gzip Content-Encoding
+// the upstream applied because the client's Accept-Encoding allowed it.
+// Entries are cached and served decoded. Other encodings are left as they
+// are.
+func decodeBody(res *http.Response, body []byte) ([]byte, error) {
+	if res.Uncompressed || !strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		return body, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return readBody(zr)
+}
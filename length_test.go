@@ -0,0 +1,85 @@
+package devcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// gzipUpstream gzips body for clients accepting it, declaring the compressed
+// length as upstreams do.
+func gzipUpstream(t testing.TB, body string) *httptest.Server {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(body))
+	gz.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Write([]byte(body))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.Write(buf.Bytes())
+	}))
+	t.Cleanup(up.Close)
+	return up
+}
+
+func TestGzipContentLength(t *testing.T) {
+	body := strings.Repeat("a compressible body ", 100)
+	for _, tt := range []struct {
+		name   string
+		header http.Header
+	}{
+		// the transport asks for gzip itself and decompresses the body
+		{"auto-decompressed", nil},
+		// the client asked for gzip, so the body is decoded by devcache
+		{"client accepts gzip", http.Header{"Accept-Encoding": {"gzip"}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, gzipUpstream(t, body).URL)
+			for _, outcome := range []string{"MISS", "HIT"} {
+				w := do(s.Handler(), "GET", "/a", tt.header)
+				if w.Code != http.StatusOK || w.Body.String() != body {
+					t.Fatalf("%s: %d %.40q", outcome, w.Code, w.Body)
+				}
+				if got := w.Header().Get("X-Cache"); got != outcome {
+					t.Errorf("X-Cache %q, want %s", got, outcome)
+				}
+			}
+			if n := Cache.ItemCount(); n != 1 {
+				t.Errorf("%d entries cached", n)
+			}
+		})
+	}
+}
+
+func TestCheckLength(t *testing.T) {
+	for _, tt := range []struct {
+		mode         string
+		declared     int64
+		uncompressed bool
+		want         error
+	}{
+		{lengthStrict, 4, false, nil},
+		{lengthStrict, -1, false, nil},
+		{lengthStrict, 10, false, errTruncated},
+		{lengthStrict, 2, false, errTruncated},
+		{lengthStrict, 10, true, nil},
+		{lengthWarn, 10, false, nil},
+		{lengthOff, 10, false, nil},
+	} {
+		flagLengthCheck = tt.mode
+		res := &http.Response{ContentLength: tt.declared, Uncompressed: tt.uncompressed}
+		if err := checkLength("/a", res, []byte("body")); err != tt.want {
+			t.Errorf("%s with %d declared, uncompressed %v: got %v, want %v", tt.mode, tt.declared, tt.uncompressed, err, tt.want)
+		}
+	}
+	flagLengthCheck = lengthStrict
+}
@@ -0,0 +1,90 @@
+package devcache
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of -log-format.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// jsonLog writes the log as JSON lines with -log-format json. The standard
+// logger writes its lines through it, each becoming a message, and each
+// request handled is written as an accessRecord.
+var jsonLog = &jsonLogWriter{out: os.Stderr}
+
+type jsonLogWriter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// logLine is a line of the standard logger, as written by jsonLog.
+type logLine struct {
+	Time time.Time `json:"time"`
+	Msg  string    `json:"msg"`
+}
+
+// Write writes a line of the standard logger, which writes one per call.
+func (l *jsonLogWriter) Write(p []byte) (int, error) {
+	l.write(logLine{Time: time.Now(), Msg: strings.TrimSuffix(string(p), "\n")})
+	return len(p), nil
+}
+
+func (l *jsonLogWriter) write(v interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	json.NewEncoder(l.out).Encode(v)
+}
+
+// accessRecord describes a handled request in the JSON log. Upstream is the
+// time spent waiting on the upstream, if it was asked.
+type accessRecord struct {
+	Time     time.Time `json:"time"`
+	Msg      string    `json:"msg"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Status   int       `json:"status"`
+	Size     int       `json:"size"`
+	Duration float64   `json:"duration_ms"`
+	Upstream float64   `json:"upstream_ms,omitempty"`
+	Cache    string    `json:"cache,omitempty"`
+	Outcome  string    `json:"outcome,omitempty"`
+	Client   string    `json:"client"`
+}
+
+// logAccess writes the access record of the request summarized by summary.
+func logAccess(summary requestRecord, rec *responseRecorder) {
+	jsonLog.write(accessRecord{
+		Time:     summary.Time,
+		Msg:      "request",
+		Method:   summary.Method,
+		Path:     summary.Path,
+		Status:   summary.Status,
+		Size:     summary.Size,
+		Duration: milliseconds(summary.Duration),
+		Upstream: milliseconds(rec.upstream),
+		Cache:    rec.Header().Get("X-Cache"),
+		Outcome:  summary.Outcome,
+		Client:   summary.Client,
+	})
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// setUpstreamLatency notes how long the request being written to w waited on
+// the upstream, for the access log.
+func setUpstreamLatency(w http.ResponseWriter, d time.Duration) {
+	if rec, ok := w.(*responseRecorder); ok {
+		rec.upstream = d
+	}
+}
@@ -0,0 +1,78 @@
+package devcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestJSONLog(t *testing.T) {
+	var buf bytes.Buffer
+	jsonLog.mu.Lock()
+	out := jsonLog.out
+	jsonLog.out = &buf
+	jsonLog.mu.Unlock()
+	defer func(w io.Writer, flags int) {
+		log.SetOutput(w)
+		log.SetFlags(flags)
+		jsonLog.mu.Lock()
+		jsonLog.out = out
+		jsonLog.mu.Unlock()
+	}(log.Writer(), log.Flags())
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("body"))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL, "-log-format", "json")
+	do(s.Handler(), "GET", "/a?x=1", nil)
+	do(s.Handler(), "GET", "/a?x=1", nil)
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// every line is JSON, the standard logger's included
+	var requests []accessRecord
+	jsonLog.mu.Lock()
+	defer jsonLog.mu.Unlock()
+	lines := bufio.NewScanner(&buf)
+	for lines.Scan() {
+		var rec accessRecord
+		if err := json.Unmarshal(lines.Bytes(), &rec); err != nil || rec.Msg == "" || rec.Time.IsZero() {
+			t.Errorf("line %s: %v", lines.Bytes(), err)
+			continue
+		}
+		if rec.Msg == "request" {
+			requests = append(requests, rec)
+		}
+	}
+	if len(requests) != 2 {
+		t.Fatalf("%d access records, want 2", len(requests))
+	}
+	for i, want := range []struct {
+		cache    string
+		upstream bool
+	}{
+		{"MISS", true},
+		{"HIT", false},
+	} {
+		rec := requests[i]
+		if rec.Method != "GET" || rec.Path != "/a?x=1" || rec.Status != http.StatusOK || rec.Size != 4 || rec.Cache != want.cache {
+			t.Errorf("request %d: %+v, want GET /a?x=1 200 4 bytes %s", i, rec, want.cache)
+		}
+		if got := rec.Upstream >= 20; got != want.upstream {
+			t.Errorf("request %d: upstream_ms %g", i, rec.Upstream)
+		}
+		if rec.Duration < rec.Upstream {
+			t.Errorf("request %d: duration_ms %g shorter than upstream_ms %g", i, rec.Duration, rec.Upstream)
+		}
+	}
+}
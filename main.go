@@ -1,60 +1,461 @@
-package main
+package devcache
 
 import (
+	"bytes"
 	"context"
-	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	cache "github.com/patrickmn/go-cache"
+	"github.com/travis-g/devcache/httpcache"
 )
 
 var (
 	// Cache is the server-wide cache of previous requests.
 	Cache *cache.Cache
 
-	flagURL  string
-	flagTTL  time.Duration
-	flagAddr string
+	// flagSet holds the flags below, as parsed by New.
+	flagSet *flag.FlagSet
+
+	flagURL         string
+	flagTTL         time.Duration
+	flagAddr        string
+	flagMaxKeyBytes int
+	flagMaxURIBytes int
+	flagCacheDir    string
+	flagWarmFile    string
+	flagMissLogSize int
+	flagMissLogAge  time.Duration
+	flagTagHeader   string
+	flagAdminToken  string
+	flagAdminAddr   string
+	flagTransforms  transformRules
+
+	flagStrictHTTPCache  bool
+	flagVerifyChecksum   bool
+	flagVaryLanguage     bool
+	flagKeyHeaders       headerList
+	flagPathKeyHeaders   keyHeaderRules
+	flagRoutes           routeList
+	flagHotRefetches     int
+	flagHotTTLCap        time.Duration
+	flagRecentSize       int
+	flagSniffContentType bool
+	flagDebug            bool
+
+	flagUpstreamMaxIdleConns     int
+	flagUpstreamMaxIdlePerHost   int
+	flagUpstreamIdleTimeout      time.Duration
+	flagUpstreamDisableKeepAlive bool
+	flagUpstreamBandwidth        byteSize
+
+	flagServeStale bool
+	flagStaleMax   time.Duration
+	flagExpireAt   expirySchedule
+
+	flagDisableUpstream   bool
+	flagOffline           bool
+	flagOfflineStatus     int
+	flagRecord            bool
+	flagLogFormat         string
+	flagShutdownTimeout   time.Duration
+	flagCacheFile         string
+	flagStore             string
+	flagBackend           string
+	flagRedisAddr         string
+	flagRedisPassword     string
+	flagRedisPrefix       string
+	flagSnapshotInterval  time.Duration
+	flagMaintenanceBody   string
+	flagMaintenanceStatus int
+
+	flagStoreVerify          string
+	flagStorePrimary         string
+	flagStoreVerifySample    float64
+	flagStoreVerifyTolerance time.Duration
+
+	flagAssertRecorded bool
+	flagAssertAllow    patternList
+	flagAssertReport   string
+
+	flagUpstreams      upstreamSet
+	flagUpstreamHeader string
+
+	flagReplayOriginalMetadata bool
+	flagOriginalHeaders        headerList
+	flagFetchBudget            time.Duration
+	flagPersistCompress        compression
+	flagSizeBudgets            sizeBudgets
+	flagSizeBudgetHeader       bool
+	flagStripQueryUpstream     bool
+	flagStripPrefix            string
+	flagTrustForwarded         bool
+	flagRetries                int
+	flagRetryBackoff           time.Duration
+	flagRetryStatus            statusRanges
+	flagProfileFile            string
+	flagBackgroundLoad         bool
+	flagDisableKeepAlive       bool
+	flagIdleTimeout            time.Duration
+	flagKeyTransforms          keyTransforms
+	flagSortQuery              bool
+	flagIgnoreParams           paramList
+	flagRangeCache             string
+	flagBackgroundWorkers      int
+	flagBackgroundQueue        int
+	flagHealthWindow           time.Duration
+	flagHealthDegradedRate     float64
+	flagHealthDownRate         float64
+	flagHealthDegradedP95      time.Duration
+	flagHealthHeader           bool
+	flagCompressCache          bool
+	flagCompressThreshold      byteSize
+	flagCanonicalJSON          patternList
+	flagRequireFreshness       bool
+	flagViaPseudonym           string
+	flagSeed                   int64
+	flagCacheAuthenticated     bool
+	flagStaleWarnings          bool
+	flagListenFamily           string
+	flagCleanPath              bool
+	flagMaxConns               int
+	flagBodyKey                string
+	flagMemoryLimit            memoryLimit
+	flagMemoryHigh             float64
+	flagMemoryLow              float64
+	flagMemoryInterval         time.Duration
+	flagUpstreamPingInterval   time.Duration
+	flagUpstreamPingPath       string
+	flagStableFixtures         bool
+	flagVolatileHeaders        headerList
+	flagScrub                  scrubRules
+	flagLengthCheck            string
+	flagCoalesceWindow         time.Duration
+	flagBypassToken            string
+	flagUpstreamPath           string
+	flagReadOnly               bool
+	flagFsckInterval           time.Duration
+	flagFsckReport             string
+	flagTenantHeader           string
+	flagTenantBasicAuth        bool
+	flagTenantRequired         bool
+	flagTenantMaxBytes         byteSize
+	flagTenantTokens           tenantTokens
+	flagCacheMethods           methodList
+	flagConfig                 string
+	flagHonorCacheControl      bool
+	flagHonorVary              bool
+	flagStaleWhileRevalidate   time.Duration
+	flagUpstreamIPFamily       string
+	flagMirrorURL              string
+	flagMirrorSample           float64
+	flagMirrorPaths            patternList
+	flagMirrorBodyLimit        byteSize
+	flagMirrorRedact           headerList
+	flagMirrorRedactParams     headerList
 )
 
+// subcommands are run instead of the server when named as the first argument.
+var subcommands = map[string]func(args []string) error{
+	"fsck":   runFsck,
+	"misses": runMisses,
+	"rekey":  runRekey,
+	"sync":   runSync,
+	"verify": runVerify,
+}
+
 type server struct {
 	router *mux.Router
+	// admin routes devcache's own endpoints. It's router itself unless admin
+	// traffic is served on a separate listener.
+	admin *mux.Router
+	// VaryFunc, if set, computes a fingerprint of each proxied request that
+	// becomes part of its cache key, so requests it tells apart are cached
+	// separately. It's for variation rules that no single header captures.
+	VaryFunc func(*http.Request) string
 }
 
 // handleRequest simply pulls the path from the request out of the Cache. This
 // handler is run after the caching middleware, so if somehow what we're looking
 // for isn't cached there's been an internal issue.
 func handleRequest(w http.ResponseWriter, r *http.Request) {
-	response, found := Cache.Get(r.RequestURI)
+	k, ok := r.Context().Value(requestKeyCtx{}).(requestKey)
+	if !ok {
+		k = keyFor(r)
+	}
+	response, found := Cache.Get(k.String())
 	if !found {
 		http.Error(w, "resource not found in cache", http.StatusInternalServerError)
 		return
 	}
-	w.Write(response.([]byte))
-	return
+	e, ok := toEntry(response)
+	if !ok {
+		http.Error(w, "invalid cache entry", http.StatusInternalServerError)
+		return
+	}
+	serveEntry(w, r, e)
 }
 
-// trims and formats excess spacing of JSON bodies
+// serveEntry writes the cached entry e in response to r.
+func serveEntry(w http.ResponseWriter, r *http.Request, e *entry) {
+	atomic.AddInt64(&e.hits, 1)
+	touchSession(e)
+	if flagStrictHTTPCache {
+		for _, warning := range httpcache.Warnings(e.Freshness, time.Since(e.Stored), false) {
+			w.Header().Add("Warning", warning)
+		}
+	}
+	e.writeHeader(w.Header())
+	if !e.Stored.IsZero() {
+		w.Header().Set("Age", strconv.Itoa(int(time.Since(e.Stored).Seconds())))
+	}
+	if flagReplayOriginalMetadata {
+		e.writeOriginalMetadata(w.Header())
+	}
+	restorePrefix(w.Header(), r)
+	if rule := flagSizeBudgets.match(e.URL); flagSizeBudgetHeader && rule.exceeded(e.size()) {
+		w.Header().Set("X-Devcache-Over-Budget", rule.header(e.size()))
+	}
+	e = e.served()
+	if e.ContentType != "" {
+		w.Header().Set("Content-Type", e.ContentType)
+	}
+	etag := e.etag()
+	w.Header().Set("ETag", etag)
+	if flagRangeCache == rangeFull && r.Header.Get("Range") != "" && e.status() == http.StatusOK {
+		serveRange(w, r, e)
+		return
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" && e.status() == http.StatusOK && etagMatch(inm, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(e.status())
+	w.Write(e.Body)
+}
+
+// trims and formats excess spacing of JSON bodies. Anything JSON may hold is
+// kept as it was sent, including top-level arrays, key order and numbers.
 func jsonMinify(data *[]byte) error {
-	tmp := map[string]interface{}{}
-	err := json.Unmarshal(*data, &tmp)
-	if err != nil {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := json.Compact(buf, *data); err != nil {
 		return err
 	}
-	min, err := json.Marshal(tmp)
+	*data = append([]byte(nil), buf.Bytes()...)
+	return nil
+}
+
+// fetch retrieves path from the upstream, forwarding header, and caches the
+// response under k, recording source as how it came to be cached. The fetched
+// entry is returned even if it couldn't be cached, along with the error.
+func fetch(k requestKey, path string, header http.Header, source string) (*entry, error) {
+	if !upstreamEnabled() {
+		return nil, errUpstreamDisabled
+	}
+	method := http.MethodGet
+	if k.hasMethod() {
+		method = k.method
+	}
+	req, err := newUpstreamRequest(method, path, header, k.body)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if flagRangeCache != "" {
+		// ranges are served from the full body
+		req.Header.Del("Range")
+		req.Header.Del("If-Range")
+	}
+
+	start := time.Now()
+	res, err := doWithRetry(traceConns(req))
+	if err != nil {
+		atomic.AddInt64(&stats.UpstreamErrors, 1)
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := readBody(bandwidth.reader(res.Body))
+	atomic.AddInt64(&stats.UpstreamBytes, int64(len(body)))
+	if err != nil {
+		atomic.AddInt64(&stats.UpstreamErrors, 1)
+		return nil, err
+	}
+	if err := checkLength(path, res, body); err != nil {
+		atomic.AddInt64(&stats.UpstreamErrors, 1)
+		return nil, err
+	}
+	if body, err = decodeBody(res, body); err != nil {
+		atomic.AddInt64(&stats.UpstreamErrors, 1)
+		return nil, err
+	}
+	if res.StatusCode >= 500 && staleServable(k) {
+		// keep the entry rather than replace it with the error
+		atomic.AddInt64(&stats.UpstreamErrors, 1)
+		log.Printf("upstream responded %s for %s", res.Status, path)
+		return nil, errServerError
+	}
+	e := &entry{
+		URL:           path,
+		Source:        source,
+		Status:        res.StatusCode,
+		ContentType:   res.Header.Get("Content-Type"),
+		Header:        storedHeader(res.Header),
+		Stored:        time.Now(),
+		FetchDuration: time.Since(start),
+	}
+	if k.hasMethod() {
+		e.Method = method
+	}
+	e.OriginalHeaders = http.Header{}
+	for _, name := range append(headerList{"Date"}, flagOriginalHeaders...) {
+		for _, v := range res.Header.Values(name) {
+			e.OriginalHeaders.Add(name, v)
+		}
+	}
+	if grace, ok := httpcache.ParseCacheControl(res.Header).Seconds("stale-if-error"); ok {
+		e.StaleIfError = grace
+	}
+	if window, ok := httpcache.ParseCacheControl(res.Header).Seconds("stale-while-revalidate"); ok {
+		e.StaleWhileRevalidate = window
+	}
+	if flagSniffContentType {
+		e.ContentType, e.SniffedType = correctContentType(path, e.ContentType, body)
+	}
+	// trim out excess content/whitespace, etc. before saving
+	in := e.transformInput()
+	e.Body, _ = flagTransforms.apply(stageRecord, &in, body)
+	e.ContentType = in.contentType
+	e.Checksum = checksum(e.Body)
+	checkSizeBudget(path, len(e.Body))
+	if flagTagHeader != "" {
+		e.Tags = parseTags(res.Header.Get(flagTagHeader))
+	}
+	// methods opted in by -cache-methods are cached as GETs would be
+	e.Freshness = httpcache.Decide(
+		httpcache.Request{Method: http.MethodGet, Header: header},
+		httpcache.Response{Status: res.StatusCode, Header: res.Header, Time: e.Stored},
+		flagStrictHTTPCache, flagTTL)
+	if flagHonorCacheControl && !flagStrictHTTPCache {
+		e.Freshness = httpcache.Honor(httpcache.Response{Status: res.StatusCode, Header: res.Header, Time: e.Stored})
+	}
+	if flagRequireFreshness && !httpcache.Explicit(res.Header) {
+		e.Freshness = httpcache.Decision{}
+	}
+	// a shared cache mustn't serve one client's authorized response to
+	// another, RFC 7234 §3.2
+	if !flagCacheAuthenticated && header.Get("Authorization") != "" && flagRoutes.match(path).sharesCredentialed() &&
+		!httpcache.ParseCacheControl(res.Header).Has("public") {
+		e.Freshness = httpcache.Decision{}
+	}
+	if flagHonorVary && k.base != "" {
+		names, all := varyNames(res.Header)
+		if all {
+			// Vary: * matches no other request, RFC 7234 §4.1
+			e.Freshness = httpcache.Decision{}
+		} else if !sameNames(names, k.vary) {
+			varies.set(k.base, names)
+			k = k.withVariant(names, header)
+		}
+	}
+	if !e.Freshness.Store {
+		log.Printf("not caching uncacheable response from %s\n", req.URL)
+		return e, errUncacheable
+	}
+	log.Printf("caching data from %s\n", req.URL)
+	return e, storeEntry(k, e)
+}
+
+// newUpstreamRequest returns a request for path to its upstream, forwarding
+// header.
+func newUpstreamRequest(method, path string, header http.Header, body []byte) (*http.Request, error) {
+	rt := flagRoutes.match(path)
+	target := path
+	if flagStripQueryUpstream {
+		// the query only distinguishes cache keys
+		if i := strings.IndexByte(target, '?'); i >= 0 {
+			target = target[:i]
+		}
+	}
+	u, err := upstreamURL(upstreamFor(rt, header), target)
+	if err != nil {
+		return nil, err
+	}
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	// forward the headers
+	req.Header = header.Clone()
+	removeHopHeaders(req.Header)
+	rt.applyAuth(req.Header)
+	if flagUpstreamHeader != "" {
+		req.Header.Del(flagUpstreamHeader)
+	}
+	req.Header.Del(bypassHeader)
+	if flagTenantHeader != "" {
+		req.Header.Del(flagTenantHeader)
+	}
+	// conditional requests are answered from the cache, the upstream must
+	// always send the full body
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+	if flagViaPseudonym != "" {
+		req.Header.Add("Via", via())
+	}
+	return req, nil
+}
+
+// errBudgetExceeded is returned by fetchWithin when the upstream didn't
+// respond within the budget.
+var errBudgetExceeded = errors.New("fetch budget exceeded")
+
+// fetchWithin is fetch, but gives up waiting after budget while the fetch
+// carries on in the background to refresh the cache. A zero budget waits for
+// as long as the fetch takes.
+func fetchWithin(k requestKey, path string, header http.Header, source string, budget time.Duration) (*entry, error) {
+	if budget <= 0 {
+		return fetch(k, path, header, source)
+	}
+	type result struct {
+		e   *entry
+		err error
+	}
+	done := make(chan result, 1)
+	header = header.Clone()
+	refresh := func() {
+		e, err := fetch(k, path, header, source)
+		done <- result{e, err}
+	}
+	if !background.submit(taskRefresh, refresh, false) {
+		// no room to finish the fetch in the background
+		return fetch(k, path, header, source)
+	}
+	timer := time.NewTimer(budget)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.e, res.err
+	case <-timer.C:
+		return nil, errBudgetExceeded
 	}
-	*data = min
-	return nil
 }
 
 // cachingMiddleware checks to see if the desired request is present in the
@@ -62,108 +463,590 @@ func jsonMinify(data *[]byte) error {
 func cachingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		path := r.RequestURI
-		_, found := Cache.Get(path)
-		if !found {
-			log.Printf("path %s not cached! forwarding headers and fetching\n", path)
-			req, err := http.NewRequest("GET", flagURL+path, nil)
+		if flagMaxURIBytes > 0 && len(path) > flagMaxURIBytes {
+			setOutcome(w, outcomeRejected)
+			http.Error(w, http.StatusText(http.StatusRequestURITooLong), http.StatusRequestURITooLong)
+			return
+		}
+		if rt := flagRoutes.match(path); rt != nil && rt.auth == authRequire && r.Header.Get("Authorization") == "" {
+			setOutcome(w, outcomeRejected)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if name, ok := selectedUpstream(r.Header); !ok {
+			setOutcome(w, outcomeRejected)
+			http.Error(w, "unknown upstream "+name, http.StatusBadRequest)
+			return
+		}
+		if bypassed(r) && upstreamEnabled() {
+			serveBypass(w, r)
+			return
+		}
+		if !cachedMethod(r.Method) {
+			serveUncachedMethod(w, r)
+			return
+		}
+		k := keyFor(r)
+		if k.hasMethod() {
+			body, err := readBody(r.Body)
 			if err != nil {
-				panic(err)
+				setOutcome(w, outcomeRejected)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
-			// forward the headers
-			req.Header = r.Header
-
-			Client := &http.Client{
-				Timeout: time.Second * 10,
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			k = k.withBody(body)
+			// handleRequest can't read the body again to find the key
+			r = r.WithContext(context.WithValue(r.Context(), requestKeyCtx{}, k))
+		}
+		if flagRangeCache == rangePartial && r.Header.Get("Range") != "" && upstreamEnabled() && !cacheReadOnly() && servePartial(w, r, k) {
+			return
+		}
+		if canonical := canonicalURI(path); canonical != path {
+			debugf("key for %s canonicalized to %s", path, k)
+			if flagDebug {
+				w.Header().Set("X-Devcache-Original-Key", path)
+				w.Header().Set("X-Devcache-Key", k.String())
 			}
-			res, err := Client.Do(req)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				log.Printf("%v\n", err)
+		}
+		cached, found := lookup(k)
+		if cacheReadOnly() && (found || !assertRecorded(path)) {
+			serveReadOnly(w, r, cached, found)
+			return
+		}
+		if replayOnly := assertRecorded(path); replayOnly || !upstreamEnabled() {
+			switch {
+			case !found && replayOnly:
+				failUnrecorded(w, r)
+			case !found:
+				setOutcome(w, outcomeRejected)
+				setHealthHeader(w, r)
+				serveMaintenance(w, r)
+			case cached.fresh(time.Now()):
+				atomic.AddInt64(&stats.Hits, 1)
+				setOutcome(w, outcomeHit)
+				serveEntry(w, r, cached)
+			default:
+				serveStale(w, r, cached, false, errNotRefreshed)
+			}
+			return
+		}
+		if found && !flagRecord && !cached.fresh(time.Now()) && time.Since(cached.Expires) <= cached.revalidateWindow() {
+			serveWhileRevalidating(w, r, cached, k, path)
+			return
+		}
+		if !found || !cached.fresh(time.Now()) || flagRecord {
+			log.Printf("path %s not cached! forwarding headers and fetching\n", path)
+			atomic.AddInt64(&stats.Misses, 1)
+			source, budget := sourceOrganic, time.Duration(0)
+			if found {
+				source, budget = sourceRefresh, flagFetchBudget
+			}
+			if flagRecord {
+				// wait for the new recording rather than serve the old one
+				budget = 0
+			}
+			start := time.Now()
+			fetchKey := func(k requestKey) (*entry, error) {
+				return flights.do(k.String(), func() (*entry, error) {
+					return fetchWithin(k, path, r.Header, source, budget)
+				})
+			}
+			e, err := fetchKey(k)
+			if vk, ok := k.variantOf(e, r.Header); ok && err == nil {
+				// the response was the first to set Vary, and requests it
+				// was shared with may select other variants
+				k = vk
+				if v, ok := lookup(k); ok {
+					e = v
+				} else {
+					e, err = fetchKey(k)
+				}
+			}
+			misses.record(path, time.Since(start))
+			setUpstreamLatency(w, time.Since(start))
+			if err == errBudgetExceeded && found {
+				serveStale(w, r, cached, false, err)
+				return
+			}
+			if err == errUnsafeKey || err == errUncacheable {
+				// serve the response without caching it
+				setOutcome(w, outcomeUncached)
+				e = e.served()
+				e.writeHeader(w.Header())
+				restorePrefix(w.Header(), r)
+				if e.ContentType != "" {
+					w.Header().Set("Content-Type", e.ContentType)
+				}
+				w.WriteHeader(e.status())
+				w.Write(e.Body)
 				return
 			}
-			body, err := ioutil.ReadAll(res.Body)
+			if err != nil && found {
+				if grace, origin := cached.staleGrace(); time.Since(cached.Expires) <= grace {
+					serveStale(w, r, cached, origin, err)
+					return
+				}
+			}
 			if err != nil {
+				setOutcome(w, outcomeError)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				log.Printf("%v\n", err)
 				return
 			}
-			// trim out excess content/whitespace before saving
-			jsonMinify(&body)
-
-			log.Printf("caching data from %s\n", req.URL)
-			Cache.Set(path, body, cache.DefaultExpiration)
-		} else {
-			log.Printf("data present in cache for %s\n", path)
+			// serve what was fetched, as it may have been cached under a
+			// variant of k
+			setOutcome(w, outcomeMiss)
+			serveEntry(w, r, e)
+			return
 		}
+		atomic.AddInt64(&stats.Hits, 1)
+		setOutcome(w, outcomeHit)
+		log.Printf("data present in cache for %s\n", k)
 		next.ServeHTTP(w, r)
 	})
 }
 
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s\n", r.Method, r.RequestURI)
-		next.ServeHTTP(w, r)
-	})
+// errServerError is returned by fetch when the upstream responds with a server
+// error while an earlier response may still be served stale.
+var errServerError = errors.New("upstream server error")
+
+// staleServable reports whether the entry cached under k may still be served
+// stale if refreshing it fails. Entries that are themselves server errors
+// aren't worth keeping over a new one.
+func staleServable(k requestKey) bool {
+	e, found := lookup(k)
+	if !found || e.status() >= 500 {
+		return false
+	}
+	grace, _ := e.staleGrace()
+	return time.Since(e.Expires) <= grace
 }
 
-func readCache(filePath string, cache *map[string]cache.Item) error {
-	file, err := os.Open(filePath)
-	if err == nil {
-		decoder := gob.NewDecoder(file)
-		err = decoder.Decode(cache)
+// serveStale serves the expired entry e because refreshing it failed with
+// err. origin is set if the upstream allowed this with stale-if-error.
+func serveStale(w http.ResponseWriter, r *http.Request, e *entry, origin bool, err error) {
+	if origin {
+		atomic.AddInt64(&stats.StaleIfError, 1)
+		setOutcome(w, outcomeStaleIfError)
+	} else {
+		atomic.AddInt64(&stats.Stale, 1)
+		setOutcome(w, outcomeStale)
+	}
+	log.Printf("serving stale %s after upstream error: %v\n", e.URL, err)
+	if flagStaleWarnings {
+		w.Header().Add("Warning", httpcache.WarningStale)
+		if err != errBudgetExceeded && err != errNotRefreshed {
+			// the refresh was attempted and failed
+			w.Header().Add("Warning", httpcache.WarningRevalidationFailed)
+		}
 	}
-	file.Close()
-	return err
+	setHealthHeader(w, r)
+	serveEntry(w, r, e)
 }
 
-func writeCache(filePath string, cache map[string]cache.Item) error {
-	file, err := os.Create(filePath)
-	if err == nil {
-		encoder := gob.NewEncoder(file)
-		encoder.Encode(cache)
+// debugf logs only when -debug is set.
+func debugf(format string, v ...interface{}) {
+	if flagDebug {
+		log.Printf(format, v...)
 	}
-	file.Close()
-	return err
 }
 
-func main() {
-	flag.StringVar(&flagURL, "url", "http://localhost:8080/", "url to proxy requests against")
-	flag.DurationVar(&flagTTL, "ttl", 24*time.Hour, "duration to cache requests for")
-	flag.StringVar(&flagAddr, "addr", ":8000", "address/port to configure the server")
-	flag.Parse()
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if flagLogFormat != logFormatJSON {
+			log.Printf("%s %s\n", r.Method, r.RequestURI)
+		}
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		mirrorThis := mirrored(r.RequestURI)
+		if mirrorThis {
+			rec.bodyLimit = int(flagMirrorBodyLimit)
+		}
+		next.ServeHTTP(rec, r)
+		summary := requestRecord{
+			Time:     start,
+			Method:   r.Method,
+			Path:     r.RequestURI,
+			Outcome:  rec.outcome,
+			Status:   rec.status,
+			Duration: time.Since(start),
+			Size:     rec.size,
+			Client:   r.RemoteAddr,
+		}
+		recent.add(summary)
+		if flagLogFormat == logFormatJSON {
+			logAccess(summary, rec)
+		}
+		if mirrorThis {
+			mirror(r, rec, summary)
+		}
+	})
+}
 
-	items := new(map[string]cache.Item)
-	err := readCache("./cache.gob", items)
-	if err == nil {
-		Cache = cache.NewFrom(flagTTL, flagTTL, *items)
-		log.Printf("loaded cache (%d items)", Cache.ItemCount())
-	} else {
-		log.Printf("error loading cache: %s", err)
-		Cache = cache.New(flagTTL, flagTTL)
+// Main runs the devcache command: the subcommand named by the first argument,
+// or else the server until it's sent SIGINT or SIGTERM. SIGHUP saves the
+// cache.
+func Main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+	s, err := New(Config{Args: os.Args[1:]})
+	switch {
+	case err == flag.ErrHelp:
+		os.Exit(0)
+	case err != nil:
+		log.Print(err)
+		os.Exit(2)
+	}
+	if err := s.Start(); err != nil {
+		log.Fatal(err)
 	}
 
-	handler := http.HandlerFunc(handleRequest)
-	http.Handle("/", loggingMiddleware(cachingMiddleware(handler)))
-
-	go func() {
-		if err := http.ListenAndServe(flagAddr, nil); err != nil {
-			log.Println(err)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range c {
+		if sig != syscall.SIGHUP {
+			break
 		}
+		log.Printf("SIGHUP received, saving the cache")
+		snapshotCache()
+	}
+	log.Printf("shutting down, waiting up to %s for requests in flight", flagShutdownTimeout)
+	go func() {
+		<-c
+		log.Println("interrupted again, exiting without saving the cache")
+		os.Exit(1)
 	}()
+	ctx, cancel := context.WithTimeout(context.Background(), flagShutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
 
-	log.Printf("server listening on %s, forwarding to %s", flagAddr, flagURL)
+// registerFlags registers every setting of the server on fs.
+func registerFlags(fs *flag.FlagSet) {
+	// flags registered with Var keep their value from an earlier New, so
+	// they're reset to their defaults first
+	flagTransforms, flagRoutes, flagUpstreams = nil, nil, nil
+	flagKeyHeaders, flagOriginalHeaders = nil, nil
+	flagAssertAllow, flagCanonicalJSON, flagMirrorPaths = nil, nil, nil
+	flagSizeBudgets, flagRetryStatus, flagKeyTransforms = nil, nil, nil
+	flagScrub, flagCacheMethods, flagIgnoreParams, flagPathKeyHeaders = nil, nil, nil, nil
+	flagExpireAt, flagMemoryLimit = expirySchedule{}, memoryLimit{}
+	flagPersistCompress = compressNone
+	flagUpstreamBandwidth, flagMirrorBodyLimit, flagTenantMaxBytes = 0, 0, 0
+	flagTenantTokens = nil
+	flagCompressThreshold = 1 << 10
+	flagVolatileHeaders = headerList{"Date", "Age", "X-Request-Id", "X-Ratelimit-*", "Set-Cookie"}
+	flagMirrorRedact = headerList{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization", "X-Devcache-Token", bypassHeader}
+	flagMirrorRedactParams = headerList{"token", "access_token", "api_key", "apikey", "key", "password", "secret"}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	fs.StringVar(&flagURL, "url", "http://localhost:8080/", "url to proxy requests against")
+	fs.DurationVar(&flagTTL, "ttl", 24*time.Hour, "duration to cache requests for")
+	fs.StringVar(&flagAddr, "addr", ":8000", "address/port to configure the server")
+	fs.IntVar(&flagMaxKeyBytes, "max-key-bytes", 2048, "longest cache key before the overflow is replaced by a digest (0 to disable)")
+	fs.IntVar(&flagMaxURIBytes, "max-uri-bytes", 16384, "reject request URIs longer than this with 414 (0 to disable)")
+	fs.StringVar(&flagBackend, "backend", backendMemory, "where entries are cached: memory, or redis to also share them through -redis-addr")
+	fs.StringVar(&flagRedisAddr, "redis-addr", "localhost:6379", "address of the Redis server shared with -backend redis")
+	fs.StringVar(&flagRedisPassword, "redis-password", "", "password of the -redis-addr server")
+	fs.StringVar(&flagRedisPrefix, "redis-prefix", "devcache:", "prefix of the keys written to Redis")
+	fs.StringVar(&flagStore, "store", storeGob, "format the cache is saved in: gob, json for a file of JSON lines, bolt for a BoltDB database or sqlite for a SQLite database")
+	fs.StringVar(&flagStoreVerify, "store-verify", "", "write entries to both of the backends old,new, each memory, redis, bolt:PATH or sqlite:PATH, and compare what they hold for a sample of lookups")
+	fs.StringVar(&flagStorePrimary, "store-primary", "old", "which -store-verify backend answers misses in memory: old or new (also -store primary=new)")
+	fs.Float64Var(&flagStoreVerifySample, "store-verify-sample", 0.1, "fraction of lookups whose entries the -store-verify backends are compared for")
+	fs.DurationVar(&flagStoreVerifyTolerance, "store-verify-tolerance", time.Second, "largest difference between the expiries of an entry in the -store-verify backends that isn't a divergence")
+	fs.StringVar(&flagCacheFile, "cache-file", "", "file the cache is loaded from and saved to (default ./cache.gob, or ./cache.jsonl, ./cache.db or ./cache.sqlite with -store json, bolt or sqlite)")
+	fs.DurationVar(&flagSnapshotInterval, "snapshot-interval", 0, "also save the cache this often, and on SIGHUP, rather than only on shutdown (0 to disable the timer)")
+	fs.StringVar(&flagCacheDir, "cache-dir", "", "persist the cache as one JSON file per entry in this directory instead of -cache-file")
+	fs.StringVar(&flagWarmFile, "warm-file", "", "file listing request URIs to fetch into the cache at startup, each optionally followed by a priority (1 first)")
+	fs.IntVar(&flagMissLogSize, "miss-log-size", 1000, "number of distinct missed paths to remember for the miss report")
+	fs.DurationVar(&flagMissLogAge, "miss-log-age", 24*time.Hour, "forget missed paths not seen for this long")
+	fs.StringVar(&flagTagHeader, "tag-header", "X-Cache-Tags", "upstream response header listing the tags of an entry")
+	fs.StringVar(&flagAdminToken, "admin-token", "", "token required to use the admin endpoints")
+	fs.StringVar(&flagAdminAddr, "admin-addr", "", "serve the admin endpoints on this address instead of alongside the proxy")
+	fs.Var(&flagTransforms, "transform", "body transform to apply, in order, as name[=statuses] where name is minify, canonical-json or error-envelope (repeatable; default minify)")
+	fs.BoolVar(&flagStrictHTTPCache, "strict-http-cache", false, "only cache responses as allowed for a shared cache by RFC 7234")
+	fs.BoolVar(&flagVerifyChecksum, "verify-checksum", false, "verify the checksum of cached bodies each time they're served")
+	fs.BoolVar(&flagVaryLanguage, "vary-language", false, "cache responses separately per primary Accept-Language tag")
+	fs.Var(&flagKeyHeaders, "key-headers", "comma-separated request headers, such as X-Api-Version, whose values are part of the cache key; credentials such as Authorization are keyed by a digest")
+	fs.Var(&flagPathKeyHeaders, "path-key-headers", "key requests for paths matching a glob or prefix by request headers too, as `PATTERN=HEADER[,HEADER...]` (repeatable)")
+	fs.Var(&flagRoutes, "route", "send paths under a prefix to another upstream, as PREFIX=URL[;auth=MODE] (repeatable)")
+	fs.IntVar(&flagHotRefetches, "hot-refetches", 0, "extend the TTL of keys refetched more than this many times within their TTL (0 to disable)")
+	fs.DurationVar(&flagHotTTLCap, "hot-ttl-cap", time.Hour, "longest TTL a hot key can be extended to")
+	fs.IntVar(&flagRecentSize, "recent-size", 1000, "number of recent requests kept for the recent and tail endpoints")
+	fs.BoolVar(&flagSniffContentType, "sniff-content-type", false, "sniff the content type of responses declared with a missing or generic type")
+	fs.BoolVar(&flagDebug, "debug", false, "enable debug logging")
+	fs.IntVar(&flagUpstreamMaxIdleConns, "upstream-max-idle-conns", 100, "maximum idle connections kept to all upstreams")
+	fs.IntVar(&flagUpstreamMaxIdlePerHost, "upstream-max-idle-per-host", 16, "maximum idle connections kept to each upstream host")
+	fs.DurationVar(&flagUpstreamIdleTimeout, "upstream-idle-timeout", 90*time.Second, "how long idle upstream connections are kept")
+	fs.BoolVar(&flagUpstreamDisableKeepAlive, "upstream-disable-keepalive", false, "use a new upstream connection for every request")
+	fs.Var(&flagUpstreamBandwidth, "upstream-bandwidth", "soft cap on the combined rate upstream bodies are read at, per second (e.g. 1MB; 0 for none)")
+	fs.BoolVar(&flagServeStale, "serve-stale", false, "serve expired entries when refreshing them fails")
+	fs.DurationVar(&flagStaleMax, "stale-max", 24*time.Hour, "how long past expiry entries may be served with -serve-stale")
+	fs.Var(&flagExpireAt, "expire-at", "expire entries at these UTC times of day instead of after -ttl, e.g. 00:00,12:00, @daily or @hourly")
+	fs.BoolVar(&flagDisableUpstream, "disable-upstream", false, "start with the upstream disabled, serving only what's cached")
+	fs.BoolVar(&flagOffline, "offline", false, "never contact the upstream: serve only what's cached, answering and logging misses with -offline-status")
+	fs.IntVar(&flagOfflineStatus, "offline-status", http.StatusGatewayTimeout, "status served for misses with -offline")
+	fs.DurationVar(&flagShutdownTimeout, "shutdown-timeout", 5*time.Second, "how long to wait on SIGINT or SIGTERM for requests and background fetches in flight before saving the cache")
+	fs.StringVar(&flagLogFormat, "log-format", logFormatText, "format of the log: text, or json for JSON lines with an access record per request")
+	fs.BoolVar(&flagRecord, "record", false, "fetch every request from the upstream, replacing its cached entry, to re-record the cache")
+	fs.StringVar(&flagMaintenanceBody, "maintenance-body", "", "file served for misses while the upstream is disabled")
+	fs.IntVar(&flagMaintenanceStatus, "maintenance-status", http.StatusServiceUnavailable, "status served for misses while the upstream is disabled")
+	fs.BoolVar(&flagAssertRecorded, "assert-recorded", false, "fail requests that aren't cached instead of fetching them, and exit nonzero if any occurred")
+	fs.Var(&flagAssertAllow, "assert-allow", "path glob or prefix exempt from -assert-recorded (repeatable)")
+	fs.StringVar(&flagAssertReport, "assert-report", "missing-requests.jsonl", "file unexpected requests are appended to with -assert-recorded")
+	fs.Var(&flagUpstreams, "upstream", "named upstream requests can select with -upstream-header, as NAME=URL (repeatable)")
+	fs.StringVar(&flagUpstreamHeader, "upstream-header", "X-Upstream", "request header naming the upstream to use instead of the routed one")
+	fs.BoolVar(&flagReplayOriginalMetadata, "replay-original-metadata", false, "add the original fetch's duration, date and -original-headers to served responses")
+	flagOriginalHeaders = headerList{"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"}
+	fs.Var(&flagOriginalHeaders, "original-headers", "comma-separated upstream headers recorded with each entry for -replay-original-metadata")
+	fs.DurationVar(&flagFetchBudget, "fetch-budget", 0, "serve an expired entry if refreshing it takes longer than this, finishing the refresh in the background (0 to always wait)")
+	fs.Var(&flagPersistCompress, "persist-compress", "compression of the saved cache file: none, gzip or zstd")
+	fs.Var(&flagSizeBudgets, "size-budget", "warn about responses larger than a budget, as `PATTERN=SIZE` (repeatable)")
+	fs.BoolVar(&flagSizeBudgetHeader, "size-budget-header", false, "add an X-Devcache-Over-Budget header to responses over their size budget")
+	fs.BoolVar(&flagStripQueryUpstream, "strip-query-upstream", false, "forward requests upstream without their query string, which still distinguishes cache keys")
+	fs.StringVar(&flagStripPrefix, "strip-prefix", "", "path prefix devcache is served under by a proxy in front of it, removed before keying and forwarding")
+	fs.BoolVar(&flagTrustForwarded, "trust-forwarded", false, "strip the path prefix given by the X-Forwarded-Prefix header")
+	fs.IntVar(&flagRetries, "retries", 0, "number of times to retry failed upstream fetches")
+	fs.DurationVar(&flagRetryBackoff, "retry-backoff", 100*time.Millisecond, "wait before the first retry, doubled for each one after")
+	fs.Var(&flagRetryStatus, "retry-status", "upstream statuses that are retried like transport errors, e.g. `502,503`")
+	fs.StringVar(&flagProfileFile, "profile-file", "", "file, such as cache.profile.json, recording which entries are hit most, used to save and load them first (empty to disable)")
+	fs.BoolVar(&flagBackgroundLoad, "background-load", false, "start serving before -cache-file is loaded, loading the hottest entries first")
+	fs.BoolVar(&flagDisableKeepAlive, "disable-keepalive", false, "close every client and upstream connection after one request, for debugging connection reuse")
+	fs.DurationVar(&flagIdleTimeout, "idle-timeout", 2*time.Minute, "how long idle client connections are kept open")
+	fs.Var(&flagKeyTransforms, "key-transform", "canonicalize a query parameter in the cache keys of matching paths, as `PATTERN=OP:PARAM[:ARG]` with OP round or lower (repeatable)")
+	fs.BoolVar(&flagSortQuery, "sort-query", false, "sort the query parameters of cache keys by name, so ?a=1&b=2 and ?b=2&a=1 share an entry")
+	fs.Var(&flagIgnoreParams, "ignore-params", "comma-separated query parameters, such as _ or utm_*, left out of cache keys; a trailing * matches a prefix")
+	fs.StringVar(&flagRangeCache, "range-cache", "", "serve Range requests from the cache: full caches whole bodies, partial only the ranges requested")
+	fs.IntVar(&flagBackgroundWorkers, "background-workers", 4, "number of background tasks (refreshes, warm-up fetches, mirroring) run at once")
+	fs.IntVar(&flagBackgroundQueue, "background-queue", 1000, "number of background tasks of each kind queued before more are dropped")
+	fs.DurationVar(&flagHealthWindow, "health-window", 5*time.Minute, "how far back upstream fetches count towards an upstream's health")
+	fs.Float64Var(&flagHealthDegradedRate, "health-degraded-rate", 0.95, "success rate below which an upstream is degraded")
+	fs.Float64Var(&flagHealthDownRate, "health-down-rate", 0.5, "success rate below which an upstream is down")
+	fs.DurationVar(&flagHealthDegradedP95, "health-degraded-p95", 2*time.Second, "95th percentile latency above which an upstream is degraded (0 to ignore latency)")
+	fs.BoolVar(&flagHealthHeader, "health-header", false, "add an X-Devcache-Upstream-Health header to responses served stale or in place of the upstream")
+	fs.BoolVar(&flagCompressCache, "compress-cache", false, "gzip cached bodies over -compress-threshold, and save the cache file compressed with gzip as with -persist-compress gzip")
+	fs.Var(&flagCompressThreshold, "compress-threshold", "smallest body gzipped in memory by -compress-cache")
+	fs.Var(&flagCanonicalJSON, "canonical-json", "store JSON bodies of paths matching this pattern with their object keys sorted (repeatable)")
+	fs.BoolVar(&flagRequireFreshness, "require-freshness", false, "only cache responses that set their freshness with Cache-Control max-age or Expires")
+	fs.StringVar(&flagMirrorURL, "mirror-url", "", "POST a JSON summary of every handled request to this URL, in the background")
+	fs.Float64Var(&flagMirrorSample, "mirror-sample", 1, "fraction of requests mirrored")
+	fs.Var(&flagMirrorPaths, "mirror-path", "only mirror requests for paths matching this pattern (repeatable)")
+	fs.Var(&flagMirrorBodyLimit, "mirror-body-limit", "include up to this much of each response body in mirrored summaries")
+	fs.Var(&flagMirrorRedact, "mirror-redact", "comma-separated headers whose values are redacted from mirrored summaries")
+	fs.Var(&flagMirrorRedactParams, "mirror-redact-params", "comma-separated query parameters whose values are redacted from mirrored summaries")
+	fs.StringVar(&flagViaPseudonym, "via", "devcache", "pseudonym added to the Via header of forwarded requests and responses (empty to disable)")
+	fs.Int64Var(&flagSeed, "seed", 0, "seed for every randomized decision, to reproduce a run (random if 0)")
+	fs.BoolVar(&flagCacheAuthenticated, "cache-authenticated", false, "cache responses to requests with an Authorization header even if they aren't Cache-Control: public")
+	fs.BoolVar(&flagStaleWarnings, "stale-warnings", true, "add Warning headers to stale responses: 110 always, and 111 if refreshing failed")
+	fs.StringVar(&flagListenFamily, "listen-family", familyAuto, "address family to listen on: auto, ipv4 or ipv6")
+	fs.StringVar(&flagUpstreamIPFamily, "upstream-ip-family", familyAuto, "address family to connect to upstreams over: auto, ipv4 or ipv6")
+	fs.BoolVar(&flagCleanPath, "clean-path", false, "collapse duplicate slashes and dot segments in request paths before keying and forwarding")
+	fs.IntVar(&flagMaxConns, "max-conns", 0, "maximum simultaneous client connections, including idle keep-alive ones; more wait to be accepted (0 for no limit)")
+	fs.StringVar(&flagBodyKey, "body-key", bodyKeyRaw, "how request bodies are digested into cache keys: raw, or json to sort object keys and drop whitespace first")
+	fs.Var(&flagMemoryLimit, "memory-limit", "memory limit to shed cold cache entries under, or auto for the cgroup's limit (unset to disable)")
+	fs.Float64Var(&flagMemoryHigh, "memory-high", 0.9, "fraction of -memory-limit at which cold entries start being shed")
+	fs.Float64Var(&flagMemoryLow, "memory-low", 0.8, "fraction of -memory-limit cold entries are shed down to")
+	fs.DurationVar(&flagMemoryInterval, "memory-interval", 5*time.Second, "how often memory usage is sampled against -memory-limit")
+	fs.DurationVar(&flagUpstreamPingInterval, "upstream-ping-interval", 0, "how often to request -upstream-ping-path from each upstream to keep idle connections open (0 to disable)")
+	fs.StringVar(&flagUpstreamPingPath, "upstream-ping-path", "/", "path requested from each upstream by -upstream-ping-interval, such as a health endpoint")
+	fs.BoolVar(&flagStableFixtures, "stable-fixtures", false, "write -cache-dir entries without fetch times, -volatile-headers or the body values selected by -scrub, so re-recording an unchanged upstream gives identical files")
+	fs.Var(&flagVolatileHeaders, "volatile-headers", "comma-separated headers left out of -stable-fixtures entries; a trailing * matches a prefix")
+	fs.Var(&flagScrub, "scrub", "set the JSON body values at a path to a fixed value in -stable-fixtures entries, as $.PATH=VALUE (repeatable)")
+	fs.StringVar(&flagLengthCheck, "length-check", lengthStrict, "what to do with upstream bodies that don't match their Content-Length: strict refuses them, warn logs them, off ignores it")
+	fs.DurationVar(&flagCoalesceWindow, "coalesce-window", 0, "how long after a fetch finishes that misses for the same key still share its result rather than fetching again")
+	fs.StringVar(&flagBypassToken, "bypass-token", "", "requests whose "+bypassHeader+" header carries this token skip the cache and are proxied live")
+	fs.StringVar(&flagUpstreamPath, "upstream-path", pathResolve, "how request paths are joined to upstream URLs: resolve keeps their encoding and the URL's path, raw appends them as strings")
+	fs.BoolVar(&flagReadOnly, "read-only", false, "freeze the cache: serve entries however old, proxy misses without caching them and never save the cache")
+	fs.DurationVar(&flagFsckInterval, "fsck-interval", 0, "check the saved cache file against the entries in memory this often, in the background (0 to disable)")
+	fs.StringVar(&flagFsckReport, "fsck-report", "", "write the problems found by the -fsck-interval check to this file as JSON lines")
+	fs.StringVar(&flagTenantHeader, "tenant-header", "", "request header naming the tenant, such as X-Devcache-Tenant; each tenant has its own entries, saved to cache-<tenant>.gob")
+	fs.BoolVar(&flagTenantBasicAuth, "tenant-basic-auth", false, "take the tenant from the basic auth username of requests without -tenant-header")
+	fs.BoolVar(&flagTenantRequired, "tenant-required", false, "refuse requests that don't name a tenant instead of serving them as the default tenant")
+	fs.Var(&flagTenantMaxBytes, "tenant-max-bytes", "evict a tenant's coldest entries to keep its bodies under this size (0 for no limit)")
+	fs.Var(&flagTenantTokens, "tenant-token", "token letting a tenant list, export and invalidate its own entries without the admin token, as `TENANT=TOKEN` (repeatable)")
+	fs.Var(&flagCacheMethods, "cache-methods", "comma-separated methods besides GET and HEAD, such as POST, whose requests are cached by method, URI and a digest of the body; requests with other methods are proxied without caching")
+	fs.BoolVar(&flagHonorCacheControl, "honor-cache-control", false, "cache responses for the max-age or Expires they set, falling back to -ttl, and never cache no-store responses (-strict-http-cache applies more of RFC 7234)")
+	fs.BoolVar(&flagHonorVary, "honor-vary", false, "cache a variant of each response that sets Vary per value of the request headers it lists, except Accept-Encoding, and never cache Vary: * responses")
+	fs.DurationVar(&flagStaleWhileRevalidate, "stale-while-revalidate", 0, "serve entries up to this long past expiry at once, refreshing them in the background (0 unless the upstream sets stale-while-revalidate)")
+	fs.StringVar(&flagConfig, "config", "", "YAML (.yaml, .yml) or TOML file of settings named like the flags; flags given on the command line override it")
+}
 
-	<-c
-	log.Println("shutting down")
-	_, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	err = writeCache("./cache.gob", Cache.Items())
+// setup checks the settings parsed into the flags and prepares the cache and
+// everything else the server relies on.
+func setup() error {
+	if flagConfig != "" {
+		settings, err := readConfig(flagConfig)
+		if err == nil {
+			err = applyConfig(settings)
+		}
+		if err != nil {
+			return fmt.Errorf("error loading %s: %s", flagConfig, err)
+		}
+	}
+	switch flagLogFormat {
+	case logFormatText:
+	case logFormatJSON:
+		log.SetFlags(0)
+		log.SetOutput(jsonLog)
+	default:
+		return fmt.Errorf("-log-format must be %s or %s", logFormatText, logFormatJSON)
+	}
+	for _, family := range []string{flagListenFamily, flagUpstreamIPFamily} {
+		if family != familyAuto && family != familyIPv4 && family != familyIPv6 {
+			return fmt.Errorf("invalid address family %q: must be auto, ipv4 or ipv6", family)
+		}
+	}
+	if flagCompressCache && flagPersistCompress == compressNone {
+		flagPersistCompress = compressGzip
+	}
+	switch flagRangeCache {
+	case "", rangeFull, rangePartial:
+	default:
+		return fmt.Errorf("-range-cache must be %s or %s", rangeFull, rangePartial)
+	}
+	if flagBodyKey != bodyKeyRaw && flagBodyKey != bodyKeyJSON {
+		return fmt.Errorf("-body-key must be %s or %s", bodyKeyRaw, bodyKeyJSON)
+	}
+	if flagUpstreamPath != pathResolve && flagUpstreamPath != pathRaw {
+		return fmt.Errorf("-upstream-path must be %s or %s", pathResolve, pathRaw)
+	}
+	switch flagLengthCheck {
+	case lengthStrict, lengthWarn, lengthOff:
+	default:
+		return fmt.Errorf("-length-check must be %s, %s or %s", lengthStrict, lengthWarn, lengthOff)
+	}
+	if flagMemoryLow <= 0 || flagMemoryLow >= flagMemoryHigh || flagMemoryHigh > 1 {
+		return errors.New("-memory-low and -memory-high must satisfy 0 < low < high <= 1")
+	}
+	if flagMemoryInterval <= 0 {
+		return errors.New("-memory-interval must be positive")
+	}
+	if primary := strings.TrimPrefix(flagStore, "primary="); primary != flagStore {
+		// -store primary=new flips the -store-verify backends, keeping the
+		// default format
+		flagStore, flagStorePrimary = storeGob, primary
+	}
+	if storeFiles[flagStore] == "" {
+		return fmt.Errorf("-store must be %s, %s, %s or %s", storeGob, storeJSON, storeBolt, storeSQLite)
+	}
+	if flagCacheFile == "" {
+		flagCacheFile = storeFiles[flagStore]
+	}
+	switch flagBackend {
+	case backendMemory:
+	case backendRedis:
+		var err error
+		if shared, err = newRedisClient(flagRedisAddr, flagRedisPassword, flagRedisPrefix); err != nil {
+			return fmt.Errorf("error connecting to redis at %s: %s", flagRedisAddr, err)
+		}
+		log.Printf("sharing the cache through redis at %s", flagRedisAddr)
+	default:
+		return fmt.Errorf("-backend must be %s or %s", backendMemory, backendRedis)
+	}
+	db, err := openDBStore(flagCacheFile)
 	if err != nil {
-		log.Printf("error writing cache: %s", err)
+		return fmt.Errorf("error opening %s: %s", flagCacheFile, err)
 	}
-	log.Printf("cache saved")
-	os.Exit(0)
+	dbStore = db
+	if flagStoreVerify != "" {
+		if flagStoreVerifySample < 0 || flagStoreVerifySample > 1 {
+			return errors.New("-store-verify-sample must be between 0 and 1")
+		}
+		var err error
+		if storeVerify, err = newStoreVerifier(flagStoreVerify, flagStorePrimary); err != nil {
+			return err
+		}
+		log.Printf("verifying store backends %s, answering from %s", flagStoreVerify, storeVerify.primarySpec)
+	}
+	if flagRecord && (flagOffline || flagDisableUpstream || flagReadOnly) {
+		return errors.New("-record can't be combined with -offline, -disable-upstream or -read-only")
+	}
+	if len(flagTransforms) == 0 {
+		flagTransforms = defaultTransforms
+	}
+	if len(flagCanonicalJSON) > 0 {
+		flagTransforms = append(flagTransforms, transformRule{
+			name:      "canonical-json",
+			transform: transforms["canonical-json"],
+			statuses:  []statusRange{{0, 999}},
+			paths:     flagCanonicalJSON,
+		})
+	}
+
+	log.Printf("random seed %d", seedRand(flagSeed))
+	upstreamClient = newUpstreamClient()
+	if flagDisableUpstream || flagOffline {
+		upstreamDisabled = 1
+	}
+	if flagMaintenanceBody != "" {
+		if err := loadMaintenanceBody(flagMaintenanceBody); err != nil {
+			return fmt.Errorf("error loading maintenance body: %s", err)
+		}
+	}
+	bandwidth.rate = int64(flagUpstreamBandwidth)
+	misses = newMissLog(flagMissLogSize, flagMissLogAge)
+	recent = newRequestRing(flagRecentSize)
+	background = newWorkPool(flagBackgroundWorkers, flagBackgroundQueue)
+	if flagMirrorURL != "" {
+		startMirror()
+	}
+
+	if flagProfileFile != "" {
+		var err error
+		if profile, err = readProfile(flagProfileFile); err != nil && !os.IsNotExist(err) {
+			log.Printf("error loading access profile: %s", err)
+		}
+	}
+	if dbStore != nil {
+		// entries are read from the database as they're requested
+		Cache = cache.New(flagTTL, flagTTL)
+		log.Printf("reading cache entries from %s as they're requested", flagCacheFile)
+		cacheLoaded = 1
+	} else if flagBackgroundLoad && flagCacheDir == "" {
+		Cache = cache.New(flagTTL, flagTTL)
+		go func() {
+			loadTenantsInBackground()
+			atomic.StoreInt32(&cacheLoaded, 1)
+		}()
+	} else {
+		items, err := loadStore(newStore(flagCacheFile))
+		if tenancy() && flagCacheDir == "" {
+			if terr := readTenantCaches(items); terr != nil {
+				log.Printf("error loading tenant caches: %s", terr)
+			} else if os.IsNotExist(err) && len(items) > 0 {
+				err = nil
+			}
+		}
+		if err == nil {
+			verifyItems(items)
+			if flagReadOnly {
+				freezeLoaded(items)
+			}
+			Cache = cache.NewFrom(flagTTL, flagTTL, items)
+			indexItems(items)
+			if storeVerify != nil {
+				storeVerify.seed(items)
+			}
+			log.Printf("loaded cache (%d items)", Cache.ItemCount())
+		} else {
+			log.Printf("error loading cache: %s", err)
+			Cache = cache.New(flagTTL, flagTTL)
+		}
+		cacheLoaded = 1
+	}
+	Cache.OnEvicted(onEvicted)
+	if flagReadOnly {
+		setReadOnly(true)
+	}
+	return nil
 }
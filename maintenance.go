@@ -0,0 +1,82 @@
+package devcache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+)
+
+// upstreamDisabled is nonzero while the upstream has been disabled, either
+// with -disable-upstream or -offline or through the admin API. Misses are then answered
+// locally instead of being fetched.
+var upstreamDisabled int32
+
+// maintenance is the response served for misses while the upstream is
+// disabled. It's loaded from -maintenance-body.
+var maintenance struct {
+	body        []byte
+	contentType string
+}
+
+func upstreamEnabled() bool {
+	return atomic.LoadInt32(&upstreamDisabled) == 0
+}
+
+// loadMaintenanceBody reads the maintenance page from filePath, taking its
+// content type from the file extension or, failing that, its contents.
+func loadMaintenanceBody(filePath string) error {
+	body, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	maintenance.body = body
+	maintenance.contentType = mime.TypeByExtension(filepath.Ext(filePath))
+	if maintenance.contentType == "" {
+		maintenance.contentType = sniffType(body)
+	}
+	return nil
+}
+
+// serveMaintenance answers a miss while the upstream is disabled. The
+// response is never cached.
+func serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	if flagOffline {
+		serveOffline(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if maintenance.body == nil {
+		http.Error(w, "upstream disabled and resource not cached", flagMaintenanceStatus)
+		return
+	}
+	w.Header().Set("Content-Type", maintenance.contentType)
+	w.WriteHeader(flagMaintenanceStatus)
+	w.Write(maintenance.body)
+}
+
+// handleUpstream reports whether the upstream is enabled and, given an enabled
+// parameter, enables or disables it.
+func handleUpstream(w http.ResponseWriter, r *http.Request) {
+	if v := r.URL.Query().Get("enabled"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "invalid enabled", http.StatusBadRequest)
+			return
+		}
+		if enabled && flagOffline {
+			http.Error(w, "the upstream can't be enabled with -offline", http.StatusConflict)
+			return
+		}
+		var disabled int32
+		if !enabled {
+			disabled = 1
+		}
+		atomic.StoreInt32(&upstreamDisabled, disabled)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"enabled": upstreamEnabled()})
+}
@@ -0,0 +1,211 @@
+package devcache
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// memoryLimit is a flag.Value for -memory-limit: a size, or auto to use the
+// limit of the cgroup devcache runs in.
+type memoryLimit struct {
+	bytes int64
+	auto  bool
+}
+
+func (m *memoryLimit) String() string {
+	switch {
+	case m.auto:
+		return "auto"
+	case m.bytes > 0:
+		return formatBytes(m.bytes)
+	}
+	return ""
+}
+
+func (m *memoryLimit) Set(s string) error {
+	if s == "auto" {
+		*m = memoryLimit{auto: true}
+		return nil
+	}
+	n, err := parseBytes(s)
+	*m = memoryLimit{bytes: n}
+	return err
+}
+
+// cgroupFiles are the files holding a cgroup's memory limit and usage, for
+// cgroup v2 and v1.
+var cgroupFiles = []struct{ limit, usage string }{
+	{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory.current"},
+	{"/sys/fs/cgroup/memory/memory.limit_in_bytes", "/sys/fs/cgroup/memory/memory.usage_in_bytes"},
+}
+
+// errNoCgroupLimit is returned by cgroupLimit when devcache's cgroup doesn't
+// limit its memory.
+var errNoCgroupLimit = errors.New("no cgroup memory limit")
+
+// cgroupLimit returns the memory limit of devcache's cgroup along with a
+// function reading its current usage.
+func cgroupLimit() (int64, func() (int64, error), error) {
+	for _, files := range cgroupFiles {
+		limit, err := readCgroupValue(files.limit)
+		if err != nil {
+			continue
+		}
+		// v1 reports no limit as a huge page-aligned number
+		if limit <= 0 || limit >= 1<<62 {
+			return 0, nil, errNoCgroupLimit
+		}
+		usage := files.usage
+		return limit, func() (int64, error) { return readCgroupValue(usage) }, nil
+	}
+	return 0, nil, errNoCgroupLimit
+}
+
+// readCgroupValue reads a cgroup file holding a single number. "max" means
+// no limit and reads as zero.
+func readCgroupValue(name string) (int64, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	v := strings.TrimSpace(string(data))
+	if v == "max" {
+		return 0, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+// runtimeUsage returns the memory the Go runtime holds from the OS, an
+// estimate of the process's resident size.
+func runtimeUsage() (int64, error) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return int64(ms.Sys - ms.HeapReleased), nil
+}
+
+// memoryMonitor sheds the coldest cache entries when memory usage crosses
+// -memory-high of the limit, until it's estimated to be back under
+// -memory-low. Usage is sampled every -memory-interval, so there's at most
+// one shedding pass per interval.
+type memoryMonitor struct {
+	limit int64
+	usage func() (int64, error)
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// startMemoryMonitor starts monitoring memory usage against -memory-limit and
+// returns a function stopping it, interrupting any shedding pass. It returns
+// a no-op if there's no limit to monitor.
+func startMemoryMonitor() func() {
+	m := &memoryMonitor{
+		limit: flagMemoryLimit.bytes,
+		usage: runtimeUsage,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	if flagMemoryLimit.auto {
+		limit, usage, err := cgroupLimit()
+		if err != nil {
+			log.Printf("not monitoring memory: %s", err)
+			return func() {}
+		}
+		m.limit, m.usage = limit, usage
+	}
+	if m.limit <= 0 {
+		return func() {}
+	}
+	log.Printf("shedding cold entries above %s of memory", formatBytes(int64(flagMemoryHigh*float64(m.limit))))
+	go m.run()
+	return func() {
+		close(m.stop)
+		<-m.done
+	}
+}
+
+func (m *memoryMonitor) run() {
+	defer close(m.done)
+	ticker := time.NewTicker(flagMemoryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+		used, err := m.usage()
+		if err != nil {
+			debugf("error reading memory usage: %s", err)
+			continue
+		}
+		if used < int64(flagMemoryHigh*float64(m.limit)) {
+			continue
+		}
+		if cacheReadOnly() {
+			log.Printf("memory usage %s of %s limit, but the cache is read-only", formatBytes(used), formatBytes(m.limit))
+			continue
+		}
+		shed, freed := m.shed(used - int64(flagMemoryLow*float64(m.limit)))
+		atomic.AddInt64(&stats.MemoryPressure, 1)
+		atomic.AddInt64(&stats.MemoryShed, int64(shed))
+		log.Printf("memory usage %s of %s limit, shed %d cold entries (%s)",
+			formatBytes(used), formatBytes(m.limit), shed, formatBytes(freed))
+	}
+}
+
+// shed evicts the coldest entries until their bodies add up to target bytes,
+// returning how many were evicted and their size. It stops early if the
+// monitor is stopped.
+func (m *memoryMonitor) shed(target int64) (int, int64) {
+	items := snapshotItems()
+	cold := make([]*entry, 0, len(items))
+	keys := make(map[*entry]string, len(items))
+	for key, item := range items {
+		if e, ok := toEntry(item.Object); ok {
+			cold = append(cold, e)
+			keys[e] = key
+		}
+	}
+	coldestFirst(cold)
+	var shed int
+	var freed int64
+	for _, e := range cold {
+		if freed >= target {
+			break
+		}
+		select {
+		case <-m.stop:
+			return shed, freed
+		default:
+		}
+		Cache.Delete(keys[e])
+		shed++
+		freed += int64(len(e.Body))
+	}
+	// return the memory now, so the next sample reflects it
+	debug.FreeOSMemory()
+	return shed, freed
+}
+
+// coldestFirst orders entries by how often they've been served, least first,
+// then by how long ago they were stored, oldest first.
+func coldestFirst(entries []*entry) {
+	hits := make(map[*entry]int64, len(entries))
+	for _, e := range entries {
+		hits[e] = atomic.LoadInt64(&e.hits)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if hits[entries[i]] != hits[entries[j]] {
+			return hits[entries[i]] < hits[entries[j]]
+		}
+		return entries[i].Stored.Before(entries[j].Stored)
+	})
+}
@@ -0,0 +1,110 @@
+package devcache
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the upstream latency
+// histogram buckets. They're Prometheus' defaults.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// upstreamLatency is the histogram of upstream request latencies per host,
+// retries included.
+var upstreamLatency = &latencyHistogram{hosts: make(map[string]*histogramCounts)}
+
+type latencyHistogram struct {
+	mu    sync.Mutex
+	hosts map[string]*histogramCounts
+}
+
+// histogramCounts are the observations of a host, counted in the first
+// bucket they fit and accumulated when written.
+type histogramCounts struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *latencyHistogram) observe(host string, d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c := h.hosts[host]
+	if c == nil {
+		c = &histogramCounts{buckets: make([]uint64, len(latencyBuckets))}
+		h.hosts[host] = c
+	}
+	seconds := d.Seconds()
+	if i := sort.SearchFloat64s(latencyBuckets, seconds); i < len(latencyBuckets) {
+		c.buckets[i]++
+	}
+	c.count++
+	c.sum += seconds
+}
+
+func (h *latencyHistogram) reset() {
+	h.mu.Lock()
+	h.hosts = make(map[string]*histogramCounts)
+	h.mu.Unlock()
+}
+
+// write writes the histogram named name in the Prometheus text format.
+func (h *latencyHistogram) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hosts := make([]string, 0, len(h.hosts))
+	for host := range h.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, host := range hosts {
+		c := h.hosts[host]
+		label := "host=" + strconv.Quote(host)
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += c.buckets[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, label, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, label, c.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", name, label, c.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, label, c.count)
+	}
+}
+
+// metric is a single-valued metric written by handleMetrics.
+type metric struct {
+	name  string
+	kind  string
+	help  string
+	value float64
+}
+
+// handleMetrics exposes the stats in the Prometheus text format: the request
+// and upstream counters, the size of the cache and a histogram of upstream
+// latencies.
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	snap := s.Snapshot()
+	st := snap.Stats
+	metrics := []metric{
+		{"devcache_hits_total", "counter", "Requests served from the cache.", float64(st.Hits)},
+		{"devcache_misses_total", "counter", "Requests fetched from the upstream.", float64(st.Misses)},
+		{"devcache_stale_total", "counter", "Expired entries served because refreshing them failed or was skipped.", float64(st.Stale + st.StaleIfError)},
+		{"devcache_coalesced_total", "counter", "Misses answered by another request's fetch.", float64(st.Coalesced)},
+		{"devcache_evictions_total", "counter", "Entries deleted or expired from the cache.", float64(st.Evictions)},
+		{"devcache_upstream_errors_total", "counter", "Failed upstream fetches.", float64(st.UpstreamErrors)},
+		{"devcache_upstream_bytes_total", "counter", "Body bytes read from the upstream.", float64(st.UpstreamBytes)},
+		{"devcache_entries", "gauge", "Entries in the cache.", float64(snap.Entries)},
+		{"devcache_bytes", "gauge", "Size of the cached bodies as stored.", float64(snap.Bytes)},
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+	upstreamLatency.write(w, "devcache_upstream_request_duration_seconds", "Latency of upstream requests, retries included.")
+}
@@ -0,0 +1,51 @@
+package devcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("body"))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL)
+	for _, path := range []string{"/a", "/a", "/a", "/b"} {
+		do(s.Handler(), "GET", path, nil)
+	}
+
+	w := do(s.Handler(), "GET", "/metrics", nil)
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %q", ct)
+	}
+	samples := map[string]float64{}
+	for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("invalid sample %q", line)
+		}
+		samples[line[:i]] = v
+	}
+	host := strconv.Quote(strings.TrimPrefix(up.URL, "http://"))
+	for name, want := range map[string]float64{
+		"devcache_hits_total":   2,
+		"devcache_misses_total": 2,
+		"devcache_entries":      2,
+		"devcache_bytes":        8,
+		// the latency histogram counts every upstream request
+		"devcache_upstream_request_duration_seconds_count{host=" + host + "}":              2,
+		"devcache_upstream_request_duration_seconds_bucket{host=" + host + ",le=\"+Inf\"}": 2,
+	} {
+		if got, ok := samples[name]; !ok || got != want {
+			t.Errorf("%s = %g (present %v), want %g", name, got, ok, want)
+		}
+	}
+}
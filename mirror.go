@@ -0,0 +1,116 @@
+package devcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// mirrorRedacted replaces redacted header and query parameter values.
+const mirrorRedacted = "<redacted>"
+
+// mirrorClient sends mirrored requests. It's nil unless -mirror-url is set.
+var mirrorClient *http.Client
+
+// mirrorRecord is the summary of a handled request sent to the mirror.
+type mirrorRecord struct {
+	requestRecord
+	RequestHeader  http.Header `json:"request_header"`
+	ResponseHeader http.Header `json:"response_header"`
+	// Body holds up to -mirror-body-limit bytes of the response body.
+	Body          []byte `json:"body,omitempty"`
+	BodyTruncated bool   `json:"body_truncated,omitempty"`
+}
+
+// startMirror starts sending mirrored requests to -mirror-url.
+func startMirror() {
+	mirrorClient = &http.Client{Timeout: 5 * time.Second}
+	log.Printf("mirroring requests to %s", flagMirrorURL)
+}
+
+// send posts rec to the mirror.
+func (rec mirrorRecord) send() {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	res, err := mirrorClient.Post(flagMirrorURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		atomic.AddInt64(&stats.MirrorErrors, 1)
+		debugf("error mirroring %s: %s", rec.Path, err)
+		return
+	}
+	res.Body.Close()
+}
+
+// mirrored reports whether the request for uri is sampled for mirroring.
+func mirrored(uri string) bool {
+	if mirrorClient == nil {
+		return false
+	}
+	if len(flagMirrorPaths) > 0 && !flagMirrorPaths.match(uri) {
+		return false
+	}
+	return flagMirrorSample >= 1 || randFloat64() < flagMirrorSample
+}
+
+// mirror queues a summary of a handled request for the mirror, redacting
+// secrets first. If the background queue is full the summary is dropped so
+// mirroring never holds up a client.
+func mirror(r *http.Request, rec *responseRecorder, summary requestRecord) {
+	m := mirrorRecord{
+		requestRecord:  summary,
+		RequestHeader:  redactHeader(r.Header),
+		ResponseHeader: redactHeader(rec.Header()),
+		Body:           rec.body,
+		BodyTruncated:  rec.size > len(rec.body),
+	}
+	m.Path = redactQuery(m.Path)
+	if !background.submit(taskMirror, m.send, false) {
+		atomic.AddInt64(&stats.MirrorDropped, 1)
+	}
+}
+
+// redactHeader returns a copy of h with the values of the -mirror-redact
+// headers replaced.
+func redactHeader(h http.Header) http.Header {
+	c := h.Clone()
+	for _, name := range flagMirrorRedact {
+		if _, ok := c[name]; ok {
+			c[name] = []string{mirrorRedacted}
+		}
+	}
+	return c
+}
+
+// redactQuery replaces the values of the -mirror-redact-params query
+// parameters in uri.
+func redactQuery(uri string) string {
+	i := strings.IndexByte(uri, '?')
+	if i < 0 {
+		return uri
+	}
+	params := strings.Split(uri[i+1:], "&")
+	for j, param := range params {
+		eq := strings.IndexByte(param, '=')
+		if eq < 0 {
+			continue
+		}
+		name, err := url.QueryUnescape(param[:eq])
+		if err != nil {
+			continue
+		}
+		for _, secret := range flagMirrorRedactParams {
+			if strings.EqualFold(name, secret) {
+				params[j] = param[:eq+1] + url.QueryEscape(mirrorRedacted)
+				break
+			}
+		}
+	}
+	return uri[:i+1] + strings.Join(params, "&")
+}
@@ -0,0 +1,175 @@
+package devcache
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// misses is the server-wide log of requests that weren't served from cache.
+var misses = newMissLog(1000, 24*time.Hour)
+
+// missRecord aggregates the cache misses seen for a single request URI.
+type missRecord struct {
+	Path     string        `json:"path"`
+	Count    int           `json:"count"`
+	Latency  time.Duration `json:"latency_ns"`
+	LastSeen time.Time     `json:"last_seen"`
+}
+
+// missLog is a bounded record of cache misses. It holds at most max paths and
+// forgets paths that haven't missed within maxAge.
+type missLog struct {
+	mu      sync.Mutex
+	max     int
+	maxAge  time.Duration
+	records map[string]*missRecord
+}
+
+func newMissLog(max int, maxAge time.Duration) *missLog {
+	return &missLog{
+		max:     max,
+		maxAge:  maxAge,
+		records: make(map[string]*missRecord),
+	}
+}
+
+// record notes a miss for path that cost latency to fetch upstream.
+func (l *missLog) record(path string, latency time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rec, ok := l.records[path]
+	if !ok {
+		l.prune(now)
+		if l.max <= 0 {
+			return
+		}
+		if len(l.records) >= l.max {
+			l.evictOldest()
+		}
+		rec = &missRecord{Path: path}
+		l.records[path] = rec
+	}
+	rec.Count++
+	rec.Latency += latency
+	rec.LastSeen = now
+}
+
+// prune drops records that have aged out. l.mu must be held.
+func (l *missLog) prune(now time.Time) {
+	if l.maxAge <= 0 {
+		return
+	}
+	for path, rec := range l.records {
+		if now.Sub(rec.LastSeen) > l.maxAge {
+			delete(l.records, path)
+		}
+	}
+}
+
+// evictOldest drops the least recently seen record. l.mu must be held.
+func (l *missLog) evictOldest() {
+	var oldest *missRecord
+	for _, rec := range l.records {
+		if oldest == nil || rec.LastSeen.Before(oldest.LastSeen) {
+			oldest = rec
+		}
+	}
+	if oldest != nil {
+		delete(l.records, oldest.Path)
+	}
+}
+
+// report returns the records last seen after since, most frequent first and
+// then by total upstream latency.
+func (l *missLog) report(since time.Time) []missRecord {
+	l.mu.Lock()
+	l.prune(time.Now())
+	list := make([]missRecord, 0, len(l.records))
+	for _, rec := range l.records {
+		if !rec.LastSeen.Before(since) {
+			list = append(list, *rec)
+		}
+	}
+	l.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Latency > list[j].Latency
+	})
+	return list
+}
+
+// handleMisses reports recent cache misses. The since parameter limits the
+// report to paths that missed within that duration, and format selects
+// between JSON and a plain list of paths usable as a -warm-file.
+func handleMisses(w http.ResponseWriter, r *http.Request) {
+	since := time.Time{}
+	if v := r.URL.Query().Get("since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		since = time.Now().Add(-d)
+	}
+	list := misses.report(since)
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case "txt":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeMissList(w, list)
+	default:
+		http.Error(w, "format must be json or txt", http.StatusBadRequest)
+	}
+}
+
+func writeMissList(w io.Writer, list []missRecord) {
+	for _, rec := range list {
+		fmt.Fprintln(w, rec.Path)
+	}
+}
+
+// runMisses implements the misses subcommand, which saves the miss report of
+// a running instance as a warm-up file.
+func runMisses(args []string) error {
+	fs := flag.NewFlagSet("misses", flag.ExitOnError)
+	addr := fs.String("server", "http://localhost:8000", "base URL of the running devcache instance")
+	since := fs.String("since", "", "only include paths that missed within this duration")
+	out := fs.String("warm-file", "warm.txt", "file to write the list of paths to (- for stdout)")
+	fs.Parse(args)
+
+	q := url.Values{"format": {"txt"}}
+	if *since != "" {
+		q.Set("since", *since)
+	}
+	res, err := http.Get(*addr + adminPrefix + "/misses?" + q.Encode())
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", res.Status, body)
+	}
+	if *out == "-" {
+		_, err = os.Stdout.Write(body)
+		return err
+	}
+	return ioutil.WriteFile(*out, body, 0644)
+}
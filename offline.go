@@ -0,0 +1,30 @@
+package devcache
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// offlineMessage is the body of the responses to misses with -offline.
+const offlineMessage = "devcache is offline (-offline) and %s %s isn't cached\n"
+
+// serveOffline answers a miss with -offline, which is never fetched: it's
+// logged and answered with -offline-status, or with the -maintenance-body if
+// there is one, so a replayed run fails the same way every time.
+func serveOffline(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&stats.OfflineMisses, 1)
+	log.Printf("offline miss: %s %s", r.Method, r.RequestURI)
+	w.Header().Set("Cache-Control", "no-store")
+	if maintenance.body != nil {
+		w.Header().Set("Content-Type", maintenance.contentType)
+		w.WriteHeader(flagOfflineStatus)
+		w.Write(maintenance.body)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(flagOfflineStatus)
+	fmt.Fprintf(w, offlineMessage, r.Method, r.RequestURI)
+}
@@ -0,0 +1,93 @@
+package devcache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestOffline(t *testing.T) {
+	var fetches int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&fetches, 1)
+		w.Write([]byte("body of " + r.URL.Path))
+	}))
+	defer up.Close()
+	file := filepath.Join(t.TempDir(), "cache.gob")
+	s := newTestServer(t, up.URL, "-cache-file", file)
+	do(s.Handler(), "GET", "/a", nil)
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newTestServer(t, up.URL, "-cache-file", file, "-offline", "-offline-status", "503")
+	for _, tt := range []struct {
+		method, path string
+		status       int
+		body         string
+	}{
+		{"GET", "/a", http.StatusOK, "body of /a"},
+		{"GET", "/b", http.StatusServiceUnavailable, "devcache is offline (-offline) and GET /b isn't cached"},
+		// uncached methods aren't proxied either
+		{"DELETE", "/a", http.StatusServiceUnavailable, "devcache is offline (-offline) and DELETE /a isn't cached"},
+	} {
+		w := do(s.Handler(), tt.method, tt.path, nil)
+		if w.Code != tt.status || strings.TrimSpace(w.Body.String()) != tt.body {
+			t.Errorf("%s %s: %d %q, want %d %q", tt.method, tt.path, w.Code, w.Body, tt.status, tt.body)
+		}
+	}
+	if w := do(s.Handler(), "POST", controlPrefix+"/upstream?enabled=true", nil); w.Code != http.StatusConflict {
+		t.Errorf("enabling the upstream: status %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := do(s.Handler(), "GET", "/b", nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("after enabling the upstream: status %d", w.Code)
+	}
+	if n := atomic.LoadInt64(&stats.OfflineMisses); n != 3 {
+		t.Errorf("%d offline misses, want 3", n)
+	}
+	if n := atomic.LoadInt64(&fetches); n != 1 {
+		t.Errorf("fetched %d times, want only while recording", n)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	var fetches int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		fmt.Fprintf(w, "v%d", atomic.AddInt64(&fetches, 1))
+	}))
+	defer up.Close()
+	file := filepath.Join(t.TempDir(), "cache.gob")
+	for _, tt := range []struct {
+		args []string
+		// want is what's served for each request in turn
+		want []string
+	}{
+		{nil, []string{"v1", "v1"}},
+		// fresh entries are fetched again, replacing the recording
+		{[]string{"-record"}, []string{"v2", "v3"}},
+		{[]string{"-offline"}, []string{"v3"}},
+	} {
+		s := newTestServer(t, up.URL, append([]string{"-cache-file", file}, tt.args...)...)
+		for i, want := range tt.want {
+			if w := do(s.Handler(), "GET", "/a", nil); w.Body.String() != want {
+				t.Errorf("%v: request %d: %q, want %q", tt.args, i, w.Body, want)
+			}
+		}
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, arg := range []string{"-offline", "-disable-upstream", "-read-only"} {
+		if s, err := New(Config{URL: up.URL, Args: []string{"-cache-file", file, "-record", arg}}); err == nil {
+			s.Shutdown(context.Background())
+			t.Errorf("-record %s: no error", arg)
+		}
+	}
+}
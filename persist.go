@@ -0,0 +1,208 @@
+package devcache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+	cache "github.com/patrickmn/go-cache"
+)
+
+// persistMagic starts every cache file written by this version. Files
+// without it are a single gob-encoded map, as written by older versions.
+const persistMagic = "DEVCACHE"
+
+// persistVersion is the version of the cache file format. The header is the
+// magic, the version and the compression byte; a stream of persistRecords
+// follows, compressed as the header says.
+const persistVersion = 1
+
+// compression is the compression applied to a saved cache file.
+type compression byte
+
+const (
+	compressNone compression = iota
+	compressGzip
+	compressZstd
+)
+
+var compressionNames = map[compression]string{
+	compressNone: "none",
+	compressGzip: "gzip",
+	compressZstd: "zstd",
+}
+
+func (c *compression) String() string {
+	return compressionNames[*c]
+}
+
+func (c *compression) Set(v string) error {
+	for k, name := range compressionNames {
+		if name == v {
+			*c = k
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown compression %q", v)
+}
+
+// persistRecord is a single cached item in a cache file. Items are encoded
+// one at a time so neither writing nor reading needs the whole file in memory
+// at once.
+type persistRecord struct {
+	Key  string
+	Item cache.Item
+}
+
+// readCache loads the cache file at filePath into items, detecting its format
+// and compression from its header.
+func readCache(filePath string, items *map[string]cache.Item) error {
+	if *items == nil {
+		*items = make(map[string]cache.Item)
+	}
+	return streamCache(filePath, func(key string, item cache.Item) {
+		(*items)[key] = item
+	})
+}
+
+// streamCache calls fn with each item in the cache file at filePath as it's
+// decoded, in the order the items were written.
+func streamCache(filePath string, fn func(key string, item cache.Item)) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return decodeCache(bufio.NewReader(file), fn)
+}
+
+// gzipMagic starts gzip streams. Whole cache files compressed with gzip,
+// rather than with the header's compression byte, are detected by it.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decodeCache calls fn with each item of the cache file read by r.
+func decodeCache(r *bufio.Reader, fn func(key string, item cache.Item)) error {
+	if magic, err := r.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		return decodeCache(bufio.NewReader(gz), fn)
+	}
+	header, err := r.Peek(len(persistMagic) + 2)
+	if err != nil || !bytes.HasPrefix(header, []byte(persistMagic)) {
+		// written before the file had a header
+		var items map[string]cache.Item
+		if err := gob.NewDecoder(r).Decode(&items); err != nil {
+			return err
+		}
+		for _, key := range profile.order(items) {
+			fn(key, items[key])
+		}
+		return nil
+	}
+	if v := header[len(persistMagic)]; v != persistVersion {
+		return fmt.Errorf("unsupported cache file version %d", v)
+	}
+	c := compression(header[len(persistMagic)+1])
+	r.Discard(len(header))
+
+	var src io.Reader = r
+	switch c {
+	case compressNone:
+	case compressGzip:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		src = gz
+	case compressZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		src = zr
+	default:
+		return fmt.Errorf("unknown cache file compression %d", c)
+	}
+	dec := gob.NewDecoder(src)
+	for {
+		var rec persistRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		fn(rec.Key, rec.Item)
+	}
+}
+
+// writeCache saves items to filePath, compressed per -persist-compress. The
+// items are written hottest first by the access profile so a background load
+// makes them available first. The file is replaced at once, so a crash while
+// it's being written leaves the previous one.
+func writeCache(filePath string, items map[string]cache.Item) error {
+	tmp := filePath + ".tmp"
+	if err := writeCacheFile(tmp, items); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filePath)
+}
+
+func writeCacheFile(filePath string, items map[string]cache.Item) error {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	w.WriteString(persistMagic)
+	w.WriteByte(persistVersion)
+	w.WriteByte(byte(flagPersistCompress))
+
+	var dst io.WriteCloser
+	switch flagPersistCompress {
+	case compressGzip:
+		dst = gzip.NewWriter(w)
+	case compressZstd:
+		if dst, err = zstd.NewWriter(w); err != nil {
+			return err
+		}
+	default:
+		dst = nopWriteCloser{w}
+	}
+	enc := gob.NewEncoder(dst)
+	for _, key := range profile.order(items) {
+		if err := enc.Encode(persistRecord{Key: key, Item: items[key]}); err != nil {
+			return err
+		}
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	// flush the file to disk before it's renamed over the previous one
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
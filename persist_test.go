@@ -0,0 +1,196 @@
+package devcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+// syntheticItems returns n entries of typical, compressible JSON.
+func syntheticItems(n int) map[string]cache.Item {
+	exp := time.Now().Add(time.Hour).UnixNano()
+	items := make(map[string]cache.Item, n)
+	for i := 0; i < n; i++ {
+		body := []byte(fmt.Sprintf(`{"id":%d,"name":"item %d","tags":["alpha","beta","gamma"],"description":"a synthetic entry standing in for a typical API response body","price":%d.99,"in_stock":true}`, i, i, i%100))
+		items[fmt.Sprintf("/items/%d", i)] = cache.Item{
+			Object:     &entry{Body: body, URL: fmt.Sprintf("/items/%d", i), ContentType: "application/json", Checksum: checksum(body)},
+			Expiration: exp,
+		}
+	}
+	return items
+}
+
+// withCompression sets -persist-compress to c for the rest of the test.
+func withCompression(tb testing.TB, c compression) {
+	prev := flagPersistCompress
+	flagPersistCompress = c
+	tb.Cleanup(func() { flagPersistCompress = prev })
+}
+
+var compressions = []compression{compressNone, compressGzip, compressZstd}
+
+func TestPersistCompressRoundTrip(t *testing.T) {
+	items := syntheticItems(100)
+	for _, c := range compressions {
+		t.Run(compressionNames[c], func(t *testing.T) {
+			withCompression(t, c)
+			path := filepath.Join(t.TempDir(), "cache.gob")
+			if err := writeCache(path, items); err != nil {
+				t.Fatal(err)
+			}
+			// the format is read from the file, whatever the flag says now
+			flagPersistCompress = compressNone
+			var got map[string]cache.Item
+			if err := readCache(path, &got); err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(items) {
+				t.Fatalf("read %d items, want %d", len(got), len(items))
+			}
+			for key, item := range items {
+				e, ok := toEntry(got[key].Object)
+				if !ok || string(e.Body) != string(item.Object.(*entry).Body) {
+					t.Fatalf("%s: read %v", key, got[key].Object)
+				}
+			}
+		})
+	}
+}
+
+func TestReadGzippedCacheFiles(t *testing.T) {
+	items := syntheticItems(10)
+	dir := t.TempDir()
+	withCompression(t, compressNone)
+	current := filepath.Join(dir, "current.gob")
+	if err := writeCache(current, items); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var legacy bytes.Buffer
+	if err := gob.NewEncoder(&legacy).Encode(items); err != nil {
+		t.Fatal(err)
+	}
+	gzipped := func(b []byte) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(b)
+		gz.Close()
+		return buf.Bytes()
+	}
+
+	for name, data := range map[string][]byte{
+		"current":         data,
+		"current gzipped": gzipped(data),
+		"legacy":          legacy.Bytes(),
+		"legacy gzipped":  gzipped(legacy.Bytes()),
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name+".gob")
+			if err := ioutil.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]cache.Item
+			if err := readCache(path, &got); err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(items) {
+				t.Fatalf("read %d items, want %d", len(got), len(items))
+			}
+		})
+	}
+}
+
+// TestCompressCacheMigration flips -compress-cache between runs, with the
+// cache file loaded each time and saved as the flag says.
+func TestCompressCacheMigration(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("body of " + r.URL.Path))
+	}))
+	defer up.Close()
+	path := filepath.Join(t.TempDir(), "cache.gob")
+	if err := writeCache(path, syntheticItems(10)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		args []string
+		want compression
+	}{
+		{[]string{"-compress-cache"}, compressGzip},
+		{nil, compressNone},
+		{[]string{"-compress-cache"}, compressGzip},
+	} {
+		s := newTestServer(t, up.URL, append([]string{"-cache-file", path}, tt.args...)...)
+		if n := s.Stats().Entries; n != 10 {
+			t.Fatalf("%v: loaded %d entries, want 10", tt.args, n)
+		}
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := compression(data[len(persistMagic)+1]); c != tt.want {
+			t.Errorf("%v: saved with %s, want %s", tt.args, compressionNames[c], compressionNames[tt.want])
+		}
+	}
+}
+
+func BenchmarkPersistWrite(b *testing.B) {
+	items := syntheticItems(10000)
+	for _, c := range compressions {
+		b.Run(compressionNames[c], func(b *testing.B) {
+			withCompression(b, c)
+			path := filepath.Join(b.TempDir(), "cache.gob")
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := writeCache(path, items); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			if fi, err := os.Stat(path); err == nil {
+				b.ReportMetric(float64(fi.Size()), "file-bytes")
+			}
+		})
+	}
+}
+
+func BenchmarkPersistRead(b *testing.B) {
+	items := syntheticItems(10000)
+	for _, c := range compressions {
+		b.Run(compressionNames[c], func(b *testing.B) {
+			withCompression(b, c)
+			path := filepath.Join(b.TempDir(), "cache.gob")
+			if err := writeCache(path, items); err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				n := 0
+				if err := streamCache(path, func(string, cache.Item) { n++ }); err != nil {
+					b.Fatal(err)
+				}
+				if n != len(items) {
+					b.Fatalf("read %d items, want %d", n, len(items))
+				}
+			}
+		})
+	}
+}
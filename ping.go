@@ -0,0 +1,92 @@
+package devcache
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// pingDrainLimit is how much of a ping response is read so its connection
+// can be reused. Longer responses are closed instead.
+const pingDrainLimit = 64 << 10
+
+// pingTargets returns the distinct upstreams requests can be sent to.
+func pingTargets() []string {
+	seen := map[string]bool{}
+	var targets []string
+	add := func(u string) {
+		if u != "" && !seen[u] {
+			seen[u] = true
+			targets = append(targets, u)
+		}
+	}
+	add(flagURL)
+	for _, rt := range flagRoutes {
+		add(rt.upstream)
+	}
+	for _, u := range flagUpstreams {
+		add(u)
+	}
+	return targets
+}
+
+// startUpstreamPinger requests -upstream-ping-path from every upstream each
+// -upstream-ping-interval, so idle connections to them stay open and the next
+// client request doesn't wait for a new one. It returns a function stopping
+// the pinger, or a no-op if pinging is disabled.
+func startUpstreamPinger() func() {
+	if flagUpstreamPingInterval <= 0 {
+		return func() {}
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(flagUpstreamPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if !upstreamEnabled() {
+				continue
+			}
+			for _, target := range pingTargets() {
+				if u, err := upstreamURL(target, flagUpstreamPingPath); err == nil {
+					pingUpstream(u)
+				} else {
+					debugf("error pinging upstream: %s", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// pingUpstream requests url, logging failures only with -debug. Pings aren't
+// counted in the upstream's health or the stats.
+func pingUpstream(url string) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		debugf("error pinging upstream: %s", err)
+		return
+	}
+	if flagViaPseudonym != "" {
+		req.Header.Add("Via", via())
+	}
+	res, err := upstreamClient.Do(req)
+	if err != nil {
+		debugf("error pinging upstream: %s", err)
+		return
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, pingDrainLimit))
+	if res.StatusCode >= 400 {
+		debugf("upstream ping %s: %s", url, res.Status)
+	}
+}
@@ -0,0 +1,159 @@
+package devcache
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+// prefixKey is the context key the path prefix stripped from a request is
+// stored under.
+type prefixKey struct{}
+
+// pathPrefix returns the prefix to strip from r: the -strip-prefix flag, or
+// X-Forwarded-Prefix if the proxy in front is trusted to set it.
+func pathPrefix(r *http.Request) string {
+	prefix := flagStripPrefix
+	if flagTrustForwarded {
+		if fwd := r.Header.Get("X-Forwarded-Prefix"); fwd != "" {
+			prefix = fwd
+		}
+	}
+	return strings.TrimSuffix(prefix, "/")
+}
+
+// trimPrefix removes prefix from the path uri if it's a whole leading path
+// segment, so /api is trimmed from /api/v1 and /api?q but not /apis.
+func trimPrefix(uri, prefix string) (string, bool) {
+	if prefix == "" || !strings.HasPrefix(uri, prefix) {
+		return uri, false
+	}
+	rest := uri[len(prefix):]
+	switch {
+	case rest == "":
+		return "/", true
+	case rest[0] == '/':
+		return rest, true
+	case rest[0] == '?':
+		return "/" + rest, true
+	}
+	return uri, false
+}
+
+// stripPrefix returns r with the path prefix the proxy in front of devcache
+// serves it under removed, so neither cache keys nor upstream paths include
+// it. The stripped prefix is kept in r's context to be restored in
+// responses.
+func stripPrefix(r *http.Request) *http.Request {
+	prefix := pathPrefix(r)
+	uri, ok := trimPrefix(r.RequestURI, prefix)
+	if !ok {
+		return r
+	}
+	r = r.WithContext(context.WithValue(r.Context(), prefixKey{}, prefix))
+	r.RequestURI = uri
+	u := *r.URL
+	u.Path, _ = trimPrefix(u.Path, prefix)
+	if u.RawPath != "" {
+		u.RawPath, _ = trimPrefix(u.RawPath, prefix)
+	}
+	r.URL = &u
+	return r
+}
+
+// cleanPath returns r with duplicate slashes and dot segments removed from its
+// path, as by path.Clean, if -clean-path is set. A trailing slash is kept. The
+// escaped path is cleaned, so encoded slashes (%2F) are kept as they are, and
+// the query is untouched.
+func cleanPath(r *http.Request) *http.Request {
+	if !flagCleanPath || !strings.HasPrefix(r.RequestURI, "/") {
+		return r
+	}
+	p, query := r.RequestURI, ""
+	if i := strings.IndexByte(p, '?'); i >= 0 {
+		p, query = p[:i], p[i:]
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		// /items/ may well be a different resource than /items
+		cleaned += "/"
+	}
+	if cleaned == p {
+		return r
+	}
+	u, err := url.ParseRequestURI(cleaned + query)
+	if err != nil {
+		return r
+	}
+	r = r.WithContext(r.Context())
+	r.RequestURI = cleaned + query
+	cu := *r.URL
+	cu.Path, cu.RawPath = u.Path, u.RawPath
+	r.URL = &cu
+	return r
+}
+
+// restorePrefix adds the prefix stripped from r back to a Location header
+// pointing elsewhere on the same host.
+func restorePrefix(h http.Header, r *http.Request) {
+	prefix, _ := r.Context().Value(prefixKey{}).(string)
+	loc := h.Get("Location")
+	if prefix == "" || !strings.HasPrefix(loc, "/") || strings.HasPrefix(loc, "//") {
+		return
+	}
+	h.Set("Location", prefix+loc)
+}
+
+// runRekey implements the rekey subcommand, which strips a path prefix from
+// the keys of a cache recorded before devcache was told to strip it.
+func runRekey(args []string) error {
+	fs := flag.NewFlagSet("rekey", flag.ExitOnError)
+	cacheFile := fs.String("cache-file", "./cache.gob", "cache file to rewrite")
+	cacheDir := fs.String("cache-dir", "", "rewrite a -cache-dir directory instead of -cache-file")
+	stripped := fs.String("strip-prefix", "", "path prefix to remove from keys")
+	fs.Parse(args)
+	prefix := strings.TrimSuffix(*stripped, "/")
+	if prefix == "" {
+		return fmt.Errorf("rekey: -strip-prefix is required")
+	}
+
+	items := new(map[string]cache.Item)
+	var err error
+	if *cacheDir != "" {
+		err = readCacheDir(*cacheDir, items)
+	} else {
+		err = readCache(*cacheFile, items)
+	}
+	if err != nil {
+		return err
+	}
+	rekeyed := make(map[string]cache.Item, len(*items))
+	n := 0
+	for key, item := range *items {
+		if trimmed, ok := trimPrefix(key, prefix); ok {
+			key = trimmed
+			if e, ok := toEntry(item.Object); ok {
+				e.URL, _ = trimPrefix(e.URL, prefix)
+				item.Object = e
+			}
+			n++
+		}
+		rekeyed[key] = item
+	}
+	if *cacheDir != "" {
+		err = writeCacheDir(*cacheDir, rekeyed)
+	} else {
+		err = writeCache(*cacheFile, rekeyed)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("rekeyed %d of %d entries\n", n, len(*items))
+	return nil
+}
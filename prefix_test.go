@@ -0,0 +1,94 @@
+package devcache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestCleanPath(t *testing.T) {
+	flagCleanPath = true
+	defer func() { flagCleanPath = false }()
+	for _, tt := range []struct {
+		uri, want, path string
+	}{
+		{"/api/foo/bar", "/api/foo/bar", "/api/foo/bar"},
+		{"/api//foo///bar", "/api/foo/bar", "/api/foo/bar"},
+		{"/api/foo/", "/api/foo/", "/api/foo/"},
+		{"/api//foo//", "/api/foo/", "/api/foo/"},
+		{"/api/./foo/../", "/api/", "/api/"},
+		{"//", "/", "/"},
+		{"/api/./foo/../bar", "/api/bar", "/api/bar"},
+		{"/../foo", "/foo", "/foo"},
+		{"/api//foo?q=a//b&r=../c", "/api/foo?q=a//b&r=../c", "/api/foo"},
+		// encoded slashes are part of a segment, not separators
+		{"/api/a%2Fb//c", "/api/a%2Fb/c", "/api/a/b/c"},
+		{"/api/a%2F%2Fb", "/api/a%2F%2Fb", "/api/a//b"},
+		{"/api/a%2F..%2Fb/", "/api/a%2F..%2Fb/", "/api/a/../b/"},
+	} {
+		r := cleanPath(httptest.NewRequest("GET", tt.uri, nil))
+		if r.RequestURI != tt.want || r.URL.Path != tt.path {
+			t.Errorf("%s: cleaned to %s with path %s, want %s with path %s", tt.uri, r.RequestURI, r.URL.Path, tt.want, tt.path)
+		}
+	}
+}
+
+func TestCleanPathKeysAndForwards(t *testing.T) {
+	var forwarded []string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = append(forwarded, r.RequestURI)
+		w.Write([]byte("ok"))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL, "-clean-path")
+
+	for _, uri := range []string{"/api//foo///bar?x=1", "/api/./foo/bar?x=1", "/api/foo/bar?x=1", "/api/a%2Fb//c", "/api/items/", "/api//items/./"} {
+		if w := do(s.Handler(), "GET", uri, nil); w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", uri, w.Code)
+		}
+	}
+	// a trailing slash makes for another resource
+	want := []string{"/api/foo/bar?x=1", "/api/a%2Fb/c", "/api/items/"}
+	if !reflect.DeepEqual(forwarded, want) {
+		t.Errorf("forwarded %q, want %q", forwarded, want)
+	}
+}
+
+func TestStripPrefixLocation(t *testing.T) {
+	locations := map[string]string{
+		"/login":    "/login",
+		"/absolute": "https://example.com/login",
+		"/relative": "//example.com/login",
+	}
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", locations[r.URL.Path])
+		// redirects are followed upstream, so they never reach the cache
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer up.Close()
+
+	for _, args := range [][]string{nil, {"-replay-original-metadata"}} {
+		s := newTestServer(t, up.URL, append([]string{"-strip-prefix", "/apicache"}, args...)...)
+		for _, tt := range []struct {
+			path, want string
+		}{
+			{"/login", "/apicache/login"},
+			// only paths on the same host are under the prefix
+			{"/absolute", "https://example.com/login"},
+			{"/relative", "//example.com/login"},
+		} {
+			for _, outcome := range []string{"MISS", "HIT"} {
+				w := do(s.Handler(), "GET", "/apicache"+tt.path, nil)
+				if got := w.Header().Get("X-Cache"); got != outcome {
+					t.Fatalf("%v %s: X-Cache %q, want %q", args, tt.path, got, outcome)
+				}
+				if got := w.Header().Values("Location"); len(got) != 1 || got[0] != tt.want {
+					t.Errorf("%v %s %s: Location %q, want %q", args, tt.path, outcome, got, tt.want)
+				}
+			}
+		}
+		s.Shutdown(context.Background())
+	}
+}
@@ -0,0 +1,127 @@
+package devcache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+// profileLimit bounds the number of keys kept in the access profile.
+const profileLimit = 10000
+
+// profileDecay is the weight given to the scores from previous runs when the
+// profile is saved, so keys that have gone cold drift down the order.
+const profileDecay = 0.5
+
+// profile is the access profile loaded at startup.
+var profile accessProfile
+
+// accessProfile scores keys by how often they've been hit, across runs.
+type accessProfile map[string]float64
+
+// readProfile loads the access profile saved at filePath.
+func readProfile(filePath string) (accessProfile, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var p accessProfile
+	return p, json.Unmarshal(data, &p)
+}
+
+// update returns p decayed, plus the hits on items during this run. Only the
+// profileLimit highest scoring keys are kept.
+func (p accessProfile) update(items map[string]cache.Item) accessProfile {
+	next := make(accessProfile, len(p))
+	for key, score := range p {
+		if _, ok := items[key]; ok {
+			next[key] = score * profileDecay
+		}
+	}
+	for key, item := range items {
+		if e, ok := toEntry(item.Object); ok {
+			if hits := atomic.LoadInt64(&e.hits); hits > 0 {
+				next[key] += float64(hits)
+			}
+		}
+	}
+	if len(next) <= profileLimit {
+		return next
+	}
+	keys := make([]string, 0, len(next))
+	for key := range next {
+		keys = append(keys, key)
+	}
+	next.sort(keys)
+	for _, key := range keys[profileLimit:] {
+		delete(next, key)
+	}
+	return next
+}
+
+// sort orders keys hottest first. Keys the profile doesn't score keep their
+// relative order after the scored ones.
+func (p accessProfile) sort(keys []string) {
+	sort.SliceStable(keys, func(i, j int) bool {
+		return p[keys[i]] > p[keys[j]]
+	})
+}
+
+// order returns the keys of items hottest first.
+func (p accessProfile) order(items map[string]cache.Item) []string {
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	p.sort(keys)
+	return keys
+}
+
+// writeProfile saves p to filePath.
+func writeProfile(filePath string, p accessProfile) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filePath, data, 0644)
+}
+
+// loadInBackground adds the items in tenant's cache file at filePath to Cache
+// as they're read, so the hottest are served while the rest are still
+// loading. Items already cached by then are left alone.
+func loadInBackground(filePath, tenant string) {
+	start := time.Now()
+	n := 0
+	err := newStore(filePath).Load(func(key string, item cache.Item) {
+		key = tenantKey(tenant, key)
+		items := map[string]cache.Item{key: item}
+		verifyItems(items)
+		item, ok := items[key]
+		if !ok {
+			return
+		}
+		ttl := cache.NoExpiration
+		if item.Expiration > 0 {
+			if ttl = time.Until(time.Unix(0, item.Expiration)); ttl <= 0 {
+				return
+			}
+		}
+		if Cache.Add(key, item.Object, ttl) == nil {
+			indexItems(items)
+			if storeVerify != nil {
+				storeVerify.seed(items)
+			}
+			n++
+		}
+	})
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("error loading cache: %s", err)
+	}
+	log.Printf("loaded %s in the background (%d items in %s)", filePath, n, time.Since(start))
+}
@@ -0,0 +1,98 @@
+package devcache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+func TestProfileUpdate(t *testing.T) {
+	hit := func(n int64) cache.Item {
+		return cache.Item{Object: &entry{hits: n}}
+	}
+	p := accessProfile{"kept": 8, "gone": 8}
+	next := p.update(map[string]cache.Item{"kept": hit(0), "new": hit(3), "cold": hit(0)})
+	want := accessProfile{"kept": 8 * profileDecay, "new": 3}
+	if len(next) != len(want) {
+		t.Fatalf("got %v, want %v", next, want)
+	}
+	for key, score := range want {
+		if next[key] != score {
+			t.Errorf("%s scored %v, want %v", key, next[key], score)
+		}
+	}
+
+	items := make(map[string]cache.Item, profileLimit+10)
+	for i := 0; i < profileLimit+10; i++ {
+		items[fmt.Sprint(i)] = hit(int64(i + 1))
+	}
+	next = accessProfile{}.update(items)
+	if len(next) != profileLimit {
+		t.Fatalf("kept %d keys, want %d", len(next), profileLimit)
+	}
+	for i := 0; i < 10; i++ {
+		if _, ok := next[fmt.Sprint(i)]; ok {
+			t.Errorf("cold key %d kept over hotter ones", i)
+		}
+	}
+}
+
+// TestProfileLoadsHotFirst loads a large cache in the background, whose
+// hottest 1% must be ready before the rest.
+func TestProfileLoadsHotFirst(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes a 100k entry cache")
+	}
+	const n, hot = 100000, 1000
+	dir := t.TempDir()
+	file, profileFile := filepath.Join(dir, "cache.gob"), filepath.Join(dir, "cache.profile.json")
+	exp := time.Now().Add(time.Hour).UnixNano()
+	items := make(map[string]cache.Item, n)
+	p := make(accessProfile, hot)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("/item/%d", i)
+		items[key] = cache.Item{Object: &entry{Body: []byte(key)}, Expiration: exp}
+		if i%(n/hot) == 0 {
+			p[key] = float64(i + 1)
+		}
+	}
+	if err := writeProfile(profileFile, p); err != nil {
+		t.Fatal(err)
+	}
+	profile = p
+	err := writeCache(file, items)
+	profile = nil
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	newTestServer(t, up.URL, "-cache-file", file, "-profile-file", profileFile, "-background-load")
+	deadline := time.Now().Add(time.Second)
+	for key := range p {
+		for {
+			if _, found := Cache.Get(key); found {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("hot key %s not loaded within a second", key)
+			}
+		}
+	}
+	loaded := Cache.ItemCount()
+	t.Logf("%d hot keys ready with %d of %d entries loaded", hot, loaded, n)
+	if loaded > n/10 {
+		t.Errorf("hot keys weren't ready before most of the rest")
+	}
+	// the load would carry on into the next test's cache
+	for atomic.LoadInt32(&cacheLoaded) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,49 @@
+package devcache
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// handlePurge evicts the entry cached under the key given in the request, or
+// every entry whose key starts with the prefix given instead. Both are
+// matched against keys without their tenant prefix, so a request that isn't
+// scoped to a tenant purges the key of every tenant.
+func handlePurge(w http.ResponseWriter, r *http.Request) {
+	key, prefix := r.URL.Query().Get("key"), r.URL.Query().Get("prefix")
+	if key == "" && prefix == "" {
+		http.Error(w, "missing key or prefix", http.StatusBadRequest)
+		return
+	}
+	var evict []string
+	for k := range scopedItems(r) {
+		_, rest := splitTenantKey(k)
+		if key != "" && rest == key || key == "" && strings.HasPrefix(rest, prefix) {
+			evict = append(evict, k)
+		}
+	}
+	for _, k := range evict {
+		deleteEntry(k)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"key":     key,
+		"prefix":  prefix,
+		"evicted": len(evict),
+	})
+}
+
+// handleFlush evicts every entry, or with tenants every entry of the tenant
+// the request is scoped to. Entries are deleted one by one rather than with
+// Cache.Flush so their tags and -cache-dir files go with them.
+func handleFlush(w http.ResponseWriter, r *http.Request) {
+	items := scopedItems(r)
+	for key := range items {
+		deleteEntry(key)
+	}
+	log.Printf("flushed %d entries", len(items))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"evicted": len(items)})
+}
@@ -0,0 +1,57 @@
+package devcache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPurge(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL)
+	for _, path := range []string{"/a", "/a/b", "/ab", "/c"} {
+		do(s.Handler(), "GET", path, nil)
+	}
+
+	for _, tt := range []struct {
+		method, target string
+		status         int
+		evicted        int
+		// left is what's left cached afterwards
+		left []string
+	}{
+		{"POST", "/purge", http.StatusBadRequest, 0, []string{"/a", "/a/b", "/ab", "/c"}},
+		{"POST", "/purge?key=/a", http.StatusOK, 1, []string{"/a/b", "/ab", "/c"}},
+		{"POST", "/purge?key=/missing", http.StatusOK, 0, []string{"/a/b", "/ab", "/c"}},
+		{"POST", "/purge?prefix=/a", http.StatusOK, 2, []string{"/c"}},
+		{"POST", "/flush", http.StatusOK, 1, nil},
+	} {
+		w := do(s.Handler(), tt.method, controlPrefix+tt.target, nil)
+		if w.Code != tt.status {
+			t.Fatalf("%s %s: status %d, want %d", tt.method, tt.target, w.Code, tt.status)
+		}
+		if w.Code == http.StatusOK {
+			var res struct{ Evicted int }
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Evicted != tt.evicted {
+				t.Errorf("%s %s: evicted %d, %v, want %d", tt.method, tt.target, res.Evicted, err, tt.evicted)
+			}
+		}
+		if n := Cache.ItemCount(); n != len(tt.left) {
+			t.Errorf("%s %s: %d entries left, want %d", tt.method, tt.target, n, len(tt.left))
+		}
+		for _, key := range tt.left {
+			if _, found := Cache.Get(key); !found {
+				t.Errorf("%s %s: %s evicted", tt.method, tt.target, key)
+			}
+		}
+	}
+
+	// and purged entries are fetched again
+	if w := do(s.Handler(), "GET", "/a", nil); w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("purged entry served with X-Cache %s", w.Header().Get("X-Cache"))
+	}
+}
@@ -0,0 +1,276 @@
+package devcache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Modes of -range-cache. Without one, Range headers are forwarded upstream as
+// any other header.
+const (
+	// rangeFull caches whole bodies and serves ranges from them.
+	rangeFull = "full"
+	// rangePartial caches only the ranges clients ask for, fetching those
+	// missing with ranged upstream requests.
+	rangePartial = "partial"
+)
+
+// keyRangeSep marks the keys of entries holding partially cached bodies, so
+// they never answer requests for a whole body.
+const keyRangeSep = "#ranges"
+
+// byteRange is a cached part of a body starting at offset Start.
+type byteRange struct {
+	Start int64  `json:"start"`
+	Data  []byte `json:"data"`
+}
+
+func (br byteRange) end() int64 {
+	return br.Start + int64(len(br.Data))
+}
+
+// rangeMu serializes updates to partial entries so concurrent requests for
+// ranges of the same body don't drop each other's ranges.
+var rangeMu sync.Mutex
+
+var errUnsatisfiableRange = errors.New("range not satisfiable")
+
+// rangeSpec is a single byte range from a Range header. An end of -1 means the
+// end of the body, and a start of -1 that end is a suffix length.
+type rangeSpec struct {
+	start, end int64
+}
+
+// parseRange parses a Range header holding a single byte range.
+func parseRange(header string) (rangeSpec, bool) {
+	if !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		return rangeSpec{}, false
+	}
+	parts := strings.SplitN(strings.TrimSpace(header[len("bytes="):]), "-", 2)
+	if len(parts) != 2 {
+		return rangeSpec{}, false
+	}
+	if parts[0] == "" {
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		return rangeSpec{-1, n}, err == nil && n > 0
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start < 0 {
+		return rangeSpec{}, false
+	}
+	if parts[1] == "" {
+		return rangeSpec{start, -1}, true
+	}
+	end, err := strconv.ParseInt(parts[1], 10, 64)
+	return rangeSpec{start, end}, err == nil && end >= start
+}
+
+// resolve returns the inclusive offsets rs covers in a body of size bytes.
+func (rs rangeSpec) resolve(size int64) (int64, int64, error) {
+	start, end := rs.start, rs.end
+	if start < 0 {
+		start = size - end
+		if start < 0 {
+			start = 0
+		}
+		end = size - 1
+	}
+	if end < 0 || end >= size {
+		end = size - 1
+	}
+	if start >= size {
+		return 0, 0, errUnsatisfiableRange
+	}
+	return start, end, nil
+}
+
+// addRange merges data at offset start into e's ranges, joining any that
+// overlap or touch.
+func (e *entry) addRange(start int64, data []byte) {
+	ranges := append(e.Ranges, byteRange{Start: start, Data: data})
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	merged := ranges[:1]
+	for _, br := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if br.Start > last.end() {
+			merged = append(merged, br)
+			continue
+		}
+		if br.end() > last.end() {
+			joined := make([]byte, br.end()-last.Start)
+			copy(joined, last.Data)
+			copy(joined[br.Start-last.Start:], br.Data)
+			last.Data = joined
+		}
+	}
+	e.Ranges = merged
+	e.Body = nil
+}
+
+// gaps returns the parts of [start, end] not yet cached in e.
+func (e *entry) gaps(start, end int64) []rangeSpec {
+	var gaps []rangeSpec
+	next := start
+	for _, br := range e.Ranges {
+		if br.end() <= next {
+			continue
+		}
+		if br.Start > end {
+			break
+		}
+		if br.Start > next {
+			gaps = append(gaps, rangeSpec{next, br.Start - 1})
+		}
+		next = br.end()
+	}
+	if next <= end {
+		gaps = append(gaps, rangeSpec{next, end})
+	}
+	return gaps
+}
+
+// slice returns bytes [start, end] of e, which must be cached.
+func (e *entry) slice(start, end int64) []byte {
+	for _, br := range e.Ranges {
+		if br.Start <= start && end < br.end() {
+			return br.Data[start-br.Start : end-br.Start+1]
+		}
+	}
+	return nil
+}
+
+// fetchRange fetches the range spec of path from the upstream and adds it to
+// e. The upstream may answer with the whole body, which is then cached whole.
+func fetchRange(e *entry, path string, header http.Header, spec string) error {
+	if !upstreamEnabled() {
+		return errUpstreamDisabled
+	}
+	req, err := newUpstreamRequest(http.MethodGet, path, header, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Del("If-Range")
+	req.Header.Set("Range", spec)
+	res, err := doWithRetry(traceConns(req))
+	if err != nil {
+		atomic.AddInt64(&stats.UpstreamErrors, 1)
+		return err
+	}
+	defer res.Body.Close()
+	body, err := readBody(bandwidth.reader(res.Body))
+	atomic.AddInt64(&stats.UpstreamBytes, int64(len(body)))
+	if err != nil {
+		atomic.AddInt64(&stats.UpstreamErrors, 1)
+		return err
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "" {
+		e.ContentType = ct
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		e.Ranges = nil
+		e.addRange(0, body)
+		e.Size = int64(len(body))
+		return nil
+	case http.StatusPartialContent:
+		var start, end, size int64
+		if _, err := fmt.Sscanf(res.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size); err != nil {
+			return fmt.Errorf("invalid Content-Range from upstream for %s: %q", path, res.Header.Get("Content-Range"))
+		}
+		e.addRange(start, body)
+		e.Size = size
+		return nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		return errUnsatisfiableRange
+	}
+	return fmt.Errorf("upstream answered range request for %s with %s", path, res.Status)
+}
+
+// servePartial answers a request for a single byte range in -range-cache
+// partial mode, fetching whichever parts of it aren't cached yet. It reports
+// whether it handled the request; requests for several ranges are left to be
+// served as usual.
+func servePartial(w http.ResponseWriter, r *http.Request, k requestKey) bool {
+	rs, ok := parseRange(r.Header.Get("Range"))
+	if !ok {
+		return false
+	}
+	path := r.RequestURI
+	k.key += keyRangeSep
+
+	rangeMu.Lock()
+	e, found := lookup(k)
+	if !found || !e.fresh(time.Now()) {
+		e = &entry{URL: path, Status: http.StatusPartialContent, Stored: time.Now()}
+	} else {
+		// ranges are added to a copy so readers of the cached entry
+		// never see it change
+		c := e.clone()
+		c.Ranges = append([]byteRange(nil), e.Ranges...)
+		e = c
+	}
+	if e.Size == 0 {
+		// the size is needed to know which part of the body the range is
+		if err := fetchRange(e, path, r.Header, r.Header.Get("Range")); err != nil {
+			rangeMu.Unlock()
+			servePartialError(w, err)
+			return true
+		}
+	}
+	start, end, err := rs.resolve(e.Size)
+	for _, gap := range e.gaps(start, end) {
+		if err != nil {
+			break
+		}
+		err = fetchRange(e, path, r.Header, fmt.Sprintf("bytes=%d-%d", gap.start, gap.end))
+	}
+	if err == nil {
+		e.Checksum = ""
+		err = storeEntry(k, e)
+	}
+	rangeMu.Unlock()
+	if err != nil {
+		servePartialError(w, err)
+		return true
+	}
+	data := e.slice(start, end)
+	if data == nil {
+		servePartialError(w, errUnsatisfiableRange)
+		return true
+	}
+	atomic.AddInt64(&e.hits, 1)
+	if e.ContentType != "" {
+		w.Header().Set("Content-Type", e.ContentType)
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, e.Size))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(data)
+	return true
+}
+
+func servePartialError(w http.ResponseWriter, err error) {
+	if err == errUnsatisfiableRange {
+		setOutcome(w, outcomeRejected)
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	setOutcome(w, outcomeError)
+	log.Printf("error fetching range: %s", err)
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+// serveRange answers a Range request from the whole cached body of e in
+// -range-cache full mode.
+func serveRange(w http.ResponseWriter, r *http.Request, e *entry) {
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(e.body()))
+}
@@ -0,0 +1,115 @@
+package devcache
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rangeUpstream serves a 100 byte body, recording the Range of each request.
+func rangeUpstream(t testing.TB) (*httptest.Server, []byte, func() []string) {
+	body := bytes.Repeat([]byte("0123456789"), 10)
+	var mu sync.Mutex
+	var requested []string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.Header.Get("Range"))
+		mu.Unlock()
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	}))
+	t.Cleanup(up.Close)
+	return up, body, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		r := requested
+		requested = nil
+		return r
+	}
+}
+
+func TestRangeCachePartial(t *testing.T) {
+	up, body, requested := rangeUpstream(t)
+	s := newTestServer(t, up.URL, "-range-cache", "partial")
+
+	for _, tt := range []struct {
+		name       string
+		start, end int
+		fetched    []string
+	}{
+		{"first", 10, 19, []string{"bytes=10-19"}},
+		{"overlapping", 15, 29, []string{"bytes=20-29"}},
+		{"adjacent", 30, 39, []string{"bytes=30-39"}},
+		{"cached", 12, 35, nil},
+		{"spanning a gap", 5, 45, []string{"bytes=5-9", "bytes=40-45"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := do(s.Handler(), "GET", "/big", http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", tt.start, tt.end)}})
+			if w.Code != http.StatusPartialContent {
+				t.Fatalf("status %d", w.Code)
+			}
+			if want := string(body[tt.start : tt.end+1]); w.Body.String() != want {
+				t.Errorf("body %q, want %q", w.Body, want)
+			}
+			if want := fmt.Sprintf("bytes %d-%d/100", tt.start, tt.end); w.Header().Get("Content-Range") != want {
+				t.Errorf("Content-Range %q, want %q", w.Header().Get("Content-Range"), want)
+			}
+			if got := requested(); !reflect.DeepEqual(got, tt.fetched) {
+				t.Errorf("fetched %q, want %q", got, tt.fetched)
+			}
+		})
+	}
+
+	// the overlapping and adjacent ranges were merged
+	v, found := Cache.Get("/big" + keyRangeSep)
+	if !found {
+		t.Fatal("ranges not cached")
+	}
+	ranges := v.(*entry).Ranges
+	if len(ranges) != 1 || ranges[0].Start != 5 || !bytes.Equal(ranges[0].Data, body[5:46]) {
+		t.Errorf("cached ranges %+v", ranges)
+	}
+	// and never answer a request for the whole body
+	if w := do(s.Handler(), "GET", "/big", nil); w.Body.String() != string(body) {
+		t.Errorf("whole body %q", w.Body)
+	}
+}
+
+func TestRangeCacheFull(t *testing.T) {
+	up, body, requested := rangeUpstream(t)
+	s := newTestServer(t, up.URL, "-range-cache", "full")
+
+	for _, spec := range []string{"bytes=10-19", "bytes=15-29", "bytes=-5"} {
+		w := do(s.Handler(), "GET", "/big", http.Header{"Range": {spec}})
+		if w.Code != http.StatusPartialContent {
+			t.Fatalf("%s: status %d", spec, w.Code)
+		}
+		if !strings.Contains(string(body), w.Body.String()) || w.Body.Len() == 0 {
+			t.Errorf("%s: body %q", spec, w.Body)
+		}
+	}
+	if got := requested(); len(got) != 1 || got[0] != "" {
+		t.Errorf("fetched %q, want the whole body once", got)
+	}
+}
+
+func TestAddRange(t *testing.T) {
+	e := &entry{}
+	e.addRange(20, []byte("cd"))
+	e.addRange(10, []byte("ab"))
+	e.addRange(12, []byte("xx"))
+	if len(e.Ranges) != 2 || e.Ranges[0].Start != 10 || string(e.Ranges[0].Data) != "abxx" {
+		t.Fatalf("ranges %+v", e.Ranges)
+	}
+	if got, want := e.gaps(0, 30), []rangeSpec{{0, 9}, {14, 19}, {22, 30}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("gaps %v, want %v", got, want)
+	}
+	if got := e.gaps(11, 13); got != nil {
+		t.Errorf("gaps in a cached range %v", got)
+	}
+}
@@ -0,0 +1,133 @@
+package devcache
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+	"github.com/travis-g/devcache/httpcache"
+)
+
+// errReadOnly is returned by storeEntry while the cache is read-only.
+var errReadOnly = errors.New("cache is read-only")
+
+// readOnly is nonzero while the cache is frozen, either with -read-only or
+// through the admin API. Nothing is stored, evicted or persisted, entries are
+// served however old they are and misses are proxied without being cached.
+var readOnly int32
+
+func cacheReadOnly() bool {
+	return atomic.LoadInt32(&readOnly) != 0
+}
+
+// frozen holds the expiration of every entry while the cache is read-only.
+// Entries are kept without one so they can't expire, and get their own back
+// when it's writable again.
+var frozen struct {
+	sync.Mutex
+	expirations map[string]int64
+}
+
+// setReadOnly freezes or thaws the cache.
+func setReadOnly(on bool) {
+	frozen.Lock()
+	defer frozen.Unlock()
+	if on == cacheReadOnly() {
+		return
+	}
+	if on {
+		atomic.StoreInt32(&readOnly, 1)
+		items := snapshotItems()
+		frozen.expirations = make(map[string]int64, len(items))
+		for key, item := range items {
+			frozen.expirations[key] = item.Expiration
+			Cache.Set(key, item.Object, cache.NoExpiration)
+		}
+		log.Printf("cache is read-only (%d entries frozen)", len(items))
+		return
+	}
+	for key, exp := range frozen.expirations {
+		v, found := Cache.Get(key)
+		switch {
+		case !found, exp == 0:
+		case time.Until(time.Unix(0, exp)) <= 0:
+			Cache.Delete(key)
+		default:
+			Cache.Set(key, v, time.Until(time.Unix(0, exp)))
+		}
+	}
+	frozen.expirations = nil
+	atomic.StoreInt32(&readOnly, 0)
+	log.Printf("cache is writable")
+}
+
+// freezeLoaded freezes the cache as it's loaded from items with -read-only.
+// Unlike setReadOnly, it keeps the entries that were saved already expired,
+// so they're served however old they are too.
+func freezeLoaded(items map[string]cache.Item) {
+	frozen.Lock()
+	defer frozen.Unlock()
+	atomic.StoreInt32(&readOnly, 1)
+	frozen.expirations = make(map[string]int64, len(items))
+	for key, item := range items {
+		frozen.expirations[key] = item.Expiration
+		item.Expiration = 0
+		items[key] = item
+	}
+	log.Printf("cache is read-only (%d entries frozen)", len(items))
+}
+
+// serveReadOnly answers a request while the cache is read-only: from the
+// entry found, if any, whether or not it's fresh, and otherwise from the
+// upstream without caching the response.
+func serveReadOnly(w http.ResponseWriter, r *http.Request, e *entry, found bool) {
+	switch {
+	case found:
+		atomic.AddInt64(&stats.Hits, 1)
+		setOutcome(w, outcomeHit)
+		if !e.fresh(time.Now()) {
+			w.Header().Add("Warning", httpcache.WarningStale)
+		}
+		serveEntry(w, r, e)
+	case upstreamEnabled():
+		atomic.AddInt64(&stats.Misses, 1)
+		setOutcome(w, outcomeUncached)
+		proxyLive(w, r)
+	default:
+		setOutcome(w, outcomeRejected)
+		serveMaintenance(w, r)
+	}
+}
+
+// refuseReadOnly answers admin requests that would change the cache with 403
+// Forbidden while it's read-only.
+func refuseReadOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cacheReadOnly() {
+			http.Error(w, errReadOnly.Error(), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleReadOnly reports whether the cache is read-only and, given an enabled
+// parameter, freezes or thaws it.
+func handleReadOnly(w http.ResponseWriter, r *http.Request) {
+	if v := r.URL.Query().Get("enabled"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "invalid enabled", http.StatusBadRequest)
+			return
+		}
+		setReadOnly(enabled)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"enabled": cacheReadOnly()})
+}
@@ -0,0 +1,29 @@
+package devcache
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestReadOnlyRefusesMutations(t *testing.T) {
+	s := newTestServer(t, "http://127.0.0.1:1", "-read-only")
+	for _, tt := range []struct {
+		method, target string
+		want           int
+	}{
+		{"POST", controlPrefix + "/stats/reset", http.StatusForbidden},
+		{"POST", controlPrefix + "/upstream?enabled=false", http.StatusForbidden},
+		{"GET", controlPrefix + "/upstream?enabled=false", http.StatusForbidden},
+		{"POST", controlPrefix + "/flush", http.StatusForbidden},
+		// reading the state is fine
+		{"GET", controlPrefix + "/upstream", http.StatusOK},
+		{"GET", controlPrefix + "/stats", http.StatusOK},
+	} {
+		if w := do(s.Handler(), tt.method, tt.target, nil); w.Code != tt.want {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.target, w.Code, tt.want)
+		}
+	}
+	if !upstreamEnabled() {
+		t.Error("the upstream was disabled")
+	}
+}
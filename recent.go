@@ -0,0 +1,226 @@
+package devcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Request outcomes recorded for each proxied request.
+const (
+	outcomeHit          = "hit"
+	outcomeMiss         = "miss"
+	outcomeStale        = "stale"
+	outcomeStaleIfError = "stale-if-error"
+	outcomeUncached     = "uncached"
+	outcomeError        = "error"
+	outcomeRejected     = "rejected"
+	outcomeBypass       = "bypass-token"
+)
+
+// cacheStatus is the X-Cache header value of responses with each outcome.
+// Errors and rejected requests have none.
+var cacheStatus = map[string]string{
+	outcomeHit:          "HIT",
+	outcomeMiss:         "MISS",
+	outcomeStale:        "STALE",
+	outcomeStaleIfError: "STALE",
+	outcomeUncached:     "MISS",
+	outcomeBypass:       "BYPASS",
+}
+
+// recent holds the most recently handled requests.
+var recent = newRequestRing(1000)
+
+// requestRecord summarizes a handled request. It never holds bodies, so the
+// ring's memory use stays predictable.
+type requestRecord struct {
+	Time     time.Time     `json:"time"`
+	Method   string        `json:"method"`
+	Path     string        `json:"path"`
+	Outcome  string        `json:"outcome"`
+	Status   int           `json:"status"`
+	Duration time.Duration `json:"duration_ns"`
+	Size     int           `json:"size"`
+	Client   string        `json:"client"`
+}
+
+// requestRing is a fixed-size ring buffer of request records that also fans
+// new records out to tail subscribers.
+type requestRing struct {
+	mu      sync.Mutex
+	records []requestRecord
+	next    int
+	full    bool
+	subs    map[chan requestRecord]struct{}
+}
+
+func newRequestRing(size int) *requestRing {
+	return &requestRing{
+		records: make([]requestRecord, size),
+		subs:    make(map[chan requestRecord]struct{}),
+	}
+}
+
+// add records rec and publishes it to subscribers. Subscribers that aren't
+// keeping up miss records rather than holding up the request.
+func (rr *requestRing) add(rec requestRecord) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if len(rr.records) > 0 {
+		rr.records[rr.next] = rec
+		rr.next = (rr.next + 1) % len(rr.records)
+		if rr.next == 0 {
+			rr.full = true
+		}
+	}
+	for ch := range rr.subs {
+		select {
+		case ch <- rec:
+		default:
+		}
+	}
+}
+
+// last returns up to n of the latest records matching outcome (any if
+// empty), oldest first.
+func (rr *requestRing) last(n int, outcome string) []requestRecord {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	count := rr.next
+	if rr.full {
+		count = len(rr.records)
+	}
+	var list []requestRecord
+	for i := 1; i <= count && len(list) < n; i++ {
+		rec := rr.records[(rr.next-i+len(rr.records))%len(rr.records)]
+		if outcome == "" || rec.Outcome == outcome {
+			list = append(list, rec)
+		}
+	}
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	return list
+}
+
+func (rr *requestRing) subscribe() chan requestRecord {
+	ch := make(chan requestRecord, 64)
+	rr.mu.Lock()
+	rr.subs[ch] = struct{}{}
+	rr.mu.Unlock()
+	return ch
+}
+
+func (rr *requestRing) unsubscribe(ch chan requestRecord) {
+	rr.mu.Lock()
+	delete(rr.subs, ch)
+	rr.mu.Unlock()
+}
+
+// responseRecorder captures what was written in response to a request, along
+// with how the cache handled it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	size    int
+	outcome string
+	// body keeps up to bodyLimit bytes of what was written.
+	body      []byte
+	bodyLimit int
+	// upstream is the time spent waiting on the upstream.
+	upstream time.Duration
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	if keep := rec.bodyLimit - len(rec.body); keep > 0 {
+		if keep > n {
+			keep = n
+		}
+		rec.body = append(rec.body, b[:keep]...)
+	}
+	rec.size += n
+	return n, err
+}
+
+// setOutcome notes how the cache handled the request being written to w, and
+// tells the client in the X-Cache header.
+func setOutcome(w http.ResponseWriter, outcome string) {
+	if status, ok := cacheStatus[outcome]; ok {
+		w.Header().Set("X-Cache", status)
+	}
+	if rec, ok := w.(*responseRecorder); ok {
+		rec.outcome = outcome
+	}
+}
+
+// handleRecent lists the latest requests. n limits how many are listed and
+// outcome filters them.
+func handleRecent(w http.ResponseWriter, r *http.Request) {
+	n, outcome, ok := recentParams(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recent.last(n, outcome))
+}
+
+// recentParams parses the n and outcome parameters of a request for recent
+// requests, answering it with an error if they're invalid.
+func recentParams(w http.ResponseWriter, r *http.Request) (int, string, bool) {
+	n := 200
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 0 {
+			http.Error(w, "invalid n", http.StatusBadRequest)
+			return 0, "", false
+		}
+	}
+	return n, r.URL.Query().Get("outcome"), true
+}
+
+// handleTail streams requests as server-sent events as they're handled.
+func handleTail(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	outcome := r.URL.Query().Get("outcome")
+	ch := recent.subscribe()
+	defer recent.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case rec := <-ch:
+			if outcome != "" && rec.Outcome != outcome {
+				continue
+			}
+			data, err := json.Marshal(rec)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
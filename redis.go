@@ -0,0 +1,251 @@
+package devcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+// Backends of -backend.
+const (
+	backendMemory = "memory"
+	backendRedis  = "redis"
+)
+
+// redisTimeout bounds each command sent to Redis, so a slow or unreachable
+// server degrades to cache misses rather than stalled requests.
+const redisTimeout = 2 * time.Second
+
+// shared is the Redis server shared by every instance with -backend redis, or
+// nil. Entries are still cached in memory: Redis is consulted on a miss, and
+// every entry stored is written to it, with its TTL as the key's expiration.
+var shared *redisClient
+
+// errRedisNil is returned for keys Redis doesn't have.
+var errRedisNil = errors.New("redis: nil")
+
+// redisClient is a minimal Redis client speaking RESP over one connection,
+// enough to get, set and delete entries.
+type redisClient struct {
+	addr     string
+	password string
+	prefix   string
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisRecord is an entry as written to Redis.
+type redisRecord struct {
+	Entry      *entry
+	Expiration int64
+}
+
+func newRedisClient(addr, password, prefix string) (*redisClient, error) {
+	c := &redisClient{addr: addr, password: password, prefix: prefix}
+	if _, err := c.do("PING"); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// do sends a command and returns its reply: a string, an int64, nil for a
+// missing bulk string or an error reply as an error. The connection is
+// dropped after any other error, to be made again by the next command.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.addr, redisTimeout)
+		if err != nil {
+			return nil, err
+		}
+		c.conn, c.r = conn, bufio.NewReader(conn)
+		if c.password != "" {
+			if _, err := c.roundTrip("AUTH", c.password); err != nil {
+				c.close()
+				return nil, err
+			}
+		}
+	}
+	reply, err := c.roundTrip(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		c.close()
+	}
+	return reply, err
+}
+
+func (c *redisClient) roundTrip(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// redisError is an error reply from Redis.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func (c *redisClient) readReply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		switch {
+		case err != nil || n < -1:
+			return nil, fmt.Errorf("redis: malformed bulk string length %q", line)
+		case n == -1:
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	}
+	return nil, fmt.Errorf("redis: unsupported reply type %q", kind)
+}
+
+// stop closes the connection to Redis, if one is open.
+func (c *redisClient) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.close()
+	}
+}
+
+func (c *redisClient) close() {
+	c.conn.Close()
+	c.conn, c.r = nil, nil
+}
+
+// get returns the entry saved under key, with when it expires.
+func (c *redisClient) get(key string) (*redisRecord, error) {
+	reply, err := c.do("GET", c.prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return nil, errRedisNil
+	}
+	rec := &redisRecord{}
+	if err := gob.NewDecoder(bytes.NewReader([]byte(data))).Decode(rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// set saves e under key for ttl, or for good if ttl isn't positive.
+func (c *redisClient) set(key string, e *entry, ttl time.Duration) error {
+	rec := redisRecord{Entry: e}
+	if ttl > 0 {
+		rec.Expiration = time.Now().Add(ttl).UnixNano()
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(rec); err != nil {
+		return err
+	}
+	args := []string{"SET", c.prefix + key, buf.String()}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(int64(ttl/time.Millisecond)+1, 10))
+	}
+	_, err := c.do(args...)
+	return err
+}
+
+func (c *redisClient) del(key string) error {
+	_, err := c.do("DEL", c.prefix+key)
+	return err
+}
+
+// sharedStore writes the entry just cached under key to the shared cache.
+func sharedStore(key string, e *entry, ttl time.Duration) {
+	if shared == nil {
+		return
+	}
+	if err := shared.set(key, e, ttl); err != nil {
+		atomic.AddInt64(&stats.RedisErrors, 1)
+		log.Printf("error saving %s to redis: %s", key, err)
+	}
+}
+
+// sharedLookup looks key up in the shared cache after a miss in memory. An
+// entry found is cached in memory too, for the rest of its TTL.
+func sharedLookup(key string) (interface{}, bool) {
+	if shared == nil {
+		return nil, false
+	}
+	rec, err := shared.get(key)
+	switch {
+	case err == errRedisNil:
+		return nil, false
+	case err != nil:
+		atomic.AddInt64(&stats.RedisErrors, 1)
+		log.Printf("error looking up %s in redis: %s", key, err)
+		return nil, false
+	}
+	ttl := cache.NoExpiration
+	if rec.Expiration > 0 {
+		if ttl = time.Until(time.Unix(0, rec.Expiration)); ttl <= 0 {
+			return nil, false
+		}
+	}
+	atomic.AddInt64(&stats.RedisHits, 1)
+	setEntry(key, rec.Entry, ttl)
+	varies.learn(key, rec.Entry)
+	return rec.Entry, true
+}
+
+// deleteEntry evicts the entry under key, from the shared cache, the -store
+// database and the -store-verify backends too. Entries shed to save memory are only evicted
+// with Cache.Delete, as the shared cache still has room for them.
+func deleteEntry(key string) {
+	Cache.Delete(key)
+	storedDelete(key)
+	if storeVerify != nil {
+		storeVerify.del(key)
+	}
+	if shared == nil {
+		return
+	}
+	if err := shared.del(key); err != nil {
+		atomic.AddInt64(&stats.RedisErrors, 1)
+		log.Printf("error deleting %s from redis: %s", key, err)
+	}
+}
@@ -0,0 +1,301 @@
+package devcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a Redis server holding strings in memory, speaking just
+// enough RESP for redisClient: PING, AUTH, GET, SET with PX and DEL.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu    sync.Mutex
+	data  map[string]string
+	px    map[string]int64
+	conns []net.Conn
+	dials int
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, password: password, data: map[string]string{}, px: map[string]int64{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns = append(f.conns, conn)
+			f.dials++
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		f.drop()
+	})
+	return f
+}
+
+func (f *fakeRedis) addr() string {
+	return f.ln.Addr().String()
+}
+
+// drop closes every connection made to f, as a restarting server would.
+func (f *fakeRedis) drop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakeRedis) get(key string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.data[key]
+	return v, ok
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	authed := f.password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write([]byte(f.exec(args, &authed))); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	var n int
+	if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		var size int
+		if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func (f *fakeRedis) exec(args []string, authed *bool) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := strings.ToUpper(args[0])
+	switch {
+	case cmd == "AUTH":
+		if args[1] != f.password {
+			return "-WRONGPASS invalid password\r\n"
+		}
+		*authed = true
+		return "+OK\r\n"
+	case !*authed:
+		return "-NOAUTH Authentication required.\r\n"
+	case cmd == "PING":
+		return "+PONG\r\n"
+	case cmd == "GET":
+		v, ok := f.data[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case cmd == "SET":
+		f.data[args[1]] = args[2]
+		delete(f.px, args[1])
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			f.px[args[1]], _ = strconv.ParseInt(args[4], 10, 64)
+		}
+		return "+OK\r\n"
+	case cmd == "DEL":
+		if _, ok := f.data[args[1]]; !ok {
+			return ":0\r\n"
+		}
+		delete(f.data, args[1])
+		return ":1\r\n"
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func TestRedisReadReply(t *testing.T) {
+	for _, tt := range []struct {
+		raw  string
+		want interface{}
+		err  string
+	}{
+		{"+OK\r\n", "OK", ""},
+		{":42\r\n", int64(42), ""},
+		{"$5\r\nhello\r\n", "hello", ""},
+		{"$0\r\n\r\n", "", ""},
+		{"$8\r\nbin\r\nary\r\n", "bin\r\nary", ""},
+		// a missing key
+		{"$-1\r\n", nil, ""},
+		{"-ERR wrong type\r\n", nil, "redis: ERR wrong type"},
+		{"$-2\r\n", nil, "malformed bulk string length"},
+		{"$five\r\n", nil, "malformed bulk string length"},
+		{"$5\r\nhel", nil, "EOF"},
+		{":x\r\n", nil, "invalid syntax"},
+		{"*1\r\n", nil, "unsupported reply type"},
+		{"\r\n", nil, "malformed reply"},
+	} {
+		c := &redisClient{r: bufio.NewReader(strings.NewReader(tt.raw))}
+		got, err := c.readReply()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: error %v, want %q", tt.raw, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %#v, %v, want %#v", tt.raw, got, err, tt.want)
+		}
+	}
+}
+
+func TestRedisReconnect(t *testing.T) {
+	f := newFakeRedis(t, "")
+	c, err := newRedisClient(f.addr(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.stop()
+
+	f.drop()
+	// the command on the dropped connection fails, and the next one dials
+	// again
+	if _, err := c.do("PING"); err == nil {
+		t.Error("command on a dropped connection succeeded")
+	}
+	if reply, err := c.do("PING"); err != nil || reply != "PONG" {
+		t.Fatalf("after reconnecting: %v, %v", reply, err)
+	}
+	// error replies leave the connection be
+	if _, err := c.do("FLUSHALL"); err == nil {
+		t.Error("error reply not returned")
+	}
+	c.do("PING")
+	f.mu.Lock()
+	dials := f.dials
+	f.mu.Unlock()
+	if dials != 2 {
+		t.Errorf("dialed %d times, want 2", dials)
+	}
+}
+
+func TestRedisAuth(t *testing.T) {
+	f := newFakeRedis(t, "s3cret")
+	if _, err := newRedisClient(f.addr(), "", ""); err == nil || !strings.Contains(err.Error(), "NOAUTH") {
+		t.Errorf("without a password: %v", err)
+	}
+	if _, err := newRedisClient(f.addr(), "wrong", ""); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("with the wrong password: %v", err)
+	}
+	c, err := newRedisClient(f.addr(), "s3cret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.stop()
+
+	// and connections made again authenticate again
+	f.drop()
+	c.do("PING")
+	if reply, err := c.do("PING"); err != nil || reply != "PONG" {
+		t.Errorf("after reconnecting: %v, %v", reply, err)
+	}
+}
+
+func TestRedisBackend(t *testing.T) {
+	f := newFakeRedis(t, "")
+	var fetches int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&fetches, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("body of " + r.URL.Path))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL, "-backend", "redis", "-redis-addr", f.addr(), "-redis-prefix", "dc:")
+
+	// entries are written through, expiring once they may no longer be
+	// served stale
+	do(s.Handler(), "GET", "/a", nil)
+	if _, ok := f.get("dc:/a"); !ok {
+		t.Fatal("entry not written to redis")
+	}
+	v, _ := Cache.Get("/a")
+	e := v.(*entry)
+	ttl := time.Until(e.Expires) + e.retention()
+	f.mu.Lock()
+	px := time.Duration(f.px["dc:/a"]) * time.Millisecond
+	f.mu.Unlock()
+	if d := px - ttl; d < 0 || d > time.Second {
+		t.Errorf("PX %s, want %s", px, ttl)
+	}
+
+	// another instance's entry is found there, for the rest of its TTL
+	Cache.Delete("/a")
+	if w := do(s.Handler(), "GET", "/a", nil); w.Header().Get("X-Cache") != "HIT" || w.Body.String() != "body of /a" {
+		t.Errorf("shared entry: %s %q", w.Header().Get("X-Cache"), w.Body)
+	}
+	if _, exp, found := Cache.GetWithExpiration("/a"); !found || exp.Sub(e.Stored) < ttl-time.Second || exp.Sub(e.Stored) > ttl+time.Second {
+		t.Errorf("cached in memory until %s, want %s after it was stored", exp, ttl)
+	}
+	if n := atomic.LoadInt64(&stats.RedisHits); n != 1 {
+		t.Errorf("%d redis hits, want 1", n)
+	}
+
+	// records past their expiration are ignored
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(redisRecord{
+		Entry:      &entry{Body: []byte("old"), Stored: time.Now().Add(-time.Hour)},
+		Expiration: time.Now().Add(-time.Minute).UnixNano(),
+	})
+	f.mu.Lock()
+	f.data["dc:/b"] = buf.String()
+	f.mu.Unlock()
+	if w := do(s.Handler(), "GET", "/b", nil); w.Body.String() != "body of /b" {
+		t.Errorf("expired record served: %q", w.Body)
+	}
+
+	// and purges reach it
+	if w := do(s.Handler(), "POST", controlPrefix+"/purge?key=/a", nil); w.Code != http.StatusOK {
+		t.Fatalf("purge: status %d", w.Code)
+	}
+	if _, ok := f.get("dc:/a"); ok {
+		t.Error("purged entry left in redis")
+	}
+	if n := atomic.LoadInt64(&fetches); n != 2 {
+		t.Errorf("fetched %d times, want 2", n)
+	}
+}
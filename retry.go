@@ -0,0 +1,92 @@
+package devcache
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// statusRanges is a flag.Value for a comma-separated list of status codes,
+// classes or ranges, as accepted by -transform.
+type statusRanges []statusRange
+
+func (s *statusRanges) String() string {
+	var ranges []string
+	for _, sr := range *s {
+		ranges = append(ranges, fmt.Sprintf("%d-%d", sr.min, sr.max))
+	}
+	return strings.Join(ranges, ",")
+}
+
+func (s *statusRanges) Set(v string) error {
+	*s = nil
+	for _, r := range strings.Split(v, ",") {
+		sr, err := parseStatusRange(strings.TrimSpace(r))
+		if err != nil {
+			return err
+		}
+		*s = append(*s, sr)
+	}
+	return nil
+}
+
+func (s statusRanges) contains(status int) bool {
+	for _, sr := range s {
+		if sr.contains(status) {
+			return true
+		}
+	}
+	return false
+}
+
+// doWithRetry sends req to the upstream, retrying up to -retries times after
+// transport errors and responses with a -retry-status status. The wait
+// between attempts starts at -retry-backoff and doubles each time. No attempt
+// is started that couldn't finish before the upstream timeout, counted from
+// the first attempt, so retries never make a request wait longer than a
+// single fetch could.
+func doWithRetry(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	deadline := start.Add(upstreamClient.Timeout)
+	backoff := flagRetryBackoff
+	for attempt := 0; ; attempt++ {
+		res, err := upstreamClient.Do(req)
+		retry := err != nil || flagRetryStatus.contains(res.StatusCode)
+		if !retry || attempt >= flagRetries ||
+			upstreamClient.Timeout > 0 && time.Now().Add(backoff).After(deadline) {
+			fr := fetchResult{
+				host:     req.URL.Host,
+				path:     req.URL.Path,
+				attempts: attempt + 1,
+				latency:  time.Since(start),
+				err:      err,
+			}
+			if err == nil {
+				fr.status = res.StatusCode
+			}
+			health.record(fr)
+			upstreamLatency.observe(fr.host, fr.latency)
+			return res, err
+		}
+		if err != nil {
+			log.Printf("retrying %s after error: %s", req.URL, err)
+		} else {
+			log.Printf("retrying %s after status %d", req.URL, res.StatusCode)
+			// drain the body so the connection can be reused
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if req.GetBody != nil {
+			// the body was sent by the failed attempt
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package devcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyUpstream answers with status for the first fails requests of each
+// path, and with 200 after.
+func flakyUpstream(status, fails int) (*httptest.Server, *int64) {
+	var calls int64
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&calls, 1) <= int64(fails) {
+			w.WriteHeader(status)
+			w.Write([]byte("failed"))
+			return
+		}
+		w.Write([]byte("ok"))
+	})), &calls
+}
+
+func TestRetryStatus(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		status    int
+		wantCalls int64
+		wantCode  int
+	}{
+		{"retried 503 succeeds", http.StatusServiceUnavailable, 3, http.StatusOK},
+		{"404 isn't retried", http.StatusNotFound, 1, http.StatusNotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			up, calls := flakyUpstream(tt.status, 2)
+			defer up.Close()
+			s := newTestServer(t, up.URL, "-retries", "3", "-retry-backoff", "1ms", "-retry-status", "502,503")
+			w := do(s.Handler(), "GET", "/a", nil)
+			if w.Code != tt.wantCode {
+				t.Errorf("status %d, want %d", w.Code, tt.wantCode)
+			}
+			if n := atomic.LoadInt64(calls); n != tt.wantCalls {
+				t.Errorf("upstream called %d times, want %d", n, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	up, calls := flakyUpstream(http.StatusServiceUnavailable, 100)
+	defer up.Close()
+	newTestServer(t, up.URL, "-retries", "10", "-retry-backoff", "60ms", "-retry-status", "503")
+	timeout := upstreamClient.Timeout
+	upstreamClient.Timeout = 100 * time.Millisecond
+	defer func() { upstreamClient.Timeout = timeout }()
+
+	req, _ := http.NewRequest("GET", up.URL+"/a", nil)
+	start := time.Now()
+	res, err := doWithRetry(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	// the second attempt starts at 60ms; a third would start after the
+	// 100ms the first attempt had
+	if n := atomic.LoadInt64(calls); n != 2 {
+		t.Errorf("upstream called %d times, want 2", n)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("retries took %s, past the deadline", elapsed)
+	}
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want the last 503", res.StatusCode)
+	}
+}
@@ -0,0 +1,63 @@
+package devcache
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/travis-g/devcache/httpcache"
+)
+
+// revalidating holds the keys being refreshed in the background, so requests
+// for an entry that expired start a single refresh between them.
+var revalidating sync.Map
+
+// revalidateWindow returns how long past expiry the entry is served at once
+// while it's refreshed in the background: as long as the upstream allowed
+// with stale-while-revalidate, or else -stale-while-revalidate.
+func (e *entry) revalidateWindow() time.Duration {
+	if e.Freshness.MustRevalidate {
+		return 0
+	}
+	if e.StaleWhileRevalidate > 0 {
+		return e.StaleWhileRevalidate
+	}
+	return flagStaleWhileRevalidate
+}
+
+// serveWhileRevalidating serves the expired entry e without waiting, and
+// refreshes it in the background unless a refresh is already under way.
+func serveWhileRevalidating(w http.ResponseWriter, r *http.Request, e *entry, k requestKey, path string) {
+	atomic.AddInt64(&stats.StaleWhileRevalidate, 1)
+	setOutcome(w, outcomeStale)
+	if flagStaleWarnings {
+		w.Header().Add("Warning", httpcache.WarningStale)
+	}
+	revalidate(k, path, r.Header)
+	serveEntry(w, r, e)
+}
+
+// revalidate refreshes the entry under k in the background. Refreshes that
+// don't fit in the background queue are skipped; the next request for the
+// entry tries again.
+func revalidate(k requestKey, path string, header http.Header) {
+	if _, busy := revalidating.LoadOrStore(k.String(), struct{}{}); busy {
+		return
+	}
+	header = header.Clone()
+	refresh := func() {
+		defer revalidating.Delete(k.String())
+		_, err := flights.do(k.String(), func() (*entry, error) {
+			return fetch(k, path, header, sourceRefresh)
+		})
+		if err != nil {
+			log.Printf("error revalidating %s: %s", path, err)
+		}
+	}
+	if !background.submit(taskRefresh, refresh, false) {
+		revalidating.Delete(k.String())
+		debugf("no room to revalidate %s", path)
+	}
+}
@@ -0,0 +1,188 @@
+package devcache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/travis-g/devcache/httpcache"
+)
+
+// Behaviors of staleUpstream.
+const (
+	upstreamOK int32 = iota
+	upstreamFailing
+	upstreamSlow
+)
+
+// staleUpstream serves every path with a minute's freshness and the
+// Cache-Control extensions named by the path, behaving as *mode says.
+func staleUpstream(t testing.TB, mode *int32) *httptest.Server {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.LoadInt32(mode) {
+		case upstreamFailing:
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		case upstreamSlow:
+			time.Sleep(200 * time.Millisecond)
+		}
+		cc := "max-age=60"
+		switch r.URL.Path {
+		case "/stale-if-error":
+			cc += ", stale-if-error=600"
+		case "/stale-while-revalidate":
+			cc += ", stale-while-revalidate=600"
+		}
+		w.Header().Set("Cache-Control", cc)
+		w.Write([]byte("body of " + r.URL.Path))
+	}))
+	t.Cleanup(up.Close)
+	return up
+}
+
+// expire makes the entry cached under key stale.
+func expire(t testing.TB, key string) {
+	t.Helper()
+	v, found := Cache.Get(key)
+	if !found {
+		t.Fatalf("%s not cached", key)
+	}
+	v.(*entry).Expires = time.Now().Add(-time.Second)
+}
+
+func TestStaleWarnings(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		args []string
+		path string
+		mode int32
+		want []string
+	}{
+		{"fresh", nil, "/stale-if-error", upstreamFailing, nil},
+		{"stale-if-error", nil, "/stale-if-error", upstreamFailing, []string{httpcache.WarningStale, httpcache.WarningRevalidationFailed}},
+		{"-serve-stale", []string{"-serve-stale"}, "/plain", upstreamFailing, []string{httpcache.WarningStale, httpcache.WarningRevalidationFailed}},
+		{"stale-while-revalidate", nil, "/stale-while-revalidate", upstreamOK, []string{httpcache.WarningStale}},
+		{"-fetch-budget", []string{"-fetch-budget", "20ms"}, "/plain", upstreamSlow, []string{httpcache.WarningStale}},
+		{"upstream disabled", nil, "/plain", upstreamOK, []string{httpcache.WarningStale}},
+		{"-stale-warnings=false", []string{"-stale-warnings=false"}, "/stale-if-error", upstreamFailing, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var mode int32
+			s := newTestServer(t, staleUpstream(t, &mode).URL, tt.args...)
+			do(s.Handler(), "GET", tt.path, nil)
+			if tt.name != "fresh" {
+				expire(t, tt.path)
+			}
+			if tt.name == "upstream disabled" {
+				atomic.StoreInt32(&upstreamDisabled, 1)
+			}
+			atomic.StoreInt32(&mode, tt.mode)
+
+			w := do(s.Handler(), "GET", tt.path, nil)
+			if w.Body.String() != "body of "+tt.path {
+				t.Fatalf("served %d %q", w.Code, w.Body)
+			}
+			if got := w.Header()["Warning"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Warning %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	var fetches int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&fetches, 1)
+		if n > 1 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(w, "v%d", n)
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL, "-stale-while-revalidate", "1m")
+	do(s.Handler(), "GET", "/a", nil)
+	expire(t, "/a")
+
+	// the stale entry is served at once, however many ask for it, while a
+	// single refresh runs
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		w := do(s.Handler(), "GET", "/a", nil)
+		if w.Body.String() != "v1" || w.Header().Get("X-Cache") != "STALE" {
+			t.Errorf("while refreshing: %s %q", w.Header().Get("X-Cache"), w.Body)
+		}
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("stale entries took %s to serve", d)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for do(s.Handler(), "GET", "/a", nil).Body.String() != "v2" {
+		if time.Now().After(deadline) {
+			t.Fatal("entry not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&fetches); n != 2 {
+		t.Errorf("fetched %d times, want 2", n)
+	}
+
+	// past the window the request waits for the refresh
+	v, _ := Cache.Get("/a")
+	v.(*entry).Expires = time.Now().Add(-2 * time.Minute)
+	if w := do(s.Handler(), "GET", "/a", nil); w.Body.String() != "v3" || w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("past the window: %s %q", w.Header().Get("X-Cache"), w.Body)
+	}
+}
+
+func TestServeStale(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		args []string
+		// fail is how refreshing fails: with a status, or 0 to drop the
+		// connection
+		fail    int
+		expired time.Duration
+		stale   bool
+	}{
+		{"server error", []string{"-serve-stale"}, http.StatusBadGateway, time.Second, true},
+		{"connection dropped", []string{"-serve-stale"}, 0, time.Second, true},
+		{"without -serve-stale", nil, http.StatusBadGateway, time.Second, false},
+		{"past -stale-max", []string{"-serve-stale", "-stale-max", "1m"}, http.StatusBadGateway, 2 * time.Minute, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var failing int32
+			up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.LoadInt32(&failing) == 0 {
+					w.Header().Set("Cache-Control", "max-age=60")
+					w.Write([]byte("cached"))
+					return
+				}
+				if tt.fail != 0 {
+					w.WriteHeader(tt.fail)
+					return
+				}
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+			}))
+			defer up.Close()
+			s := newTestServer(t, up.URL, tt.args...)
+			do(s.Handler(), "GET", "/a", nil)
+			v, _ := Cache.Get("/a")
+			v.(*entry).Expires = time.Now().Add(-tt.expired)
+			atomic.StoreInt32(&failing, 1)
+
+			w := do(s.Handler(), "GET", "/a", nil)
+			if stale := w.Code == http.StatusOK && w.Body.String() == "cached"; stale != tt.stale {
+				t.Errorf("served %d %q, stale %v, want %v", w.Code, w.Body, stale, tt.stale)
+			}
+			if tt.stale && w.Header().Get("X-Cache") != "STALE" {
+				t.Errorf("X-Cache %q, want STALE", w.Header().Get("X-Cache"))
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package devcache
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// seed is the seed of rng, logged at startup so a run's random decisions can
+// be reproduced with -seed.
+var seed int64
+
+// rng is the single source of randomness for every randomized behavior of the
+// server, so runs with the same seed, flags and requests decide the same way.
+// Features draw from it in the order requests are handled:
+//   - mirroring draws once per request to decide whether to sample it, if
+//     -mirror-sample is below 1.
+//   - -store-verify draws once per entry looked up to decide whether to
+//     compare it, if -store-verify-sample is below 1.
+var rng = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(1))}
+
+// seedRand seeds rng with s, or with the time if s is 0, and returns the seed
+// used.
+func seedRand(s int64) int64 {
+	if s == 0 {
+		s = time.Now().UnixNano()
+	}
+	rng.Lock()
+	rng.Rand = rand.New(rand.NewSource(s))
+	rng.Unlock()
+	seed = s
+	return s
+}
+
+// randFloat64 returns a number in [0, 1) from rng.
+func randFloat64() float64 {
+	rng.Lock()
+	defer rng.Unlock()
+	return rng.Float64()
+}
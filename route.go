@@ -0,0 +1,198 @@
+package devcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// authMode is how a route treats the client's Authorization header.
+type authMode string
+
+const (
+	// authDefault leaves the header as the global behavior does.
+	authDefault authMode = ""
+	// authForward forwards the header and caches per credential.
+	authForward authMode = "forward"
+	// authReplace swaps the header for a configured service credential, so
+	// responses are shared between clients.
+	authReplace authMode = "replace"
+	// authStrip removes the header, so responses are shared between clients.
+	authStrip authMode = "strip"
+	// authRequire rejects requests without the header and otherwise behaves
+	// like authForward.
+	authRequire authMode = "require"
+)
+
+// route sends requests under a path prefix to its own upstream.
+type route struct {
+	prefix   string
+	upstream string
+	auth     authMode
+	// authHeader and authValue are injected in authReplace mode.
+	authHeader string
+	authValue  string
+}
+
+// perCredential reports whether responses on the route are private to the
+// credentials they were fetched with.
+func (rt *route) perCredential() bool {
+	return rt != nil && (rt.auth == authForward || rt.auth == authRequire)
+}
+
+// sharesCredentialed reports whether responses fetched with the client's
+// credentials are cached under a key shared with other clients.
+func (rt *route) sharesCredentialed() bool {
+	return rt == nil || rt.auth == authDefault
+}
+
+// applyAuth rewrites the headers to forward upstream according to the route's
+// auth mode.
+func (rt *route) applyAuth(h http.Header) {
+	if rt == nil {
+		return
+	}
+	switch rt.auth {
+	case authReplace:
+		h.Del("Authorization")
+		h.Set(rt.authHeader, rt.authValue)
+	case authStrip:
+		h.Del("Authorization")
+	}
+}
+
+// credentialDigest returns a short digest identifying the credentials in h.
+func credentialDigest(h http.Header) string {
+	auth := h.Get("Authorization")
+	if auth == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(auth))
+	return hex.EncodeToString(sum[:8])
+}
+
+// routeList is the set of configured routes, set with the -route flag.
+type routeList []*route
+
+func (rs *routeList) String() string {
+	var specs []string
+	for _, rt := range *rs {
+		spec := rt.prefix + "=" + rt.upstream
+		if rt.auth != authDefault {
+			spec += ";auth=" + string(rt.auth)
+		}
+		specs = append(specs, spec)
+	}
+	return strings.Join(specs, " ")
+}
+
+// Set adds a route given as PREFIX=URL, optionally followed by ;auth=MODE
+// where MODE is forward, strip, require or replace:HEADER: VALUE.
+func (rs *routeList) Set(spec string) error {
+	parts := strings.Split(spec, ";")
+	i := strings.Index(parts[0], "=")
+	if i <= 0 || i == len(parts[0])-1 {
+		return fmt.Errorf("route %q must be PREFIX=URL", spec)
+	}
+	rt := &route{prefix: parts[0][:i], upstream: parts[0][i+1:]}
+	for _, opt := range parts[1:] {
+		opt = strings.TrimSpace(opt)
+		if !strings.HasPrefix(opt, "auth=") {
+			return fmt.Errorf("route %q: unknown option %q", spec, opt)
+		}
+		if err := rt.setAuth(strings.TrimPrefix(opt, "auth=")); err != nil {
+			return fmt.Errorf("route %q: %s", spec, err)
+		}
+	}
+	*rs = append(*rs, rt)
+	return nil
+}
+
+func (rs *routeList) repeatable() {}
+
+func (rt *route) setAuth(mode string) error {
+	switch authMode(mode) {
+	case authForward, authStrip, authRequire:
+		rt.auth = authMode(mode)
+		return nil
+	}
+	if !strings.HasPrefix(mode, "replace") {
+		return fmt.Errorf("unknown auth mode %q", mode)
+	}
+	spec := strings.TrimPrefix(strings.TrimPrefix(mode, "replace"), ":")
+	i := strings.Index(spec, ":")
+	if i <= 0 || strings.TrimSpace(spec[i+1:]) == "" {
+		return fmt.Errorf("auth replace needs a header, as replace:HEADER: VALUE")
+	}
+	rt.auth = authReplace
+	rt.authHeader = strings.TrimSpace(spec[:i])
+	rt.authValue = strings.TrimSpace(spec[i+1:])
+	return nil
+}
+
+// match returns the route with the longest prefix matching path, or nil if
+// the path goes to the default upstream.
+func (rs routeList) match(path string) *route {
+	var best *route
+	for _, rt := range rs {
+		if strings.HasPrefix(path, rt.prefix) && (best == nil || len(rt.prefix) > len(best.prefix)) {
+			best = rt
+		}
+	}
+	return best
+}
+
+// upstreamSet is the set of named upstreams requests can select, set with
+// the -upstream flag.
+type upstreamSet map[string]string
+
+func (us *upstreamSet) String() string {
+	var specs []string
+	for name, u := range *us {
+		specs = append(specs, name+"="+u)
+	}
+	return strings.Join(specs, " ")
+}
+
+// Set adds an upstream given as NAME=URL.
+func (us *upstreamSet) Set(spec string) error {
+	i := strings.Index(spec, "=")
+	if i <= 0 || i == len(spec)-1 {
+		return fmt.Errorf("upstream %q must be NAME=URL", spec)
+	}
+	if *us == nil {
+		*us = upstreamSet{}
+	}
+	(*us)[spec[:i]] = spec[i+1:]
+	return nil
+}
+
+func (us *upstreamSet) repeatable() {}
+
+// selectedUpstream returns the name of the upstream a request selected with
+// the -upstream-header header, if any, and whether that name is configured.
+func selectedUpstream(h http.Header) (string, bool) {
+	if flagUpstreamHeader == "" {
+		return "", true
+	}
+	name := h.Get(flagUpstreamHeader)
+	if name == "" {
+		return "", true
+	}
+	_, ok := flagUpstreams[name]
+	return name, ok
+}
+
+// upstreamFor returns the base URL a request with header h is sent to: the
+// upstream it selected, or else its route's, or else -url.
+func upstreamFor(rt *route, h http.Header) string {
+	if name, ok := selectedUpstream(h); ok && name != "" {
+		return flagUpstreams[name]
+	}
+	if rt == nil {
+		return flagURL
+	}
+	return rt.upstream
+}
@@ -0,0 +1,71 @@
+package devcache
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// expirySchedule is a set of times of day, in UTC, at which every entry
+// expires. It's set with -expire-at.
+type expirySchedule struct {
+	// offsets are the times of day as durations since midnight, sorted.
+	offsets []time.Duration
+	spec    string
+}
+
+func (s *expirySchedule) String() string {
+	return s.spec
+}
+
+// Set parses a comma-separated list of UTC times of day (HH:MM or
+// HH:MM:SS), or one of @hourly and @daily.
+func (s *expirySchedule) Set(spec string) error {
+	var offsets []time.Duration
+	switch spec {
+	case "@daily":
+		offsets = []time.Duration{0}
+	case "@hourly":
+		for h := 0; h < 24; h++ {
+			offsets = append(offsets, time.Duration(h)*time.Hour)
+		}
+	default:
+		for _, part := range strings.Split(spec, ",") {
+			part = strings.TrimSpace(part)
+			layout := "15:04"
+			if strings.Count(part, ":") == 2 {
+				layout = "15:04:05"
+			}
+			t, err := time.Parse(layout, part)
+			if err != nil {
+				return fmt.Errorf("invalid time of day %q", part)
+			}
+			offsets = append(offsets, t.Sub(t.Truncate(24*time.Hour)))
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	s.offsets, s.spec = offsets, spec
+	return nil
+}
+
+// next returns the first scheduled time after now.
+func (s *expirySchedule) next(now time.Time) time.Time {
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	for _, off := range s.offsets {
+		if t := midnight.Add(off); t.After(now) {
+			return t
+		}
+	}
+	return midnight.AddDate(0, 0, 1).Add(s.offsets[0])
+}
+
+// until returns how long from now until the next scheduled time, and whether
+// a schedule is set at all.
+func (s *expirySchedule) until(now time.Time) (time.Duration, bool) {
+	if len(s.offsets) == 0 {
+		return 0, false
+	}
+	return s.next(now).Sub(now), true
+}
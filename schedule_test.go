@@ -0,0 +1,72 @@
+package devcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiryScheduleNext(t *testing.T) {
+	day := func(d int, hms string) time.Time {
+		t, err := time.Parse("15:04:05", hms)
+		if err != nil {
+			panic(err)
+		}
+		return time.Date(2024, 12, d, t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+	}
+	for _, tt := range []struct {
+		spec string
+		now  time.Time
+		want time.Time
+	}{
+		{"@daily", day(30, "15:00:00"), day(31, "00:00:00")},
+		// across the boundary, and across a month and a year
+		{"@daily", day(31, "23:59:59"), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", day(30, "15:30:00"), day(30, "16:00:00")},
+		{"@hourly", day(30, "23:30:00"), day(31, "00:00:00")},
+		{"00:00,12:00", day(30, "11:59:59"), day(30, "12:00:00")},
+		{"00:00,12:00", day(30, "12:00:00"), day(31, "00:00:00")},
+		{"12:00, 06:30:15", day(30, "01:00:00"), day(30, "06:30:15")},
+		{"23:00", day(30, "22:00:00"), day(30, "23:00:00")},
+	} {
+		var s expirySchedule
+		if err := s.Set(tt.spec); err != nil {
+			t.Fatalf("%q: %s", tt.spec, err)
+		}
+		if got := s.next(tt.now); !got.Equal(tt.want) {
+			t.Errorf("%q at %s: got %s, want %s", tt.spec, tt.now, got, tt.want)
+		}
+		// a local time is compared in UTC
+		local := tt.now.In(time.FixedZone("UTC+5", 5*3600))
+		if got := s.next(local); !got.Equal(tt.want) {
+			t.Errorf("%q at %s: got %s, want %s", tt.spec, local, got, tt.want)
+		}
+	}
+}
+
+func TestExpiryScheduleUntil(t *testing.T) {
+	var s expirySchedule
+	if _, ok := s.until(time.Now()); ok {
+		t.Error("empty schedule is set")
+	}
+	if err := s.Set("00:00"); err != nil {
+		t.Fatal(err)
+	}
+	before := time.Date(2024, 12, 31, 23, 59, 0, 0, time.UTC)
+	if ttl, ok := s.until(before); !ok || ttl != time.Minute {
+		t.Errorf("a minute before midnight: got %s, %v", ttl, ok)
+	}
+	after := before.Add(2 * time.Minute)
+	if ttl, ok := s.until(after); !ok || ttl != 24*time.Hour-time.Minute {
+		t.Errorf("a minute after midnight: got %s, %v", ttl, ok)
+	}
+}
+
+func TestExpiryScheduleInvalid(t *testing.T) {
+	for _, spec := range []string{"", "25:00", "noon", "12:00,", "@weekly"} {
+		var s expirySchedule
+		if err := s.Set(spec); err == nil {
+			t.Errorf("%q accepted", spec)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package devcache
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// adminPrefix and controlPrefix are the path prefixes reserved for devcache's
+// own endpoints. Paths under them are never proxied.
+const (
+	adminPrefix   = "/_devcache"
+	controlPrefix = "/__cache"
+)
+
+// newServer returns a server with all routes registered. If separateAdmin is
+// set the admin endpoints are only served by s.admin rather than alongside the
+// proxy.
+func newServer(separateAdmin bool) *server {
+	s := &server{router: mux.NewRouter()}
+	// paths are cache keys, so they must reach the proxy exactly as sent
+	s.router.SkipClean(true)
+	s.admin = s.router
+	if separateAdmin {
+		s.admin = mux.NewRouter()
+	}
+	s.routes()
+	return s
+}
+
+func (s *server) routes() {
+	s.admin.HandleFunc("/healthz", handleHealthz).Methods("GET")
+	s.admin.HandleFunc("/readyz", handleReadyz).Methods("GET")
+	s.admin.Handle("/debug/vars", expvar.Handler()).Methods("GET")
+	s.admin.HandleFunc("/metrics", s.handleMetrics).Methods("GET")
+
+	admin := s.admin.PathPrefix(adminPrefix).Subrouter()
+	admin.Use(adminAuth, apiVersion)
+	s.apiRoutes(admin)
+	admin.HandleFunc("/misses", handleMisses).Methods("GET")
+	admin.HandleFunc("/recent", handleRecent).Methods("GET")
+	admin.HandleFunc("/tail", handleTail).Methods("GET")
+	admin.HandleFunc("/assert-report", handleAssertReport).Methods("GET")
+	admin.HandleFunc("/store-verify", handleStoreVerify).Methods("GET")
+	admin.HandleFunc("/size-budgets", handleSizeBudgets).Methods("GET")
+	tenantRoute(admin.HandleFunc("/entries", handleEntries).Methods("GET"))
+	tenantRoute(admin.HandleFunc("/export", handleExport).Methods("POST"))
+	admin.HandleFunc("/import", refuseReadOnly(handleImport)).Methods("POST")
+	admin.HandleFunc("/upstreams", handleUpstreams).Methods("GET")
+	admin.HandleFunc("/errors", handleErrors).Methods("GET")
+	admin.HandleFunc("/session/start", refuseReadOnly(handleSessionStart)).Methods("POST")
+	admin.HandleFunc("/session/stop", handleSessionStop).Methods("POST")
+	admin.HandleFunc("/session/{name}/export", handleSessionExport).Methods("GET")
+
+	control := s.admin.PathPrefix(controlPrefix).Subrouter()
+	control.Use(adminAuth)
+	control.HandleFunc("/", s.handleIndex).Methods("GET")
+	tenantRoute(control.HandleFunc("/invalidate", refuseReadOnly(handleInvalidate)).Methods("POST"))
+	tenantRoute(control.HandleFunc("/purge", refuseReadOnly(handlePurge)).Methods("POST"))
+	tenantRoute(control.HandleFunc("/flush", refuseReadOnly(handleFlush)).Methods("POST"))
+	control.HandleFunc("/stats", s.handleStats).Methods("GET")
+	control.HandleFunc("/stats/reset", refuseReadOnly(handleStatsReset)).Methods("POST")
+	control.HandleFunc("/upstream", refuseReadOnly(handleUpstream)).Methods("POST")
+	control.HandleFunc("/upstream", refuseReadOnly(handleUpstream)).Methods("GET").Queries("enabled", "{enabled}")
+	control.HandleFunc("/upstream", handleUpstream).Methods("GET")
+	control.HandleFunc("/read-only", handleReadOnly).Methods("GET", "POST")
+	tenantRoute(control.HandleFunc("/tenants", handleTenants).Methods("GET"))
+	tenantRoute(control.HandleFunc("/key", s.handleKey).Methods("GET"))
+
+	handler := http.HandlerFunc(handleRequest)
+	s.router.PathPrefix("/").Handler(viaMiddleware(loggingMiddleware(tenantMiddleware(s.varyMiddleware(cachingMiddleware(handler))))))
+}
+
+// fingerprintKey is the context key a request's VaryFunc fingerprint is
+// stored under.
+type fingerprintKey struct{}
+
+// varyMiddleware computes the fingerprint of proxied requests for keyFor. It
+// consults s.VaryFunc per request so it may be set after newServer returns.
+func (s *server) varyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.VaryFunc != nil {
+			if fp := s.VaryFunc(r); fp != "" {
+				r = r.WithContext(context.WithValue(r.Context(), fingerprintKey{}, fp))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// fingerprint returns the VaryFunc fingerprint computed for r, if any.
+func fingerprint(r *http.Request) string {
+	fp, _ := r.Context().Value(fingerprintKey{}).(string)
+	return fp
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, cleanPath(stripPrefix(r)))
+}
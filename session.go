@@ -0,0 +1,197 @@
+package devcache
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// session is the recording session in progress, if any. Entries stored or
+// served while it's active are tagged with its name so they can be exported
+// apart from the rest of the cache.
+var session struct {
+	sync.Mutex
+	name  string
+	until time.Time
+}
+
+// sessionMu guards the Sessions of every entry.
+var sessionMu sync.Mutex
+
+// activeSession returns the name of the session in progress, or "" if there
+// is none. Sessions end by themselves once their duration is up.
+func activeSession() string {
+	session.Lock()
+	defer session.Unlock()
+	if session.name != "" && time.Now().After(session.until) {
+		session.name = ""
+	}
+	return session.name
+}
+
+// touchSession tags e with the session in progress.
+func touchSession(e *entry) {
+	name := activeSession()
+	if name == "" {
+		return
+	}
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	for _, s := range e.Sessions {
+		if s == name {
+			return
+		}
+	}
+	e.Sessions = append(e.Sessions, name)
+}
+
+// inSession reports whether e was tagged with the named session.
+func (e *entry) inSession(name string) bool {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	for _, s := range e.Sessions {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// handleSessionStart starts a named recording session. Only one session can
+// be in progress at a time.
+func handleSessionStart(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name     string `json:"name"`
+		Duration string `json:"duration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "session name is required", http.StatusBadRequest)
+		return
+	}
+	d, err := time.ParseDuration(req.Duration)
+	if err != nil || d <= 0 {
+		http.Error(w, "invalid session duration "+req.Duration, http.StatusBadRequest)
+		return
+	}
+	if name := activeSession(); name != "" {
+		http.Error(w, "session "+name+" is already in progress", http.StatusConflict)
+		return
+	}
+	session.Lock()
+	session.name, session.until = req.Name, time.Now().Add(d)
+	until := session.until
+	session.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"name": req.Name, "until": until})
+}
+
+// handleSessionStop ends the session in progress early.
+func handleSessionStop(w http.ResponseWriter, r *http.Request) {
+	session.Lock()
+	session.name = ""
+	session.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSessionExport writes the entries tagged with a session as JSON lines,
+// in the format accepted by the import endpoint, or as a HAR file with
+// format=har.
+func handleSessionExport(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	items := snapshotItems()
+	var sessionKeys []string
+	for key, item := range items {
+		if e, ok := toEntry(item.Object); ok && e.inSession(name) {
+			sessionKeys = append(sessionKeys, key)
+		}
+	}
+	sort.Strings(sessionKeys)
+
+	switch r.URL.Query().Get("format") {
+	case "", "jsonl":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		for _, key := range sessionKeys {
+			if de := newDirEntry(key, items[key]); de != nil {
+				enc.Encode(de)
+			}
+		}
+	case "har":
+		entries := make([]harEntry, 0, len(sessionKeys))
+		for _, key := range sessionKeys {
+			e, _ := toEntry(items[key].Object)
+			entries = append(entries, newHAREntry(e))
+		}
+		var har harFile
+		har.Log.Version = "1.2"
+		har.Log.Creator.Name = "devcache"
+		har.Log.Entries = entries
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.har"`)
+		json.NewEncoder(w).Encode(har)
+	default:
+		http.Error(w, "format must be jsonl or har", http.StatusBadRequest)
+	}
+}
+
+// harFile is the subset of the HAR 1.2 format needed to describe cached
+// responses.
+type harFile struct {
+	Log struct {
+		Version string `json:"version"`
+		Creator struct {
+			Name string `json:"name"`
+		} `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	Time            float64   `json:"time"`
+	Request         struct {
+		Method string `json:"method"`
+		URL    string `json:"url"`
+	} `json:"request"`
+	Response struct {
+		Status  int `json:"status"`
+		Content struct {
+			Size     int    `json:"size"`
+			MimeType string `json:"mimeType"`
+			Text     string `json:"text"`
+			Encoding string `json:"encoding,omitempty"`
+		} `json:"content"`
+	} `json:"response"`
+}
+
+func newHAREntry(e *entry) harEntry {
+	e = e.decompressed()
+	var h harEntry
+	h.StartedDateTime = e.Stored
+	h.Time = float64(e.FetchDuration) / float64(time.Millisecond)
+	h.Request.Method = e.method()
+	h.Request.URL = flagURL + e.URL
+	if u, err := upstreamURL(flagURL, e.URL); err == nil {
+		h.Request.URL = u
+	}
+	h.Response.Status = e.status()
+	h.Response.Content.Size = len(e.Body)
+	h.Response.Content.MimeType = e.ContentType
+	if utf8.Valid(e.Body) {
+		h.Response.Content.Text = string(e.Body)
+	} else {
+		h.Response.Content.Text = base64.StdEncoding.EncodeToString(e.Body)
+		h.Response.Content.Encoding = "base64"
+	}
+	return h
+}
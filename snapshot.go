@@ -0,0 +1,83 @@
+package devcache
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+// cacheLoaded is nonzero once the saved cache has been loaded, which with
+// -background-load happens after the server has started. Until then a
+// snapshot would overwrite the file with the part loaded so far.
+var cacheLoaded int32
+
+// saveMu serializes saves, so a snapshot can't race the save at shutdown.
+var saveMu sync.Mutex
+
+// saveCache saves items to the -store: to one file per tenant with tenants,
+// unless -cache-dir keeps them all. A -store database already has them, as
+// they're written through to it when stored.
+func saveCache(items map[string]cache.Item) error {
+	saveMu.Lock()
+	defer saveMu.Unlock()
+	if dbStore != nil {
+		return nil
+	}
+	if tenancy() && flagCacheDir == "" {
+		return writeTenantCaches(items)
+	}
+	return newStore(flagCacheFile).Save(items)
+}
+
+// startSnapshots saves the cache every -snapshot-interval, so a crash only
+// loses what was cached since the last snapshot. It returns a function
+// stopping the snapshots, after which the cache is saved a last time at
+// shutdown.
+func startSnapshots() func() {
+	var tick <-chan time.Time
+	var ticker *time.Ticker
+	if flagSnapshotInterval > 0 {
+		ticker = time.NewTicker(flagSnapshotInterval)
+		tick = ticker.C
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		if ticker != nil {
+			defer ticker.Stop()
+		}
+		for {
+			select {
+			case <-stop:
+				return
+			case <-tick:
+			}
+			snapshotCache()
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// snapshotCache saves the cache unless it's read-only or still loading.
+func snapshotCache() {
+	switch {
+	case cacheReadOnly():
+		debugf("cache is read-only, not saving a snapshot")
+	case atomic.LoadInt32(&cacheLoaded) == 0:
+		log.Printf("cache is still loading, not saving a snapshot")
+	default:
+		start := time.Now()
+		items := snapshotItems()
+		if err := saveCache(items); err != nil {
+			log.Printf("error saving cache snapshot: %s", err)
+			return
+		}
+		debugf("saved cache snapshot (%d items in %s)", len(items), time.Since(start))
+	}
+}
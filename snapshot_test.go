@@ -0,0 +1,53 @@
+package devcache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+)
+
+// TestSnapshotLatency saves a large cache while measuring hits, which must
+// not wait for the snapshot to be copied.
+func TestSnapshotLatency(t *testing.T) {
+	if testing.Short() {
+		t.Skip("fills a 200k entry cache")
+	}
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	newTestServer(t, up.URL)
+	const n = 200000
+	body := []byte(`{"value": "a cached body of a typical size"}`)
+	for i := 0; i < n; i++ {
+		setEntry(fmt.Sprintf("/item/%d", i), &entry{Body: body}, time.Hour)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		snapshotCache()
+	}()
+	var latencies []time.Duration
+	for i := 0; ; i++ {
+		select {
+		case <-done:
+		default:
+			start := time.Now()
+			lookup(requestKey{key: fmt.Sprintf("/item/%d", i%n)})
+			latencies = append(latencies, time.Since(start))
+			continue
+		}
+		break
+	}
+	if len(latencies) < 100 {
+		t.Skipf("the save took too little time to measure (%d hits)", len(latencies))
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	p99 := latencies[len(latencies)*99/100]
+	t.Logf("p99 of %d hits during the save: %s", len(latencies), p99)
+	if p99 > 3*time.Millisecond {
+		t.Errorf("p99 of hits during the save is %s, want under 3ms", p99)
+	}
+}
@@ -0,0 +1,82 @@
+package devcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// genericTypes are content types upstreams send when they don't know better.
+var genericTypes = map[string]bool{
+	"":                         true,
+	"text/plain":               true,
+	"application/octet-stream": true,
+}
+
+// mediaType returns the media type of a Content-Type value without its
+// parameters.
+func mediaType(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return mt
+}
+
+// looksLikeJSON reports whether body starts like a JSON object or array,
+// ignoring leading whitespace. It's a cheap check that doesn't validate the
+// rest of the body.
+func looksLikeJSON(body []byte) bool {
+	trimmed := bytes.TrimLeft(body, " \t\r\n")
+	return len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[')
+}
+
+// isJSON reports whether a body declared as contentType should be treated as
+// JSON. Bodies without a declared type are sniffed.
+func isJSON(contentType string, body []byte) bool {
+	if contentType == "" {
+		return looksLikeJSON(body)
+	}
+	mt := mediaType(contentType)
+	return mt == "application/json" || strings.HasSuffix(mt, "+json")
+}
+
+// sniffType guesses the content type of body. JSON is recognized even though
+// http.DetectContentType reports it as plain text.
+func sniffType(body []byte) string {
+	if looksLikeJSON(body) && json.Valid(body) {
+		return "application/json"
+	}
+	return http.DetectContentType(body)
+}
+
+// isText reports whether a sniffed type is textual, and so reliable enough
+// to override the declared one.
+func isText(contentType string) bool {
+	mt := mediaType(contentType)
+	return strings.HasPrefix(mt, "text/") || mt == "application/json"
+}
+
+// correctContentType returns the content type to cache a body declared as
+// declared with. A missing or generic declared type is replaced with the
+// sniffed one if the body is text; binary bodies keep their declared type,
+// since a sniff only sees the first bytes. If the declared type is specific
+// but disagrees with the sniffed one, it's kept and the sniffed type is
+// returned as mismatch.
+func correctContentType(url, declared string, body []byte) (contentType, mismatch string) {
+	sniffed := sniffType(body)
+	if genericTypes[mediaType(declared)] {
+		if isText(sniffed) && mediaType(sniffed) != mediaType(declared) {
+			return sniffed, ""
+		}
+		return declared, ""
+	}
+	if isText(sniffed) && !genericTypes[mediaType(sniffed)] && mediaType(sniffed) != mediaType(declared) {
+		log.Printf("content type of %s declared as %s but looks like %s", url, declared, sniffed)
+		return declared, sniffed
+	}
+	return declared, ""
+}
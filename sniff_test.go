@@ -0,0 +1,40 @@
+package devcache
+
+import "testing"
+
+func TestLooksLikeJSON(t *testing.T) {
+	for body, want := range map[string]bool{
+		`{"a": 1}`:         true,
+		`[1, 2]`:           true,
+		"  \n\t{\"a\": 1}": true,
+		"\r\n[]":           true,
+		"":                 false,
+		"   ":              false,
+		`"string"`:         false,
+		"42":               false,
+		"<html></html>":    false,
+		"plain text {":     false,
+	} {
+		if got := looksLikeJSON([]byte(body)); got != want {
+			t.Errorf("%q: got %v, want %v", body, got, want)
+		}
+	}
+}
+
+func TestIsJSON(t *testing.T) {
+	for _, tt := range []struct {
+		contentType, body string
+		want              bool
+	}{
+		{"", `{"a": 1}`, true},
+		{"", "not json", false},
+		{"application/json", "not json", true},
+		{"application/json; charset=utf-8", `{}`, true},
+		{"application/problem+json", `{}`, true},
+		{"text/plain", `{"a": 1}`, false},
+	} {
+		if got := isJSON(tt.contentType, []byte(tt.body)); got != tt.want {
+			t.Errorf("%q, %q: got %v, want %v", tt.contentType, tt.body, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package devcache
+
+import "sync"
+
+// Sources of cache entries: the code path that stored them.
+const (
+	sourceOrganic = "organic"
+	sourceWarmup  = "warmup"
+	sourceRefresh = "refresh"
+	sourceImport  = "import"
+)
+
+// stores counts the entries stored from each source.
+var stores = &sourceCounts{counts: make(map[string]int64)}
+
+type sourceCounts struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func (sc *sourceCounts) add(source string) {
+	if source == "" {
+		source = sourceOrganic
+	}
+	sc.mu.Lock()
+	sc.counts[source]++
+	sc.mu.Unlock()
+}
+
+func (sc *sourceCounts) snapshot() map[string]int64 {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	snap := make(map[string]int64, len(sc.counts))
+	for source, n := range sc.counts {
+		snap[source] = n
+	}
+	return snap
+}
+
+// source returns how the entry came to be cached. Entries stored before
+// sources were recorded were stored by organic traffic.
+func (e *entry) source() string {
+	if e.Source == "" {
+		return sourceOrganic
+	}
+	return e.Source
+}
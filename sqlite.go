@@ -0,0 +1,152 @@
+package devcache
+
+import (
+	"database/sql"
+	"os"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+	// registers the "sqlite" driver
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema creates the table of a SQLite store. Expiration is kept in a
+// column of its own, in Unix nanoseconds, so the saved cache can be queried by
+// hand.
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS entries (
+	key TEXT PRIMARY KEY,
+	expiration INTEGER NOT NULL,
+	record BLOB NOT NULL
+)`
+
+// sqliteStore saves the cache to a SQLite database, with a row per entry.
+// Rows are written hottest first and loaded in the order they were written.
+type sqliteStore string
+
+// open opens the database, creating it if create is set.
+func (s sqliteStore) open(create bool) (*sql.DB, error) {
+	if !create {
+		if _, err := os.Stat(string(s)); err != nil {
+			return nil, err
+		}
+	}
+	db, err := sql.Open("sqlite", string(s))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (s sqliteStore) Load(fn func(key string, item cache.Item)) error {
+	db, err := s.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT key, record FROM entries ORDER BY rowid")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var data []byte
+		if err := rows.Scan(&key, &data); err != nil {
+			return err
+		}
+		item, err := decodeItem(data)
+		if err != nil {
+			return err
+		}
+		fn(key, item)
+	}
+	return rows.Err()
+}
+
+func (s sqliteStore) Save(items map[string]cache.Item) error {
+	db, err := s.open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	// the rows are replaced in a single transaction, so an interrupted save
+	// leaves the previous ones
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM entries"); err != nil {
+		return err
+	}
+	insert, err := tx.Prepare("INSERT INTO entries (key, expiration, record) VALUES (?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	for _, key := range profile.order(items) {
+		data, err := encodeItem(items[key])
+		if err != nil {
+			return err
+		}
+		if _, err := insert.Exec(key, items[key].Expiration, data); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// sqliteBackend reads and writes the rows of an open SQLite store one at a
+// time, as a -store-verify backend.
+type sqliteBackend struct {
+	db *sql.DB
+}
+
+func newSQLiteBackend(path string) (*sqliteBackend, error) {
+	db, err := sqliteStore(path).open(true)
+	if err != nil {
+		return nil, err
+	}
+	// a write per stored entry is much cheaper with a write-ahead log
+	if _, err := db.Exec("PRAGMA journal_mode=WAL"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteBackend{db: db}, nil
+}
+
+func (b *sqliteBackend) get(key string) (*entry, int64, error) {
+	var data []byte
+	err := b.db.QueryRow("SELECT record FROM entries WHERE key = ?", key).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, 0, errNotStored
+	} else if err != nil {
+		return nil, 0, err
+	}
+	return decodeRecord(data)
+}
+
+func (b *sqliteBackend) set(key string, e *entry, ttl time.Duration) error {
+	data, err := encodeRecord(e, ttl)
+	if err != nil {
+		return err
+	}
+	_, err = b.db.Exec("INSERT OR REPLACE INTO entries (key, expiration, record) VALUES (?, ?, ?)", key, expiration(ttl), data)
+	return err
+}
+
+func (b *sqliteBackend) del(key string) error {
+	_, err := b.db.Exec("DELETE FROM entries WHERE key = ?", key)
+	return err
+}
+
+func (b *sqliteBackend) close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,232 @@
+package devcache
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// stats holds the server-wide counters.
+var stats Stats
+
+// Stats are counters of the server's activity. Every field is an int64
+// updated with sync/atomic.
+type Stats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	// Evictions counts entries deleted or expired from the cache.
+	Evictions int64 `json:"evictions"`
+	// UpstreamErrors counts failed upstream fetches.
+	UpstreamErrors int64 `json:"upstream_errors"`
+	// UpstreamBytes counts body bytes read from the upstream.
+	UpstreamBytes int64 `json:"upstream_bytes"`
+	// Stale counts expired entries served under -serve-stale, and
+	// StaleIfError those served as allowed by the upstream's stale-if-error.
+	Stale        int64 `json:"stale"`
+	StaleIfError int64 `json:"stale_if_error"`
+	// StaleWhileRevalidate counts expired entries served at once while
+	// they were refreshed in the background.
+	StaleWhileRevalidate int64 `json:"stale_while_revalidate"`
+	// UnsafeStores counts entries refused because their key didn't account
+	// for the request body.
+	UnsafeStores int64 `json:"unsafe_stores"`
+	// Corrupt counts entries dropped because their body didn't match its
+	// checksum.
+	Corrupt int64 `json:"corrupt"`
+	// UpstreamIPv4 and UpstreamIPv6 count the upstream connections made over
+	// each address family, and UpstreamDialErrors the connections that
+	// couldn't be made.
+	UpstreamIPv4       int64 `json:"upstream_ipv4"`
+	UpstreamIPv6       int64 `json:"upstream_ipv6"`
+	UpstreamDialErrors int64 `json:"upstream_dial_errors"`
+	// MirrorDropped counts request summaries dropped because the background
+	// queue was full, and MirrorErrors those the mirror didn't accept.
+	MirrorDropped int64 `json:"mirror_dropped"`
+	MirrorErrors  int64 `json:"mirror_errors"`
+	// MemoryPressure counts the times memory usage crossed -memory-high, and
+	// MemoryShed the entries evicted to bring it down.
+	MemoryPressure int64 `json:"memory_pressure"`
+	MemoryShed     int64 `json:"memory_shed"`
+	// Coalesced counts misses answered by another request's fetch of the
+	// same key.
+	Coalesced int64 `json:"coalesced"`
+	// Bypassed counts requests proxied live because they carried the
+	// -bypass-token.
+	Bypassed int64 `json:"bypassed"`
+	// TenantShed counts entries evicted to keep a tenant within
+	// -tenant-max-bytes.
+	TenantShed int64 `json:"tenant_shed"`
+	// OfflineMisses counts misses answered without the upstream under
+	// -offline.
+	OfflineMisses int64 `json:"offline_misses"`
+	// RedisHits counts misses in memory found in the shared cache with
+	// -backend redis, and RedisErrors the commands to it that failed.
+	RedisHits   int64 `json:"redis_hits"`
+	RedisErrors int64 `json:"redis_errors"`
+	// StoreVerifyChecks counts the entries compared between the
+	// -store-verify backends, StoreVerifyDivergences those that differed,
+	// StoreVerifySkipped the lookups sampled but not compared as too many
+	// comparisons were running, and StoreVerifyErrors the backend operations
+	// that failed.
+	StoreVerifyChecks      int64 `json:"store_verify_checks"`
+	StoreVerifyDivergences int64 `json:"store_verify_divergences"`
+	StoreVerifySkipped     int64 `json:"store_verify_skipped"`
+	StoreVerifyErrors      int64 `json:"store_verify_errors"`
+}
+
+// counters returns pointers to each of the counters in s.
+func (s *Stats) counters() []*int64 {
+	v := reflect.ValueOf(s).Elem()
+	counters := make([]*int64, v.NumField())
+	for i := range counters {
+		counters[i] = v.Field(i).Addr().Interface().(*int64)
+	}
+	return counters
+}
+
+// load returns a copy of s read atomically counter by counter.
+func (s *Stats) load() Stats {
+	var c Stats
+	dst := c.counters()
+	for i, p := range s.counters() {
+		*dst[i] = atomic.LoadInt64(p)
+	}
+	return c
+}
+
+// Reset zeroes every counter.
+func (s *Stats) Reset() {
+	for _, p := range s.counters() {
+		atomic.StoreInt64(p, 0)
+	}
+}
+
+// CompressedStats describes the bodies stored compressed: how many there
+// are, their size as stored and their size uncompressed.
+type CompressedStats struct {
+	Entries  int   `json:"entries"`
+	Bytes    int64 `json:"bytes"`
+	RawBytes int64 `json:"raw_bytes"`
+}
+
+// snapshotTopKeys is the number of keys listed in a Snapshot.
+const snapshotTopKeys = 10
+
+// Snapshot is a point-in-time summary of the cache's state.
+type Snapshot struct {
+	Time    time.Time `json:"time"`
+	Entries int       `json:"entries"`
+	// Bytes is the total size of the cached bodies, as stored.
+	Bytes int64 `json:"bytes"`
+	// Compressed describes the bodies stored compressed by -compress-cache.
+	Compressed CompressedStats `json:"compressed"`
+	// Tenants describes each tenant, with -tenant-header or
+	// -tenant-basic-auth.
+	Tenants map[string]TenantStats `json:"tenants,omitempty"`
+	Stats   Stats                  `json:"stats"`
+	// TopKeys are the most frequently hit keys.
+	TopKeys []KeySummary `json:"top_keys"`
+	// Promoted are the keys whose TTL was extended because they're hot.
+	Promoted map[string]time.Duration `json:"promoted"`
+	// Connections are the reused and new upstream connections per host.
+	Connections map[string]ConnCounts `json:"connections"`
+	// OverBudget is the number of responses over each -size-budget rule.
+	OverBudget map[string]int64 `json:"over_budget"`
+	// Stores counts the entries stored by each source.
+	Stores map[string]int64 `json:"stores"`
+	// Background describes the background work pool.
+	Background BackgroundStats `json:"background"`
+	// Seed is the seed of the server's random decisions.
+	Seed int64 `json:"seed"`
+	// ReadOnly is set while the cache is frozen.
+	ReadOnly bool `json:"read_only"`
+	// Config is the value of every flag the server was started with.
+	Config map[string]string `json:"config"`
+}
+
+// KeySummary describes a single cached entry.
+type KeySummary struct {
+	Key   string `json:"key"`
+	Bytes int    `json:"bytes"`
+	Hits  int64  `json:"hits"`
+}
+
+// Snapshot returns the current state of the cache. Entry counts and sizes are
+// computed from a single copy of the cache's index, so they agree with each
+// other; bodies aren't copied.
+func (s *server) Snapshot() Snapshot {
+	items := Cache.Items()
+	snap := Snapshot{
+		Time:        time.Now(),
+		Entries:     len(items),
+		Stats:       stats.load(),
+		Promoted:    hot.promoted(),
+		Connections: conns.snapshot(),
+		OverBudget:  overBudget(),
+		Stores:      stores.snapshot(),
+		Background:  background.stats(),
+		Seed:        seed,
+		ReadOnly:    cacheReadOnly(),
+		Config:      configSummary(),
+	}
+	keys := make([]KeySummary, 0, len(items))
+	for key, item := range items {
+		e, ok := toEntry(item.Object)
+		if !ok {
+			continue
+		}
+		snap.Bytes += int64(len(e.Body))
+		if e.Compressed {
+			snap.Compressed.Entries++
+			snap.Compressed.Bytes += int64(len(e.Body))
+			snap.Compressed.RawBytes += int64(e.RawSize)
+		}
+		keys = append(keys, KeySummary{Key: key, Bytes: e.size(), Hits: atomic.LoadInt64(&e.hits)})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Hits != keys[j].Hits {
+			return keys[i].Hits > keys[j].Hits
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	if len(keys) > snapshotTopKeys {
+		keys = keys[:snapshotTopKeys]
+	}
+	snap.TopKeys = keys
+	if tenancy() {
+		snap.Tenants = tenantStats(items, "")
+	}
+	return snap
+}
+
+// configSummary returns the value of every flag, with secrets redacted.
+func configSummary() map[string]string {
+	config := map[string]string{}
+	flagSet.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if (strings.Contains(f.Name, "token") || strings.Contains(f.Name, "password")) && v != "" {
+			v = "<redacted>"
+		}
+		config[f.Name] = v
+	})
+	return config
+}
+
+// handleStats serves a Snapshot of the cache.
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Snapshot())
+}
+
+// handleStatsReset zeroes the server's counters.
+func handleStatsReset(w http.ResponseWriter, r *http.Request) {
+	stats.Reset()
+	tenantRequests.reset()
+	upstreamLatency.reset()
+	w.WriteHeader(http.StatusNoContent)
+}
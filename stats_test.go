@@ -0,0 +1,50 @@
+package devcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestStatsRace exercises the counters from requests, the stats endpoint and
+// resets at once. Run it with -race.
+func TestStatsRace(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL)
+	h := s.Handler()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				switch i % 4 {
+				case 0:
+					do(h, "POST", controlPrefix+"/stats/reset", nil)
+				case 1:
+					do(h, "GET", controlPrefix+"/stats", nil)
+				default:
+					do(h, "GET", "/a", nil)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if w := do(h, "POST", controlPrefix+"/stats/reset", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("reset: status %d", w.Code)
+	}
+	if c := stats.load(); c != (Stats{}) {
+		t.Errorf("counters not zeroed: %+v", c)
+	}
+	do(h, "GET", "/a", nil)
+	if n := atomic.LoadInt64(&stats.Hits); n != 1 {
+		t.Errorf("%d hits after reset, want 1", n)
+	}
+}
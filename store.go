@@ -0,0 +1,261 @@
+package devcache
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+// errUnsafeKey is returned when storing under a key derived from a request
+// with a body, unless the key includes a digest of that body.
+var errUnsafeKey = errors.New("refusing to cache request body under a key without a body digest")
+
+// errUncacheable is returned for responses the caching rules don't allow to be
+// stored.
+var errUncacheable = errors.New("response is not cacheable")
+
+// keys tracks every key in the Cache, so the cache can be walked without
+// holding its lock for the whole walk.
+var keys sync.Map
+
+// keysMu orders storing entries with setEntry and unindexing them in
+// onEvicted, so the eviction of an entry can't unindex the one replacing it.
+var keysMu sync.Mutex
+
+// setEntry caches e under key for ttl and indexes it, in place of any entry
+// already cached under key.
+func setEntry(key string, e *entry, ttl time.Duration) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	if v, found := Cache.Get(key); found {
+		if old, ok := toEntry(v); ok {
+			tags.remove(key, tagsMissing(old.Tags, e.Tags))
+		}
+	}
+	Cache.Set(key, e, ttl)
+	keys.Store(key, struct{}{})
+	tags.add(key, e.Tags)
+	tenantUsage.set(key, int64(len(e.Body)))
+}
+
+// snapshotItems returns a copy of the Cache's unexpired items. Unlike
+// Cache.Items, which holds the cache's lock while copying everything, items
+// are copied one at a time, so requests are never blocked for long. The result
+// is only eventually consistent: entries stored or evicted during the copy may
+// or may not be included.
+func snapshotItems() map[string]cache.Item {
+	items := make(map[string]cache.Item, Cache.ItemCount())
+	keys.Range(func(k, _ interface{}) bool {
+		key := k.(string)
+		v, exp, found := Cache.GetWithExpiration(key)
+		if !found {
+			return true
+		}
+		item := cache.Item{Object: v}
+		if !exp.IsZero() {
+			item.Expiration = exp.UnixNano()
+		}
+		items[key] = item
+		return true
+	})
+	return items
+}
+
+// errUpstreamDisabled is returned by fetch while the upstream is disabled, and
+// errNotRefreshed explains why stale entries are served without trying to
+// refresh them.
+var (
+	errUpstreamDisabled = errors.New("upstream disabled")
+	errNotRefreshed     = errors.New("upstream disabled or replaying only")
+)
+
+// storeEntry caches e under k and updates everything derived from the cache's
+// contents.
+func storeEntry(k requestKey, e *entry) error {
+	if cacheReadOnly() {
+		return errReadOnly
+	}
+	if !k.safe() {
+		atomic.AddInt64(&stats.UnsafeStores, 1)
+		log.Printf("BUG: %s: %s", errUnsafeKey, k)
+		return errUnsafeKey
+	}
+	key := k.String()
+	if e.Checksum == "" {
+		e.Checksum = checksum(e.body())
+	}
+	e.compress()
+	if flagTenantMaxBytes > 0 {
+		makeRoom(key, len(e.Body))
+	}
+	if old, found := Cache.Get(key); found {
+		if oe, ok := toEntry(old); ok {
+			tags.remove(key, oe.Tags)
+		}
+	}
+	ttl := e.Freshness.TTL
+	if ttl == 0 {
+		ttl = flagTTL
+		// the schedule replaces the default TTL, but only shortens ones set
+		// by the upstream
+		if until, ok := flagExpireAt.until(time.Now()); ok {
+			ttl = until
+		}
+	} else if until, ok := flagExpireAt.until(time.Now()); ok && until < ttl {
+		ttl = until
+	}
+	touchSession(e)
+	ttl = hot.ttl(key, ttl)
+	e.Expires = time.Now().Add(ttl)
+	// keep the entry around for as long as it may be served stale
+	setEntry(key, e, ttl+e.retention())
+	sharedStore(key, e, ttl+e.retention())
+	storedSet(key, e, ttl+e.retention())
+	if storeVerify != nil {
+		storeVerify.set(key, e, ttl+e.retention())
+	}
+	stores.add(e.Source)
+	if flagCacheDir != "" {
+		if err := persistDirEntry(flagCacheDir, key); err != nil {
+			log.Printf("error writing cache entry: %s", err)
+		}
+	}
+	return nil
+}
+
+// importItem caches an item exported by another instance under key, keeping
+// its expiry. Expired items are skipped. It reports whether the item was
+// stored.
+func importItem(key string, item cache.Item) bool {
+	e, ok := toEntry(item.Object)
+	if !ok || !e.verify() || cacheReadOnly() {
+		return false
+	}
+	ttl := cache.NoExpiration
+	if item.Expiration > 0 {
+		if ttl = time.Until(time.Unix(0, item.Expiration)); ttl <= 0 {
+			return false
+		}
+	}
+	if old, found := Cache.Get(key); found {
+		if oe, ok := toEntry(old); ok {
+			tags.remove(key, oe.Tags)
+		}
+	}
+	e.Source = sourceImport
+	setEntry(key, e, ttl)
+	sharedStore(key, e, ttl)
+	storedSet(key, e, ttl)
+	if storeVerify != nil {
+		storeVerify.set(key, e, ttl)
+	}
+	stores.add(e.Source)
+	varies.learn(key, e)
+	if flagCacheDir != "" {
+		if err := persistDirEntry(flagCacheDir, key); err != nil {
+			log.Printf("error writing cache entry: %s", err)
+		}
+	}
+	return true
+}
+
+// lookup returns the entry cached under k. With -verify-checksum an entry
+// whose body no longer matches its checksum is dropped and reported as not
+// found, so it's refetched.
+func lookup(k requestKey) (*entry, bool) {
+	v, found := Cache.Get(k.String())
+	if !found {
+		v, found = sharedLookup(k.String())
+	}
+	if !found {
+		v, found = storedLookup(k.String())
+	}
+	if !found && storeVerify != nil {
+		v, found = storeVerify.lookup(k.String())
+	}
+	if !found {
+		return nil, false
+	}
+	if storeVerify != nil {
+		storeVerify.sample(k.String())
+	}
+	e, ok := toEntry(v)
+	if !ok {
+		return nil, false
+	}
+	if flagVerifyChecksum && !e.verify() {
+		atomic.AddInt64(&stats.Corrupt, 1)
+		log.Printf("warning: dropping corrupt cache entry %s", k)
+		deleteEntry(k.String())
+		return nil, false
+	}
+	return e, true
+}
+
+// onEvicted is called by the Cache whenever an entry is deleted or expires.
+func onEvicted(key string, v interface{}) {
+	atomic.AddInt64(&stats.Evictions, 1)
+	keysMu.Lock()
+	// the key may have been stored again since it was evicted, keeping the
+	// tags of its new entry
+	current, found := Cache.Get(key)
+	if !found {
+		keys.Delete(key)
+		tenantUsage.remove(key)
+	}
+	if e, ok := toEntry(v); ok {
+		if ce, ok := toEntry(current); ok {
+			tags.remove(key, tagsMissing(e.Tags, ce.Tags))
+		} else {
+			tags.remove(key, e.Tags)
+		}
+	}
+	keysMu.Unlock()
+	if !found {
+		storedExpire(key)
+	}
+	if flagCacheDir != "" {
+		if err := removeCacheDirEntry(flagCacheDir, key); err != nil {
+			log.Printf("error removing cache entry: %s", err)
+		}
+	}
+}
+
+// indexItems rebuilds the indexes derived from the cache's contents after it
+// has been loaded.
+func indexItems(items map[string]cache.Item) {
+	for key, item := range items {
+		keys.Store(key, struct{}{})
+		if e, ok := toEntry(item.Object); ok {
+			tags.add(key, e.Tags)
+			tenantUsage.set(key, int64(len(e.Body)))
+			varies.learn(key, e)
+		}
+	}
+}
+
+// verifyItems drops loaded items whose bodies don't match their checksums and
+// checksums the ones that have none yet.
+func verifyItems(items map[string]cache.Item) {
+	for key, item := range items {
+		e, ok := toEntry(item.Object)
+		if !ok {
+			continue
+		}
+		if e.Checksum == "" {
+			e.Checksum = checksum(e.body())
+			item.Object = e
+			items[key] = item
+			continue
+		}
+		if !e.verify() {
+			atomic.AddInt64(&stats.Corrupt, 1)
+			log.Printf("warning: dropping corrupt cache entry %s", key)
+			delete(items, key)
+		}
+	}
+}
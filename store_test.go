@@ -0,0 +1,327 @@
+package devcache
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+func TestEvictionKeepsReplacedKey(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	newTestServer(t, up.URL)
+
+	for i := 0; i < 200; i++ {
+		setEntry("k", &entry{Body: []byte("old"), Tags: []string{"a", "b"}}, time.Minute)
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			Cache.Delete("k")
+		}()
+		go func() {
+			defer wg.Done()
+			setEntry("k", &entry{Body: []byte("new"), Tags: []string{"b"}}, time.Minute)
+		}()
+		wg.Wait()
+
+		_, cached := Cache.Get("k")
+		_, indexed := keys.Load("k")
+		if cached != indexed {
+			t.Fatalf("iteration %d: cached %v but indexed %v", i, cached, indexed)
+		}
+		if got := len(tags.keysFor("a")); got != 0 {
+			t.Fatalf("iteration %d: tag a still has %d keys", i, got)
+		}
+		if got := len(tags.keysFor("b")); cached && got != 1 {
+			t.Fatalf("iteration %d: tag b has %d keys, want 1", i, got)
+		}
+		Cache.Delete("k")
+	}
+}
+
+func TestWriteCacheReplacesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.gob")
+	exp := time.Now().Add(time.Hour).UnixNano()
+	for _, body := range []string{"one", "two"} {
+		items := map[string]cache.Item{"k": {Object: &entry{Body: []byte(body)}, Expiration: exp}}
+		if err := writeCache(path, items); err != nil {
+			t.Fatal(err)
+		}
+		var got map[string]cache.Item
+		if err := readCache(path, &got); err != nil {
+			t.Fatal(err)
+		}
+		if e, ok := toEntry(got["k"].Object); !ok || string(e.Body) != body {
+			t.Fatalf("read %v, want %q", got["k"].Object, body)
+		}
+	}
+	if matches, _ := filepath.Glob(path + ".tmp"); len(matches) != 0 {
+		t.Errorf("temporary file left behind: %v", matches)
+	}
+}
+
+func TestUnsafeStoresRefused(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(append([]byte(r.Method+" "), body...))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL, "-cache-methods", "POST")
+	unsafe := requestKey{key: "/unsafe", hasBody: true}
+
+	for _, tt := range []struct {
+		name  string
+		store func() error
+	}{
+		{"storeEntry", func() error { return storeEntry(unsafe, &entry{Body: []byte("x")}) }},
+		// the middleware, refreshes and warm-up all store through fetch
+		{"fetch", func() error {
+			_, err := fetch(unsafe, "/unsafe", http.Header{}, sourceWarmup)
+			return err
+		}},
+		{"middleware", func() error {
+			r := httptest.NewRequest("GET", "/unsafe", strings.NewReader("a body"))
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Errorf("status %d, want the response served uncached", w.Code)
+			}
+			// the middleware serves the response rather than failing, so
+			// only the count tells the store was refused
+			return errUnsafeKey
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			before := atomic.LoadInt64(&stats.UnsafeStores)
+			if err := tt.store(); err != errUnsafeKey {
+				t.Errorf("got %v, want errUnsafeKey", err)
+			}
+			if n := atomic.LoadInt64(&stats.UnsafeStores); n != before+1 {
+				t.Errorf("unsafe stores counted %d, want %d", n, before+1)
+			}
+			if n := Cache.ItemCount(); n != 0 {
+				t.Errorf("%d entries cached", n)
+			}
+		})
+	}
+
+	// POSTs to one path with different bodies get entries of their own
+	for i := 0; i < 2; i++ {
+		for _, body := range []string{"a", "b"} {
+			r := httptest.NewRequest("POST", "/post", strings.NewReader(body))
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, r)
+			if w.Body.String() != "POST "+body {
+				t.Fatalf("body %q: got %q", body, w.Body)
+			}
+		}
+	}
+	if n := Cache.ItemCount(); n != 2 {
+		t.Errorf("%d entries cached, want 2", n)
+	}
+}
+
+func TestCorruptEntriesDropped(t *testing.T) {
+	var fetches int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&fetches, 1)
+		w.Write([]byte("body of " + r.URL.Path))
+	}))
+	defer up.Close()
+	file := filepath.Join(t.TempDir(), "cache.gob")
+
+	// on load
+	exp := time.Now().Add(time.Hour).UnixNano()
+	good := &entry{Body: []byte("good")}
+	bad := &entry{Body: []byte("bad")}
+	good.Checksum, bad.Checksum = checksum(good.Body), checksum(bad.Body)
+	bad.Body[0] ^= 1
+	err := writeCache(file, map[string]cache.Item{
+		"/good": {Object: good, Expiration: exp},
+		"/bad":  {Object: bad, Expiration: exp},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, up.URL, "-cache-file", file, "-verify-checksum")
+	if _, found := Cache.Get("/good"); !found {
+		t.Error("intact entry not loaded")
+	}
+	if _, found := Cache.Get("/bad"); found {
+		t.Error("corrupt entry loaded")
+	}
+	if n := atomic.LoadInt64(&stats.Corrupt); n != 1 {
+		t.Errorf("%d corrupt entries counted, want 1", n)
+	}
+
+	// and on serve, with -verify-checksum
+	do(s.Handler(), "GET", "/a", nil)
+	v, _ := Cache.Get("/a")
+	v.(*entry).Body[0] ^= 1
+	w := do(s.Handler(), "GET", "/a", nil)
+	if w.Body.String() != "body of /a" {
+		t.Errorf("served %q", w.Body)
+	}
+	if n := atomic.LoadInt64(&fetches); n != 2 {
+		t.Errorf("upstream fetched %d times, want the corrupt entry refetched", n)
+	}
+	if n := atomic.LoadInt64(&stats.Corrupt); n != 2 {
+		t.Errorf("%d corrupt entries counted, want 2", n)
+	}
+}
+
+func TestRequireFreshness(t *testing.T) {
+	var fetches int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&fetches, 1)
+		switch r.URL.Path {
+		case "/max-age":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/expires":
+			w.Header().Set("Expires", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+		case "/last-modified":
+			w.Header().Set("Last-Modified", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+		}
+		w.Write([]byte("body of " + r.URL.Path))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL, "-require-freshness")
+
+	for _, tt := range []struct {
+		path   string
+		cached bool
+	}{
+		{"/max-age", true},
+		{"/expires", true},
+		{"/last-modified", false},
+		{"/none", false},
+	} {
+		before := atomic.LoadInt64(&fetches)
+		for i := 0; i < 2; i++ {
+			w := do(s.Handler(), "GET", tt.path, nil)
+			if w.Code != http.StatusOK || w.Body.String() != "body of "+tt.path {
+				t.Fatalf("%s: %d %q", tt.path, w.Code, w.Body)
+			}
+		}
+		want := int64(2)
+		if tt.cached {
+			want = 1
+		}
+		if n := atomic.LoadInt64(&fetches) - before; n != want {
+			t.Errorf("%s: fetched %d times, want %d", tt.path, n, want)
+		}
+	}
+}
+
+func TestHonorCacheControl(t *testing.T) {
+	var fetches int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&fetches, 1)
+		switch r.URL.Path {
+		case "/max-age":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/expires":
+			w.Header().Set("Expires", time.Now().Add(2*time.Hour).UTC().Format(http.TimeFormat))
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/expired":
+			w.Header().Set("Cache-Control", "max-age=0")
+		}
+		w.Write([]byte("body of " + r.URL.Path))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL, "-honor-cache-control", "-ttl", "1h")
+
+	for _, tt := range []struct {
+		path string
+		// ttl is the entry's TTL, or 0 if it isn't cached
+		ttl time.Duration
+	}{
+		{"/max-age", time.Minute},
+		{"/expires", 2 * time.Hour},
+		// without either, -ttl applies
+		{"/none", time.Hour},
+		{"/no-store", 0},
+		{"/expired", 0},
+	} {
+		before := atomic.LoadInt64(&fetches)
+		for i := 0; i < 2; i++ {
+			if w := do(s.Handler(), "GET", tt.path, nil); w.Code != http.StatusOK || w.Body.String() != "body of "+tt.path {
+				t.Fatalf("%s: %d %q", tt.path, w.Code, w.Body)
+			}
+		}
+		v, found := Cache.Get(tt.path)
+		if tt.ttl == 0 {
+			if found {
+				t.Errorf("%s: cached", tt.path)
+			}
+			if n := atomic.LoadInt64(&fetches) - before; n != 2 {
+				t.Errorf("%s: fetched %d times, want 2", tt.path, n)
+			}
+			continue
+		}
+		if !found {
+			t.Fatalf("%s: not cached", tt.path)
+		}
+		if d := time.Until(v.(*entry).Expires) - tt.ttl; d > 0 || d < -2*time.Second {
+			t.Errorf("%s: expires in %s, want %s", tt.path, time.Until(v.(*entry).Expires), tt.ttl)
+		}
+		if n := atomic.LoadInt64(&fetches) - before; n != 1 {
+			t.Errorf("%s: fetched %d times, want 1", tt.path, n)
+		}
+	}
+}
+
+func TestAuthenticatedRequests(t *testing.T) {
+	var fetches int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&fetches, 1)
+		if r.URL.Path == "/public" {
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Write([]byte("body of " + r.URL.Path))
+	}))
+	defer up.Close()
+	auth := http.Header{"Authorization": {"Bearer a"}}
+
+	for _, tt := range []struct {
+		args   []string
+		path   string
+		header http.Header
+		cached bool
+	}{
+		{nil, "/private", auth, false},
+		{nil, "/public", auth, true},
+		{nil, "/private", nil, true},
+		{[]string{"-cache-authenticated"}, "/private", auth, true},
+	} {
+		s := newTestServer(t, up.URL, tt.args...)
+		before := atomic.LoadInt64(&fetches)
+		for i := 0; i < 2; i++ {
+			w := do(s.Handler(), "GET", tt.path, tt.header)
+			if w.Code != http.StatusOK || w.Body.String() != "body of "+tt.path {
+				t.Fatalf("%s: %d %q", tt.path, w.Code, w.Body)
+			}
+		}
+		want := int64(2)
+		if tt.cached {
+			want = 1
+		}
+		if n := atomic.LoadInt64(&fetches) - before; n != want {
+			t.Errorf("%q %s with %v: fetched %d times, want %d", tt.args, tt.path, tt.header, n, want)
+		}
+		s.Shutdown(context.Background())
+	}
+}
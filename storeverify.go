@@ -0,0 +1,378 @@
+package devcache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+// errNotStored is returned by entryBackends for keys they don't have.
+var errNotStored = errors.New("entry not stored")
+
+// entryBackend is a backend entries are written to and read from one at a
+// time, as compared by -store-verify.
+type entryBackend interface {
+	// get returns the entry under key and when it expires, in Unix
+	// nanoseconds or 0 if it doesn't. It returns errNotStored if there's no
+	// unexpired entry.
+	get(key string) (*entry, int64, error)
+	// set saves e under key for ttl, or for good if ttl isn't positive.
+	set(key string, e *entry, ttl time.Duration) error
+	del(key string) error
+	close() error
+}
+
+// memoryBackend is the Cache as an entryBackend. Entries are already written
+// to and deleted from it by storeEntry and deleteEntry, so set and del do
+// nothing.
+type memoryBackend struct{}
+
+func (memoryBackend) get(key string) (*entry, int64, error) {
+	v, exp, found := Cache.GetWithExpiration(key)
+	if !found {
+		return nil, 0, errNotStored
+	}
+	e, ok := toEntry(v)
+	if !ok {
+		return nil, 0, errNotStored
+	}
+	if exp.IsZero() {
+		return e, 0, nil
+	}
+	return e, exp.UnixNano(), nil
+}
+
+func (memoryBackend) set(key string, e *entry, ttl time.Duration) error { return nil }
+func (memoryBackend) del(key string) error                              { return nil }
+func (memoryBackend) close() error                                      { return nil }
+
+// redisBackend is a Redis server as an entryBackend.
+type redisBackend struct {
+	*redisClient
+}
+
+func (b redisBackend) get(key string) (*entry, int64, error) {
+	rec, err := b.redisClient.get(key)
+	if err == errRedisNil {
+		return nil, 0, errNotStored
+	} else if err != nil {
+		return nil, 0, err
+	}
+	return rec.Entry, rec.Expiration, nil
+}
+
+func (b redisBackend) close() error {
+	b.stop()
+	return nil
+}
+
+// expiration returns when an entry stored now for ttl expires, in Unix
+// nanoseconds or 0 if it doesn't.
+func expiration(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixNano()
+}
+
+// encodeRecord encodes e stored for ttl as a record of the bolt and SQLite
+// backends, in the format of their Stores.
+func encodeRecord(e *entry, ttl time.Duration) ([]byte, error) {
+	return encodeItem(cache.Item{Object: e, Expiration: expiration(ttl)})
+}
+
+// decodeRecord decodes a record written by encodeRecord, returning
+// errNotStored if it has expired.
+func decodeRecord(data []byte) (*entry, int64, error) {
+	item, err := decodeItem(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	e, ok := toEntry(item.Object)
+	if !ok || item.Expired() {
+		return nil, 0, errNotStored
+	}
+	return e, item.Expiration, nil
+}
+
+// openBackend opens the -store-verify backend named by spec: memory, redis
+// (at -redis-addr), bolt:PATH or sqlite:PATH.
+func openBackend(spec string) (entryBackend, error) {
+	kind, path := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, path = spec[:i], spec[i+1:]
+	}
+	switch {
+	case kind == backendMemory && path == "":
+		return memoryBackend{}, nil
+	case kind == backendRedis && path == "":
+		c, err := newRedisClient(flagRedisAddr, flagRedisPassword, flagRedisPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to redis at %s: %s", flagRedisAddr, err)
+		}
+		return redisBackend{c}, nil
+	case kind == storeBolt && path != "":
+		return newBoltBackend(path)
+	case kind == storeSQLite && path != "":
+		return newSQLiteBackend(path)
+	}
+	return nil, fmt.Errorf("unknown -store-verify backend %q: must be memory, redis, bolt:PATH or sqlite:PATH", spec)
+}
+
+// Kinds of divergence found by -store-verify.
+const (
+	divergenceMissing = "missing"
+	divergenceBody    = "body"
+	divergenceExpiry  = "expiry"
+)
+
+// storeVerifyReportLimit bounds the divergences kept for the report.
+const storeVerifyReportLimit = 100
+
+// storeVerifyConcurrency bounds the comparisons running at once. Lookups
+// sampled while it's reached aren't compared, so verification never queues
+// up behind a slow backend.
+const storeVerifyConcurrency = 4
+
+// storeVerify compares the -store-verify backends, or is nil.
+var storeVerify *storeVerifier
+
+// storeVerifier writes entries to both of the -store-verify backends and
+// compares what they hold for a sample of the keys looked up.
+type storeVerifier struct {
+	oldSpec, newSpec string
+	old, new         entryBackend
+	// primary is the backend looked up on a miss in memory, old unless
+	// -store-primary is new, and primarySpec its spec.
+	primary     entryBackend
+	primarySpec string
+	slots       chan struct{}
+
+	mu          sync.Mutex
+	divergences []storeDivergence
+}
+
+// storeDivergence is a difference found between the backends for a key.
+type storeDivergence struct {
+	Time   time.Time `json:"time"`
+	Key    string    `json:"key"`
+	Kind   string    `json:"kind"`
+	Detail string    `json:"detail"`
+}
+
+// newStoreVerifier opens the backends of the -store-verify spec old,new.
+func newStoreVerifier(spec, primary string) (*storeVerifier, error) {
+	specs := strings.Split(spec, ",")
+	if len(specs) != 2 {
+		return nil, errors.New("-store-verify must be two backends, old,new")
+	}
+	v := &storeVerifier{oldSpec: specs[0], newSpec: specs[1], slots: make(chan struct{}, storeVerifyConcurrency)}
+	var err error
+	if v.old, err = openBackend(v.oldSpec); err != nil {
+		return nil, err
+	}
+	if v.new, err = openBackend(v.newSpec); err != nil {
+		v.old.close()
+		return nil, err
+	}
+	switch primary {
+	case "old":
+		v.primary, v.primarySpec = v.old, v.oldSpec
+	case "new":
+		v.primary, v.primarySpec = v.new, v.newSpec
+	default:
+		v.close()
+		return nil, errors.New("-store-primary must be old or new")
+	}
+	return v, nil
+}
+
+func (v *storeVerifier) close() {
+	for _, b := range []entryBackend{v.old, v.new} {
+		if err := b.close(); err != nil {
+			log.Printf("error closing store backend: %s", err)
+		}
+	}
+}
+
+// seed writes the items loaded into memory to the other backends, so they
+// start out holding the same entries.
+func (v *storeVerifier) seed(items map[string]cache.Item) {
+	now := time.Now().UnixNano()
+	for key, item := range items {
+		e, ok := toEntry(item.Object)
+		if !ok {
+			continue
+		}
+		ttl := time.Duration(0)
+		if item.Expiration > 0 {
+			if ttl = time.Duration(item.Expiration - now); ttl <= 0 {
+				continue
+			}
+		}
+		v.set(key, e, ttl)
+	}
+}
+
+// set writes e under key to both backends.
+func (v *storeVerifier) set(key string, e *entry, ttl time.Duration) {
+	for _, b := range []entryBackend{v.old, v.new} {
+		if err := b.set(key, e, ttl); err != nil {
+			atomic.AddInt64(&stats.StoreVerifyErrors, 1)
+			log.Printf("error saving %s to store backend: %s", key, err)
+		}
+	}
+}
+
+// del deletes key from both backends.
+func (v *storeVerifier) del(key string) {
+	for _, b := range []entryBackend{v.old, v.new} {
+		if err := b.del(key); err != nil {
+			atomic.AddInt64(&stats.StoreVerifyErrors, 1)
+			log.Printf("error deleting %s from store backend: %s", key, err)
+		}
+	}
+}
+
+// lookup looks key up in the primary backend after a miss in memory. An entry
+// found is cached in memory too, for the rest of its TTL.
+func (v *storeVerifier) lookup(key string) (interface{}, bool) {
+	if _, ok := v.primary.(memoryBackend); ok {
+		return nil, false
+	}
+	e, exp, err := v.primary.get(key)
+	switch {
+	case err == errNotStored:
+		return nil, false
+	case err != nil:
+		atomic.AddInt64(&stats.StoreVerifyErrors, 1)
+		log.Printf("error looking up %s in store backend: %s", key, err)
+		return nil, false
+	}
+	ttl := cache.NoExpiration
+	if exp > 0 {
+		if ttl = time.Until(time.Unix(0, exp)); ttl <= 0 {
+			return nil, false
+		}
+	}
+	setEntry(key, e, ttl)
+	varies.learn(key, e)
+	return e, true
+}
+
+// sample compares the backends' entries for key in the background, for a
+// -store-verify-sample fraction of the calls. It never waits: the comparison
+// is skipped if storeVerifyConcurrency of them are already running.
+func (v *storeVerifier) sample(key string) {
+	if flagStoreVerifySample < 1 && randFloat64() >= flagStoreVerifySample {
+		return
+	}
+	select {
+	case v.slots <- struct{}{}:
+	default:
+		atomic.AddInt64(&stats.StoreVerifySkipped, 1)
+		return
+	}
+	go func() {
+		defer func() { <-v.slots }()
+		v.compare(key)
+	}()
+}
+
+// compare compares the backends' entries for key, recording any divergence.
+func (v *storeVerifier) compare(key string) {
+	atomic.AddInt64(&stats.StoreVerifyChecks, 1)
+	oldEntry, oldExp, oldErr := v.old.get(key)
+	newEntry, newExp, newErr := v.new.get(key)
+	for _, err := range []error{oldErr, newErr} {
+		if err != nil && err != errNotStored {
+			atomic.AddInt64(&stats.StoreVerifyErrors, 1)
+			log.Printf("error comparing %s between store backends: %s", key, err)
+			return
+		}
+	}
+	switch {
+	case oldErr != nil && newErr != nil:
+		return
+	case oldErr != nil:
+		v.diverged(key, divergenceMissing, "not in "+v.oldSpec)
+		return
+	case newErr != nil:
+		v.diverged(key, divergenceMissing, "not in "+v.newSpec)
+		return
+	}
+	// the bodies are hashed as they're stored, so a backend mangling them is
+	// caught even if it kept their checksums
+	oldSum, newSum := checksum(oldEntry.body()), checksum(newEntry.body())
+	switch {
+	case oldSum != newSum:
+		v.diverged(key, divergenceBody, fmt.Sprintf("body %s in %s, %s in %s", oldSum, v.oldSpec, newSum, v.newSpec))
+	case expiryDiffers(oldExp, newExp):
+		v.diverged(key, divergenceExpiry, fmt.Sprintf("expires %s in %s, %s in %s", formatExpiration(oldExp), v.oldSpec, formatExpiration(newExp), v.newSpec))
+	}
+}
+
+// expiryDiffers reports whether the expirations a and b differ by more than
+// -store-verify-tolerance.
+func expiryDiffers(a, b int64) bool {
+	if a == 0 || b == 0 {
+		return a != b
+	}
+	d := time.Duration(a - b)
+	if d < 0 {
+		d = -d
+	}
+	return d > flagStoreVerifyTolerance
+}
+
+func formatExpiration(exp int64) string {
+	if exp == 0 {
+		return "never"
+	}
+	return time.Unix(0, exp).UTC().Format(time.RFC3339Nano)
+}
+
+// diverged logs and records a divergence, keeping the latest
+// storeVerifyReportLimit.
+func (v *storeVerifier) diverged(key, kind, detail string) {
+	atomic.AddInt64(&stats.StoreVerifyDivergences, 1)
+	log.Printf("store backends diverge on %s: %s: %s", key, kind, detail)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.divergences) == storeVerifyReportLimit {
+		v.divergences = v.divergences[1:]
+	}
+	v.divergences = append(v.divergences, storeDivergence{Time: time.Now(), Key: key, Kind: kind, Detail: detail})
+}
+
+// handleStoreVerify reports the divergences found between the -store-verify
+// backends.
+func handleStoreVerify(w http.ResponseWriter, r *http.Request) {
+	v := storeVerify
+	if v == nil {
+		http.Error(w, "-store-verify isn't enabled", http.StatusNotFound)
+		return
+	}
+	v.mu.Lock()
+	divergences := append([]storeDivergence{}, v.divergences...)
+	v.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"old":         v.oldSpec,
+		"new":         v.newSpec,
+		"primary":     v.primarySpec,
+		"checked":     atomic.LoadInt64(&stats.StoreVerifyChecks),
+		"diverged":    atomic.LoadInt64(&stats.StoreVerifyDivergences),
+		"skipped":     atomic.LoadInt64(&stats.StoreVerifySkipped),
+		"errors":      atomic.LoadInt64(&stats.StoreVerifyErrors),
+		"divergences": divergences,
+	})
+}
@@ -0,0 +1,116 @@
+package devcache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitChecks waits for the -store-verify comparisons to reach n.
+func waitChecks(t *testing.T, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&stats.StoreVerifyChecks) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d comparisons, want %d", atomic.LoadInt64(&stats.StoreVerifyChecks), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the divergence is recorded after the check is counted
+	time.Sleep(20 * time.Millisecond)
+}
+
+func TestStoreVerify(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("body of " + r.URL.Path))
+	}))
+	defer up.Close()
+	db := filepath.Join(t.TempDir(), "verify.db")
+	s := newTestServer(t, up.URL, "-store-verify", "memory,bolt:"+db, "-store-verify-sample", "1")
+
+	do(s.Handler(), "GET", "/a", nil)
+	var key string
+	keys.Range(func(k, _ interface{}) bool {
+		key = k.(string)
+		return false
+	})
+	if _, _, err := storeVerify.new.get(key); err != nil {
+		t.Fatalf("entry not written to the new backend: %v", err)
+	}
+
+	report := func() (r struct {
+		Diverged    int64             `json:"diverged"`
+		Divergences []storeDivergence `json:"divergences"`
+	}) {
+		w := do(s.Handler(), "GET", adminPrefix+"/store-verify", nil)
+		if err := json.Unmarshal(w.Body.Bytes(), &r); err != nil {
+			t.Fatalf("report %q: %s", w.Body, err)
+		}
+		return r
+	}
+	checks := int64(0)
+	for _, tt := range []struct {
+		name   string
+		change func()
+		kind   string
+	}{
+		{"same", func() {}, ""},
+		{"body", func() { storeVerify.new.set(key, &entry{Body: []byte("other")}, time.Hour) }, divergenceBody},
+		{"expiry", func() {
+			e, _, _ := storeVerify.old.get(key)
+			storeVerify.new.set(key, e, 48*time.Hour)
+		}, divergenceExpiry},
+		{"missing", func() { storeVerify.new.del(key) }, divergenceMissing},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(report().Divergences)
+			tt.change()
+			do(s.Handler(), "GET", "/a", nil)
+			checks++
+			waitChecks(t, checks)
+			r := report()
+			if tt.kind == "" {
+				if r.Diverged != 0 {
+					t.Fatalf("diverged %d times: %+v", r.Diverged, r.Divergences)
+				}
+				return
+			}
+			if len(r.Divergences) != before+1 {
+				t.Fatalf("got %d divergences, want %d", len(r.Divergences), before+1)
+			}
+			if d := r.Divergences[before]; d.Key != key || d.Kind != tt.kind {
+				t.Errorf("got divergence %+v, want %s on %s", d, tt.kind, key)
+			}
+		})
+	}
+}
+
+func TestStorePrimaryNew(t *testing.T) {
+	var fetches int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&fetches, 1)
+		w.Write([]byte("ok"))
+	}))
+	defer up.Close()
+	db := filepath.Join(t.TempDir(), "verify.sqlite")
+	s := newTestServer(t, up.URL, "-store-verify", "memory,sqlite:"+db)
+	do(s.Handler(), "GET", "/a", nil)
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a fresh memory cache is answered from the new backend
+	s = newTestServer(t, up.URL, "-store-verify", "memory,sqlite:"+db, "-store", "primary=new")
+	w := do(s.Handler(), "GET", "/a", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Fatalf("got %d %q", w.Code, w.Body)
+	}
+	if n := atomic.LoadInt64(&fetches); n != 1 {
+		t.Errorf("upstream fetched %d times, want 1", n)
+	}
+}
@@ -0,0 +1,211 @@
+package devcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// entrySummary identifies the version of a cached entry, so two instances can
+// tell which entries they don't share.
+type entrySummary struct {
+	Key      string    `json:"key"`
+	Checksum string    `json:"checksum"`
+	Stored   time.Time `json:"stored"`
+}
+
+// handleEntries lists a summary of every cached entry, or of those stored by
+// the source given in the request.
+func handleEntries(w http.ResponseWriter, r *http.Request) {
+	source := r.URL.Query().Get("source")
+	items := scopedItems(r)
+	list := make([]entrySummary, 0, len(items))
+	for key, item := range items {
+		e, ok := toEntry(item.Object)
+		if !ok || (source != "" && e.source() != source) {
+			continue
+		}
+		sum := e.Checksum
+		if sum == "" {
+			sum = checksum(e.body())
+		}
+		list = append(list, entrySummary{Key: key, Checksum: sum, Stored: e.Stored})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// handleExport writes the entries for the JSON array of keys in the request
+// body as JSON lines, in the format of -cache-dir entry files. Keys that
+// aren't cached are left out.
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	var keys []string
+	if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	items := scopedItems(r)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, key := range keys {
+		item, ok := items[key]
+		if !ok {
+			continue
+		}
+		if de := newDirEntry(key, item); de != nil {
+			enc.Encode(de)
+		}
+	}
+}
+
+// handleImport caches the entries in the request body, written as by
+// handleExport, and reports how many were stored.
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	dec := json.NewDecoder(r.Body)
+	imported, skipped := 0, 0
+	for dec.More() {
+		de := dirEntry{entry: &entry{}}
+		if err := dec.Decode(&de); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if importItem(de.Key, de.item()) {
+			imported++
+		} else {
+			skipped++
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"imported": imported, "skipped": skipped})
+}
+
+// syncPeer is a devcache instance taking part in a sync.
+type syncPeer struct {
+	url   string
+	token string
+}
+
+// do sends a request to an admin endpoint of the peer and returns the
+// response body.
+func (p syncPeer) do(method, endpoint string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(p.url, "/")+adminPrefix+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if p.token != "" {
+		req.Header.Set("X-Devcache-Token", p.token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, p.url, res.Status, bytes.TrimSpace(data))
+	}
+	return data, nil
+}
+
+func (p syncPeer) entries() (map[string]entrySummary, error) {
+	data, err := p.do("GET", "/entries", nil)
+	if err != nil {
+		return nil, err
+	}
+	var list []entrySummary
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	entries := make(map[string]entrySummary, len(list))
+	for _, s := range list {
+		entries[s.Key] = s
+	}
+	return entries, nil
+}
+
+// runSync implements the sync subcommand, which copies the entries a remote
+// instance has and a local one doesn't into the local one. Only the
+// difference is transferred, so an interrupted sync resumes where it stopped
+// when run again.
+func runSync(args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	from := fs.String("from", "", "base URL of the instance to copy entries from")
+	fromToken := fs.String("from-token", "", "admin token of the -from instance")
+	to := fs.String("to", "http://localhost:8000", "base URL of the instance to copy entries to")
+	token := fs.String("token", "", "admin token of the -to instance")
+	prefer := fs.String("prefer", "newest", "which entry wins when both have a key with different bodies: local, remote or newest")
+	batch := fs.Int("batch", 100, "number of entries transferred per request")
+	fs.Parse(args)
+	if *from == "" {
+		return fmt.Errorf("sync: -from is required")
+	}
+	if *prefer != "local" && *prefer != "remote" && *prefer != "newest" {
+		return fmt.Errorf("sync: -prefer must be local, remote or newest")
+	}
+	if *batch < 1 {
+		*batch = 1
+	}
+	remote := syncPeer{url: *from, token: *fromToken}
+	local := syncPeer{url: *to, token: *token}
+
+	remoteEntries, err := remote.entries()
+	if err != nil {
+		return err
+	}
+	localEntries, err := local.entries()
+	if err != nil {
+		return err
+	}
+	var missing []string
+	conflicts := 0
+	for key, rs := range remoteEntries {
+		ls, ok := localEntries[key]
+		switch {
+		case !ok:
+			missing = append(missing, key)
+		case ls.Checksum == rs.Checksum:
+		case *prefer == "remote", *prefer == "newest" && rs.Stored.After(ls.Stored):
+			conflicts++
+			missing = append(missing, key)
+		default:
+			conflicts++
+		}
+	}
+	sort.Strings(missing)
+	fmt.Printf("%d remote entries, %d to transfer (%d conflicting)\n", len(remoteEntries), len(missing), conflicts)
+
+	imported := 0
+	for i := 0; i < len(missing); i += *batch {
+		keys := missing[i:]
+		if len(keys) > *batch {
+			keys = keys[:*batch]
+		}
+		body, _ := json.Marshal(keys)
+		export, err := remote.do("POST", "/export", body)
+		if err != nil {
+			return err
+		}
+		data, err := local.do("POST", "/import", export)
+		if err != nil {
+			return err
+		}
+		var result map[string]int
+		if err := json.Unmarshal(data, &result); err != nil {
+			return err
+		}
+		imported += result["imported"]
+		fmt.Printf("transferred %d/%d\n", i+len(keys), len(missing))
+	}
+	fmt.Printf("imported %d entries\n", imported)
+	return nil
+}
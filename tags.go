@@ -0,0 +1,120 @@
+package devcache
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// tags indexes cached keys by the tags the upstream attached to them.
+var tags = newTagIndex()
+
+// tagIndex maps each tag to the set of keys carrying it.
+type tagIndex struct {
+	mu   sync.Mutex
+	keys map[string]map[string]struct{}
+}
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{keys: make(map[string]map[string]struct{})}
+}
+
+func (t *tagIndex) add(key string, tags []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tag := range tags {
+		set, ok := t.keys[tag]
+		if !ok {
+			set = make(map[string]struct{})
+			t.keys[tag] = set
+		}
+		set[key] = struct{}{}
+	}
+}
+
+func (t *tagIndex) remove(key string, tags []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tag := range tags {
+		if set, ok := t.keys[tag]; ok {
+			delete(set, key)
+			if len(set) == 0 {
+				delete(t.keys, tag)
+			}
+		}
+	}
+}
+
+// keysFor returns the keys currently carrying tag.
+func (t *tagIndex) keysFor(tag string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keys := make([]string, 0, len(t.keys[tag]))
+	for key := range t.keys[tag] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// tagsMissing returns the tags not in keep.
+func tagsMissing(tags, keep []string) []string {
+	var missing []string
+	for _, tag := range tags {
+		found := false
+		for _, k := range keep {
+			if k == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, tag)
+		}
+	}
+	return missing
+}
+
+// parseTags splits a comma-separated tag header value.
+func parseTags(v string) []string {
+	var tags []string
+	for _, tag := range strings.Split(v, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// handleInvalidate evicts every entry carrying the tag, or stored by the
+// source, given in the request.
+func handleInvalidate(w http.ResponseWriter, r *http.Request) {
+	tag, source := r.URL.Query().Get("tag"), r.URL.Query().Get("source")
+	var evict []string
+	switch {
+	case tag != "":
+		for _, key := range tags.keysFor(tag) {
+			if inScope(r, key) {
+				evict = append(evict, key)
+			}
+		}
+	case source != "":
+		for key, item := range scopedItems(r) {
+			if e, ok := toEntry(item.Object); ok && e.source() == source {
+				evict = append(evict, key)
+			}
+		}
+	default:
+		http.Error(w, "missing tag or source", http.StatusBadRequest)
+		return
+	}
+	for _, key := range evict {
+		deleteEntry(key)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tag":     tag,
+		"source":  source,
+		"evicted": len(evict),
+	})
+}
@@ -0,0 +1,475 @@
+package devcache
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+	cache "github.com/patrickmn/go-cache"
+)
+
+// defaultTenant is the tenant of requests that don't name one. Its keys
+// carry no tenant prefix, so a cache recorded without tenants is its cache.
+const defaultTenant = "default"
+
+// tenantKeyPrefix starts the keys of every tenant but the default one, which
+// are "@tenant:" followed by the key the request would otherwise have.
+const tenantKeyPrefix = "@"
+
+// validTenant matches the tenant names accepted. They end up in keys and
+// file names, so they're kept short and plain.
+var validTenant = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// tenancy reports whether requests are told apart by tenant.
+func tenancy() bool {
+	return flagTenantHeader != "" || flagTenantBasicAuth
+}
+
+// tenantOf returns the tenant r identifies itself as, by -tenant-header or
+// with -tenant-basic-auth by its basic auth username.
+func tenantOf(r *http.Request) (string, bool) {
+	if flagTenantHeader != "" {
+		if t := r.Header.Get(flagTenantHeader); t != "" {
+			return t, true
+		}
+	}
+	if flagTenantBasicAuth {
+		if user, _, ok := r.BasicAuth(); ok && user != "" {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+// tenantKey returns key as stored for tenant.
+func tenantKey(tenant, key string) string {
+	if tenant == "" || tenant == defaultTenant {
+		return key
+	}
+	return tenantKeyPrefix + tenant + ":" + key
+}
+
+// splitTenantKey returns the tenant a stored key belongs to and the key
+// without its tenant prefix.
+func splitTenantKey(key string) (string, string) {
+	if !strings.HasPrefix(key, tenantKeyPrefix) {
+		return defaultTenant, key
+	}
+	i := strings.IndexByte(key, ':')
+	if i < 0 || !validTenant.MatchString(key[1:i]) {
+		return defaultTenant, key
+	}
+	return key[1:i], key[i+1:]
+}
+
+// tenantCtxKey is the context key the tenant of a proxied request is stored
+// under, and scopeKey the one the tenant an admin request is scoped to is.
+type (
+	tenantCtxKey struct{}
+	scopeKey     struct{}
+)
+
+// requestTenant returns the tenant tenantMiddleware found r to belong to.
+func requestTenant(r *http.Request) string {
+	if t, ok := r.Context().Value(tenantCtxKey{}).(string); ok {
+		return t
+	}
+	return defaultTenant
+}
+
+// tenantMiddleware finds the tenant of proxied requests for keyFor, and counts
+// the requests of each tenant by outcome. Requests without a tenant belong to
+// the default one, or with -tenant-required are refused.
+func tenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tenancy() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tenant, ok := tenantOf(r)
+		switch {
+		case !ok && flagTenantRequired:
+			if flagTenantBasicAuth {
+				w.Header().Set("WWW-Authenticate", `Basic realm="devcache"`)
+			}
+			setOutcome(w, outcomeRejected)
+			http.Error(w, "missing tenant", http.StatusUnauthorized)
+			return
+		case !ok:
+			tenant = defaultTenant
+		case !validTenant.MatchString(tenant):
+			setOutcome(w, outcomeRejected)
+			http.Error(w, "invalid tenant", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantCtxKey{}, tenant)))
+		if rec, ok := w.(*responseRecorder); ok {
+			tenantRequests.add(tenant, rec.outcome)
+		}
+	})
+}
+
+// tenantRequests counts the requests of each tenant by outcome.
+var tenantRequests = &tenantCounter{counts: make(map[string]map[string]int64)}
+
+type tenantCounter struct {
+	mu     sync.Mutex
+	counts map[string]map[string]int64
+}
+
+func (c *tenantCounter) add(tenant, outcome string) {
+	if outcome == "" {
+		outcome = "other"
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts[tenant] == nil {
+		c.counts[tenant] = make(map[string]int64)
+	}
+	c.counts[tenant][outcome]++
+}
+
+func (c *tenantCounter) snapshot(tenant string) map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]int64, len(c.counts[tenant]))
+	for outcome, n := range c.counts[tenant] {
+		counts[outcome] = n
+	}
+	return counts
+}
+
+func (c *tenantCounter) reset() {
+	c.mu.Lock()
+	c.counts = make(map[string]map[string]int64)
+	c.mu.Unlock()
+}
+
+// TenantStats describes the entries and requests of a tenant.
+type TenantStats struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+	// Requests counts the tenant's requests by outcome.
+	Requests map[string]int64 `json:"requests"`
+}
+
+// tenantStats returns the stats of every tenant with entries or requests, or
+// only of scope if it isn't empty.
+func tenantStats(items map[string]cache.Item, scope string) map[string]TenantStats {
+	all := map[string]TenantStats{}
+	for key, item := range items {
+		e, ok := toEntry(item.Object)
+		if !ok {
+			continue
+		}
+		tenant, _ := splitTenantKey(key)
+		ts := all[tenant]
+		ts.Entries++
+		ts.Bytes += int64(len(e.Body))
+		all[tenant] = ts
+	}
+	tenantRequests.mu.Lock()
+	for tenant := range tenantRequests.counts {
+		if _, ok := all[tenant]; !ok {
+			all[tenant] = TenantStats{}
+		}
+	}
+	tenantRequests.mu.Unlock()
+	for tenant, ts := range all {
+		if scope != "" && tenant != scope {
+			delete(all, tenant)
+			continue
+		}
+		ts.Requests = tenantRequests.snapshot(tenant)
+		all[tenant] = ts
+	}
+	return all
+}
+
+// tenantRoutes are the admin routes a tenant may use without the admin token,
+// scoped to its own entries.
+var tenantRoutes = map[*mux.Route]bool{}
+
+// tenantRoute marks rt as open to tenants, see tenantRoutes.
+func tenantRoute(rt *mux.Route) {
+	tenantRoutes[rt] = true
+}
+
+// tenantTokens is a repeatable flag of TENANT=TOKEN credentials, each
+// letting requests use the tenantRoutes scoped to the tenant.
+type tenantTokens map[string]string
+
+func (t *tenantTokens) String() string {
+	tenants := make([]string, 0, len(*t))
+	for _, tenant := range *t {
+		tenants = append(tenants, tenant+"=<redacted>")
+	}
+	sort.Strings(tenants)
+	return strings.Join(tenants, " ")
+}
+
+func (t *tenantTokens) Set(spec string) error {
+	i := strings.IndexByte(spec, '=')
+	if i <= 0 || i == len(spec)-1 {
+		return fmt.Errorf("tenant token %q is not TENANT=TOKEN", spec)
+	}
+	if !validTenant.MatchString(spec[:i]) {
+		return fmt.Errorf("invalid tenant %q", spec[:i])
+	}
+	if *t == nil {
+		*t = tenantTokens{}
+	}
+	(*t)[spec[i+1:]] = spec[:i]
+	return nil
+}
+
+func (t *tenantTokens) repeatable() {}
+
+// tenant returns the tenant whose token is token.
+func (t tenantTokens) tenant(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	for candidate, tenant := range t {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(candidate)) == 1 {
+			return tenant, true
+		}
+	}
+	return "", false
+}
+
+// scopeTenant returns r scoped to the tenant it identifies as or, failing
+// that, to the one named by its tenant parameter. Admin requests without
+// either see every tenant's entries. It's only a filter: adminAuth has
+// checked the request may see them all.
+func scopeTenant(r *http.Request) (*http.Request, bool) {
+	if !tenancy() {
+		return r, true
+	}
+	tenant, ok := tenantOf(r)
+	if !ok {
+		tenant = r.URL.Query().Get("tenant")
+	}
+	if tenant == "" {
+		return r, true
+	}
+	if !validTenant.MatchString(tenant) {
+		return r, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), scopeKey{}, tenant)), true
+}
+
+// adminScope returns the tenant an admin request is scoped to, or "" if it
+// sees every tenant.
+func adminScope(r *http.Request) string {
+	t, _ := r.Context().Value(scopeKey{}).(string)
+	return t
+}
+
+// inScope reports whether the entry under key may be seen by r.
+func inScope(r *http.Request, key string) bool {
+	scope := adminScope(r)
+	if scope == "" {
+		return true
+	}
+	tenant, _ := splitTenantKey(key)
+	return tenant == scope
+}
+
+// scopedItems returns the cached items r may see.
+func scopedItems(r *http.Request) map[string]cache.Item {
+	items := snapshotItems()
+	if adminScope(r) == "" {
+		return items
+	}
+	for key := range items {
+		if !inScope(r, key) {
+			delete(items, key)
+		}
+	}
+	return items
+}
+
+// handleTenants lists the stats of every tenant, or of the one the request is
+// scoped to.
+func handleTenants(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tenantStats(snapshotItems(), adminScope(r)))
+}
+
+// tenantUsage keeps a running total of the bytes of each tenant's cached
+// bodies, so makeRoom needn't walk the cache on every store. setEntry and
+// onEvicted keep it up to date, under keysMu.
+var tenantUsage = newUsageIndex()
+
+type usageIndex struct {
+	mu sync.Mutex
+	// sizes holds the body size of every key of each tenant.
+	sizes  map[string]map[string]int64
+	totals map[string]int64
+}
+
+func newUsageIndex() *usageIndex {
+	return &usageIndex{sizes: make(map[string]map[string]int64), totals: make(map[string]int64)}
+}
+
+// set records size as the size of the body cached under key, in place of
+// any it had.
+func (u *usageIndex) set(key string, size int64) {
+	tenant, _ := splitTenantKey(key)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.sizes[tenant] == nil {
+		u.sizes[tenant] = make(map[string]int64)
+	}
+	u.totals[tenant] += size - u.sizes[tenant][key]
+	u.sizes[tenant][key] = size
+}
+
+// remove forgets the body cached under key.
+func (u *usageIndex) remove(key string) {
+	tenant, _ := splitTenantKey(key)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.totals[tenant] -= u.sizes[tenant][key]
+	delete(u.sizes[tenant], key)
+	if len(u.sizes[tenant]) == 0 {
+		delete(u.sizes, tenant)
+		delete(u.totals, tenant)
+	}
+}
+
+// used returns the bytes of tenant's bodies, leaving out the one cached under
+// key, along with tenant's other keys.
+func (u *usageIndex) used(tenant, key string) (int64, []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	keys := make([]string, 0, len(u.sizes[tenant]))
+	for k := range u.sizes[tenant] {
+		if k != key {
+			keys = append(keys, k)
+		}
+	}
+	return u.totals[tenant] - u.sizes[tenant][key], keys
+}
+
+// makeRoom evicts the coldest entries of the tenant key belongs to until an
+// entry of size bytes fits within -tenant-max-bytes, so one tenant filling
+// the cache only ever evicts its own entries. The entry stored under key
+// itself is left to be replaced.
+func makeRoom(key string, size int) {
+	tenant, _ := splitTenantKey(key)
+	used, ownKeys := tenantUsage.used(tenant, key)
+	over := used + int64(size) - int64(flagTenantMaxBytes)
+	if over <= 0 {
+		return
+	}
+	var own []*entry
+	keys := map[*entry]string{}
+	for _, k := range ownKeys {
+		v, found := Cache.Get(k)
+		e, ok := toEntry(v)
+		if !found || !ok {
+			continue
+		}
+		own = append(own, e)
+		keys[e] = k
+	}
+	coldestFirst(own)
+	shed := 0
+	for _, e := range own {
+		if over <= 0 {
+			break
+		}
+		Cache.Delete(keys[e])
+		over -= int64(len(e.Body))
+		shed++
+	}
+	atomic.AddInt64(&stats.TenantShed, int64(shed))
+	debugf("tenant %s over -tenant-max-bytes, shed %d entries", tenant, shed)
+}
+
+// tenantFile returns the cache file a tenant's entries are saved to: the
+// -cache-file for the default tenant, and next to it with the tenant's name
+// appended for the others, such as cache-tenant.gob.
+func tenantFile(tenant string) string {
+	if tenant == defaultTenant {
+		return flagCacheFile
+	}
+	ext := filepath.Ext(flagCacheFile)
+	return strings.TrimSuffix(flagCacheFile, ext) + "-" + tenant + ext
+}
+
+// tenantFiles returns the tenants with a cache file other than the default
+// one.
+func tenantFiles() []string {
+	ext := filepath.Ext(flagCacheFile)
+	prefix := strings.TrimSuffix(flagCacheFile, ext) + "-"
+	files, _ := filepath.Glob(prefix + "*" + ext)
+	var tenants []string
+	for _, file := range files {
+		t := strings.TrimSuffix(strings.TrimPrefix(file, prefix), ext)
+		if validTenant.MatchString(t) && t != defaultTenant {
+			tenants = append(tenants, t)
+		}
+	}
+	return tenants
+}
+
+// readTenantCaches adds the entries in every tenant's cache file to items,
+// under the tenant's keys.
+func readTenantCaches(items map[string]cache.Item) error {
+	for _, tenant := range tenantFiles() {
+		err := newStore(tenantFile(tenant)).Load(func(key string, item cache.Item) {
+			items[tenantKey(tenant, key)] = item
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTenantCaches saves items to one cache file per tenant, each with keys
+// as they'd be without tenants. Tenants whose entries are all gone have their
+// file emptied.
+func writeTenantCaches(items map[string]cache.Item) error {
+	byTenant := map[string]map[string]cache.Item{defaultTenant: {}}
+	for _, tenant := range tenantFiles() {
+		byTenant[tenant] = map[string]cache.Item{}
+	}
+	for key, item := range items {
+		tenant, k := splitTenantKey(key)
+		if byTenant[tenant] == nil {
+			byTenant[tenant] = map[string]cache.Item{}
+		}
+		byTenant[tenant][k] = item
+	}
+	for tenant, own := range byTenant {
+		if err := newStore(tenantFile(tenant)).Save(own); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadTenantsInBackground loads the default cache file and then, with
+// tenants, every tenant's, as loadInBackground does.
+func loadTenantsInBackground() {
+	loadInBackground(tenantFile(defaultTenant), defaultTenant)
+	if !tenancy() {
+		return
+	}
+	for _, tenant := range tenantFiles() {
+		loadInBackground(tenantFile(tenant), tenant)
+	}
+}
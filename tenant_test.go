@@ -0,0 +1,141 @@
+package devcache
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTenantAdminAuth(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL, "-tenant-header", "X-Devcache-Tenant", "-admin-token", "root", "-tenant-token", "alice=a-token")
+	fill := func() {
+		for _, tenant := range []string{"", "alice", "bob"} {
+			for _, path := range []string{"/a", "/b"} {
+				do(s.Handler(), "GET", path, http.Header{"X-Devcache-Tenant": {tenant}})
+			}
+		}
+	}
+	cached := func() []string {
+		var keys []string
+		for key := range Cache.Items() {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	admin := http.Header{"X-Devcache-Token": {"root"}}
+	alice := http.Header{"Authorization": {"Bearer a-token"}}
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		target string
+		header http.Header
+		status int
+		left   int
+	}{
+		// naming a tenant is no credential
+		{"tenant parameter", "POST", controlPrefix + "/flush?tenant=default", nil, http.StatusUnauthorized, 6},
+		{"tenant header", "POST", controlPrefix + "/flush", http.Header{"X-Devcache-Tenant": {"alice"}}, http.StatusUnauthorized, 6},
+		{"wrong token", "POST", controlPrefix + "/flush", http.Header{"X-Devcache-Token": {"a-token!"}}, http.StatusUnauthorized, 6},
+		// a tenant token only opens tenant routes
+		{"tenant token on admin route", "POST", controlPrefix + "/stats/reset", alice, http.StatusUnauthorized, 6},
+		// scoped to its own tenant, whichever one the request names
+		{"tenant token", "POST", controlPrefix + "/flush", alice, http.StatusOK, 4},
+		{"tenant token naming another", "POST", controlPrefix + "/flush?tenant=bob", alice, http.StatusOK, 4},
+		{"tenant token purge", "POST", controlPrefix + "/purge?key=/a", alice, http.StatusOK, 5},
+		// the admin token sees every tenant, or the one it names
+		{"admin token naming a tenant", "POST", controlPrefix + "/flush?tenant=bob", admin, http.StatusOK, 4},
+		{"admin token purge", "POST", controlPrefix + "/purge?key=/a", admin, http.StatusOK, 3},
+		{"admin token purge prefix", "POST", controlPrefix + "/purge?prefix=/", admin, http.StatusOK, 0},
+		{"admin token", "POST", controlPrefix + "/flush", admin, http.StatusOK, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			Cache.Flush()
+			fill()
+			w := do(s.Handler(), tt.method, tt.target, tt.header)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if left := cached(); len(left) != tt.left {
+				t.Errorf("%d entries left, want %d: %q", len(left), tt.left, left)
+			}
+		})
+	}
+}
+
+func TestTenantRoutesWithoutAdminToken(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL, "-tenant-header", "X-Devcache-Tenant")
+	for _, tenant := range []string{"", "alice", "bob"} {
+		do(s.Handler(), "GET", "/a", http.Header{"X-Devcache-Tenant": {tenant}})
+	}
+
+	for _, tt := range []struct {
+		target string
+		header http.Header
+		status int
+	}{
+		{controlPrefix + "/flush", nil, http.StatusUnauthorized},
+		{controlPrefix + "/flush?tenant=bob", nil, http.StatusOK},
+		{controlPrefix + "/flush", http.Header{"X-Devcache-Tenant": {"alice"}}, http.StatusOK},
+	} {
+		if w := do(s.Handler(), "POST", tt.target, tt.header); w.Code != tt.status {
+			t.Errorf("%s %v: status %d, want %d", tt.target, tt.header, w.Code, tt.status)
+		}
+	}
+	if w := do(s.Handler(), "GET", controlPrefix+"/tenants", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("tenants listed without naming one: status %d", w.Code)
+	}
+	if _, found := Cache.Get("/a"); !found || Cache.ItemCount() != 1 {
+		t.Errorf("%d entries left, want the default tenant's", Cache.ItemCount())
+	}
+}
+
+func TestTenantMaxBytes(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), 100))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL, "-tenant-header", "X-Devcache-Tenant", "-tenant-max-bytes", "250")
+	get := func(tenant, path string) {
+		do(s.Handler(), "GET", path, http.Header{"X-Devcache-Tenant": {tenant}})
+	}
+	get("bob", "/a")
+	get("bob", "/b")
+	for _, path := range []string{"/a", "/b", "/a", "/c"} {
+		get("alice", path)
+	}
+
+	// alice's coldest entry made room for her third, and bob kept his
+	for key, want := range map[string]bool{
+		"@alice:/a": true, "@alice:/b": false, "@alice:/c": true,
+		"@bob:/a": true, "@bob:/b": true,
+	} {
+		if _, found := Cache.Get(key); found != want {
+			t.Errorf("%s cached %v, want %v", key, found, want)
+		}
+	}
+	if n := atomic.LoadInt64(&stats.TenantShed); n != 1 {
+		t.Errorf("shed %d entries, want 1", n)
+	}
+	if used, _ := tenantUsage.used("alice", ""); used != 200 {
+		t.Errorf("alice uses %d bytes, want 200", used)
+	}
+
+	// and freed bytes are counted as the entries go
+	do(s.Handler(), "POST", controlPrefix+"/flush?tenant=alice", nil)
+	if used, _ := tenantUsage.used("alice", ""); used != 0 {
+		t.Errorf("alice uses %d bytes after a flush, want 0", used)
+	}
+}
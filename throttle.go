@@ -0,0 +1,64 @@
+package devcache
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// bandwidth caps the combined rate at which upstream bodies are read.
+var bandwidth = &throttle{}
+
+// throttleChunk is the most read from a throttled reader at once, keeping the
+// rate smooth.
+const throttleChunk = 32 << 10
+
+// throttle paces reads so their total throughput stays under a rate in bytes
+// per second. It schedules reads back to back in virtual time, so the cap is
+// shared by all readers but only holds on average.
+type throttle struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time
+}
+
+// wait blocks until n more bytes may be read.
+func (t *throttle) wait(n int) {
+	t.mu.Lock()
+	if t.rate <= 0 {
+		t.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	delay := t.next.Sub(now)
+	t.next = t.next.Add(time.Duration(int64(n) * int64(time.Second) / t.rate))
+	t.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// reader wraps r so reads from it are paced by t.
+func (t *throttle) reader(r io.Reader) io.Reader {
+	if t.rate <= 0 {
+		return r
+	}
+	return &throttledReader{r: r, t: t}
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *throttle
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := tr.r.Read(p)
+	tr.t.wait(n)
+	return n, err
+}
@@ -0,0 +1,233 @@
+package devcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// transformInput describes the response whose body a transform rewrites.
+type transformInput struct {
+	path        string
+	status      int
+	contentType string
+}
+
+// transformFunc rewrites the body of a response.
+type transformFunc func(in transformInput, body []byte) ([]byte, error)
+
+// transformStage is when a transform runs. Bodies are always decoded from
+// their Content-Encoding before any transform sees them, see decodeBody, and
+// served without one, so transforms never have to deal with compressed bytes
+// or fix lengths themselves.
+type transformStage int
+
+const (
+	// stageRecord transforms run once on a fetched body, before it's cached.
+	stageRecord transformStage = iota
+	// stageServe transforms run on the cached body each time it's served,
+	// leaving the cached body as it was fetched.
+	stageServe
+)
+
+// transform is a body transform that can be configured by name.
+type transform struct {
+	fn transformFunc
+	// json limits the transform to JSON bodies.
+	json  bool
+	stage transformStage
+	// contentType, if set, is the Content-Type of the bodies it produces.
+	contentType string
+}
+
+// transforms are the body transforms that can be configured by name.
+var transforms = map[string]transform{
+	"minify": {fn: func(in transformInput, body []byte) ([]byte, error) {
+		err := jsonMinify(&body)
+		return body, err
+	}, json: true},
+	"canonical-json": {fn: func(in transformInput, body []byte) ([]byte, error) {
+		canonical, err := canonicalJSON(in.path, body)
+		if err != nil {
+			debugf("not canonicalizing malformed JSON from %s: %s", in.path, err)
+		}
+		return canonical, err
+	}, json: true},
+	// the envelope is served rather than recorded, so the cache keeps the
+	// upstream's error as it was and the envelope can be changed without
+	// recording it again
+	"error-envelope": {fn: errorEnvelope, stage: stageServe, contentType: "application/json"},
+}
+
+// statusRange is an inclusive range of status codes.
+type statusRange struct {
+	min, max int
+}
+
+func (sr statusRange) contains(status int) bool {
+	return status >= sr.min && status <= sr.max
+}
+
+// transformRule applies a named transform to responses whose status is in
+// one of its ranges and, if it has any paths, whose path matches one.
+type transformRule struct {
+	name string
+	transform
+	statuses []statusRange
+	paths    patternList
+}
+
+func (t transformRule) matches(in transformInput, body []byte) bool {
+	if len(t.paths) > 0 && !t.paths.match(in.path) {
+		return false
+	}
+	if t.json && !isJSON(in.contentType, body) {
+		return false
+	}
+	for _, sr := range t.statuses {
+		if sr.contains(in.status) {
+			return true
+		}
+	}
+	return false
+}
+
+// transformRules is the configured transform pipeline, in the order the
+// transforms run. It's set with the -transform flag.
+type transformRules []transformRule
+
+// defaultTransforms minifies every response, as devcache always has.
+var defaultTransforms = transformRules{
+	{name: "minify", transform: transforms["minify"], statuses: []statusRange{{0, 999}}},
+}
+
+func (rules *transformRules) String() string {
+	var specs []string
+	for _, t := range *rules {
+		var ranges []string
+		for _, sr := range t.statuses {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", sr.min, sr.max))
+		}
+		spec := t.name + "=" + strings.Join(ranges, ",")
+		if len(t.paths) > 0 {
+			spec += "@" + t.paths.String()
+		}
+		specs = append(specs, spec)
+	}
+	return strings.Join(specs, " ")
+}
+
+// Set adds a transform given as name or name=statuses, where statuses is a
+// comma-separated list of codes (404), classes (4xx) or ranges (400-499).
+func (rules *transformRules) Set(spec string) error {
+	name, ranges := spec, "*"
+	if i := strings.Index(spec, "="); i >= 0 {
+		name, ranges = spec[:i], spec[i+1:]
+	}
+	tf, ok := transforms[name]
+	if !ok {
+		return fmt.Errorf("unknown transform %q", name)
+	}
+	t := transformRule{name: name, transform: tf}
+	for _, r := range strings.Split(ranges, ",") {
+		sr, err := parseStatusRange(strings.TrimSpace(r))
+		if err != nil {
+			return err
+		}
+		t.statuses = append(t.statuses, sr)
+	}
+	*rules = append(*rules, t)
+	return nil
+}
+
+func (rules *transformRules) repeatable() {}
+
+func parseStatusRange(s string) (statusRange, error) {
+	switch {
+	case s == "*":
+		return statusRange{0, 999}, nil
+	case len(s) == 3 && strings.HasSuffix(s, "xx"):
+		class, err := strconv.Atoi(s[:1])
+		if err != nil {
+			return statusRange{}, fmt.Errorf("invalid status class %q", s)
+		}
+		return statusRange{class * 100, class*100 + 99}, nil
+	case strings.Contains(s, "-"):
+		parts := strings.SplitN(s, "-", 2)
+		min, err1 := strconv.Atoi(parts[0])
+		max, err2 := strconv.Atoi(parts[1])
+		if err1 != nil || err2 != nil || min > max {
+			return statusRange{}, fmt.Errorf("invalid status range %q", s)
+		}
+		return statusRange{min, max}, nil
+	}
+	code, err := strconv.Atoi(s)
+	if err != nil {
+		return statusRange{}, fmt.Errorf("invalid status %q", s)
+	}
+	return statusRange{code, code}, nil
+}
+
+// apply runs the transforms of stage matching in over body, in order,
+// updating the content type of in for those that change it. A transform that
+// fails leaves the body as it was. It reports whether any transform ran.
+func (rules transformRules) apply(stage transformStage, in *transformInput, body []byte) ([]byte, bool) {
+	var ran bool
+	for _, t := range rules {
+		if t.stage != stage || !t.matches(*in, body) {
+			continue
+		}
+		if out, err := t.fn(*in, body); err == nil {
+			body, ran = out, true
+			if t.contentType != "" {
+				in.contentType = t.contentType
+			}
+		}
+	}
+	return body, ran
+}
+
+// has reports whether any of the rules run at stage.
+func (rules transformRules) has(stage transformStage) bool {
+	for _, t := range rules {
+		if t.stage == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// served returns e decompressed and with the serve transforms applied to its
+// body, or e itself if neither changes it.
+func (e *entry) served() *entry {
+	e = e.decompressed()
+	if !flagTransforms.has(stageServe) {
+		return e
+	}
+	in := e.transformInput()
+	body, ok := flagTransforms.apply(stageServe, &in, e.Body)
+	if !ok {
+		return e
+	}
+	served := e.clone()
+	served.Body, served.Checksum, served.ContentType = body, checksum(body), in.contentType
+	return served
+}
+
+// errorEnvelope wraps an error response body in a standard JSON envelope. JSON
+// bodies are embedded as-is, anything else as a string.
+func errorEnvelope(in transformInput, body []byte) ([]byte, error) {
+	var detail interface{} = string(body)
+	if json.Valid(body) {
+		detail = json.RawMessage(body)
+	}
+	return json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"status":  in.status,
+			"message": http.StatusText(in.status),
+			"detail":  detail,
+		},
+	})
+}
@@ -0,0 +1,231 @@
+package devcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseStatusRange(t *testing.T) {
+	for _, tt := range []struct {
+		spec string
+		want statusRange
+		err  bool
+	}{
+		{"*", statusRange{0, 999}, false},
+		{"404", statusRange{404, 404}, false},
+		{"4xx", statusRange{400, 499}, false},
+		{"500-599", statusRange{500, 599}, false},
+		{"5xy", statusRange{}, true},
+		{"599-500", statusRange{}, true},
+		{"abc", statusRange{}, true},
+	} {
+		got, err := parseStatusRange(tt.spec)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("%q: got %v, %v, want %v, error %v", tt.spec, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestTransformStatusRanges(t *testing.T) {
+	var rules transformRules
+	for _, spec := range []string{"minify=2xx", "canonical-json=404,500-599"} {
+		if err := rules.Set(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	body := []byte(`{"b": 1, "a": 2}`)
+	for _, tt := range []struct {
+		status int
+		want   string
+	}{
+		{200, `{"b":1,"a":2}`},
+		{299, `{"b":1,"a":2}`},
+		{301, `{"b": 1, "a": 2}`},
+		{400, `{"b": 1, "a": 2}`},
+		{404, `{"a":2,"b":1}`},
+		{503, `{"a":2,"b":1}`},
+	} {
+		in := transformInput{path: "/x", status: tt.status, contentType: "application/json"}
+		got, _ := rules.apply(stageRecord, &in, append([]byte{}, body...))
+		if string(got) != tt.want {
+			t.Errorf("%d: got %s, want %s", tt.status, got, tt.want)
+		}
+	}
+	if err := rules.Set("shout=2xx"); err == nil {
+		t.Error("unknown transform accepted")
+	}
+}
+
+func TestErrorEnvelopeServed(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("no such thing"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL, "-transform", "minify=2xx", "-transform", "error-envelope=4xx")
+
+	for i := 0; i < 2; i++ {
+		w := do(s.Handler(), "GET", "/missing", nil)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("status %d, want 404", w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type %q, want application/json", ct)
+		}
+		var envelope struct {
+			Error struct {
+				Status int    `json:"status"`
+				Detail string `json:"detail"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+			t.Fatalf("body %q: %s", w.Body, err)
+		}
+		if envelope.Error.Status != http.StatusNotFound || envelope.Error.Detail != "no such thing" {
+			t.Errorf("envelope %+v", envelope.Error)
+		}
+	}
+
+	// the cache keeps the upstream's body as it was
+	cached := false
+	for _, item := range Cache.Items() {
+		if e, ok := toEntry(item.Object); ok && e.status() == http.StatusNotFound {
+			cached = true
+			if string(e.decompressed().Body) != "no such thing" || e.ContentType != "text/plain" {
+				t.Errorf("cached %q as %q", e.Body, e.ContentType)
+			}
+		}
+	}
+	if !cached {
+		t.Error("404 wasn't cached")
+	}
+
+	if w := do(s.Handler(), "GET", "/ok", nil); w.Body.String() != `{"ok":true}` {
+		t.Errorf("2xx body %q, want it minified", w.Body)
+	}
+}
+
+// TestPipeline runs combinations of upstream encodings, transforms and cache
+// compression, checking the body served on a miss and a hit is the upstream's
+// decoded once and transformed in order.
+func TestPipeline(t *testing.T) {
+	const original = "{\n  \"b\": 1,\n  \"a\": [1, 2]\n}"
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte(original))
+	gz.Close()
+
+	for _, encoding := range []string{"identity", "gzip", "gzip requested"} {
+		for _, tt := range []struct {
+			transforms []string
+			status     int
+			want       string
+		}{
+			{[]string{"minify=*"}, 200, `{"b":1,"a":[1,2]}`},
+			{[]string{"minify=4xx"}, 200, original},
+			{[]string{"canonical-json=*"}, 200, `{"a":[1,2],"b":1}`},
+			{[]string{"minify=*", "canonical-json=*"}, 200, `{"a":[1,2],"b":1}`},
+			{[]string{"minify=*", "error-envelope=4xx"}, 200, `{"b":1,"a":[1,2]}`},
+			{[]string{"minify=*", "error-envelope=4xx"}, 404, `{"error":{"detail":{"b":1,"a":[1,2]},"message":"Not Found","status":404}}`},
+			{[]string{"canonical-json=*", "error-envelope=4xx"}, 404, `{"error":{"detail":{"a":[1,2],"b":1},"message":"Not Found","status":404}}`},
+			// the envelope is served, so it wraps whatever was recorded
+			{[]string{"error-envelope=4xx", "canonical-json=*"}, 404, `{"error":{"detail":{"a":[1,2],"b":1},"message":"Not Found","status":404}}`},
+		} {
+			for _, compress := range []bool{false, true} {
+				name := fmt.Sprintf("%s/%v/%d/compress=%v", encoding, tt.transforms, tt.status, compress)
+				t.Run(name, func(t *testing.T) {
+					up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						w.Header().Set("Content-Type", "application/json")
+						w.Header().Set("Cache-Control", "max-age=60")
+						if encoding == "identity" || !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+							w.WriteHeader(tt.status)
+							w.Write([]byte(original))
+							return
+						}
+						w.Header().Set("Content-Encoding", "gzip")
+						w.WriteHeader(tt.status)
+						w.Write(gzipped.Bytes())
+					}))
+					defer up.Close()
+					args := []string{"-compress-threshold", "1"}
+					for _, spec := range tt.transforms {
+						args = append(args, "-transform", spec)
+					}
+					if compress {
+						args = append(args, "-compress-cache")
+					}
+					s := newTestServer(t, up.URL, args...)
+					var header http.Header
+					if encoding == "gzip requested" {
+						header = http.Header{"Accept-Encoding": {"gzip"}}
+					}
+
+					for _, outcome := range []string{"MISS", "HIT"} {
+						w := do(s.Handler(), "GET", "/a", header)
+						if w.Code != tt.status {
+							t.Fatalf("%s: status %d", outcome, w.Code)
+						}
+						if w.Body.String() != tt.want {
+							t.Errorf("%s: body %s, want %s", outcome, w.Body, tt.want)
+						}
+						if ce := w.Header().Get("Content-Encoding"); ce != "" {
+							t.Errorf("%s: served with Content-Encoding %q", outcome, ce)
+						}
+						if cl := w.Header().Get("Content-Length"); cl != "" && cl != strconv.Itoa(w.Body.Len()) {
+							t.Errorf("%s: Content-Length %s for %d bytes", outcome, cl, w.Body.Len())
+						}
+						if got := w.Header().Get("X-Cache"); got != outcome {
+							t.Errorf("X-Cache %q, want %s", got, outcome)
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+// TestServeTransformConcurrentHits serves an entry with a serve transform from
+// many requests at once. Run with -race: transforming it mustn't race with
+// counting its hits.
+func TestServeTransformConcurrentHits(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"b":1}`))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL, "-transform", "error-envelope=4xx")
+	do(s.Handler(), "GET", "/a", nil)
+
+	const want = `{"error":{"detail":{"b":1},"message":"Not Found","status":404}}`
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := do(s.Handler(), "GET", "/a", nil); w.Body.String() != want {
+				t.Errorf("body %s, want %s", w.Body, want)
+			}
+		}()
+	}
+	wg.Wait()
+	// the miss was served from the entry too
+	if keys := s.Stats().TopKeys; len(keys) != 1 || keys[0].Hits != 21 {
+		t.Errorf("keys %+v, want /a with 21 hits", keys)
+	}
+}
@@ -0,0 +1,269 @@
+package devcache
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamClient is shared by every request to the upstreams so connections
+// to them are reused.
+var upstreamClient = &http.Client{Timeout: 10 * time.Second}
+
+// newUpstreamClient returns a client whose transport is tuned by the
+// -upstream-* flags.
+func newUpstreamClient() *http.Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: dialFamily(&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          flagUpstreamMaxIdleConns,
+		MaxIdleConnsPerHost:   flagUpstreamMaxIdlePerHost,
+		IdleConnTimeout:       flagUpstreamIdleTimeout,
+		DisableKeepAlives:     flagUpstreamDisableKeepAlive || flagDisableKeepAlive,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: transport,
+	}
+}
+
+// Address families, for -listen-family and -upstream-ip-family.
+const (
+	familyAuto = "auto"
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+)
+
+// familyNetwork returns the network to dial or listen on for family. Auto
+// dials both families, racing them per Happy Eyeballs (RFC 6555).
+func familyNetwork(family string) string {
+	switch family {
+	case familyIPv4:
+		return "tcp4"
+	case familyIPv6:
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+// addrFamily returns the family of the IP address of addr.
+func addrFamily(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok && tcp.IP.To4() == nil {
+		return familyIPv6
+	}
+	return familyIPv4
+}
+
+// dialFamily wraps d to dial upstreams over -upstream-ip-family, counting the
+// connections made over each family.
+func dialFamily(d *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := d.DialContext(ctx, familyNetwork(flagUpstreamIPFamily), addr)
+		if err != nil {
+			atomic.AddInt64(&stats.UpstreamDialErrors, 1)
+			return nil, err
+		}
+		family := addrFamily(conn.RemoteAddr())
+		if family == familyIPv6 {
+			atomic.AddInt64(&stats.UpstreamIPv6, 1)
+		} else {
+			atomic.AddInt64(&stats.UpstreamIPv4, 1)
+		}
+		debugf("connected to upstream %s at %s over %s", addr, conn.RemoteAddr(), family)
+		return conn, nil
+	}
+}
+
+// hopHeaders apply to a single connection, so they're never forwarded to the
+// upstream. A client's Connection: close ends its own connection, not the
+// one devcache keeps open to the upstream.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Modes of -upstream-path, how request paths are joined to upstream URLs.
+const (
+	// pathResolve resolves the path against the upstream URL, keeping its
+	// encoding and joining it to the URL's own path with a single slash.
+	pathResolve = "resolve"
+	// pathRaw appends the path to the upstream URL as a string, as devcache
+	// always had.
+	pathRaw = "raw"
+)
+
+// errPathEscapes is returned for request paths whose dot segments would
+// resolve outside of the upstream URL's own path.
+var errPathEscapes = errors.New("path escapes the upstream URL's path")
+
+// upstreamURL returns the URL path, a request URI, is fetched from at the
+// upstream base. Dot segments are resolved, and paths they'd take out of the
+// base's own path are refused with errPathEscapes.
+func upstreamURL(base, path string) (string, error) {
+	if flagUpstreamPath == pathRaw {
+		return base + path, nil
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path, u.RawPath = u.Path+"/", ""
+	}
+	r, err := url.ParseRequestURI(path)
+	if err != nil {
+		return "", err
+	}
+	// relative to the base's path, without being mistaken for a scheme or,
+	// with more slashes, for an absolute path or a host
+	ref := &url.URL{
+		Path:     strings.TrimLeft(r.Path, "/"),
+		RawPath:  strings.TrimLeft(r.RawPath, "/"),
+		RawQuery: r.RawQuery,
+	}
+	resolved := u.ResolveReference(ref)
+	if !strings.HasPrefix(resolved.Path, u.Path) {
+		return "", errPathEscapes
+	}
+	return resolved.String(), nil
+}
+
+// removeHopHeaders deletes the hop-by-hop headers from h, including any named
+// by its Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// via is the Via header value devcache adds to requests and responses it
+// forwards, RFC 7230 §5.7.1.
+func via() string {
+	return "1.1 " + flagViaPseudonym
+}
+
+// viaMiddleware adds devcache to the Via header of responses.
+func viaMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if flagViaPseudonym != "" {
+			w = &viaWriter{ResponseWriter: w}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// viaWriter adds devcache to the Via header of a response as it's written,
+// so it follows the proxies before it in any Via replayed from the upstream.
+type viaWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *viaWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Add("Via", via())
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *viaWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// connReuseWarnAfter is how many new connections to a host are made between
+// checks of its reuse ratio, and connReuseWarnRatio the ratio below which a
+// warning is logged.
+const (
+	connReuseWarnAfter = 20
+	connReuseWarnRatio = 0.05
+)
+
+// conns counts reused and new upstream connections per host.
+var conns = &connStats{hosts: make(map[string]*ConnCounts)}
+
+// ConnCounts are the connections obtained for requests to one upstream host.
+type ConnCounts struct {
+	Reused int64   `json:"reused"`
+	New    int64   `json:"new"`
+	Ratio  float64 `json:"reuse_ratio"`
+}
+
+type connStats struct {
+	mu    sync.Mutex
+	hosts map[string]*ConnCounts
+}
+
+// got records a connection obtained for a request to host.
+func (cs *connStats) got(host string, info httptrace.GotConnInfo) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.hosts[host]
+	if !ok {
+		c = &ConnCounts{}
+		cs.hosts[host] = c
+	}
+	if info.Reused {
+		c.Reused++
+	} else {
+		c.New++
+	}
+	c.Ratio = float64(c.Reused) / float64(c.Reused+c.New)
+	debugf("upstream connection to %s (reused: %t, idle: %s); reuse ratio %.2f", host, info.Reused, info.IdleTime, c.Ratio)
+	if !info.Reused && c.New%connReuseWarnAfter == 0 && c.Ratio < connReuseWarnRatio {
+		log.Printf("warning: upstream connections to %s are rarely reused (%d new, %d reused); it may be closing them, check its keep-alive settings and -upstream-* flags", host, c.New, c.Reused)
+	}
+}
+
+// snapshot returns a copy of the counts for every host.
+func (cs *connStats) snapshot() map[string]ConnCounts {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	hosts := make(map[string]ConnCounts, len(cs.hosts))
+	for host, c := range cs.hosts {
+		hosts[host] = *c
+	}
+	return hosts
+}
+
+// traceConns instruments req so the connection it's sent on is counted.
+func traceConns(req *http.Request) *http.Request {
+	host := req.URL.Host
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conns.got(host, info)
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
@@ -0,0 +1,104 @@
+package devcache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestUpstreamURL(t *testing.T) {
+	flagUpstreamPath = pathResolve
+	tests := []struct {
+		base, path string
+		want       string
+		err        error
+	}{
+		{"http://h/api/", "/users?id=1", "http://h/api/users?id=1", nil},
+		{"http://h/api", "/users", "http://h/api/users", nil},
+		{"http://h/api/", "/a%2Fb", "http://h/api/a%2Fb", nil},
+		{"http://h/api/", "/a/../b", "http://h/api/b", nil},
+		{"http://h/api/", "/", "http://h/api/", nil},
+		{"http://h/api/", "//other/x", "http://h/api/other/x", nil},
+		{"http://h/api/", "/../secret", "", errPathEscapes},
+		{"http://h/api/", "/a/../../b", "", errPathEscapes},
+		{"http://h/", "/../x", "http://h/x", nil},
+	}
+	for _, tt := range tests {
+		got, err := upstreamURL(tt.base, tt.path)
+		if got != tt.want || err != tt.err {
+			t.Errorf("upstreamURL(%q, %q) = %q, %v, want %q, %v", tt.base, tt.path, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestUpstreamURLRaw(t *testing.T) {
+	flagUpstreamPath = pathRaw
+	defer func() { flagUpstreamPath = pathResolve }()
+	if got, _ := upstreamURL("http://h/api", "/a%2Fb"); got != "http://h/api/a%2Fb" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestStripQueryUpstream(t *testing.T) {
+	var seen []string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, r.URL.RequestURI())
+		w.Write([]byte("page " + r.URL.Query().Get("page")))
+	}))
+	defer up.Close()
+	s := newTestServer(t, up.URL, "-strip-query-upstream")
+
+	for i := 0; i < 2; i++ {
+		for _, page := range []string{"1", "2"} {
+			do(s.Handler(), "GET", "/list?page="+page, nil)
+		}
+	}
+	if len(seen) != 2 {
+		t.Fatalf("upstream saw %v, want each query cached separately", seen)
+	}
+	for _, uri := range seen {
+		if uri != "/list" {
+			t.Errorf("upstream saw %q, want the bare path", uri)
+		}
+	}
+}
+
+func TestVia(t *testing.T) {
+	var got, upstreamVia []string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header["Via"]
+		w.Header()["Via"] = upstreamVia
+		w.Write([]byte("ok"))
+	}))
+	defer up.Close()
+
+	for _, tt := range []struct {
+		args        []string
+		upstreamVia []string
+		upstream    []string
+		response    []string
+	}{
+		{nil, nil, []string{"1.0 corp", "1.1 devcache"}, []string{"1.1 devcache"}},
+		{[]string{"-via", "edge"}, nil, []string{"1.0 corp", "1.1 edge"}, []string{"1.1 edge"}},
+		{[]string{"-via", ""}, nil, []string{"1.0 corp"}, nil},
+		// proxies between devcache and the upstream come first
+		{nil, []string{"1.1 cdn"}, []string{"1.0 corp", "1.1 devcache"}, []string{"1.1 cdn", "1.1 devcache"}},
+		{[]string{"-via", ""}, []string{"1.1 cdn"}, []string{"1.0 corp"}, []string{"1.1 cdn"}},
+	} {
+		got, upstreamVia = nil, tt.upstreamVia
+		s := newTestServer(t, up.URL, tt.args...)
+		// the response is devcache's own whether served from the cache or not
+		for _, outcome := range []string{"MISS", "HIT"} {
+			w := do(s.Handler(), "GET", "/a", http.Header{"Via": {"1.0 corp"}})
+			if via := w.Header()["Via"]; !reflect.DeepEqual(via, tt.response) {
+				t.Errorf("%q: %s response Via %q, want %q", tt.args, outcome, via, tt.response)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.upstream) {
+			t.Errorf("%q: upstream got Via %q, want %q", tt.args, got, tt.upstream)
+		}
+		s.Shutdown(context.Background())
+	}
+}
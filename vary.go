@@ -0,0 +1,132 @@
+package devcache
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// varies indexes the keys of responses that set Vary, as they were keyed
+// before their variant was known, by the request headers they vary by. With
+// -honor-vary, later requests for those keys are keyed by those headers too.
+var varies = newVaryIndex()
+
+type varyIndex struct {
+	mu    sync.RWMutex
+	names map[string][]string
+}
+
+func newVaryIndex() *varyIndex {
+	return &varyIndex{names: make(map[string][]string)}
+}
+
+// get returns the headers the responses for base vary by, or nil.
+func (v *varyIndex) get(base string) []string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.names[base]
+}
+
+// set records that the responses for base vary by names, or no longer vary
+// if names is empty.
+func (v *varyIndex) set(base string, names []string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(names) == 0 {
+		delete(v.names, base)
+		return
+	}
+	v.names[base] = names
+}
+
+// learn indexes the variant e cached under key, once it's loaded or
+// imported.
+func (v *varyIndex) learn(key string, e *entry) {
+	i := strings.Index(key, keyVariantSep)
+	if i < 0 {
+		return
+	}
+	if names, all := varyNames(e.Header); !all && len(names) > 0 {
+		v.set(key[:i], names)
+	}
+}
+
+// varyNames returns the request headers listed by the Vary headers in h,
+// canonicalized and sorted, and whether they list *. Accept-Encoding is left
+// out, as bodies are cached decoded.
+func varyNames(h http.Header) (names []string, all bool) {
+	seen := map[string]bool{}
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			switch {
+			case name == "*":
+				return nil, true
+			case name == "", name == "Accept-Encoding", seen[name]:
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, false
+}
+
+// variantKey encodes the values in h of the headers named, to be folded into
+// a key. Headers h doesn't send are keyed as empty, and credentials by a
+// digest, as by headerKey.
+func variantKey(names []string, h http.Header) string {
+	values := url.Values{}
+	for _, name := range names {
+		values[name] = keyedValues(name, h)
+		if len(values[name]) == 0 {
+			values[name] = []string{""}
+		}
+	}
+	return values.Encode()
+}
+
+// withVariant keys k by the values in h of the headers named, in place of
+// those it was keyed by.
+func (k requestKey) withVariant(names []string, h http.Header) requestKey {
+	key := k.base
+	if len(names) > 0 {
+		key += keyVariantSep + variantKey(names, h)
+	}
+	k.key = limitKey(key, flagMaxKeyBytes)
+	if k.bodyDigest {
+		k.key = limitKey(k.key+keyBodySep+k.digest, flagMaxKeyBytes)
+	}
+	k.vary = names
+	return k
+}
+
+// sameNames reports whether a and b list the same headers in the same order.
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// variantOf returns the key the response to a request with header h is cached
+// under, once e, the response fetched for k, turned out to vary by headers k
+// wasn't keyed by. It reports false if k already keys the right variant.
+func (k requestKey) variantOf(e *entry, h http.Header) (requestKey, bool) {
+	if !flagHonorVary || k.base == "" || e == nil {
+		return k, false
+	}
+	names, all := varyNames(e.Header)
+	if all || sameNames(names, k.vary) {
+		return k, false
+	}
+	return k.withVariant(names, h), true
+}
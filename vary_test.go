@@ -0,0 +1,101 @@
+package devcache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// varyingUpstream responds with the X-Lang request header after delay,
+// varying by it, and counts its requests in fetches.
+func varyingUpstream(t *testing.T, delay time.Duration, fetches *int64) *httptest.Server {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(fetches, 1)
+		time.Sleep(delay)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "X-Lang")
+		w.Write([]byte(r.Method + " " + r.Header.Get("X-Lang")))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// doLang serves a request with method for /greeting, selecting lang. POSTs
+// send an empty JSON body.
+func doLang(h http.Handler, method, lang string) *httptest.ResponseRecorder {
+	var body io.Reader
+	if method == http.MethodPost {
+		body = strings.NewReader("{}")
+	}
+	r := httptest.NewRequest(method, "/greeting", body)
+	r.Header.Set("X-Lang", lang)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestVary(t *testing.T) {
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		t.Run(method, func(t *testing.T) {
+			var fetches int64
+			upstream := varyingUpstream(t, 0, &fetches)
+			s := newTestServer(t, upstream.URL, "-honor-vary", "-cache-methods", "POST")
+
+			for _, tt := range []struct {
+				lang, cache string
+			}{
+				// the first response learns that the path varies
+				{"en", "MISS"},
+				{"fr", "MISS"},
+				{"en", "HIT"},
+				{"fr", "HIT"},
+			} {
+				w := doLang(s.Handler(), method, tt.lang)
+				if w.Code != http.StatusOK {
+					t.Fatalf("%s: status %d: %s", tt.lang, w.Code, w.Body)
+				}
+				if got, want := w.Body.String(), method+" "+tt.lang; got != want {
+					t.Errorf("%s: body %q, want %q", tt.lang, got, want)
+				}
+				if got := w.Header().Get("X-Cache"); got != tt.cache {
+					t.Errorf("%s: X-Cache %q, want %q", tt.lang, got, tt.cache)
+				}
+			}
+			if n := atomic.LoadInt64(&fetches); n != 2 {
+				t.Errorf("fetched %d times, want 2", n)
+			}
+		})
+	}
+}
+
+func TestVaryCoalesced(t *testing.T) {
+	var fetches int64
+	upstream := varyingUpstream(t, 50*time.Millisecond, &fetches)
+	s := newTestServer(t, upstream.URL, "-honor-vary")
+
+	// both requests share the first fetch, before the path is known to vary
+	langs := []string{"en", "fr", "en"}
+	bodies := make([]string, len(langs))
+	var wg sync.WaitGroup
+	for i, lang := range langs {
+		wg.Add(1)
+		go func(i int, lang string) {
+			defer wg.Done()
+			bodies[i] = doLang(s.Handler(), http.MethodGet, lang).Body.String()
+		}(i, lang)
+	}
+	wg.Wait()
+	for i, lang := range langs {
+		if want := "GET " + lang; bodies[i] != want {
+			t.Errorf("request %d: body %q, want %q", i, bodies[i], want)
+		}
+	}
+	if n := atomic.LoadInt64(&fetches); n != 2 {
+		t.Errorf("fetched %d times, want 2", n)
+	}
+}
@@ -0,0 +1,176 @@
+package devcache
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+// verifyResult is the outcome of refetching one cached entry.
+type verifyResult struct {
+	Key    string `json:"key"`
+	Result string `json:"result"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Results of verifying an entry against the upstream.
+const (
+	verifyMatch   = "match"
+	verifyChanged = "changed"
+	verifyError   = "error"
+)
+
+// runVerify implements the verify subcommand, which refetches cached paths
+// and reports how many still match the upstream.
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	cacheFile := fs.String("cache-file", "./cache.gob", "cache file to verify")
+	cacheDir := fs.String("cache-dir", "", "verify a -cache-dir directory instead of -cache-file")
+	upstream := fs.String("url", "http://localhost:8080/", "upstream to compare against")
+	sample := fs.Int("sample", 200, "number of entries to check")
+	all := fs.Bool("all", false, "check every entry instead of a sample")
+	concurrency := fs.Int("concurrency", 4, "number of concurrent requests")
+	rate := fs.Float64("rate", 10, "maximum requests per second (0 for no limit)")
+	report := fs.String("report", "", "write the results for changed and erroring entries to this file as JSON lines")
+	sampleSeed := fs.Int64("seed", 0, "seed for choosing the sample, to check the same entries again (random if 0)")
+	maxMismatch := fs.Float64("max-mismatch", 0.1, "exit nonzero if more than this fraction of entries changed or errored")
+	fs.Parse(args)
+
+	items := new(map[string]cache.Item)
+	var err error
+	if *cacheDir != "" {
+		err = readCacheDir(*cacheDir, items)
+	} else {
+		err = readCache(*cacheFile, items)
+	}
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(*items))
+	for key := range *items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if !*all && *sample < len(keys) {
+		fmt.Printf("sampling with seed %d\n", seedRand(*sampleSeed))
+		rng.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+		keys = keys[:*sample]
+	}
+
+	var tick <-chan time.Time
+	if *rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	jobs := make(chan string)
+	results := make(chan verifyResult)
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range jobs {
+				e, _ := toEntry((*items)[key].Object)
+				results <- verifyEntry(client, *upstream, key, e)
+			}
+		}()
+	}
+	go func() {
+		for _, key := range keys {
+			if tick != nil {
+				<-tick
+			}
+			jobs <- key
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	counts := map[string]int{}
+	var bad []verifyResult
+	for res := range results {
+		counts[res.Result]++
+		if res.Result != verifyMatch {
+			bad = append(bad, res)
+		}
+		if done := counts[verifyMatch] + counts[verifyChanged] + counts[verifyError]; done%50 == 0 {
+			fmt.Fprintf(os.Stderr, "checked %d/%d\n", done, len(keys))
+		}
+	}
+	fmt.Printf("%d matching, %d changed, %d now erroring (of %d checked, %d cached)\n",
+		counts[verifyMatch], counts[verifyChanged], counts[verifyError], len(keys), len(*items))
+
+	if *report != "" {
+		file, err := os.Create(*report)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(file)
+		for _, res := range bad {
+			enc.Encode(res)
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+	if len(keys) > 0 {
+		if ratio := float64(len(bad)) / float64(len(keys)); ratio > *maxMismatch {
+			return fmt.Errorf("mismatch ratio %.2f exceeds %.2f", ratio, *maxMismatch)
+		}
+	}
+	return nil
+}
+
+// verifyEntry refetches the entry cached under key from upstream and compares
+// the transformed body with the cached one.
+func verifyEntry(client *http.Client, upstream, key string, e *entry) verifyResult {
+	res := verifyResult{Key: key}
+	if e == nil {
+		res.Result, res.Error = verifyError, "undecodable entry"
+		return res
+	}
+	path := e.URL
+	if path == "" {
+		path = key
+	}
+	u, err := upstreamURL(upstream, path)
+	if err != nil {
+		res.Result, res.Error = verifyError, err.Error()
+		return res
+	}
+	resp, err := client.Get(u)
+	if err != nil {
+		res.Result, res.Error = verifyError, err.Error()
+		return res
+	}
+	defer resp.Body.Close()
+	res.Status = resp.StatusCode
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		res.Result, res.Error = verifyError, err.Error()
+		return res
+	}
+	if resp.StatusCode >= 500 {
+		res.Result = verifyError
+		return res
+	}
+	body, _ = defaultTransforms.apply(stageRecord, &transformInput{path: path, status: resp.StatusCode, contentType: resp.Header.Get("Content-Type")}, body)
+	if checksum(body) != checksum(e.body()) {
+		res.Result = verifyChanged
+		return res
+	}
+	res.Result = verifyMatch
+	return res
+}
@@ -0,0 +1,111 @@
+package devcache
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultWarmPriority is the priority of warm file paths that don't give one.
+// Lower priorities are fetched first.
+const defaultWarmPriority = 5
+
+// warmPath is a path to warm and its priority.
+type warmPath struct {
+	path     string
+	priority int
+}
+
+// criticalPending counts the priority 1 paths still to be warmed. The server
+// isn't ready until it's zero.
+var criticalPending int64
+
+// readWarmFile reads the request URIs listed one per line in filePath, each
+// optionally followed by a priority, and returns them in the order they should
+// be fetched. Blank lines and lines starting with # are ignored.
+func readWarmFile(filePath string) ([]warmPath, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var paths []warmPath
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		wp := warmPath{path: line, priority: defaultWarmPriority}
+		if fields := strings.Fields(line); len(fields) == 2 {
+			p, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid priority in %q", filePath, line)
+			}
+			wp = warmPath{path: fields[0], priority: p}
+		}
+		paths = append(paths, wp)
+	}
+	sort.SliceStable(paths, func(i, j int) bool { return paths[i].priority < paths[j].priority })
+	return paths, scanner.Err()
+}
+
+// startWarm warms paths in the background.
+func startWarm(paths []warmPath) {
+	for _, wp := range paths {
+		if wp.priority <= 1 {
+			atomic.AddInt64(&criticalPending, 1)
+		}
+	}
+	go warm(paths)
+}
+
+// warm fetches every path that isn't already cached on the background work
+// pool. Paths are queued in the order given, so higher priority paths are
+// ready first.
+func warm(paths []warmPath) {
+	var fetched int64
+	var wg sync.WaitGroup
+	for _, wp := range paths {
+		wp := wp
+		wg.Add(1)
+		background.submit(taskWarm, func() {
+			defer wg.Done()
+			if warmPathOnce(wp.path) {
+				atomic.AddInt64(&fetched, 1)
+			}
+			if wp.priority <= 1 && atomic.AddInt64(&criticalPending, -1) == 0 {
+				log.Printf("warm-up of priority 1 paths complete")
+			}
+		}, true)
+	}
+	wg.Wait()
+	log.Printf("warm-up complete (%d of %d paths fetched)", fetched, len(paths))
+}
+
+// warmPathOnce fetches path if it isn't already cached and reports whether it
+// was fetched.
+func warmPathOnce(path string) bool {
+	r, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		log.Printf("warm-up: skipping %s: %s", path, err)
+		return false
+	}
+	r.RequestURI = path
+	k := keyFor(r)
+	if _, found := Cache.Get(k.String()); found {
+		return false
+	}
+	if _, err := fetch(k, path, http.Header{}, sourceWarmup); err != nil {
+		log.Printf("warm-up: error fetching %s: %s", path, err)
+		return false
+	}
+	return true
+}
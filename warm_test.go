@@ -0,0 +1,53 @@
+package devcache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWarmPriority(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		w.Write([]byte("ok"))
+	}))
+	defer up.Close()
+	file := filepath.Join(t.TempDir(), "warm.txt")
+	list := "/later 5\n# comment\n/default\n/critical 1\n\n/next 2\n/critical-too 1\n"
+	if err := ioutil.WriteFile(file, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// one worker fetches the paths one at a time, in the order queued
+	newTestServer(t, up.URL, "-background-workers", "1")
+
+	paths, err := readWarmFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startWarm(paths)
+	deadline := time.Now().Add(5 * time.Second)
+	for Cache.ItemCount() < len(paths) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// equal priorities keep the order of the file
+	want := []string{"/critical", "/critical-too", "/next", "/later", "/default"}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(fetched, want) {
+		t.Errorf("fetched %q, want %q", fetched, want)
+	}
+	if n := atomic.LoadInt64(&criticalPending); n != 0 {
+		t.Errorf("%d priority 1 paths pending", n)
+	}
+}
@@ -0,0 +1,146 @@
+package devcache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// taskKind is a kind of background task. Kinds are listed from the highest
+// priority to the lowest: queued tasks of a higher priority always start
+// first.
+type taskKind int
+
+const (
+	// taskRefresh finishes fetches that a client stopped waiting for.
+	taskRefresh taskKind = iota
+	// taskWarm fetches warm file paths.
+	taskWarm
+	// taskMirror sends request summaries to the mirror.
+	taskMirror
+	numTaskKinds
+)
+
+var taskKindNames = [numTaskKinds]string{"refresh", "warm", "mirror"}
+
+// background runs all background work, so the concurrency of fetches and
+// notifications made off the request path is capped as a whole by
+// -background-workers.
+var background *workPool
+
+// workPool runs tasks on a fixed number of workers, taking queued tasks in
+// priority order.
+type workPool struct {
+	queues   [numTaskKinds]chan func()
+	ready    chan struct{}
+	inFlight int64
+	dropped  [numTaskKinds]int64
+	// quit is closed to stop the workers.
+	quit     chan struct{}
+	stopOnce sync.Once
+}
+
+// newWorkPool starts workers goroutines, each kind of task queueing up to
+// depth tasks.
+func newWorkPool(workers, depth int) *workPool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &workPool{ready: make(chan struct{}, int(numTaskKinds)*depth), quit: make(chan struct{})}
+	for i := range p.queues {
+		p.queues[i] = make(chan func(), depth)
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workPool) work() {
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-p.ready:
+		}
+		// each signal on ready matches one queued task
+		for _, q := range p.queues {
+			select {
+			case task := <-q:
+				atomic.AddInt64(&p.inFlight, 1)
+				task()
+				atomic.AddInt64(&p.inFlight, -1)
+			default:
+				continue
+			}
+			break
+		}
+	}
+}
+
+// submit queues task. If the queue for its kind is full, the task is dropped
+// and submit returns false, unless wait is set, in which case submit blocks
+// until there's room or the pool is stopped.
+func (p *workPool) submit(kind taskKind, task func(), wait bool) bool {
+	if wait {
+		select {
+		case p.queues[kind] <- task:
+		case <-p.quit:
+			return false
+		}
+	} else {
+		select {
+		case p.queues[kind] <- task:
+		default:
+			atomic.AddInt64(&p.dropped[kind], 1)
+			return false
+		}
+	}
+	p.ready <- struct{}{}
+	return true
+}
+
+// stop stops the workers once they're done with the tasks they're running.
+// Tasks queued or submitted later never run.
+func (p *workPool) stop() {
+	p.stopOnce.Do(func() {
+		close(p.quit)
+	})
+}
+
+// drain waits until no task is running and no refresh is queued, or until
+// ctx is done, and reports whether the pool drained. Queued warm and mirror
+// tasks are left, as they're worth nothing once the server is gone.
+func (p *workPool) drain(ctx context.Context) bool {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&p.inFlight) > 0 || len(p.queues[taskRefresh]) > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// BackgroundStats describe the background work pool.
+type BackgroundStats struct {
+	Queued   map[string]int   `json:"queued"`
+	InFlight int64            `json:"in_flight"`
+	Dropped  map[string]int64 `json:"dropped"`
+}
+
+func (p *workPool) stats() BackgroundStats {
+	s := BackgroundStats{
+		Queued:   make(map[string]int, numTaskKinds),
+		InFlight: atomic.LoadInt64(&p.inFlight),
+		Dropped:  make(map[string]int64, numTaskKinds),
+	}
+	for kind, q := range p.queues {
+		s.Queued[taskKindNames[kind]] = len(q)
+		s.Dropped[taskKindNames[kind]] = atomic.LoadInt64(&p.dropped[kind])
+	}
+	return s
+}